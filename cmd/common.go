@@ -0,0 +1,483 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+	"github.com/tolson-vkn/pifrost/watcher"
+)
+
+// How to reach pi-hole, see provider.HTTPConfig.
+var (
+	piHoleURL        string
+	piHoleTimeout    time.Duration
+	piHoleCAFile     string
+	piHoleClientCert string
+	piHoleClientKey  string
+	piHoleSkipVerify bool
+	piHoleProxy      string
+)
+
+// Where the pi-hole credentials come from, besides the plain flags.
+var (
+	piHoleTokenFile      string
+	piHoleTokenSecret    string
+	piHolePasswordFile   string
+	piHolePasswordSecret string
+)
+
+// Addresses published for objects without an ip-family annotation.
+var ipFamily string
+
+// Address field of services without a target-source annotation.
+var serviceTargetSource string
+
+// Whether headless services are published at their pods, and services at
+// node addresses.
+var (
+	headlessServices bool
+	serviceNodeIPs   bool
+)
+
+// Whether Gateway API routes and DNSEndpoints are watched.
+var (
+	gatewayAPI  bool
+	dnsEndpoint bool
+)
+
+// Whether and how a record is published per node.
+var (
+	nodeNameTemplate  string
+	nodeAddressTypes  []string
+	nodeSelector      string
+	nodeNotReadyGrace time.Duration
+)
+
+// Which DNS provider records are written to, and the file provider settings.
+var (
+	dnsProviderName   string
+	filePath          string
+	fileFormat        string
+	fileReloadCommand string
+)
+
+// The zone and TSIG key of the RFC 2136 provider.
+var (
+	rfc2136Server         string
+	rfc2136Zone           string
+	rfc2136TSIGKey        string
+	rfc2136TSIGSecret     string
+	rfc2136TSIGSecretFile string
+	rfc2136TSIGAlgorithm  string
+	rfc2136TTL            uint32
+	rfc2136Timeout        time.Duration
+)
+
+// How to reach AdGuard Home and log in.
+var (
+	adGuardURL            string
+	adGuardUsername       string
+	adGuardPassword       string
+	adGuardPasswordFile   string
+	adGuardPasswordSecret string
+	adGuardTimeout        time.Duration
+	adGuardCAFile         string
+	adGuardSkipVerify     bool
+)
+
+const (
+	providerPiHole  = "pihole"
+	providerFile    = "file"
+	providerRFC2136 = "rfc2136"
+	providerAdGuard = "adguard"
+)
+
+// Flags shared by every command which talks to pi-hole and kubernetes, so
+// plan sees the cluster exactly like server does.
+func addPiHoleFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&insecure, "insecure", false, "communicate over http:// (default: https://)")
+	cmd.Flags().StringVar(&piHoleHost, "pihole-host", "", "hostname or IP of pihole instance")
+	cmd.Flags().StringVar(&piHoleToken, "pihole-token", "", "API token for pihole (v5)")
+	cmd.Flags().StringVar(&piHoleTokenFile, "pihole-token-file", "", "file holding the API token for pihole (v5), reloaded when it changes")
+	cmd.Flags().StringVar(&piHoleTokenSecret, "pihole-token-secret", "", "namespace/name/key of a secret holding the API token for pihole (v5), reloaded when it changes")
+	cmd.Flags().StringVar(&piHolePassword, "pihole-password", "", "app password for pihole (v6)")
+	cmd.Flags().StringVar(&piHolePasswordFile, "pihole-password-file", "", "file holding the app password for pihole (v6), reloaded when it changes")
+	cmd.Flags().StringVar(&piHolePasswordSecret, "pihole-password-secret", "", "namespace/name/key of a secret holding the app password for pihole (v6), reloaded when it changes")
+	cmd.Flags().StringVar(&piHoleAPI, "pihole-api", provider.PiHoleAPIAuto, "pihole API version to use (auto, v5, v6)")
+	cmd.Flags().StringVar(&piHoleURL, "pihole-url", "", "URL of the pihole web interface, e.g. https://pihole.lan:8443/admin, supersedes --pihole-host and --insecure")
+	cmd.Flags().DurationVar(&piHoleTimeout, "pihole-timeout", provider.DefaultHTTPTimeout, "timeout of each request to pihole")
+	cmd.Flags().StringVar(&piHoleCAFile, "pihole-ca-file", "", "PEM bundle of CAs trusted for the pihole certificate, on top of the system CAs")
+	cmd.Flags().StringVar(&piHoleClientCert, "pihole-client-cert", "", "client certificate presented to pihole, needs --pihole-client-key")
+	cmd.Flags().StringVar(&piHoleClientKey, "pihole-client-key", "", "key of --pihole-client-cert")
+	cmd.Flags().BoolVar(&piHoleSkipVerify, "pihole-tls-skip-verify", false, "accept any pihole certificate (default: false)")
+	cmd.Flags().StringVar(&piHoleProxy, "pihole-proxy", "", "proxy URL for pihole requests (default: HTTPS_PROXY and HTTP_PROXY)")
+}
+
+func addSourceFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "absolute path to kubeconfig (default: in cluster config)")
+	cmd.Flags().BoolVar(&autoIngress, "ingress-auto", false, "do not require annotation on ingress resources (default: false)")
+	cmd.Flags().StringVar(&ingressEIP, "ingress-externalip", "", "force use of provided external ip (default: use ingress external ip)")
+	cmd.Flags().BoolVar(&prune, "prune", false, "delete records pifrost created which no object wants anymore (default: false)")
+	cmd.Flags().StringVar(&serviceTargetSource, "service-target-source", string(watcher.TargetSourceLoadBalancer), "address field services without a target-source annotation point at (loadbalancer, externalIPs, clusterIP, node-ips)")
+	cmd.Flags().BoolVar(&headlessServices, "headless-services", false, "also publish annotated headless services at their ready pods, watching EndpointSlices (default: false)")
+	cmd.Flags().BoolVar(&serviceNodeIPs, "service-node-ips", false, "allow the node-ips target source in service annotations, watching nodes (default: false, implied by --service-target-source=node-ips)")
+	cmd.Flags().BoolVar(&gatewayAPI, "gateway-api", false, "also publish the hostnames of Gateway API HTTPRoute, GRPCRoute and TLSRoute objects, opted in like ingresses (default: false)")
+	cmd.Flags().StringVar(&nodeNameTemplate, "node-name-template", "", "publish a record per node named by this template of the node, e.g. {{.Name}}.k8s.home.lan (default: nodes are not published)")
+	cmd.Flags().StringSliceVar(&nodeAddressTypes, "node-address-types", []string{"InternalIP", "ExternalIP", "Hostname"}, "node address types to publish in order of preference, the first type a node has addresses of wins")
+	cmd.Flags().StringVar(&nodeSelector, "node-selector", "", "label selector of the nodes to publish (default: every node)")
+	cmd.Flags().DurationVar(&nodeNotReadyGrace, "node-not-ready-grace", 5*time.Minute, "how long a NotReady node keeps its record")
+	cmd.Flags().BoolVar(&dnsEndpoint, "dnsendpoint", false, "also publish the records of external-dns DNSEndpoint objects (externaldns.k8s.io) the provider supports (default: false)")
+	cmd.Flags().StringVar(&ipFamily, "ip-family", string(watcher.IPFamilyDual), "addresses to publish for objects without an ip-family annotation, A records for ipv4 and AAAA records for ipv6 (ipv4, ipv6, dual)")
+}
+
+// Check the source flags, then describe how objects become records.
+func sourceConfig() watcher.SourceConfig {
+	family, err := watcher.ParseIPFamily(ipFamily)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	targetSource, err := watcher.ParseTargetSource(serviceTargetSource)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	config := watcher.SourceConfig{
+		IngressAuto:         autoIngress,
+		IngressExternalIP:   ingressEIP,
+		ServiceTargetSource: targetSource,
+		HeadlessServices:    headlessServices,
+		ServiceNodeIPs:      serviceNodeIPs || targetSource == watcher.TargetSourceNodeIPs,
+		IPFamily:            family,
+		GatewayAPI:          gatewayAPI,
+		DNSEndpoint:         dnsEndpoint,
+		NodeNotReadyGrace:   nodeNotReadyGrace,
+	}
+
+	if len(nodeNameTemplate) != 0 {
+		config.NodeNameTemplate, err = watcher.ParseNodeNameTemplate(nodeNameTemplate)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		config.NodeAddressTypes, err = watcher.ParseNodeAddressTypes(nodeAddressTypes)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		config.NodeSelector, err = labels.Parse(nodeSelector)
+		if err != nil {
+			logrus.Fatalf("Invalid --node-selector: %s", err)
+		}
+	}
+
+	return config
+}
+
+func addRegistryFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&registryStore, "registry", registry.StoreConfigMap, "where to remember which records pifrost owns (memory, configmap, file)")
+	cmd.Flags().StringVar(&registryNS, "registry-namespace", "pifrost", "namespace of the registry configmap")
+	cmd.Flags().StringVar(&registryName, "registry-configmap", "pifrost-registry", "name of the registry configmap")
+	cmd.Flags().StringVar(&registryFile, "registry-file", "pifrost-registry.json", "path of the registry state file")
+	cmd.Flags().StringVar(&conflictPolicy, "conflict-policy", string(registry.PolicySkip), "what to do with records pifrost does not own (takeover, skip, error)")
+}
+
+// Kubernetes client from --kubeconfig, or the in cluster config.
+func kubeClient() (*rest.Config, kubernetes.Interface) {
+	var kconfig *rest.Config
+	var err error
+	if len(kubeconfig) == 0 {
+		kconfig, err = rest.InClusterConfig()
+		if err != nil {
+			logrus.Fatalf("Could not get in cluster config: %s", err)
+		}
+	} else {
+		kconfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			logrus.Fatalf("Could not get out of cluster config: %s", err)
+		}
+	}
+
+	client, err := kubernetes.NewForConfig(kconfig)
+	if err != nil {
+		logrus.Fatalf("Could not create kubernetes client: %s", err)
+	}
+
+	return kconfig, client
+}
+
+// Select the DNS provider, every provider adds its own flags.
+func addProviderFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&dnsProviderName, "provider", providerPiHole, "DNS provider to write records to (pihole, file, rfc2136, adguard)")
+	addPiHoleFlags(cmd)
+	cmd.Flags().StringVar(&filePath, "file-path", "/etc/pihole/custom.list", "hosts file or dnsmasq.d snippet managed by the file provider")
+	cmd.Flags().StringVar(&fileFormat, "file-format", provider.FileFormatHosts, "format of --file-path (hosts, dnsmasq)")
+	cmd.Flags().StringVar(&fileReloadCommand, "file-reload-command", "", "command run after the file provider writes, e.g. \"pihole restartdns reload\" (default: none)")
+	cmd.Flags().StringVar(&rfc2136Server, "rfc2136-server", "", "nameserver accepting dynamic updates and zone transfers, host or host:port")
+	cmd.Flags().StringVar(&rfc2136Zone, "rfc2136-zone", "", "zone the rfc2136 provider manages, e.g. home.lan")
+	cmd.Flags().StringVar(&rfc2136TSIGKey, "rfc2136-tsig-key", "", "name of the TSIG key signing updates and transfers (default: unsigned)")
+	cmd.Flags().StringVar(&rfc2136TSIGSecret, "rfc2136-tsig-secret", "", "base64 secret of --rfc2136-tsig-key")
+	cmd.Flags().StringVar(&rfc2136TSIGSecretFile, "rfc2136-tsig-secret-file", "", "file holding the base64 secret of --rfc2136-tsig-key")
+	cmd.Flags().StringVar(&rfc2136TSIGAlgorithm, "rfc2136-tsig-algorithm", "hmac-sha256", "algorithm of --rfc2136-tsig-key (hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384, hmac-sha512)")
+	cmd.Flags().Uint32Var(&rfc2136TTL, "rfc2136-ttl", provider.DefaultRFC2136TTL, "TTL of records the rfc2136 provider creates")
+	cmd.Flags().DurationVar(&rfc2136Timeout, "rfc2136-timeout", provider.DefaultHTTPTimeout, "timeout of each exchange with the nameserver")
+	cmd.Flags().StringVar(&adGuardURL, "adguard-url", "", "URL of the AdGuard Home web interface, e.g. http://adguard.lan:3000")
+	cmd.Flags().StringVar(&adGuardUsername, "adguard-username", "", "AdGuard Home user pifrost logs in as")
+	cmd.Flags().StringVar(&adGuardPassword, "adguard-password", "", "password of --adguard-username")
+	cmd.Flags().StringVar(&adGuardPasswordFile, "adguard-password-file", "", "file holding the password of --adguard-username, reloaded when it changes")
+	cmd.Flags().StringVar(&adGuardPasswordSecret, "adguard-password-secret", "", "namespace/name/key of a secret holding the password of --adguard-username, reloaded when it changes")
+	cmd.Flags().DurationVar(&adGuardTimeout, "adguard-timeout", provider.DefaultHTTPTimeout, "timeout of each request to AdGuard Home")
+	cmd.Flags().StringVar(&adGuardCAFile, "adguard-ca-file", "", "PEM bundle of CAs trusted for the AdGuard Home certificate, on top of the system CAs")
+	cmd.Flags().BoolVar(&adGuardSkipVerify, "adguard-tls-skip-verify", false, "accept any AdGuard Home certificate (default: false)")
+}
+
+// Check the provider flags, then create and validate the provider.
+func newDNSProvider(ctx context.Context, client kubernetes.Interface) provider.DNSProvider {
+	var dnsProvider provider.DNSProvider
+	var err error
+	switch dnsProviderName {
+	case providerPiHole:
+		dnsProvider, err = newPiHoleProvider(ctx, client)
+	case providerFile:
+		dnsProvider, err = provider.NewFileProvider(provider.FileConfig{
+			Path:          filePath,
+			Format:        fileFormat,
+			ReloadCommand: strings.Fields(fileReloadCommand),
+		})
+	case providerRFC2136:
+		dnsProvider, err = newRFC2136Provider()
+	case providerAdGuard:
+		dnsProvider, err = newAdGuardProvider(ctx, client)
+	default:
+		logrus.Fatalf("Unknown --provider [%s], must be pihole, file, rfc2136 or adguard", dnsProviderName)
+	}
+	if err != nil {
+		logrus.Fatalf("Could not initialize DNS provider: %s", err)
+	}
+
+	err = dnsProvider.ValidateProvider(ctx)
+	if err != nil {
+		logrus.Fatalf("Could not validate DNS provider: %s", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"provider":     dnsProvider.Capabilities().Name,
+		"record_types": dnsProvider.Capabilities().RecordTypes,
+	}).Info("DNS provider ready")
+
+	return dnsProvider
+}
+
+// Check the pi-hole flags, then create the provider for --pihole-api.
+func newPiHoleProvider(ctx context.Context, client kubernetes.Interface) (provider.DNSProvider, error) {
+	endpoint := newEndpoint()
+	token := newCredential(ctx, client, "pihole-token", piHoleToken, piHoleTokenFile, piHoleTokenSecret)
+	password := newCredential(ctx, client, "pihole-password", piHolePassword, piHolePasswordFile, piHolePasswordSecret)
+
+	var dnsProvider provider.DNSProvider
+	var err error
+	switch piHoleAPI {
+	case provider.PiHoleAPIAuto:
+		if token == nil && password == nil {
+			logrus.Fatal("Need to specify: --pihole-token or --pihole-password, or their -file or -secret flags")
+		}
+		dnsProvider, err = provider.InitAutoDNSProvider(
+			endpoint,
+			token,
+			password,
+		)
+	case provider.PiHoleAPIV5:
+		if token == nil {
+			logrus.Fatal("Need to specify: --pihole-token, --pihole-token-file or --pihole-token-secret")
+		}
+		dnsProvider, err = provider.InitDNSProvider(
+			endpoint,
+			token,
+		)
+	case provider.PiHoleAPIV6:
+		if password == nil {
+			logrus.Fatal("Need to specify: --pihole-password, --pihole-password-file or --pihole-password-secret")
+		}
+		dnsProvider, err = provider.InitV6DNSProvider(
+			endpoint,
+			password,
+		)
+	default:
+		logrus.Fatalf("Unknown --pihole-api [%s], must be auto, v5 or v6", piHoleAPI)
+	}
+
+	return dnsProvider, err
+}
+
+// Check the rfc2136 flags, then create the provider. The TSIG secret is
+// read once, the provider does not hold a session to renew.
+func newRFC2136Provider() (provider.DNSProvider, error) {
+	if len(rfc2136TSIGSecret) != 0 && len(rfc2136TSIGSecretFile) != 0 {
+		logrus.Fatal("Only specify one of: --rfc2136-tsig-secret or --rfc2136-tsig-secret-file")
+	}
+
+	secret := rfc2136TSIGSecret
+	if len(rfc2136TSIGSecretFile) != 0 {
+		data, err := os.ReadFile(rfc2136TSIGSecretFile)
+		if err != nil {
+			logrus.Fatalf("Could not load TSIG secret: %s", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+
+	return provider.NewRFC2136Provider(provider.RFC2136Config{
+		Server:        rfc2136Server,
+		Zone:          rfc2136Zone,
+		TSIGKeyName:   rfc2136TSIGKey,
+		TSIGSecret:    secret,
+		TSIGAlgorithm: rfc2136TSIGAlgorithm,
+		TTL:           rfc2136TTL,
+		Timeout:       rfc2136Timeout,
+	})
+}
+
+// Check the AdGuard Home flags, then create the provider.
+func newAdGuardProvider(ctx context.Context, client kubernetes.Interface) (provider.DNSProvider, error) {
+	if len(adGuardURL) == 0 || len(adGuardUsername) == 0 {
+		logrus.Fatal("Need to specify: --adguard-url and --adguard-username")
+	}
+	password := newCredential(ctx, client, "adguard-password", adGuardPassword, adGuardPasswordFile, adGuardPasswordSecret)
+	if password == nil {
+		logrus.Fatal("Need to specify: --adguard-password, --adguard-password-file or --adguard-password-secret")
+	}
+
+	endpoint, err := provider.NewEndpoint(adGuardURL, provider.HTTPConfig{
+		Timeout:    adGuardTimeout,
+		CAFile:     adGuardCAFile,
+		SkipVerify: adGuardSkipVerify,
+	})
+	if err != nil {
+		logrus.Fatalf("Could not configure AdGuard Home endpoint: %s", err)
+	}
+	if adGuardSkipVerify {
+		logrus.Warn("AdGuard Home certificate is not verified (--adguard-tls-skip-verify)")
+	}
+
+	return provider.InitAdGuardDNSProvider(endpoint, adGuardUsername, password)
+}
+
+// The credential from at most one of --<name>, --<name>-file and
+// --<name>-secret, nil when none is given. Files and secrets are watched for
+// changes until ctx is cancelled.
+func newCredential(ctx context.Context, client kubernetes.Interface, name, value, file, secret string) provider.Credential {
+	given := 0
+	for _, flag := range []string{value, file, secret} {
+		if len(flag) != 0 {
+			given++
+		}
+	}
+	if given > 1 {
+		logrus.Fatalf("Only specify one of: --%[1]s, --%[1]s-file or --%[1]s-secret", name)
+	}
+
+	switch {
+	case len(value) != 0:
+		provider.RedactSecret(value)
+		return provider.StaticCredential(value)
+	case len(file) != 0:
+		credential, err := provider.NewFileCredential(file)
+		if err != nil {
+			logrus.Fatalf("Could not load --%s: %s", name, err)
+		}
+		go credential.Watch(ctx)
+		return credential
+	case len(secret) != 0:
+		credential, err := watcher.NewSecretCredential(ctx, client, secret)
+		if err != nil {
+			logrus.Fatalf("Could not load --%s: %s", name, err)
+		}
+		go credential.Watch(ctx)
+		return credential
+	}
+
+	return nil
+}
+
+// Where pi-hole is, --pihole-url or else --pihole-host, and the transport
+// to reach it.
+func newEndpoint() *provider.Endpoint {
+	rawURL := piHoleURL
+	if len(rawURL) == 0 {
+		if len(piHoleHost) == 0 {
+			logrus.Fatal("Need to specify: --pihole-url or --pihole-host")
+		}
+
+		var err error
+		rawURL, err = provider.HostURL(insecure, piHoleHost)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	endpoint, err := provider.NewEndpoint(rawURL, provider.HTTPConfig{
+		Timeout:        piHoleTimeout,
+		CAFile:         piHoleCAFile,
+		ClientCertFile: piHoleClientCert,
+		ClientKeyFile:  piHoleClientKey,
+		SkipVerify:     piHoleSkipVerify,
+		Proxy:          piHoleProxy,
+	})
+	if err != nil {
+		logrus.Fatalf("Could not configure pi-hole endpoint: %s", err)
+	}
+	if piHoleSkipVerify {
+		logrus.Warn("pi-hole certificate is not verified (--pihole-tls-skip-verify)")
+	}
+
+	return endpoint
+}
+
+// Providers holding a session end it on the way out, pi-hole only allows a
+// few at a time.
+func logout(ctx context.Context, dnsProvider provider.DNSProvider) {
+	session, ok := dnsProvider.(interface{ Logout(context.Context) error })
+	if !ok {
+		return
+	}
+	if err := session.Logout(ctx); err != nil {
+		logrus.Warnf("Could not end DNS provider session: %s", err)
+	}
+}
+
+// Load the record registry from the store picked by --registry. A read only
+// registry never saves what it claims.
+func newRegistry(ctx context.Context, client kubernetes.Interface, readOnly bool) *registry.Registry {
+	var store registry.Store
+	switch registryStore {
+	case registry.StoreMemory:
+		logrus.Warn("Record registry is kept in memory, ownership is forgotten on restart")
+		store = registry.MemoryStore{}
+	case registry.StoreConfigMap:
+		store = registry.NewConfigMapStore(client, registryNS, registryName)
+	case registry.StoreFile:
+		store = registry.NewFileStore(registryFile)
+	default:
+		logrus.Fatalf("Unknown --registry [%s], must be memory, configmap or file", registryStore)
+	}
+
+	if readOnly {
+		store = registry.ReadOnlyStore{Store: store}
+	}
+
+	reg, err := registry.New(ctx, store)
+	if err != nil {
+		logrus.Fatalf("Could not initialize record registry: %s", err)
+	}
+
+	return reg
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"k8s.io/client-go/dynamic"
+
+	"github.com/tolson-vkn/pifrost/registry"
+	"github.com/tolson-vkn/pifrost/watcher"
+)
+
+const (
+	planOutputTable = "table"
+	planOutputJSON  = "json"
+
+	// Exit code when the plan has changes, errors exit with 1.
+	planExitChanges = 2
+)
+
+var planOutput string
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Print pending DNS changes",
+	Long: `Compare the records all services, ingresses, nodes, routes and DNSEndpoints want with what pihole holds and print the
+changes server would make, without making them. Exits 2 when changes are pending.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		// Keep stdout for the plan.
+		logrus.SetOutput(os.Stderr)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if planOutput != planOutputTable && planOutput != planOutputJSON {
+			logrus.Fatalf("Unknown --output [%s], must be table or json", planOutput)
+		}
+		policy, err := registry.ParseConflictPolicy(conflictPolicy)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		config := sourceConfig()
+		kconfig, client := kubeClient()
+		piHole := newDNSProvider(ctx, client)
+		reg := newRegistry(ctx, client, true)
+
+		dynamicClient, err := dynamic.NewForConfig(kconfig)
+		if err != nil {
+			logrus.Fatalf("Could not create dynamic client: %s", err)
+		}
+
+		reconciler := watcher.NewReconciler(client, dynamicClient, piHole, reg, config, 0, prune)
+		changes, err := reconciler.Plan(ctx, policy)
+
+		logoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		logout(logoutCtx, piHole)
+		cancel()
+
+		if err != nil {
+			logrus.Fatalf("Could not plan changes: %s", err)
+		}
+
+		switch planOutput {
+		case planOutputTable:
+			err = printPlanTable(os.Stdout, changes)
+		case planOutputJSON:
+			err = printPlanJSON(os.Stdout, changes)
+		}
+		if err != nil {
+			logrus.Fatalf("Could not print plan: %s", err)
+		}
+
+		if len(changes) != 0 {
+			os.Exit(planExitChanges)
+		}
+	},
+}
+
+func printPlanTable(out io.Writer, changes []watcher.PlannedChange) error {
+	if len(changes) == 0 {
+		_, err := fmt.Fprintln(out, "No changes, pihole matches the cluster.")
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tNAME\tTYPE\tVALUE\tCURRENT\tOWNER")
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Action, c.Name, c.Type, orDash(c.Value), orDash(strings.Join(c.Current, ",")), orDash(c.Owner))
+	}
+
+	return w.Flush()
+}
+
+func printPlanJSON(out io.Writer, changes []watcher.PlannedChange) error {
+	if changes == nil {
+		changes = []watcher.PlannedChange{}
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(changes)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	addProviderFlags(planCmd)
+	addSourceFlags(planCmd)
+	addRegistryFlags(planCmd)
+	planCmd.Flags().StringVarP(&planOutput, "output", "o", planOutputTable, "plan format (table, json)")
+}
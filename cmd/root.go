@@ -7,11 +7,14 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+
+	"github.com/tolson-vkn/pifrost/provider"
 )
 
 var (
-	cfgFile  string
-	logLevel string
+	cfgFile   string
+	logLevel  string
+	logFormat string
 
 	rootCmd = &cobra.Command{
 		Use:   "pifrost",
@@ -24,27 +27,37 @@ var (
 func Execute() {
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, provider.Redact(err.Error()))
 		os.Exit(1)
 	}
 }
 
 func init() {
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
-		if err := setUpLogs(os.Stdout, logLevel); err != nil {
+		if err := setUpLogs(os.Stdout, logLevel, logFormat); err != nil {
 			return err
 		}
 		return nil
 	}
 
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", logrus.InfoLevel.String(), "log level (debug, info, warn, error, fatal, panic")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "log format (text, json)")
 
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(serverCmd)
+	rootCmd.AddCommand(planCmd)
 }
 
-func setUpLogs(out io.Writer, level string) error {
+func setUpLogs(out io.Writer, level, format string) error {
 	logrus.SetOutput(out)
+	switch format {
+	case "text":
+		logrus.SetFormatter(&provider.RedactFormatter{Formatter: &logrus.TextFormatter{}})
+	case "json":
+		logrus.SetFormatter(&provider.RedactFormatter{Formatter: &logrus.JSONFormatter{}})
+	default:
+		return fmt.Errorf("Unknown --log-format [%s], must be text or json", format)
+	}
 	lvl, err := logrus.ParseLevel(level)
 	if err != nil {
 		return err
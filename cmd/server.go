@@ -1,23 +1,47 @@
 package cmd
 
 import (
+	"context"
+	"expvar"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
-
 	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
 	"github.com/tolson-vkn/pifrost/watcher"
 )
 
 var (
-	insecure    bool
-	autoIngress bool
-	piHoleHost  string
-	ingressEIP  string
-	piHoleToken string
-	kubeconfig  string
+	insecure       bool
+	autoIngress    bool
+	piHoleHost     string
+	ingressEIP     string
+	piHoleToken    string
+	piHolePassword string
+	piHoleAPI      string
+	kubeconfig     string
+	reconcile      time.Duration
+	prune          bool
+	registryStore  string
+	registryNS     string
+	registryName   string
+	registryFile   string
+	conflictPolicy string
+	metricsAddress string
+	leaderElect    bool
+	leaseName      string
+	leaseNS        string
+	leaseDuration  time.Duration
+	renewDeadline  time.Duration
+	retryPeriod    time.Duration
+	drainTimeout   time.Duration
+	dryRun         bool
 )
 
 var serverCmd = &cobra.Command{
@@ -25,52 +49,114 @@ var serverCmd = &cobra.Command{
 	Short: "Start server",
 	Long:  `Start ExternalDNS pihole server daemon`,
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
-		if len(piHoleHost) == 0 {
-			logrus.Fatal("Need to specify: --pihole-host")
+		policy, err := registry.ParseConflictPolicy(conflictPolicy)
+		if err != nil {
+			logrus.Fatal(err)
 		}
 
-		if len(piHoleToken) == 0 {
-			logrus.Fatal("Need to specify: --pihole-token")
+		config := sourceConfig()
+		config.DryRun = dryRun
+		kconfig, client := kubeClient()
+		piHole := newDNSProvider(ctx, client)
+		reg := newRegistry(ctx, client, dryRun)
+
+		logrus.WithFields(logrus.Fields{
+			"registry":        registryStore,
+			"conflict_policy": policy,
+		}).Info("Record ownership enabled")
+
+		defer func() {
+			logoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			logout(logoutCtx, piHole)
+		}()
+
+		var dnsProvider provider.DNSProvider = piHole
+		if dryRun {
+			dnsProvider = provider.NewDryRunProvider(dnsProvider)
+		}
+		dnsProvider = registry.NewOwnedProvider(dnsProvider, reg, policy)
+
+		if len(metricsAddress) != 0 {
+			go serveMetrics(ctx, metricsAddress)
 		}
 
-		kconfig := new(rest.Config)
-		var err error
-		if len(kubeconfig) == 0 {
-			kconfig, err = rest.InClusterConfig()
+		leading := watcher.Lead()
+		if leaderElect {
+			identity, err := os.Hostname()
 			if err != nil {
-				logrus.Fatalf("Could not get in cluster config: %s", err)
+				logrus.Fatalf("Could not get leader election identity: %s", err)
 			}
-		} else {
-			kconfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+
+			// Keep the lease until in flight changes are drained, a standby
+			// taking over earlier could race them.
+			electCtx, stopElect := context.WithCancel(context.Background())
+			var released <-chan struct{}
+			leading, released, err = watcher.Elect(electCtx, client, watcher.LeaderElection{
+				LeaseName:     leaseName,
+				Namespace:     leaseNS,
+				Identity:      identity,
+				LeaseDuration: leaseDuration,
+				RenewDeadline: renewDeadline,
+				RetryPeriod:   retryPeriod,
+			})
 			if err != nil {
-				logrus.Fatalf("Could not get out of cluster config: %s", err)
+				logrus.Fatalf("Could not start leader election: %s", err)
 			}
+			defer func() {
+				stopElect()
+				select {
+				case <-released:
+				case <-time.After(renewDeadline):
+					logrus.Warn("Timed out releasing leader election lease")
+				}
+			}()
 		}
 
-		dnsProvider, err := provider.InitDNSProvider(
-			insecure,
-			piHoleHost,
-			piHoleToken,
-		)
-		if err != nil {
-			logrus.Fatalf("Could not initialize DNS provider: %s", err)
-		}
+		watcher.Watch(ctx, dnsProvider, reg, kconfig, config, reconcile, prune, leading, drainTimeout)
+		logrus.Info("Shut down")
+	},
+}
 
-		err = dnsProvider.ValidateProvider()
-		if err != nil {
-			logrus.Fatalf("Could not validate DNS provider: %s", err)
-		}
+// Serve expvar, which includes the workqueue depths, on /debug/vars until
+// ctx is cancelled.
+func serveMetrics(ctx context.Context, address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
 
-		watcher.Watch(dnsProvider, kconfig, autoIngress, ingressEIP)
-	},
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"address": address,
+	}).Info("Serving metrics on /debug/vars")
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logrus.Errorf("Metrics server stopped: %s", err)
+	}
 }
 
 func init() {
-	serverCmd.Flags().BoolVar(&insecure, "insecure", false, "communicate over http:// (default: https://)")
-	serverCmd.Flags().StringVar(&piHoleHost, "pihole-host", "", "hostname or IP of pihole instance")
-	serverCmd.Flags().StringVar(&piHoleToken, "pihole-token", "", "API token for pihole")
-	serverCmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "absolute path to kubeconfig (default: in cluster config)")
-	serverCmd.Flags().BoolVar(&autoIngress, "ingress-auto", false, "do not require annotation on ingress resources (default: false)")
-	serverCmd.Flags().StringVar(&ingressEIP, "ingress-externalip", "", "force use of provided external ip (default: use ingress external ip)")
+	addProviderFlags(serverCmd)
+	addSourceFlags(serverCmd)
+	addRegistryFlags(serverCmd)
+	serverCmd.Flags().DurationVar(&reconcile, "reconcile-interval", 5*time.Minute, "how often to compare all records with pihole and repair drift, 0 disables")
+	serverCmd.Flags().StringVar(&metricsAddress, "metrics-address", "", "address to serve queue depth and other metrics on /debug/vars, e.g. :8080 (default: disabled)")
+	serverCmd.Flags().BoolVar(&leaderElect, "leader-elect", false, "campaign for a lease so only one of several replicas writes records (default: false)")
+	serverCmd.Flags().StringVar(&leaseName, "leader-elect-lease-name", "pifrost", "name of the leader election lease")
+	serverCmd.Flags().StringVar(&leaseNS, "leader-elect-namespace", "pifrost", "namespace of the leader election lease")
+	serverCmd.Flags().DurationVar(&leaseDuration, "leader-elect-lease-duration", 15*time.Second, "how long standbys wait before taking over an unrenewed lease")
+	serverCmd.Flags().DurationVar(&renewDeadline, "leader-elect-renew-deadline", 10*time.Second, "how long the leader keeps trying to renew before giving up")
+	serverCmd.Flags().DurationVar(&retryPeriod, "leader-elect-retry-period", 2*time.Second, "how often to try to acquire or renew the lease")
+	serverCmd.Flags().DurationVar(&drainTimeout, "shutdown-timeout", 20*time.Second, "how long record changes in flight get to finish after SIGTERM")
+	serverCmd.Flags().BoolVar(&dryRun, "dry-run", false, "log the changes pifrost would make to pihole and the registry without making them (default: false)")
 }
@@ -0,0 +1,359 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	adGuardListPath   = "/control/rewrite/list"
+	adGuardAddPath    = "/control/rewrite/add"
+	adGuardDeletePath = "/control/rewrite/delete"
+)
+
+// AdGuardRequest manages DNS rewrites of AdGuard Home. A rewrite answers a
+// domain with an IP, or with another domain like a CNAME.
+type AdGuardRequest struct {
+	endpoint *Endpoint
+	username string
+	password Credential
+
+	index recordIndex
+}
+
+// AdGuardAPIError is a failed request, AdGuard Home answers errors in plain
+// text.
+type AdGuardAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *AdGuardAPIError) Error() string {
+	return fmt.Sprintf("AdGuard Home API error [%d]: %s", e.StatusCode, e.Message)
+}
+
+// Match the provider errors, so callers need not know which API answered.
+func (e *AdGuardAPIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrRecordExists:
+		return e.StatusCode == http.StatusBadRequest && strings.Contains(strings.ToLower(e.Message), "exists")
+	case ErrTransient:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	}
+	return false
+}
+
+// A rewrite as the API lists, adds and deletes it.
+// {"domain":"foo.example.xyz","answer":"10.1.1.1"}
+type adGuardRewrite struct {
+	Domain string `json:"domain"`
+	Answer string `json:"answer"`
+}
+
+// Make sure the AdGuard Home client satisfies the provider contract.
+var _ DNSProvider = &AdGuardRequest{}
+
+// Create an AdGuard Home DNS provider, authenticating as username.
+func InitAdGuardDNSProvider(endpoint *Endpoint, username string, password Credential) (*AdGuardRequest, error) {
+	if endpoint == nil {
+		return nil, errors.New("Need an AdGuard Home endpoint")
+	}
+	if len(username) == 0 || password == nil {
+		return nil, errors.New("Need an AdGuard Home username and password")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"url":      endpoint,
+		"username": username,
+	}).Info("Creating DNS Provider (AdGuard Home)")
+
+	return &AdGuardRequest{
+		endpoint: endpoint,
+		username: username,
+		password: password,
+	}, nil
+}
+
+// List rewrites to check AdGuard Home accepts connections.
+func (a *AdGuardRequest) ValidateProvider(ctx context.Context) error {
+	var count int = 1
+	const tries int = 8
+	for {
+		logrus.Info("Attempting to reach AdGuard Home...")
+		_, err := a.GetDNS(ctx)
+		if err == nil {
+			logrus.Info("Connected.")
+			return nil
+		}
+		// Retrying will not fix the password.
+		if errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		logrus.Debugf("AdGuard Home not ready: %s", err)
+		if err := backoff(ctx, 1<<count*time.Second); err != nil {
+			return err
+		}
+		count++
+		if count == tries {
+			break
+		}
+	}
+
+	return errors.New("Failed to connect to AdGuard Home.")
+}
+
+// Rewrites answer with IPv4 or IPv6 addresses, or a domain.
+func (a *AdGuardRequest) Capabilities() Capabilities {
+	return Capabilities{
+		Name:        "adguard",
+		RecordTypes: []string{RecordA, RecordAAAA, RecordCNAME},
+	}
+}
+
+// Records AdGuard Home holds, from the record index while it is fresh.
+func (a *AdGuardRequest) GetDNS(ctx context.Context) ([]Domain, error) {
+	if domains, ok := a.index.list(); ok {
+		return domains, nil
+	}
+
+	response, err := a.doRequest(ctx, "GET", adGuardListPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get DNS rewrites: %w", err)
+	}
+
+	domains, err := decodeAdGuardRewrites(response)
+	if err != nil {
+		return nil, fmt.Errorf("Failed decode rewrites: %w", err)
+	}
+	a.index.set(domains)
+
+	return domains, nil
+}
+
+// Records named name, only lists rewrites when the record index is stale.
+func (a *AdGuardRequest) named(ctx context.Context, name string) ([]Domain, error) {
+	if records, ok := a.index.named(name); ok {
+		return records, nil
+	}
+
+	domains, err := a.GetDNS(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Domain
+	for _, d := range domains {
+		if d.domain == name {
+			records = append(records, d)
+		}
+	}
+	return records, nil
+}
+
+// Call add function or delete function.
+func (a *AdGuardRequest) ModifyDNS(ctx context.Context, dcs *DNSChangeSet) error {
+	switch dcs.action {
+	case "add":
+		return a.add(ctx, dcs)
+	case "delete":
+		return a.delete(ctx, dcs)
+	}
+
+	return nil
+}
+
+// Add action but is also a change action. AdGuard Home holds any number of
+// rewrites per domain, the ones the record replaces are deleted first so it
+// answers like pi-hole would.
+func (a *AdGuardRequest) add(ctx context.Context, dcs *DNSChangeSet) error {
+	records, err := a.named(ctx, dcs.domain.domain)
+	if err != nil {
+		return fmt.Errorf("Failed to add: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": dcs.domain.domain,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
+	}).Info("Creating record.")
+
+	for _, d := range records {
+		if d == dcs.domain {
+			logrus.WithFields(logrus.Fields{
+				"domain": dcs.domain.domain,
+			}).Info("Domain already exists with hostname and target")
+			return nil
+		}
+	}
+
+	replaced := replacedBy(a.Capabilities(), dcs.domain, records)
+	if len(replaced) != 0 {
+		logrus.WithFields(logrus.Fields{
+			"domain": dcs.domain.domain,
+		}).Info("Record with domain exists, change")
+	}
+	for _, d := range replaced {
+		err = a.write(ctx, adGuardDeletePath, d)
+		if err != nil {
+			return fmt.Errorf("Could not change record: %w", err)
+		}
+	}
+
+	err = a.write(ctx, adGuardAddPath, dcs.domain)
+	if err != nil {
+		return fmt.Errorf("Could not add record: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": dcs.domain.domain,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
+	}).Info("Created record.")
+
+	return nil
+}
+
+// Delete the rewrite, it must answer with the record's value.
+func (a *AdGuardRequest) delete(ctx context.Context, dcs *DNSChangeSet) error {
+	records, err := a.named(ctx, dcs.domain.domain)
+	if err != nil {
+		return fmt.Errorf("Failed to delete: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": dcs.domain.domain,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
+	}).Info("Deleting record.")
+
+	if !hasRecord(dcs.domain, records) {
+		return ErrRecordNotFound
+	}
+
+	err = a.write(ctx, adGuardDeletePath, dcs.domain)
+	if err != nil {
+		return fmt.Errorf("Could not delete record: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": dcs.domain.domain,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
+	}).Info("Deleted record.")
+
+	return nil
+}
+
+// Add or delete the rewrite of d and keep the record index in step with it.
+// When the outcome is unknown the index is dropped.
+func (a *AdGuardRequest) write(ctx context.Context, path string, d Domain) error {
+	payload, err := json.Marshal(adGuardRewrite{Domain: d.domain, Answer: d.Value()})
+	if err != nil {
+		return errors.New("Failed to encode rewrite.")
+	}
+
+	_, err = a.doRequest(ctx, "POST", path, payload)
+	if err != nil {
+		a.index.invalidate()
+		return err
+	}
+
+	if path == adGuardAddPath {
+		a.index.add(d)
+	} else {
+		a.index.remove(d)
+	}
+
+	return nil
+}
+
+// Perform a request with basic auth. A rejected password is reloaded and the
+// request retried once.
+func (a *AdGuardRequest) doRequest(ctx context.Context, method, path string, payload []byte) ([]byte, error) {
+	var body []byte
+	err := withCredential(ctx, a.password, func() error {
+		var err error
+		body, err = a.send(ctx, method, path, payload)
+		return err
+	})
+
+	return body, err
+}
+
+func (a *AdGuardRequest) send(ctx context.Context, method, path string, payload []byte) ([]byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.endpoint.url(path), reqBody)
+	if err != nil {
+		return nil, errors.New("Failed to create HTTP request.")
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	password := a.password.Get()
+	RedactSecret(password)
+	req.SetBasicAuth(a.username, password)
+
+	logrus.Debugf("Request: %s %s", method, req.URL)
+
+	resp, err := a.endpoint.client.Do(req)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil || resp == nil {
+		return nil, transient(errors.New("Error sending request to the server."))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.New("Failed to read response body.")
+	}
+
+	if resp.StatusCode >= 300 {
+		message := strings.TrimSpace(string(body))
+		if len(message) == 0 {
+			message = http.StatusText(resp.StatusCode)
+		}
+		return nil, &AdGuardAPIError{StatusCode: resp.StatusCode, Message: message}
+	}
+
+	return body, nil
+}
+
+// Decode the rewrite list. Answers are validated like change sets, rewrites
+// pifrost can not express, such as wildcards, are skipped.
+// [{"domain":"foo.example.xyz","answer":"10.1.1.1"},{"domain":"alias.example.xyz","answer":"foo.example.xyz"}]
+func decodeAdGuardRewrites(responseBody []byte) ([]Domain, error) {
+	var rewrites []adGuardRewrite
+	if err := json.Unmarshal(responseBody, &rewrites); err != nil {
+		return nil, fmt.Errorf("Error decoding GET: %w", err)
+	}
+
+	var domains []Domain
+	for _, rewrite := range rewrites {
+		d, err := parseRecord(rewrite.Answer, rewrite.Domain)
+		if err != nil {
+			logrus.Debugf("Skipping rewrite [%s -> %s]: %s", rewrite.Domain, rewrite.Answer, err)
+			continue
+		}
+		domains = append(domains, d)
+	}
+	logrus.Debugf("Created domain struct: [%s]", domains)
+
+	return domains, nil
+}
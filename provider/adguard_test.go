@@ -0,0 +1,204 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// mockAdGuardServer keeps the rewrites of a fake AdGuard Home.
+type mockAdGuardServer struct {
+	mu       sync.Mutex
+	rewrites []adGuardRewrite
+	password string
+	status   int
+	requests int
+}
+
+// Start an AdGuard Home stand-in holding rewrites, which accepts admin with
+// mockpassword.
+func startMockAdGuardServer(t *testing.T, rewrites ...adGuardRewrite) (*httptest.Server, *mockAdGuardServer) {
+	state := &mockAdGuardServer{
+		rewrites: rewrites,
+		password: "mockpassword",
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		state.requests++
+
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != state.password {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if state.status != 0 {
+			http.Error(w, http.StatusText(state.status), state.status)
+			return
+		}
+
+		switch {
+		case r.URL.Path == adGuardListPath && r.Method == "GET":
+			w.Header().Set("Content-Type", "application/json")
+			if state.rewrites == nil {
+				w.Write([]byte("[]"))
+				return
+			}
+			json.NewEncoder(w).Encode(state.rewrites)
+			return
+		case r.Method != "POST":
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var rewrite adGuardRewrite
+		if err := json.NewDecoder(r.Body).Decode(&rewrite); err != nil {
+			http.Error(w, "json.Decode: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case adGuardAddPath:
+			for _, current := range state.rewrites {
+				if current == rewrite {
+					http.Error(w, "rewrite already exists", http.StatusBadRequest)
+					return
+				}
+			}
+			state.rewrites = append(state.rewrites, rewrite)
+		case adGuardDeletePath:
+			for i, current := range state.rewrites {
+				if current == rewrite {
+					state.rewrites = append(state.rewrites[:i], state.rewrites[i+1:]...)
+					return
+				}
+			}
+			http.Error(w, "rewrite not found", http.StatusBadRequest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	return mockServer, state
+}
+
+func newTestAdGuardProvider(t *testing.T, serverURL string, password Credential) *AdGuardRequest {
+	adg, err := InitAdGuardDNSProvider(testEndpoint(t, serverURL), "admin", password)
+	if err != nil {
+		t.Fatalf("Error from InitAdGuardDNSProvider: %s", err)
+	}
+	return adg
+}
+
+func TestAdGuardProvider(t *testing.T) {
+	mockServer, state := startMockAdGuardServer(t,
+		adGuardRewrite{Domain: "router.home.lan", Answer: "192.168.1.1"},
+		adGuardRewrite{Domain: "www.home.lan", Answer: "router.home.lan"},
+		adGuardRewrite{Domain: "*.apps.home.lan", Answer: "192.168.1.2"},
+		adGuardRewrite{Domain: "blocked.home.lan", Answer: "A"},
+	)
+	defer mockServer.Close()
+	adg := newTestAdGuardProvider(t, mockServer.URL, StaticCredential("mockpassword"))
+	ctx := context.Background()
+
+	// Test case 1: IP and CNAME style rewrites are listed, others skipped
+	if err := adg.ValidateProvider(ctx); err != nil {
+		t.Fatalf("Error from ValidateProvider: %s", err)
+	}
+	domains, err := adg.GetDNS(ctx)
+	expected := []Domain{NewDomain("192.168.1.1", "router.home.lan"), NewCNAME("www.home.lan", "router.home.lan")}
+	if err != nil || !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Domains: %v, Expected: %v. Error: %v", domains, expected, err)
+	}
+
+	// Test case 2: Adding both families of a name, and adding again
+	for _, ip := range []string{"192.168.5.1", "fd00::5", "192.168.5.1"} {
+		dcs, _ := CreateChangeSet(ip, "echo.home.lan", "add")
+		if err := adg.ModifyDNS(ctx, dcs); err != nil {
+			t.Errorf("Error from add: %s", err)
+		}
+	}
+
+	// Test case 3: A second IPv4 address is added next to the first
+	dcs, _ := CreateChangeSet("192.168.5.2", "echo.home.lan", "add")
+	if err := adg.ModifyDNS(ctx, dcs); err != nil {
+		t.Errorf("Error from change: %s", err)
+	}
+
+	// Test case 4: A CNAME replaces the address
+	dcs, _ = CreateChangeSet("lb.home.lan", "router.home.lan", "add")
+	if err := adg.ModifyDNS(ctx, dcs); err != nil {
+		t.Errorf("Error from change: %s", err)
+	}
+
+	expectedRewrites := []adGuardRewrite{
+		{Domain: "www.home.lan", Answer: "router.home.lan"},
+		{Domain: "*.apps.home.lan", Answer: "192.168.1.2"},
+		{Domain: "blocked.home.lan", Answer: "A"},
+		{Domain: "echo.home.lan", Answer: "192.168.5.1"},
+		{Domain: "echo.home.lan", Answer: "fd00::5"},
+		{Domain: "echo.home.lan", Answer: "192.168.5.2"},
+		{Domain: "router.home.lan", Answer: "lb.home.lan"},
+	}
+	if !reflect.DeepEqual(expectedRewrites, state.rewrites) {
+		t.Errorf("Rewrites: %v, Expected: %v.", state.rewrites, expectedRewrites)
+	}
+
+	// Test case 5: Deleting, and deleting again
+	dcs, _ = CreateChangeSet("fd00::5", "echo.home.lan", "delete")
+	if err := adg.ModifyDNS(ctx, dcs); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+	if err := adg.ModifyDNS(ctx, dcs); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrRecordNotFound)
+	}
+}
+
+func TestAdGuardProviderErrors(t *testing.T) {
+	mockServer, state := startMockAdGuardServer(t)
+	defer mockServer.Close()
+	ctx := context.Background()
+
+	// Test case 1: A wrong password is unauthorized and not retried
+	adg := newTestAdGuardProvider(t, mockServer.URL, StaticCredential("wrongpassword"))
+	if err := adg.ValidateProvider(ctx); !errors.Is(err, ErrUnauthorized) || state.requests != 1 {
+		t.Errorf("Error: %v, Expected: %v. Requests: %d", err, ErrUnauthorized, state.requests)
+	}
+
+	// Test case 2: A rotated password is reloaded
+	path := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(path, []byte("oldpassword"), 0600)
+	password, _ := NewFileCredential(path)
+	adg = newTestAdGuardProvider(t, mockServer.URL, password)
+	os.WriteFile(path, []byte("mockpassword"), 0600)
+	if _, err := adg.GetDNS(ctx); err != nil {
+		t.Errorf("Error from GetDNS: %s", err)
+	}
+
+	// Test case 3: A failing AdGuard Home is transient
+	state.status = http.StatusServiceUnavailable
+	adg.index.invalidate()
+	if _, err := adg.GetDNS(ctx); !errors.Is(err, ErrTransient) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrTransient)
+	}
+}
+
+func TestDecodeAdGuardRewrites(t *testing.T) {
+	// Test case 1: Empty list
+	domains, err := decodeAdGuardRewrites([]byte("[]"))
+	if err != nil || len(domains) != 0 {
+		t.Errorf("Domains: %v, Error: %v", domains, err)
+	}
+
+	// Test case 2: Not a list
+	if _, err := decodeAdGuardRewrites([]byte(`{"domain":"foo.example.xyz"}`)); err == nil {
+		t.Error("Expected error decoding an object")
+	}
+}
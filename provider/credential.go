@@ -0,0 +1,141 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How often a credential file is checked for a new credential. kubelet
+// takes up to a minute to update a projected Secret anyway.
+const credentialPollInterval = 10 * time.Second
+
+// Credential is the pi-hole token (v5) or app password (v6). It may be
+// rotated while pifrost runs, providers call Get for every request.
+type Credential interface {
+	Get() string
+	// Fetch the credential again, true when it changed. Providers call it
+	// when pi-hole rejected the current one.
+	Reload(ctx context.Context) (bool, error)
+}
+
+// StaticCredential is a credential given on the command line, it never
+// changes.
+type StaticCredential string
+
+func (s StaticCredential) Get() string {
+	return string(s)
+}
+
+func (s StaticCredential) Reload(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+// FileCredential reads the credential from a file, such as a Secret mounted
+// as a volume, and picks up changes to it.
+type FileCredential struct {
+	path string
+
+	mu    sync.RWMutex
+	value string
+}
+
+// Make sure the file credential satisfies the credential contract.
+var _ Credential = &FileCredential{}
+
+// Create a credential from the file at path, which must hold one.
+func NewFileCredential(path string) (*FileCredential, error) {
+	fc := &FileCredential{
+		path: path,
+	}
+	if _, err := fc.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return fc, nil
+}
+
+func (fc *FileCredential) Get() string {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.value
+}
+
+// Read the file again, true when it holds a new credential. A missing,
+// unreadable or empty file is an error and the current credential is kept,
+// Secret volumes briefly look like that while kubelet swaps them.
+func (fc *FileCredential) Reload(ctx context.Context) (bool, error) {
+	content, err := os.ReadFile(fc.path)
+	if err != nil {
+		return false, fmt.Errorf("Could not read credential file: %w", err)
+	}
+
+	value := strings.TrimSpace(string(content))
+	if len(value) == 0 {
+		return false, fmt.Errorf("Credential file [%s] is empty", fc.path)
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if value == fc.value {
+		return false, nil
+	}
+	RedactSecret(value)
+	fc.value = value
+
+	return true, nil
+}
+
+// Check the file for a new credential every credentialPollInterval until ctx
+// is cancelled.
+func (fc *FileCredential) Watch(ctx context.Context) {
+	ticker := time.NewTicker(credentialPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := fc.Reload(ctx)
+		if err != nil {
+			logrus.Warnf("Keeping current pi-hole credential: %s", err)
+			continue
+		}
+		if changed {
+			logrus.WithFields(logrus.Fields{
+				"file": fc.path,
+			}).Info("pi-hole credential changed, reloaded")
+		}
+	}
+}
+
+// Run fn, and once more if pi-hole rejected the credential and a reload came
+// up with a new one.
+func withCredential(ctx context.Context, credential Credential, fn func() error) error {
+	err := fn()
+	if !errors.Is(err, ErrUnauthorized) {
+		return err
+	}
+
+	changed, reloadErr := credential.Reload(ctx)
+	if reloadErr != nil {
+		logrus.Warnf("Could not reload pi-hole credential: %s", reloadErr)
+		return err
+	}
+	if !changed {
+		return err
+	}
+
+	logrus.Info("pi-hole rejected the credential, retrying with the reloaded one")
+	return fn()
+}
@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileCredential(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+
+	// Test case 1: Missing and empty files
+	if _, err := NewFileCredential(path); err == nil {
+		t.Error("Expected error for missing file")
+	}
+	os.WriteFile(path, []byte("\n"), 0600)
+	if _, err := NewFileCredential(path); err == nil {
+		t.Error("Expected error for empty file")
+	}
+
+	// Test case 2: Read on creation, without the trailing newline
+	os.WriteFile(path, []byte("first\n"), 0600)
+	credential, err := NewFileCredential(path)
+	if err != nil || credential.Get() != "first" {
+		t.Errorf("Credential: %v, Error: %v", credential, err)
+	}
+
+	// Test case 3: Reload picks up a rotated file
+	os.WriteFile(path, []byte("second"), 0600)
+	changed, err := credential.Reload(context.Background())
+	if err != nil || !changed || credential.Get() != "second" {
+		t.Errorf("Credential: %s, Changed: %v, Error: %v", credential.Get(), changed, err)
+	}
+	if changed, _ := credential.Reload(context.Background()); changed {
+		t.Error("Reload of an unchanged file reported a change")
+	}
+
+	// Test case 4: A file being swapped keeps the current credential
+	os.Remove(path)
+	if _, err := credential.Reload(context.Background()); err == nil || credential.Get() != "second" {
+		t.Errorf("Credential: %s, Error: %v", credential.Get(), err)
+	}
+}
+
+func TestCredentialRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(path, []byte("oldtoken"), 0600)
+	token, _ := NewFileCredential(path)
+
+	// Only accepts the rotated token.
+	var rejected int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("auth") != "newtoken" {
+			rejected++
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`{"data":[["example.com","192.168.1.2"]]}[]`))
+	}))
+	defer mockServer.Close()
+
+	mockPHR, _ := InitDNSProvider(testEndpoint(t, mockServer.URL), token)
+
+	// Test case 1: Rejected token without a new one
+	if _, err := mockPHR.GetDNS(context.Background()); err == nil {
+		t.Error("Expected error from GetDNS")
+	}
+
+	// Test case 2: The rotated token is picked up right away
+	os.WriteFile(path, []byte("newtoken"), 0600)
+	rejected = 0
+	if _, err := mockPHR.GetDNS(context.Background()); err != nil {
+		t.Errorf("Error from GetDNS: %s", err)
+	}
+	if rejected != 1 {
+		t.Errorf("Rejected: %d, Expected: 1.", rejected)
+	}
+
+	// Test case 3: v6 reloads the password when logging in fails
+	v6Server, v6URL, state := startMockV6Server(t, "192.168.1.2 example.com")
+	defer v6Server.Close()
+
+	os.WriteFile(path, []byte("wrong"), 0600)
+	password, _ := NewFileCredential(path)
+	v6PHR, _ := InitV6DNSProvider(testEndpoint(t, v6URL), password)
+	os.WriteFile(path, []byte("mockpassword"), 0600)
+	if _, err := v6PHR.GetDNS(context.Background()); err != nil {
+		t.Errorf("Error from GetDNS: %s", err)
+	}
+	if state.logins != 1 {
+		t.Errorf("Logins: %d, Expected: 1.", state.logins)
+	}
+}
@@ -0,0 +1,203 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PiHoleAPIAuto = "auto"
+	PiHoleAPIV5   = "v5"
+	PiHoleAPIV6   = "v6"
+
+	v6VersionPath = "/api/info/version"
+)
+
+var ErrProviderNotValidated = errors.New("pi-hole API version not detected yet, call ValidateProvider")
+
+// PiHoleAuto detects which API a pi-hole speaks on ValidateProvider and then
+// hands every call to the matching client.
+type PiHoleAuto struct {
+	endpoint *Endpoint
+	token    Credential
+	password Credential
+
+	client DNSProvider
+}
+
+// Make sure the auto detecting client satisfies the provider contract.
+var _ DNSProvider = &PiHoleAuto{}
+
+// Create a pi-hole provider which detects the API version. Either the v5 token
+// or the v6 password may be nil, but not both.
+func InitAutoDNSProvider(endpoint *Endpoint, token, password Credential) (*PiHoleAuto, error) {
+	if endpoint == nil {
+		return nil, errors.New("Need a pi-hole endpoint")
+	}
+
+	if token == nil && password == nil {
+		return nil, errors.New("Need a pi-hole token (v5) or password (v6)")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"url": endpoint,
+	}).Info("Creating DNS Provider (pi-hole auto detect)")
+
+	return &PiHoleAuto{
+		endpoint: endpoint,
+		token:    token,
+		password: password,
+	}, nil
+}
+
+// Probe the pi-hole for its API version, create the matching client and
+// validate it.
+func (pa *PiHoleAuto) ValidateProvider(ctx context.Context) error {
+	var api string
+	var err error
+
+	var count int = 1
+	const tries int = 8
+	for {
+		logrus.Info("Detecting pi-hole API version...")
+		api, err = DetectPiHoleAPI(ctx, pa.endpoint)
+		if err == nil {
+			break
+		}
+		logrus.Debugf("pi-hole API detection failed: %s", err)
+		if err := backoff(ctx, 1<<count*time.Second); err != nil {
+			return err
+		}
+		count++
+		if count == tries {
+			return fmt.Errorf("Failed to detect pi-hole API version: %w", err)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"api": api,
+		"url": pa.endpoint,
+	}).Info("Detected pi-hole API")
+
+	switch api {
+	case PiHoleAPIV5:
+		if pa.token == nil {
+			return errors.New("pi-hole speaks the v5 API which needs an API token (--pihole-token), only a v6 password (--pihole-password) was given")
+		}
+		pa.client, err = InitDNSProvider(pa.endpoint, pa.token)
+	case PiHoleAPIV6:
+		if pa.password == nil {
+			return errors.New("pi-hole speaks the v6 API which needs an app password (--pihole-password), only a v5 API token (--pihole-token) was given")
+		}
+		pa.client, err = InitV6DNSProvider(pa.endpoint, pa.password)
+	}
+	if err != nil {
+		return err
+	}
+
+	return pa.client.ValidateProvider(ctx)
+}
+
+func (pa *PiHoleAuto) Capabilities() Capabilities {
+	if pa.client == nil {
+		return Capabilities{
+			Name:          "pihole",
+			SingleAddress: true,
+		}
+	}
+	return pa.client.Capabilities()
+}
+
+func (pa *PiHoleAuto) GetDNS(ctx context.Context) ([]Domain, error) {
+	if pa.client == nil {
+		return nil, ErrProviderNotValidated
+	}
+	return pa.client.GetDNS(ctx)
+}
+
+func (pa *PiHoleAuto) ModifyDNS(ctx context.Context, dcs *DNSChangeSet) error {
+	if pa.client == nil {
+		return ErrProviderNotValidated
+	}
+	return pa.client.ModifyDNS(ctx, dcs)
+}
+
+// Logout ends the session of the detected client, only v6 has one.
+func (pa *PiHoleAuto) Logout(ctx context.Context) error {
+	if v6, ok := pa.client.(*PiHoleV6Request); ok {
+		return v6.Logout(ctx)
+	}
+	return nil
+}
+
+// API returns the detected API version, empty until validated.
+func (pa *PiHoleAuto) API() string {
+	switch pa.client.(type) {
+	case *PiHoleRequest:
+		return PiHoleAPIV5
+	case *PiHoleV6Request:
+		return PiHoleAPIV6
+	}
+	return ""
+}
+
+// DetectPiHoleAPI asks the pi-hole which API it speaks. v6 answers on
+// /api/info/version with JSON, even when unauthenticated. v5 only has
+// api.php which answers a version query with {"version":3}.
+func DetectPiHoleAPI(ctx context.Context, endpoint *Endpoint) (string, error) {
+	status, body, err := probe(ctx, endpoint, v6VersionPath)
+	if err != nil {
+		return "", err
+	}
+	if (status == http.StatusOK || status == http.StatusUnauthorized) && json.Valid(body) {
+		return PiHoleAPIV6, nil
+	}
+
+	status, body, err = probe(ctx, endpoint, apiPath+"?version")
+	if err != nil {
+		return "", err
+	}
+	if status == http.StatusOK {
+		var vR struct {
+			Version json.Number `json:"version"`
+		}
+		if err := json.Unmarshal(body, &vR); err == nil && len(vR.Version) != 0 {
+			return PiHoleAPIV5, nil
+		}
+	}
+
+	return "", fmt.Errorf("Host does not look like a pi-hole, got status [%d]", status)
+}
+
+func probe(ctx context.Context, endpoint *Endpoint, path string) (int, []byte, error) {
+	logrus.Debugf("Probe: %s%s", endpoint, path)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.url(path), nil)
+	if err != nil {
+		return 0, nil, errors.New("Failed to create HTTP request.")
+	}
+
+	resp, err := endpoint.client.Do(req)
+	if ctx.Err() != nil {
+		return 0, nil, ctx.Err()
+	}
+	if err != nil || resp == nil {
+		return 0, nil, transient(errors.New("Error sending request to the server."))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, errors.New("Failed to read response body.")
+	}
+
+	return resp.StatusCode, []byte(strings.TrimSpace(string(body))), nil
+}
@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func startMockV5Server(t *testing.T) (*httptest.Server, string) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != apiPath {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<html>404 Not Found</html>"))
+			return
+		}
+
+		var mockResponse string
+		if _, ok := r.URL.Query()["version"]; ok {
+			mockResponse = `{"version":3}`
+		}
+		switch r.URL.Query().Get("action") {
+		case "get":
+			mockResponse = `{"data":[["example.com","192.168.1.2"]]}[]`
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(mockResponse))
+	}))
+
+	return mockServer, mockServer.URL
+}
+
+func TestDetectPiHoleAPI(t *testing.T) {
+	// Test case 1: v5
+	v5Server, v5URL := startMockV5Server(t)
+	defer v5Server.Close()
+
+	api, err := DetectPiHoleAPI(context.Background(), testEndpoint(t, v5URL))
+	if err != nil || api != PiHoleAPIV5 {
+		t.Errorf("API: %s, Expected: %s. Error: %v", api, PiHoleAPIV5, err)
+	}
+
+	// Test case 2: v6
+	v6Server, v6URL, _ := startMockV6Server(t)
+	defer v6Server.Close()
+
+	api, err = DetectPiHoleAPI(context.Background(), testEndpoint(t, v6URL))
+	if err != nil || api != PiHoleAPIV6 {
+		t.Errorf("API: %s, Expected: %s. Error: %v", api, PiHoleAPIV6, err)
+	}
+
+	// Test case 3: Not a pi-hole
+	otherServer := httptest.NewServer(http.NotFoundHandler())
+	defer otherServer.Close()
+
+	_, err = DetectPiHoleAPI(context.Background(), testEndpoint(t, otherServer.URL))
+	if err == nil {
+		t.Error("Expected detection to fail")
+	}
+}
+
+func TestAutoProvider(t *testing.T) {
+	v5Server, v5URL := startMockV5Server(t)
+	defer v5Server.Close()
+	v6Server, v6URL, _ := startMockV6Server(t, "192.168.1.2 example.com")
+	defer v6Server.Close()
+
+	// Test case 1: Not usable before validation
+	auto, _ := InitAutoDNSProvider(testEndpoint(t, v5URL), StaticCredential("mocktoken"), nil)
+	if _, err := auto.GetDNS(context.Background()); err != ErrProviderNotValidated {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrProviderNotValidated)
+	}
+
+	// Test case 2: v5 with token
+	if err := auto.ValidateProvider(context.Background()); err != nil {
+		t.Errorf("Error from ValidateProvider: %s", err)
+	}
+	if auto.API() != PiHoleAPIV5 {
+		t.Errorf("API: %s, Expected: %s.", auto.API(), PiHoleAPIV5)
+	}
+
+	// Test case 3: v6 with password
+	auto, _ = InitAutoDNSProvider(testEndpoint(t, v6URL), nil, StaticCredential("mockpassword"))
+	if err := auto.ValidateProvider(context.Background()); err != nil {
+		t.Errorf("Error from ValidateProvider: %s", err)
+	}
+	if auto.Capabilities().Name != "pihole-v6" {
+		t.Errorf("Provider: %s, Expected: pihole-v6.", auto.Capabilities().Name)
+	}
+	domains, err := auto.GetDNS(context.Background())
+	if err != nil || len(domains) != 1 {
+		t.Errorf("Domains: %v, Error: %v", domains, err)
+	}
+
+	// Test case 4: v6 with only a token
+	auto, _ = InitAutoDNSProvider(testEndpoint(t, v6URL), StaticCredential("mocktoken"), nil)
+	err = auto.ValidateProvider(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "--pihole-password") {
+		t.Errorf("Expected credential mismatch error, got: %v", err)
+	}
+
+	// Test case 5: v5 with only a password
+	auto, _ = InitAutoDNSProvider(testEndpoint(t, v5URL), nil, StaticCredential("mockpassword"))
+	err = auto.ValidateProvider(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "--pihole-token") {
+		t.Errorf("Expected credential mismatch error, got: %v", err)
+	}
+
+	// Test case 6: No credentials at all
+	_, err = InitAutoDNSProvider(testEndpoint(t, v5URL), nil, nil)
+	if err == nil {
+		t.Error("Expected missing credential error")
+	}
+}
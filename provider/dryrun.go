@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DryRunProvider reads from the wrapped provider but only logs the changes it
+// would have sent. Every change set is one log line with fixed fields, with
+// --log-format=json the output diffs cleanly against another run. Reads see
+// the changes logged so far, so later changes are decided like in a real run.
+type DryRunProvider struct {
+	DNSProvider
+
+	mu sync.Mutex
+	// The last change logged per record, in order.
+	pending []*DNSChangeSet
+}
+
+// Make sure the dry run wrapper satisfies the provider contract.
+var _ DNSProvider = &DryRunProvider{}
+
+func NewDryRunProvider(dnsProvider DNSProvider) *DryRunProvider {
+	logrus.Warn("Dry run, changes are logged but not sent to the DNS provider")
+
+	return &DryRunProvider{
+		DNSProvider: dnsProvider,
+	}
+}
+
+// Records the wrapped provider holds, with the changes logged so far applied.
+func (dr *DryRunProvider) GetDNS(ctx context.Context) ([]Domain, error) {
+	domains, err := dr.DNSProvider.GetDNS(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	var applied []Domain
+	for _, d := range domains {
+		if dr.changed(d) == nil {
+			applied = append(applied, d)
+		}
+	}
+	for _, dcs := range dr.pending {
+		if dcs.action == "add" {
+			applied = append(applied, dcs.domain)
+		}
+	}
+	return applied, nil
+}
+
+// The last change logged for d, nil when there is none.
+func (dr *DryRunProvider) changed(d Domain) *DNSChangeSet {
+	for _, dcs := range dr.pending {
+		if dcs.domain == d {
+			return dcs
+		}
+	}
+	return nil
+}
+
+// Log a change set and remember it for later reads.
+func (dr *DryRunProvider) apply(dcs *DNSChangeSet, implicit bool) {
+	logDryRun(dcs, dcs.domain, implicit)
+
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	var kept []*DNSChangeSet
+	for _, p := range dr.pending {
+		if p.domain != dcs.domain {
+			kept = append(kept, p)
+		}
+	}
+	dr.pending = append(kept, dcs)
+}
+
+// Log the change sets the wrapped provider would send. Adding a record
+// replaces the records of the same name it can not coexist with, those
+// deletes are logged as implicit.
+func (dr *DryRunProvider) ModifyDNS(ctx context.Context, dcs *DNSChangeSet) error {
+	domains, err := dr.GetDNS(ctx)
+	if err != nil {
+		return err
+	}
+
+	if dcs.action == "delete" {
+		if !hasRecord(dcs.domain, domains) {
+			return ErrRecordNotFound
+		}
+		dr.apply(dcs, false)
+		return nil
+	}
+
+	for _, d := range domains {
+		if d == dcs.domain {
+			logrus.WithFields(logrus.Fields{
+				"dry_run": true,
+				"domain":  d.domain,
+			}).Debug("Domain already exists with hostname and target")
+			return nil
+		}
+	}
+
+	for _, d := range replacedBy(dr.Capabilities(), dcs.domain, domains) {
+		dr.apply(&DNSChangeSet{
+			domain: d,
+			action: "delete",
+			owner:  dcs.owner,
+		}, true)
+	}
+	dr.apply(dcs, false)
+
+	return nil
+}
+
+func logDryRun(dcs *DNSChangeSet, d Domain, implicit bool) {
+	logrus.WithFields(logrus.Fields{
+		"dry_run":  true,
+		"action":   dcs.action,
+		"domain":   d.domain,
+		"type":     d.Type(),
+		"target":   d.Value(),
+		"owner":    dcs.owner,
+		"implicit": implicit,
+	}).Info("Dry run change set")
+}
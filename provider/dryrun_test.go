@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestDryRunProvider(t *testing.T) {
+	var writes int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("action") != "get":
+			writes++
+		case q.Has("customcname"):
+			w.Write([]byte(`{"data":[["alias.example.com","example.com"]]}`))
+		default:
+			w.Write([]byte(`{"data":[["example.com","192.168.1.2"]]}[]`))
+		}
+	}))
+	defer mockServer.Close()
+
+	mockPHR, _ := InitDNSProvider(testEndpoint(t, mockServer.URL), StaticCredential("mocktoken"))
+	dryRun := NewDryRunProvider(mockPHR)
+
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	changes := func() []string {
+		var logged []string
+		for _, e := range hook.AllEntries() {
+			if e.Message != "Dry run change set" {
+				continue
+			}
+			logged = append(logged, strings.Join([]string{
+				e.Data["action"].(string),
+				e.Data["type"].(string),
+				e.Data["domain"].(string),
+				e.Data["target"].(string),
+				e.Data["owner"].(string),
+			}, " "))
+			if e.Data["implicit"] == true {
+				logged[len(logged)-1] += " implicit"
+			}
+		}
+		hook.Reset()
+		return logged
+	}
+
+	// Test case 1: Reads hit the provider
+	domains, err := dryRun.GetDNS(context.Background())
+	if err != nil || len(domains) != 2 {
+		t.Errorf("Domains: %v, Error: %v", domains, err)
+	}
+
+	// Test case 2: Replacing a record logs the implicit delete
+	dcs, _ := CreateChangeSet("192.168.1.3", "example.com", "add")
+	if err := dryRun.ModifyDNS(context.Background(), dcs.WithOwner("service/default/echo")); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	expected := []string{
+		"delete A example.com 192.168.1.2 service/default/echo implicit",
+		"add A example.com 192.168.1.3 service/default/echo",
+	}
+	if logged := changes(); !reflect.DeepEqual(expected, logged) {
+		t.Errorf("Logged: %v, Expected: %v.", logged, expected)
+	}
+
+	// Test case 3: Existing record is not changed
+	dcs, _ = CreateChangeSet("example.com", "alias.example.com", "add")
+	dryRun.ModifyDNS(context.Background(), dcs)
+	if logged := changes(); len(logged) != 0 {
+		t.Errorf("Logged: %v, Expected nothing.", logged)
+	}
+
+	// Test case 4: Delete
+	dcs, _ = CreateChangeSet("example.com", "alias.example.com", "delete")
+	dryRun.ModifyDNS(context.Background(), dcs)
+	expected = []string{"delete CNAME alias.example.com example.com "}
+	if logged := changes(); !reflect.DeepEqual(expected, logged) {
+		t.Errorf("Logged: %v, Expected: %v.", logged, expected)
+	}
+
+	// Test case 5: Delete a name held with another IP
+	dcs, _ = CreateChangeSet("192.168.1.9", "example.com", "delete")
+	if err := dryRun.ModifyDNS(context.Background(), dcs); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error from delete: %v", err)
+	}
+	if logged := changes(); len(logged) != 0 {
+		t.Errorf("Logged: %v, Expected nothing.", logged)
+	}
+
+	// Test case 6: Reads see the logged changes
+	domains, _ = dryRun.GetDNS(context.Background())
+	expected = []string{"example.com 192.168.1.3"}
+	var listed []string
+	for _, d := range domains {
+		listed = append(listed, d.Name()+" "+d.Value())
+	}
+	if !reflect.DeepEqual(expected, listed) {
+		t.Errorf("Domains: %v, Expected: %v.", listed, expected)
+	}
+
+	// Test case 7: Nothing was written
+	if writes != 0 {
+		t.Errorf("Dry run sent %d changes", writes)
+	}
+}
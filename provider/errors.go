@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors a provider returns, wrapped, so callers can tell them apart with
+// errors.Is.
+var (
+	ErrRecordExists   = errors.New("Record already exists")
+	ErrRecordNotFound = errors.New("Record does not exist")
+	ErrUnauthorized   = errors.New("pi-hole rejected the credentials")
+	ErrFTLNotRunning  = errors.New("pi-hole FTL is not running")
+	// Retrying later may succeed, such as when pi-hole is unreachable.
+	ErrTransient = errors.New("pi-hole is temporarily unavailable")
+	// The provider can not hold the record type, retrying will not help.
+	ErrUnsupportedRecord = errors.New("Record type not supported by the provider")
+	// The record was written by hand, pifrost does not change it.
+	ErrUnmanagedRecord = errors.New("Record is outside the pifrost managed block")
+	// The record name is not in the zone the provider manages.
+	ErrOutsideZone = errors.New("Record is outside the managed zone")
+)
+
+// transientError keeps the cause of a failure worth retrying while matching
+// ErrTransient.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+func (e *transientError) Is(target error) bool {
+	return target == ErrTransient
+}
+
+func transient(err error) error {
+	return &transientError{err: err}
+}
+
+// Classify the message of a legacy API response which did not succeed.
+// {"success":false,"message":"This domain already has a custom DNS entry for an IPv4"}
+func legacyError(message string) error {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "already"):
+		return fmt.Errorf("%w: %s", ErrRecordExists, message)
+	case strings.Contains(lower, "does not exist"):
+		return fmt.Errorf("%w: %s", ErrRecordNotFound, message)
+	case strings.Contains(lower, "not authorized"), strings.Contains(lower, "unauthorized"):
+		return fmt.Errorf("%w: %s", ErrUnauthorized, message)
+	case strings.Contains(lower, "ftl") && strings.Contains(lower, "not running"):
+		return fmt.Errorf("%w: %s", ErrFTLNotRunning, message)
+	}
+
+	return fmt.Errorf("pi-hole rejected the change: %s", message)
+}
@@ -0,0 +1,438 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ip name lines, like /etc/hosts and pi-hole's custom.list.
+	FileFormatHosts = "hosts"
+	// host-record= and cname= lines of a dnsmasq.d snippet.
+	FileFormatDnsmasq = "dnsmasq"
+
+	// The records between the markers belong to pifrost, everything else in
+	// the file is left as it is.
+	fileBlockBegin = "# BEGIN pifrost managed records, edits inside this block are overwritten"
+	fileBlockEnd   = "# END pifrost managed records"
+	// Comment naming the object a record was made for, on the line above it.
+	fileOwnerPrefix = "# pifrost owner: "
+)
+
+// FileConfig describes the file a FileProvider manages.
+type FileConfig struct {
+	// The hosts file or dnsmasq.d snippet, created on the first write.
+	Path string
+	// hosts or dnsmasq.
+	Format string
+	// Run after every write so the DNS server picks the change up, e.g.
+	// pihole restartdns reload. Nothing is run when empty.
+	ReloadCommand []string
+}
+
+// FileProvider manages records in a managed block of a hosts file or dnsmasq
+// snippet, for pi-hole on the same host or a plain dnsmasq. Lines outside the
+// block are hand-written, they are listed but never changed.
+type FileProvider struct {
+	config FileConfig
+
+	mu sync.Mutex
+	// The last reload command failed, run it again on the next change.
+	reloadPending bool
+}
+
+// Make sure the file provider satisfies the provider contract.
+var _ DNSProvider = &FileProvider{}
+
+// A record in the managed block.
+type fileRecord struct {
+	domain Domain
+	owner  string
+}
+
+// The parsed file. Lines outside the managed block are kept verbatim.
+type fileContent struct {
+	before    []string
+	after     []string
+	managed   []fileRecord
+	unmanaged []Domain
+}
+
+func NewFileProvider(config FileConfig) (*FileProvider, error) {
+	if len(config.Path) == 0 {
+		return nil, errors.New("Need a file path")
+	}
+	if config.Format != FileFormatHosts && config.Format != FileFormatDnsmasq {
+		return nil, fmt.Errorf("Unknown file format [%s], must be hosts or dnsmasq", config.Format)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path":   config.Path,
+		"format": config.Format,
+	}).Info("Creating DNS Provider")
+
+	return &FileProvider{
+		config: config,
+	}, nil
+}
+
+// The file must be readable, or not exist yet in a directory we can write to.
+func (fp *FileProvider) ValidateProvider(ctx context.Context) error {
+	if _, err := fp.read(); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(fp.config.Path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(fp.config.Path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Could not write to [%s]: %w", dir, err)
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+
+	return nil
+}
+
+// Hosts files can not hold CNAME records.
+func (fp *FileProvider) Capabilities() Capabilities {
+	if fp.config.Format == FileFormatHosts {
+		return Capabilities{
+			Name:        "hosts-file",
+			RecordTypes: []string{RecordA, RecordAAAA},
+		}
+	}
+	return Capabilities{
+		Name:        "dnsmasq-file",
+		RecordTypes: []string{RecordA, RecordAAAA, RecordCNAME},
+	}
+}
+
+// Every record in the file, managed or hand-written.
+func (fp *FileProvider) GetDNS(ctx context.Context) ([]Domain, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	content, err := fp.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []Domain
+	for _, r := range content.managed {
+		domains = append(domains, r.domain)
+	}
+	return append(domains, content.unmanaged...), nil
+}
+
+func (fp *FileProvider) ModifyDNS(ctx context.Context, dcs *DNSChangeSet) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if !fp.Capabilities().Supports(dcs.domain.Type()) {
+		return fmt.Errorf("%w: %s in a %s file", ErrUnsupportedRecord, dcs.domain.Type(), fp.config.Format)
+	}
+
+	content, err := fp.read()
+	if err != nil {
+		return err
+	}
+
+	var changed bool
+	switch dcs.action {
+	case "add":
+		changed, err = content.add(dcs)
+	case "delete":
+		changed, err = content.delete(dcs)
+	}
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		if err := fp.write(content); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"domain": dcs.domain.domain,
+			"type":   dcs.domain.Type(),
+			"target": dcs.domain.Value(),
+			"action": dcs.action,
+		}).Info("Wrote record to file.")
+	}
+
+	if changed || fp.reloadPending {
+		return fp.reload(ctx)
+	}
+
+	return nil
+}
+
+// Add d to the managed block, replacing the managed records it can not
+// coexist with. Hand-written records in the way are an error.
+func (fc *fileContent) add(dcs *DNSChangeSet) (bool, error) {
+	d := dcs.domain
+	for _, r := range fc.managed {
+		if r.domain == d {
+			logrus.WithFields(logrus.Fields{
+				"domain": d.domain,
+			}).Info("Domain already exists with hostname and target")
+			return false, nil
+		}
+	}
+	for _, u := range fc.unmanaged {
+		if u == d {
+			logrus.WithFields(logrus.Fields{
+				"domain": d.domain,
+			}).Info("Domain already exists with hostname and target")
+			return false, nil
+		}
+		if d.Replaces(u) {
+			return false, fmt.Errorf("%w: %s %s", ErrUnmanagedRecord, u.Type(), u.domain)
+		}
+	}
+
+	kept := fc.managed[:0]
+	for _, r := range fc.managed {
+		if !d.Replaces(r.domain) {
+			kept = append(kept, r)
+		}
+	}
+	fc.managed = append(kept, fileRecord{
+		domain: d,
+		owner:  dcs.owner,
+	})
+
+	return true, nil
+}
+
+// Remove d from the managed block.
+func (fc *fileContent) delete(dcs *DNSChangeSet) (bool, error) {
+	for i, r := range fc.managed {
+		if r.domain == dcs.domain {
+			fc.managed = append(fc.managed[:i], fc.managed[i+1:]...)
+			return true, nil
+		}
+	}
+	for _, u := range fc.unmanaged {
+		if u == dcs.domain {
+			return false, fmt.Errorf("%w: %s %s", ErrUnmanagedRecord, u.Type(), u.domain)
+		}
+	}
+
+	return false, ErrRecordNotFound
+}
+
+// Parse the file, a missing file is empty.
+func (fp *FileProvider) read() (*fileContent, error) {
+	data, err := os.ReadFile(fp.config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &fileContent{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read [%s]: %w", fp.config.Path, err)
+	}
+
+	content := &fileContent{}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+
+	inBlock, seenBlock := false, false
+	owner := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == fileBlockBegin && !seenBlock:
+			inBlock, seenBlock = true, true
+		case trimmed == fileBlockEnd && inBlock:
+			inBlock = false
+		case inBlock && strings.HasPrefix(trimmed, fileOwnerPrefix):
+			owner = strings.TrimPrefix(trimmed, fileOwnerPrefix)
+		case inBlock:
+			for _, d := range parseFileLine(fp.config.Format, trimmed) {
+				content.managed = append(content.managed, fileRecord{
+					domain: d,
+					owner:  owner,
+				})
+			}
+			owner = ""
+		case seenBlock:
+			content.after = append(content.after, line)
+			content.unmanaged = append(content.unmanaged, parseFileLine(fp.config.Format, trimmed)...)
+		default:
+			content.before = append(content.before, line)
+			content.unmanaged = append(content.unmanaged, parseFileLine(fp.config.Format, trimmed)...)
+		}
+	}
+	if inBlock {
+		return nil, fmt.Errorf("Managed block in [%s] is not closed by [%s]", fp.config.Path, fileBlockEnd)
+	}
+
+	return content, nil
+}
+
+// The records of a line, none for comments and lines we do not understand.
+func parseFileLine(format, line string) []Domain {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if len(line) == 0 {
+		return nil
+	}
+
+	if format == FileFormatHosts {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return nil
+		}
+		var domains []Domain
+		for _, name := range fields[1:] {
+			domains = append(domains, NewDomain(fields[0], name))
+		}
+		return domains
+	}
+
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return nil
+	}
+	values := strings.Split(value, ",")
+	switch key {
+	// host-record=name[,name...],ip[,ip][,ttl]
+	case "host-record":
+		var names, ips []string
+		for _, v := range values {
+			if net.ParseIP(v) != nil {
+				ips = append(ips, v)
+			} else if !isTTL(v) {
+				names = append(names, v)
+			}
+		}
+		var domains []Domain
+		for _, name := range names {
+			for _, ip := range ips {
+				domains = append(domains, NewDomain(ip, name))
+			}
+		}
+		return domains
+	// cname=name[,name...],target[,ttl]
+	case "cname":
+		if len(values) > 1 && isTTL(values[len(values)-1]) {
+			values = values[:len(values)-1]
+		}
+		if len(values) < 2 {
+			return nil
+		}
+		target := values[len(values)-1]
+		var domains []Domain
+		for _, name := range values[:len(values)-1] {
+			domains = append(domains, NewCNAME(name, target))
+		}
+		return domains
+	}
+
+	return nil
+}
+
+func isTTL(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// The line of a managed record.
+func formatFileLine(format string, d Domain) string {
+	if format == FileFormatHosts {
+		return fmt.Sprintf("%s %s", d.ip, d.domain)
+	}
+	if d.Type() == RecordCNAME {
+		return fmt.Sprintf("cname=%s,%s", d.domain, d.target)
+	}
+	return fmt.Sprintf("host-record=%s,%s", d.domain, d.ip)
+}
+
+// Render the file and swap it in, so the DNS server never reads half of it.
+func (fp *FileProvider) write(content *fileContent) error {
+	var buf bytes.Buffer
+	for _, line := range content.before {
+		fmt.Fprintln(&buf, line)
+	}
+	fmt.Fprintln(&buf, fileBlockBegin)
+	for _, r := range content.managed {
+		if len(r.owner) != 0 {
+			fmt.Fprintln(&buf, fileOwnerPrefix+r.owner)
+		}
+		fmt.Fprintln(&buf, formatFileLine(fp.config.Format, r.domain))
+	}
+	fmt.Fprintln(&buf, fileBlockEnd)
+	for _, line := range content.after {
+		fmt.Fprintln(&buf, line)
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(fp.config.Path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fp.config.Path), filepath.Base(fp.config.Path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Could not write [%s]: %w", fp.config.Path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not write [%s]: %w", fp.config.Path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not write [%s]: %w", fp.config.Path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Could not write [%s]: %w", fp.config.Path, err)
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return fmt.Errorf("Could not write [%s]: %w", fp.config.Path, err)
+	}
+
+	return os.Rename(tmp.Name(), fp.config.Path)
+}
+
+// Run the reload command. A failure is retried with the next change, the
+// file already holds the records.
+func (fp *FileProvider) reload(ctx context.Context) error {
+	if len(fp.config.ReloadCommand) == 0 {
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, fp.config.ReloadCommand[0], fp.config.ReloadCommand[1:]...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		fp.reloadPending = true
+		return transient(fmt.Errorf("Reload command failed: %w: %s", err, strings.TrimSpace(string(output))))
+	}
+	fp.reloadPending = false
+
+	logrus.WithFields(logrus.Fields{
+		"command": strings.Join(fp.config.ReloadCommand, " "),
+	}).Debug("Reloaded DNS server")
+
+	return nil
+}
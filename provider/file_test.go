@@ -0,0 +1,184 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestFileProvider(t *testing.T, format, content string, reload ...string) (*FileProvider, string) {
+	path := filepath.Join(t.TempDir(), "custom.list")
+	if len(content) != 0 {
+		if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatalf("Error writing file: %s", err)
+		}
+	}
+
+	fp, err := NewFileProvider(FileConfig{
+		Path:          path,
+		Format:        format,
+		ReloadCommand: reload,
+	})
+	if err != nil {
+		t.Fatalf("Error from NewFileProvider: %s", err)
+	}
+	if err := fp.ValidateProvider(context.Background()); err != nil {
+		t.Fatalf("Error from ValidateProvider: %s", err)
+	}
+
+	return fp, path
+}
+
+func TestFileProviderHosts(t *testing.T) {
+	handWritten := "# my records\n192.168.1.1 router.home.lan\n"
+	fp, path := newTestFileProvider(t, FileFormatHosts, handWritten)
+	ctx := context.Background()
+
+	// Test case 1: Hand-written records are listed
+	domains, err := fp.GetDNS(ctx)
+	expected := []Domain{NewDomain("192.168.1.1", "router.home.lan")}
+	if err != nil || !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Domains: %v, Expected: %v. Error: %v", domains, expected, err)
+	}
+
+	// Test case 2: Records are added in the managed block with their owner
+	dcs, _ := CreateChangeSet("192.168.5.1", "echo.home.lan", "add")
+	if err := fp.ModifyDNS(ctx, dcs.WithOwner("service/default/echo")); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	dcs, _ = CreateChangeSet("fd00::5", "echo.home.lan", "add")
+	if err := fp.ModifyDNS(ctx, dcs.WithOwner("service/default/echo")); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	data, _ := os.ReadFile(path)
+	expectedFile := handWritten + fileBlockBegin + "\n" +
+		"# pifrost owner: service/default/echo\n192.168.5.1 echo.home.lan\n" +
+		"# pifrost owner: service/default/echo\nfd00::5 echo.home.lan\n" +
+		fileBlockEnd + "\n"
+	if string(data) != expectedFile {
+		t.Errorf("File:\n%s\nExpected:\n%s", data, expectedFile)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("Mode: %v, Expected: 0640.", info.Mode().Perm())
+	}
+
+	// Test case 3: A second IPv4 address is added next to the first
+	dcs, _ = CreateChangeSet("192.168.5.2", "echo.home.lan", "add")
+	if err := fp.ModifyDNS(ctx, dcs); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	domains, _ = fp.GetDNS(ctx)
+	expected = []Domain{NewDomain("192.168.5.1", "echo.home.lan"), NewDomain("fd00::5", "echo.home.lan"), NewDomain("192.168.5.2", "echo.home.lan"), NewDomain("192.168.1.1", "router.home.lan")}
+	if !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Domains: %v, Expected: %v.", domains, expected)
+	}
+
+	// Test case 4: Hand-written records are never deleted
+	dcs, _ = CreateChangeSet("192.168.1.1", "router.home.lan", "delete")
+	if err := fp.ModifyDNS(ctx, dcs); !errors.Is(err, ErrUnmanagedRecord) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrUnmanagedRecord)
+	}
+
+	// Test case 5: CNAMEs do not fit in a hosts file
+	dcs, _ = CreateChangeSet("echo.home.lan", "alias.home.lan", "add")
+	if err := fp.ModifyDNS(ctx, dcs); !errors.Is(err, ErrUnsupportedRecord) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrUnsupportedRecord)
+	}
+
+	// Test case 6: Deleting, and deleting again
+	for _, ip := range []string{"192.168.5.1", "192.168.5.2", "fd00::5"} {
+		dcs, _ = CreateChangeSet(ip, "echo.home.lan", "delete")
+		if err := fp.ModifyDNS(ctx, dcs); err != nil {
+			t.Errorf("Error from delete: %s", err)
+		}
+	}
+	if err := fp.ModifyDNS(ctx, dcs); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrRecordNotFound)
+	}
+	data, _ = os.ReadFile(path)
+	if string(data) != handWritten+fileBlockBegin+"\n"+fileBlockEnd+"\n" {
+		t.Errorf("File:\n%s", data)
+	}
+}
+
+func TestFileProviderDnsmasq(t *testing.T) {
+	handWritten := "address=/ads.example.com/0.0.0.0\ncname=www.home.lan,router.home.lan,300\n"
+	block := fileBlockBegin + "\n" + "host-record=old.home.lan,192.168.5.9\n" + fileBlockEnd + "\n"
+	fp, path := newTestFileProvider(t, FileFormatDnsmasq, handWritten+block+"# trailing\n")
+	ctx := context.Background()
+
+	// Test case 1: Records of both, lines around the block
+	domains, err := fp.GetDNS(ctx)
+	expected := []Domain{NewDomain("192.168.5.9", "old.home.lan"), NewCNAME("www.home.lan", "router.home.lan")}
+	if err != nil || !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Domains: %v, Expected: %v. Error: %v", domains, expected, err)
+	}
+
+	// Test case 2: A CNAME replaces the managed address
+	dcs, _ := CreateChangeSet("lb.home.lan", "old.home.lan", "add")
+	if err := fp.ModifyDNS(ctx, dcs.WithOwner("ingress/default/old")); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	data, _ := os.ReadFile(path)
+	expectedFile := handWritten + fileBlockBegin + "\n" +
+		"# pifrost owner: ingress/default/old\ncname=old.home.lan,lb.home.lan\n" +
+		fileBlockEnd + "\n# trailing\n"
+	if string(data) != expectedFile {
+		t.Errorf("File:\n%s\nExpected:\n%s", data, expectedFile)
+	}
+
+	// Test case 3: Owners survive reading the file again
+	content, _ := fp.read()
+	if len(content.managed) != 1 || content.managed[0].owner != "ingress/default/old" {
+		t.Errorf("Managed: %+v", content.managed)
+	}
+
+	// Test case 4: An unclosed block is refused
+	os.WriteFile(path, []byte(fileBlockBegin+"\n"), 0644)
+	if _, err := fp.GetDNS(ctx); err == nil {
+		t.Error("Expected error for an unclosed block")
+	}
+}
+
+func TestFileProviderReload(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "reloaded")
+	fp, _ := newTestFileProvider(t, FileFormatHosts, "", "touch", marker)
+	ctx := context.Background()
+
+	// Test case 1: The reload command runs after a write
+	dcs, _ := CreateChangeSet("192.168.5.1", "echo.home.lan", "add")
+	if err := fp.ModifyDNS(ctx, dcs); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Reload command did not run: %s", err)
+	}
+
+	// Test case 2: A failed reload is transient and retried with the next change
+	fp.config.ReloadCommand = []string{"false"}
+	dcs, _ = CreateChangeSet("192.168.5.2", "echo.home.lan", "add")
+	if err := fp.ModifyDNS(ctx, dcs); !errors.Is(err, ErrTransient) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrTransient)
+	}
+	fp.config.ReloadCommand = []string{"touch", marker + "2"}
+	if err := fp.ModifyDNS(ctx, dcs); err != nil {
+		t.Errorf("Error from retry: %s", err)
+	}
+	if _, err := os.Stat(marker + "2"); err != nil || fp.reloadPending {
+		t.Errorf("Reload command did not run again: %v", err)
+	}
+}
+
+func TestNewFileProvider(t *testing.T) {
+	if _, err := NewFileProvider(FileConfig{Path: "custom.list", Format: "zone"}); err == nil || !strings.Contains(err.Error(), "Unknown file format") {
+		t.Errorf("Expected unknown format error, got: %v", err)
+	}
+	if _, err := NewFileProvider(FileConfig{Format: FileFormatHosts}); err == nil {
+		t.Error("Expected missing path error")
+	}
+}
@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"sync"
+	"time"
+)
+
+// How long a listing of pi-hole records is trusted. Changes made outside of
+// pifrost show up after at most this long, the reconciler repairs anything
+// written against a stale listing on its next pass.
+const recordIndexTTL = time.Minute
+
+// recordIndex caches the records a provider holds so a change does not need
+// a full listing first. It is filled by a listing, kept up to date by the
+// provider's own successful writes, and dropped when a write fails or the
+// listing is older than recordIndexTTL. The zero value is empty.
+type recordIndex struct {
+	mu      sync.Mutex
+	loaded  time.Time
+	domains []Domain
+	byName  map[string][]Domain
+}
+
+// Every record, false when the index needs a fresh listing.
+func (ri *recordIndex) list() ([]Domain, bool) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	if !ri.freshLocked() {
+		return nil, false
+	}
+	return append([]Domain(nil), ri.domains...), true
+}
+
+// Records named name, false when the index needs a fresh listing.
+func (ri *recordIndex) named(name string) ([]Domain, bool) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	if !ri.freshLocked() {
+		return nil, false
+	}
+	return append([]Domain(nil), ri.byName[name]...), true
+}
+
+// Replace the index with a fresh listing.
+func (ri *recordIndex) set(domains []Domain) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	ri.domains = append([]Domain(nil), domains...)
+	ri.byName = make(map[string][]Domain, len(domains))
+	for _, d := range domains {
+		ri.byName[d.domain] = append(ri.byName[d.domain], d)
+	}
+	ri.loaded = time.Now()
+}
+
+// Record d was written.
+func (ri *recordIndex) add(d Domain) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	if !ri.freshLocked() {
+		return
+	}
+	for _, current := range ri.byName[d.domain] {
+		if current == d {
+			return
+		}
+	}
+	ri.domains = append(ri.domains, d)
+	ri.byName[d.domain] = append(ri.byName[d.domain], d)
+}
+
+// Record d was deleted.
+func (ri *recordIndex) remove(d Domain) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	if !ri.freshLocked() {
+		return
+	}
+	ri.domains = without(ri.domains, d)
+	ri.byName[d.domain] = without(ri.byName[d.domain], d)
+	if len(ri.byName[d.domain]) == 0 {
+		delete(ri.byName, d.domain)
+	}
+}
+
+// Forget everything, the next lookup lists the records again. Used when a
+// write failed and what the provider holds is unknown.
+func (ri *recordIndex) invalidate() {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	ri.loaded = time.Time{}
+	ri.domains = nil
+	ri.byName = nil
+}
+
+// Caller holds the lock.
+func (ri *recordIndex) freshLocked() bool {
+	return !ri.loaded.IsZero() && time.Since(ri.loaded) < recordIndexTTL
+}
+
+func without(domains []Domain, d Domain) []Domain {
+	kept := domains[:0]
+	for _, current := range domains {
+		if current != d {
+			kept = append(kept, current)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,170 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecordIndex(t *testing.T) {
+	a := NewDomain("192.168.1.2", "example.com")
+	cname := NewCNAME("alias.example.com", "example.com")
+	var ri recordIndex
+
+	// Test case 1: Empty index needs a listing
+	if _, ok := ri.list(); ok {
+		t.Error("Empty index is fresh")
+	}
+	ri.add(a)
+	if _, ok := ri.named(a.domain); ok {
+		t.Error("Add filled a stale index")
+	}
+
+	// Test case 2: Lookups by name
+	ri.set([]Domain{a, cname})
+	records, ok := ri.named(a.domain)
+	if !ok || !reflect.DeepEqual([]Domain{a}, records) {
+		t.Errorf("Records: %v, Fresh: %v", records, ok)
+	}
+	if records, _ := ri.named("missing.example.com"); len(records) != 0 {
+		t.Errorf("Records: %v, Expected none.", records)
+	}
+
+	// Test case 3: Writes keep the index up to date
+	other := NewDomain("192.168.1.3", "other.example.com")
+	ri.add(other)
+	ri.add(other)
+	ri.remove(a)
+	domains, _ := ri.list()
+	if !reflect.DeepEqual([]Domain{cname, other}, domains) {
+		t.Errorf("Domains: %v", domains)
+	}
+	if records, _ := ri.named(a.domain); len(records) != 0 {
+		t.Errorf("Records: %v, Expected none.", records)
+	}
+
+	// Test case 4: Invalidated and expired indexes need a listing
+	ri.invalidate()
+	if _, ok := ri.list(); ok {
+		t.Error("Invalidated index is fresh")
+	}
+	ri.set([]Domain{a})
+	ri.loaded = time.Now().Add(-recordIndexTTL)
+	if _, ok := ri.named(a.domain); ok {
+		t.Error("Expired index is fresh")
+	}
+}
+
+func TestIndexedModifyDNS(t *testing.T) {
+	var gets, writes int32
+	var fail atomic.Bool
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("action") == "get" && q.Has("customcname"):
+			w.Write([]byte(`{"data":[]}`))
+		case q.Get("action") == "get":
+			atomic.AddInt32(&gets, 1)
+			w.Write([]byte(`{"data":[["example.com","192.168.1.2"]]}[]`))
+		case fail.Load():
+			w.Write([]byte(`{"success":false,"message":"Not allowed"}`))
+		default:
+			atomic.AddInt32(&writes, 1)
+			w.Write([]byte(`{"success":true,"message":""}`))
+		}
+	}))
+	defer mockServer.Close()
+
+	mockPHR, _ := InitDNSProvider(testEndpoint(t, mockServer.URL), StaticCredential("mocktoken"))
+	modify := func(action string, d Domain) error {
+		return mockPHR.ModifyDNS(context.Background(), &DNSChangeSet{domain: d, action: action})
+	}
+
+	// Test case 1: One listing serves every change
+	if err := modify("add", NewDomain("192.168.1.3", "other.example.com")); err != nil {
+		t.Errorf("Error from ModifyDNS: %s", err)
+	}
+	if err := modify("add", NewDomain("192.168.1.4", "example.com")); err != nil {
+		t.Errorf("Error from ModifyDNS: %s", err)
+	}
+	if err := modify("delete", NewDomain("192.168.1.3", "other.example.com")); err != nil {
+		t.Errorf("Error from ModifyDNS: %s", err)
+	}
+	if gets != 1 || writes != 4 {
+		t.Errorf("Listings: %d, Writes: %d, Expected: 1, 4.", gets, writes)
+	}
+
+	// Test case 2: Changes the index already holds are skipped
+	if err := modify("add", NewDomain("192.168.1.4", "example.com")); err != nil {
+		t.Errorf("Error from ModifyDNS: %s", err)
+	}
+	if writes != 4 {
+		t.Errorf("Writes: %d, Expected: 4.", writes)
+	}
+
+	// Test case 3: A rejected write drops the index
+	fail.Store(true)
+	modify("add", NewDomain("192.168.1.5", "new.example.com"))
+	fail.Store(false)
+	domains, err := mockPHR.GetDNS(context.Background())
+	if err != nil || gets != 2 {
+		t.Errorf("Listings: %d, Expected: 2, Error: %v", gets, err)
+	}
+	if !reflect.DeepEqual([]Domain{NewDomain("192.168.1.2", "example.com")}, domains) {
+		t.Errorf("Domains: %v", domains)
+	}
+}
+
+// A pi-hole holding thousands of records, every change used to list all of
+// them first.
+func BenchmarkModifyDNS(b *testing.B) {
+	const records = 5000
+	var listing strings.Builder
+	listing.WriteString(`{"data":[`)
+	for i := 0; i < records; i++ {
+		if i != 0 {
+			listing.WriteString(",")
+		}
+		fmt.Fprintf(&listing, `["host%d.example.com","10.0.%d.%d"]`, i, i/256, i%256)
+	}
+	listing.WriteString(`]}`)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("action") == "get" && q.Has("customcname"):
+			w.Write([]byte(`{"data":[]}`))
+		case q.Get("action") == "get":
+			w.Write([]byte(listing.String()))
+		default:
+			w.Write([]byte(`{"success":true,"message":""}`))
+		}
+	}))
+	defer mockServer.Close()
+
+	bench := func(b *testing.B, cached bool) {
+		mockPHR, _ := InitDNSProvider(testEndpoint(b, mockServer.URL), StaticCredential("mocktoken"))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if !cached {
+				mockPHR.index.invalidate()
+			}
+			dcs := &DNSChangeSet{
+				domain: NewDomain(fmt.Sprintf("192.168.%d.%d", i/256%256, i%256), fmt.Sprintf("host%d.example.com", i%records)),
+				action: "add",
+			}
+			if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+				b.Fatalf("Error from ModifyDNS: %s", err)
+			}
+		}
+	}
+
+	b.Run("listing", func(b *testing.B) { bench(b, false) })
+	b.Run("index", func(b *testing.B) { bench(b, true) })
+}
@@ -0,0 +1,650 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	v6AuthPath  = "/api/auth"
+	v6HostsPath = "/api/config/dns/hosts"
+	v6CNAMEPath = "/api/config/dns/cnameRecords"
+	// Renew the session a little before pi-hole expires it.
+	v6SessionMargin = 30 * time.Second
+)
+
+// PiHoleV6Request talks to the pi-hole v6 REST API. Unlike the legacy API
+// it authenticates with an app password which is exchanged for a session ID.
+type PiHoleV6Request struct {
+	endpoint *Endpoint
+	password Credential
+
+	mu       sync.Mutex
+	sid      string
+	validity time.Duration
+	expires  time.Time
+
+	index recordIndex
+}
+
+// PiHoleAPIError is the error body returned by the v6 API.
+type PiHoleAPIError struct {
+	StatusCode int
+	Key        string `json:"key"`
+	Message    string `json:"message"`
+	Hint       string `json:"hint"`
+}
+
+func (e *PiHoleAPIError) Error() string {
+	if len(e.Hint) != 0 {
+		return fmt.Sprintf("pi-hole API error [%d] %s: %s (%s)", e.StatusCode, e.Key, e.Message, e.Hint)
+	}
+	return fmt.Sprintf("pi-hole API error [%d] %s: %s", e.StatusCode, e.Key, e.Message)
+}
+
+// Match the provider errors, so callers need not know which API answered.
+func (e *PiHoleAPIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrRecordNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRecordExists:
+		return e.StatusCode == http.StatusBadRequest && strings.Contains(strings.ToLower(e.Message), "already present")
+	case ErrTransient:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	}
+	return false
+}
+
+type v6Session struct {
+	Valid    bool   `json:"valid"`
+	SID      string `json:"sid"`
+	Validity int    `json:"validity"`
+	Message  string `json:"message"`
+}
+
+// Make sure the pi-hole v6 client satisfies the provider contract.
+var _ DNSProvider = &PiHoleV6Request{}
+
+// Create a pi-hole v6 DNS provider request struct.
+func InitV6DNSProvider(endpoint *Endpoint, password Credential) (*PiHoleV6Request, error) {
+	if endpoint == nil {
+		return nil, errors.New("Need a pi-hole endpoint")
+	}
+	if password == nil {
+		return nil, errors.New("Need a pi-hole password")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"url": endpoint,
+	}).Info("Creating DNS Provider (pi-hole v6)")
+
+	return &PiHoleV6Request{
+		endpoint: endpoint,
+		password: password,
+	}, nil
+}
+
+// Log in and list records to check the pi-hole accepts connections.
+func (p *PiHoleV6Request) ValidateProvider(ctx context.Context) error {
+	var count int = 1
+	const tries int = 8
+	for {
+		logrus.Info("Attempting to reach pi-hole...")
+		_, err := p.GetDNS(ctx)
+		if err == nil {
+			logrus.Info("Connected.")
+			return nil
+		}
+		// Retrying will not fix the password.
+		if errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		logrus.Debugf("pi-hole not ready: %s", err)
+		if err := backoff(ctx, 1<<count*time.Second); err != nil {
+			return err
+		}
+		count++
+		if count == tries {
+			break
+		}
+	}
+
+	return errors.New("Failed to connect to pi-hole.")
+}
+
+// The v6 client manages local DNS hosts, IPv4 and IPv6, and CNAME records.
+func (p *PiHoleV6Request) Capabilities() Capabilities {
+	return Capabilities{
+		Name:          "pihole-v6",
+		RecordTypes:   []string{RecordA, RecordAAAA, RecordCNAME},
+		SingleAddress: true,
+	}
+}
+
+// Records pi-hole holds, from the record index while it is fresh.
+func (p *PiHoleV6Request) GetDNS(ctx context.Context) ([]Domain, error) {
+	if domains, ok := p.index.list(); ok {
+		return domains, nil
+	}
+
+	response, err := p.doRequest(ctx, "GET", v6HostsPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get DNS records: %w", err)
+	}
+
+	domains, err := decodeV6Hosts(response)
+	if err != nil {
+		return nil, fmt.Errorf("Failed decode domains: %w", err)
+	}
+
+	response, err = p.doRequest(ctx, "GET", v6CNAMEPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get CNAME records: %w", err)
+	}
+
+	cnames, err := decodeV6CNAMEs(response)
+	if err != nil {
+		return nil, fmt.Errorf("Failed decode CNAMEs: %w", err)
+	}
+
+	domains = append(domains, cnames...)
+	p.index.set(domains)
+
+	return domains, nil
+}
+
+// Records named name, only lists pi-hole when the record index is stale.
+func (p *PiHoleV6Request) named(ctx context.Context, name string) ([]Domain, error) {
+	if records, ok := p.index.named(name); ok {
+		return records, nil
+	}
+
+	domains, err := p.GetDNS(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Domain
+	for _, d := range domains {
+		if d.domain == name {
+			records = append(records, d)
+		}
+	}
+	return records, nil
+}
+
+// Call add function or delete function.
+func (p *PiHoleV6Request) ModifyDNS(ctx context.Context, dcs *DNSChangeSet) error {
+	switch dcs.action {
+	case "add":
+		return p.add(ctx, dcs)
+	case "delete":
+		return p.delete(ctx, dcs)
+	}
+
+	return nil
+}
+
+// Add action but is also a change action.
+func (p *PiHoleV6Request) add(ctx context.Context, dcs *DNSChangeSet) error {
+	records, err := p.named(ctx, dcs.domain.domain)
+	if err != nil {
+		return fmt.Errorf("Failed to add: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": dcs.domain.domain,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
+	}).Info("Creating record.")
+
+	for _, d := range records {
+		if d == dcs.domain {
+			logrus.WithFields(logrus.Fields{
+				"domain": dcs.domain.domain,
+			}).Info("Domain already exists with hostname and target")
+			return nil
+		}
+	}
+
+	replaced := replacedBy(p.Capabilities(), dcs.domain, records)
+	if len(replaced) != 0 {
+		logrus.WithFields(logrus.Fields{
+			"domain": dcs.domain.domain,
+		}).Info("Record with domain exists, change")
+	}
+	for _, d := range replaced {
+		err = p.remove(ctx, d)
+		if err != nil {
+			return fmt.Errorf("Could not change record: %w", err)
+		}
+	}
+
+	err = p.write(ctx, "PUT", dcs.domain)
+	if err != nil {
+		return fmt.Errorf("Could not add record: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": dcs.domain.domain,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
+	}).Info("Created record.")
+
+	return nil
+}
+
+// Delete
+func (p *PiHoleV6Request) delete(ctx context.Context, dcs *DNSChangeSet) error {
+	records, err := p.named(ctx, dcs.domain.domain)
+	if err != nil {
+		return fmt.Errorf("Failed to delete: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": dcs.domain.domain,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
+	}).Info("Deleting record.")
+
+	if !hasRecord(dcs.domain, records) {
+		return ErrRecordNotFound
+	}
+
+	err = p.remove(ctx, dcs.domain)
+	if err != nil {
+		return fmt.Errorf("Could not delete record: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": dcs.domain.domain,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
+	}).Info("Deleted record.")
+
+	return nil
+}
+
+// PUT or DELETE record d and keep the record index in step with it. When
+// the outcome is unknown the index is dropped.
+func (p *PiHoleV6Request) write(ctx context.Context, method string, d Domain) error {
+	_, err := p.doRequest(ctx, method, v6RecordPath(d), nil)
+	if err != nil {
+		p.index.invalidate()
+		return err
+	}
+
+	if method == "PUT" {
+		p.index.add(d)
+	} else {
+		p.index.remove(d)
+	}
+
+	return nil
+}
+
+// Delete record d. A hosts line may name several records of one IP, pi-hole
+// only deletes whole lines, so the line naming d is written again without d
+// before the original is deleted. Should either write fail the other names
+// stay, a retry skips the line already written.
+func (p *PiHoleV6Request) remove(ctx context.Context, d Domain) error {
+	if d.Type() == RecordCNAME {
+		return p.write(ctx, "DELETE", d)
+	}
+
+	response, err := p.doRequest(ctx, "GET", v6HostsPath, nil)
+	if err != nil {
+		return err
+	}
+	lines, err := decodeV6HostsLines(response)
+	if err != nil {
+		return err
+	}
+
+	line, ok := v6HostsLine(lines, d)
+	if !ok {
+		p.index.remove(d)
+		return ErrRecordNotFound
+	}
+	if rest := v6WithoutName(line, d.domain); len(rest) != 0 && !containsLine(lines, rest) {
+		if err := p.writeLine(ctx, "PUT", rest); err != nil {
+			return err
+		}
+	}
+	if err := p.writeLine(ctx, "DELETE", line); err != nil {
+		return err
+	}
+
+	p.index.remove(d)
+	return nil
+}
+
+// PUT or DELETE a raw hosts line. When the outcome is unknown the record
+// index is dropped.
+func (p *PiHoleV6Request) writeLine(ctx context.Context, method, line string) error {
+	_, err := p.doRequest(ctx, method, fmt.Sprintf("%s/%s", v6HostsPath, url.PathEscape(line)), nil)
+	if err != nil {
+		p.index.invalidate()
+	}
+	return err
+}
+
+// Logout ends the current session, pi-hole only allows a limited number of
+// concurrent sessions so we should clean up after ourselves.
+func (p *PiHoleV6Request) Logout(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.sid) == 0 {
+		return nil
+	}
+
+	resp, err := p.send(ctx, "DELETE", v6AuthPath, nil, p.sid)
+	if err != nil {
+		return fmt.Errorf("Failed to logout: %w", err)
+	}
+	defer resp.Body.Close()
+
+	p.setSession("")
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusUnauthorized {
+		body, _ := io.ReadAll(resp.Body)
+		return decodeV6Error(resp.StatusCode, body)
+	}
+
+	logrus.Debug("Logged out of pi-hole session")
+	return nil
+}
+
+// Return a valid session ID, logging in again when the session is missing or
+// about to expire. Caller must hold the lock.
+func (p *PiHoleV6Request) session(ctx context.Context) (string, error) {
+	if !p.expires.IsZero() && time.Now().Add(v6SessionMargin).Before(p.expires) {
+		return p.sid, nil
+	}
+
+	err := withCredential(ctx, p.password, func() error {
+		return p.login(ctx)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return p.sid, nil
+}
+
+// Exchange the password for a new session. Caller must hold the lock.
+func (p *PiHoleV6Request) login(ctx context.Context) error {
+	password := p.password.Get()
+	RedactSecret(password)
+	payload, err := json.Marshal(map[string]string{"password": password})
+	if err != nil {
+		return errors.New("Failed to encode auth request.")
+	}
+
+	resp, err := p.send(ctx, "POST", v6AuthPath, payload, "")
+	if err != nil {
+		return fmt.Errorf("Failed to authenticate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.New("Failed to read response body.")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeV6Error(resp.StatusCode, body)
+	}
+
+	var auth struct {
+		Session v6Session `json:"session"`
+	}
+	if err := json.Unmarshal(body, &auth); err != nil {
+		return fmt.Errorf("Error decoding auth: %w", err)
+	}
+	if !auth.Session.Valid {
+		return fmt.Errorf("%w: %s", ErrUnauthorized, auth.Session.Message)
+	}
+	// A pi-hole without a password hands out a valid session with no ID.
+	if len(auth.Session.SID) == 0 {
+		logrus.Warn("pi-hole does not require a password")
+	}
+
+	p.setSession(auth.Session.SID)
+	p.validity = time.Duration(auth.Session.Validity) * time.Second
+	p.expires = time.Now().Add(p.validity)
+	logrus.Debug("Authenticated new pi-hole session")
+
+	return nil
+}
+
+// Replace the session ID, an empty sid drops the session. Only the current
+// ID is redacted. Caller must hold the lock.
+func (p *PiHoleV6Request) setSession(sid string) {
+	ReplaceSecret(p.sid, sid)
+	p.sid = sid
+	if len(sid) == 0 {
+		p.expires = time.Time{}
+	}
+}
+
+// Perform an authenticated request against the pi-hole v6 API. A 401 means
+// the session was dropped server side, log in again and retry once.
+func (p *PiHoleV6Request) doRequest(ctx context.Context, method, path string, payload []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		sid, err := p.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := p.send(ctx, method, path, payload, sid)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.New("Failed to read response body.")
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			logrus.Debug("pi-hole session expired, renewing")
+			p.setSession("")
+			continue
+		}
+
+		if resp.StatusCode >= 300 {
+			return nil, decodeV6Error(resp.StatusCode, body)
+		}
+
+		// Every authenticated request extends the session.
+		p.expires = time.Now().Add(p.validity)
+
+		return body, nil
+	}
+}
+
+func (p *PiHoleV6Request) send(ctx context.Context, method, path string, payload []byte, sid string) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.endpoint.url(path), body)
+	if err != nil {
+		return nil, errors.New("Failed to create HTTP request.")
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(sid) != 0 {
+		req.Header.Set("X-FTL-SID", sid)
+	}
+
+	logrus.Debugf("Request: %s %s", method, req.URL)
+
+	resp, err := p.endpoint.client.Do(req)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil || resp == nil {
+		return nil, transient(errors.New("Error sending request to the server."))
+	}
+
+	return resp, nil
+}
+
+// Config entries are addressed by their url encoded value, "ip domain" for
+// hosts pifrost writes and "domain,target" for CNAMEs.
+func v6RecordPath(d Domain) string {
+	if d.Type() == RecordCNAME {
+		return fmt.Sprintf("%s/%s", v6CNAMEPath, url.PathEscape(fmt.Sprintf("%s,%s", d.domain, d.target)))
+	}
+	return fmt.Sprintf("%s/%s", v6HostsPath, url.PathEscape(fmt.Sprintf("%s %s", d.ip, d.domain)))
+}
+
+// The hosts line naming address record d.
+func v6HostsLine(lines []string, d Domain) (string, bool) {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != d.ip {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if name == d.domain {
+				return line, true
+			}
+		}
+	}
+	return "", false
+}
+
+// The hosts line without name, empty when no other name is left.
+func v6WithoutName(line, name string) string {
+	fields := strings.Fields(line)
+	kept := fields[:1]
+	for _, f := range fields[1:] {
+		if f != name {
+			kept = append(kept, f)
+		}
+	}
+	if len(kept) < 2 {
+		return ""
+	}
+	return strings.Join(kept, " ")
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode the raw lines of the local DNS hosts config
+// {"config":{"dns":{"hosts":["10.1.1.1 foo.example.xyz"]}},"took":0.003}
+func decodeV6HostsLines(responseBody []byte) ([]string, error) {
+	var hR struct {
+		Config struct {
+			DNS struct {
+				Hosts []string `json:"hosts"`
+			} `json:"dns"`
+		} `json:"config"`
+	}
+
+	if err := json.Unmarshal(responseBody, &hR); err != nil {
+		return nil, fmt.Errorf("Error decoding GET: %w", err)
+	}
+	return hR.Config.DNS.Hosts, nil
+}
+
+// Decode the local DNS hosts config into records.
+func decodeV6Hosts(responseBody []byte) ([]Domain, error) {
+	lines, err := decodeV6HostsLines(responseBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []Domain
+	for _, entry := range lines {
+		fields := strings.Fields(entry)
+		if len(fields) < 2 {
+			logrus.Debugf("Skipping malformed hosts entry: [%s]", entry)
+			continue
+		}
+		// A hosts line may carry several names for the same IP.
+		for _, name := range fields[1:] {
+			domains = append(domains, NewDomain(fields[0], name))
+		}
+	}
+	logrus.Debugf("Created domain struct: [%s]", domains)
+
+	return domains, nil
+}
+
+// Decode the CNAME records config, the TTL is optional
+// {"config":{"dns":{"cnameRecords":["alias.example.xyz,foo.example.xyz,300"]}},"took":0.003}
+func decodeV6CNAMEs(responseBody []byte) ([]Domain, error) {
+	var cR struct {
+		Config struct {
+			DNS struct {
+				CNAMERecords []string `json:"cnameRecords"`
+			} `json:"dns"`
+		} `json:"config"`
+	}
+
+	if err := json.Unmarshal(responseBody, &cR); err != nil {
+		return nil, fmt.Errorf("Error decoding GET: %w", err)
+	}
+
+	var domains []Domain
+	for _, entry := range cR.Config.DNS.CNAMERecords {
+		fields := strings.Split(entry, ",")
+		if len(fields) < 2 {
+			logrus.Debugf("Skipping malformed CNAME entry: [%s]", entry)
+			continue
+		}
+		domains = append(domains, NewCNAME(fields[0], fields[1]))
+	}
+	logrus.Debugf("Created CNAME struct: [%s]", domains)
+
+	return domains, nil
+}
+
+// Decode a v6 error body
+// {"error":{"key":"unauthorized","message":"Unauthorized","hint":null},"took":0.001}
+func decodeV6Error(statusCode int, responseBody []byte) error {
+	var eR struct {
+		Error PiHoleAPIError `json:"error"`
+	}
+
+	apiErr := &eR.Error
+	if err := json.Unmarshal(responseBody, &eR); err != nil || len(apiErr.Key) == 0 {
+		apiErr.Key = strings.ToLower(strings.ReplaceAll(http.StatusText(statusCode), " ", "_"))
+		apiErr.Message = http.StatusText(statusCode)
+	}
+	apiErr.StatusCode = statusCode
+
+	return apiErr
+}
@@ -0,0 +1,429 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockV6Server is a small stand in for the pi-hole v6 API.
+type mockV6Server struct {
+	mu       sync.Mutex
+	hosts    []string
+	cnames   []string
+	sessions map[string]bool
+	logins   int
+	// Answer the next list entry request of this method with a 502.
+	failNext string
+}
+
+func startMockV6Server(t *testing.T, hosts ...string) (*httptest.Server, string, *mockV6Server) {
+	state := &mockV6Server{
+		hosts:    hosts,
+		sessions: map[string]bool{},
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Path == v6AuthPath {
+			switch r.Method {
+			case "POST":
+				var body struct {
+					Password string `json:"password"`
+				}
+				json.NewDecoder(r.Body).Decode(&body)
+				if body.Password != "mockpassword" {
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(`{"session":{"valid":false,"totp":false,"sid":null,"validity":-1,"message":"password incorrect"},"took":0.01}`))
+					return
+				}
+				state.logins++
+				sid := "mocksid" + strings.Repeat("x", state.logins)
+				state.sessions[sid] = true
+				w.Write([]byte(`{"session":{"valid":true,"totp":false,"sid":"` + sid + `","csrf":"mockcsrf","validity":1800,"message":"app-password correct"},"took":0.01}`))
+			case "DELETE":
+				delete(state.sessions, r.Header.Get("X-FTL-SID"))
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+
+		if !state.sessions[r.Header.Get("X-FTL-SID")] {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"key":"unauthorized","message":"Unauthorized","hint":null},"took":0.001}`))
+			return
+		}
+
+		// Both config lists behave the same way.
+		var list *[]string
+		var base, key string
+		switch {
+		case strings.HasPrefix(r.URL.Path, v6HostsPath):
+			list, base, key = &state.hosts, v6HostsPath, "hosts"
+		case strings.HasPrefix(r.URL.Path, v6CNAMEPath):
+			list, base, key = &state.cnames, v6CNAMEPath, "cnameRecords"
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"key":"not_found","message":"Not found","hint":null},"took":0.001}`))
+			return
+		}
+
+		if r.URL.Path == base && r.Method == "GET" {
+			entries, _ := json.Marshal(*list)
+			if *list == nil {
+				entries = []byte("[]")
+			}
+			w.Write([]byte(`{"config":{"dns":{"` + key + `":` + string(entries) + `}},"took":0.003}`))
+			return
+		}
+
+		if r.Method == state.failNext {
+			state.failNext = ""
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"error":{"key":"bad_gateway","message":"Bad gateway","hint":null},"took":0.001}`))
+			return
+		}
+
+		entry, _ := url.PathUnescape(strings.TrimPrefix(r.URL.Path, base+"/"))
+		switch r.Method {
+		case "PUT":
+			for _, h := range *list {
+				if h == entry {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"error":{"key":"bad_request","message":"Item already present","hint":"Uniqueness of items is enforced"},"took":0.001}`))
+					return
+				}
+			}
+			*list = append(*list, entry)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"took":0.01}`))
+		case "DELETE":
+			for i, h := range *list {
+				if h == entry {
+					*list = append((*list)[:i], (*list)[i+1:]...)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"key":"not_found","message":"Item not found","hint":null},"took":0.001}`))
+		}
+	}))
+
+	return mockServer, mockServer.URL, state
+}
+
+func TestV6GetDNS(t *testing.T) {
+	mockServer, serverURL, _ := startMockV6Server(t, "192.168.1.2 example.com", "192.168.1.3 a.example.com b.example.com")
+	defer mockServer.Close()
+
+	expected := []Domain{
+		{
+			ip:     "192.168.1.2",
+			domain: "example.com",
+		},
+		{
+			ip:     "192.168.1.3",
+			domain: "a.example.com",
+		},
+		{
+			ip:     "192.168.1.3",
+			domain: "b.example.com",
+		},
+	}
+
+	mockPHR, _ := InitV6DNSProvider(testEndpoint(t, serverURL), StaticCredential("mockpassword"))
+	domains, err := mockPHR.GetDNS(context.Background())
+	if err != nil {
+		t.Errorf("Error from GetDNS: %s", err)
+	}
+	if !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Did not get valid example domains: %v", domains)
+	}
+}
+
+func TestV6ModifyDNS(t *testing.T) {
+	mockServer, serverURL, state := startMockV6Server(t, "192.168.1.2 example.com")
+	defer mockServer.Close()
+
+	mockPHR, _ := InitV6DNSProvider(testEndpoint(t, serverURL), StaticCredential("mockpassword"))
+
+	// Test case 1: Add new record
+	dcs, _ := CreateChangeSet("192.168.1.5", "new.example.com", "add")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+
+	// Test case 2: Add changes the IP of an existing record
+	dcs, _ = CreateChangeSet("192.168.1.9", "example.com", "add")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from change: %s", err)
+	}
+
+	expected := []string{"192.168.1.5 new.example.com", "192.168.1.9 example.com"}
+	if !reflect.DeepEqual(expected, state.hosts) {
+		t.Errorf("Hosts: %v, Expected: %v.", state.hosts, expected)
+	}
+
+	// Test case 3: Add duplicate is a no-op
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from duplicate add: %s", err)
+	}
+
+	// Test case 4: Delete
+	dcs, _ = CreateChangeSet("192.168.1.9", "example.com", "delete")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+
+	// Test case 5: Delete record not found
+	dcs, _ = CreateChangeSet("192.168.1.1", "boop.example.com", "delete")
+	err := mockPHR.ModifyDNS(context.Background(), dcs)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error from delete: %v", err)
+	}
+
+	// Test case 6: Delete a name held with another IP
+	dcs, _ = CreateChangeSet("192.168.1.6", "new.example.com", "delete")
+	err = mockPHR.ModifyDNS(context.Background(), dcs)
+	if !errors.Is(err, ErrRecordNotFound) || !reflect.DeepEqual(state.hosts, []string{"192.168.1.5 new.example.com"}) {
+		t.Errorf("Error from delete: %v, Hosts: %v", err, state.hosts)
+	}
+
+	// Only needed to log in once.
+	if state.logins != 1 {
+		t.Errorf("Logins: %d, Expected: 1.", state.logins)
+	}
+}
+
+func TestV6MultiNameHosts(t *testing.T) {
+	mockServer, serverURL, state := startMockV6Server(t, "192.168.1.3 a.example.com b.example.com c.example.com")
+	defer mockServer.Close()
+
+	mockPHR, _ := InitV6DNSProvider(testEndpoint(t, serverURL), StaticCredential("mockpassword"))
+
+	// Test case 1: Delete one name of a line, the other names stay
+	dcs, _ := CreateChangeSet("192.168.1.3", "b.example.com", "delete")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+	expected := []string{"192.168.1.3 a.example.com c.example.com"}
+	if !reflect.DeepEqual(expected, state.hosts) {
+		t.Errorf("Hosts: %v, Expected: %v.", state.hosts, expected)
+	}
+
+	// Test case 2: Add replaces a name of the line
+	dcs, _ = CreateChangeSet("192.168.1.9", "a.example.com", "add")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from change: %s", err)
+	}
+	expected = []string{"192.168.1.3 c.example.com", "192.168.1.9 a.example.com"}
+	if !reflect.DeepEqual(expected, state.hosts) {
+		t.Errorf("Hosts: %v, Expected: %v.", state.hosts, expected)
+	}
+
+	// Test case 3: Delete the last name of a line
+	dcs, _ = CreateChangeSet("192.168.1.3", "c.example.com", "delete")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+	expected = []string{"192.168.1.9 a.example.com"}
+	if !reflect.DeepEqual(expected, state.hosts) {
+		t.Errorf("Hosts: %v, Expected: %v.", state.hosts, expected)
+	}
+}
+
+func TestV6MultiNameHostsFailure(t *testing.T) {
+	mockServer, serverURL, state := startMockV6Server(t, "192.168.1.3 a.example.com b.example.com")
+	defer mockServer.Close()
+
+	mockPHR, _ := InitV6DNSProvider(testEndpoint(t, serverURL), StaticCredential("mockpassword"))
+	dcs, _ := CreateChangeSet("192.168.1.3", "b.example.com", "delete")
+
+	// Test case 1: The rewritten line fails, the original stays
+	state.failNext = "PUT"
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err == nil {
+		t.Error("Expected error from delete")
+	}
+	expected := []string{"192.168.1.3 a.example.com b.example.com"}
+	if !reflect.DeepEqual(expected, state.hosts) {
+		t.Errorf("Hosts: %v, Expected: %v.", state.hosts, expected)
+	}
+
+	// Test case 2: Deleting the original fails, the other name stays
+	state.failNext = "DELETE"
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err == nil {
+		t.Error("Expected error from delete")
+	}
+	expected = []string{"192.168.1.3 a.example.com b.example.com", "192.168.1.3 a.example.com"}
+	if !reflect.DeepEqual(expected, state.hosts) {
+		t.Errorf("Hosts: %v, Expected: %v.", state.hosts, expected)
+	}
+
+	// Test case 3: A retry only deletes the original
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+	expected = []string{"192.168.1.3 a.example.com"}
+	if !reflect.DeepEqual(expected, state.hosts) {
+		t.Errorf("Hosts: %v, Expected: %v.", state.hosts, expected)
+	}
+}
+
+func TestV6CNAME(t *testing.T) {
+	mockServer, serverURL, state := startMockV6Server(t, "192.168.1.2 example.com")
+	defer mockServer.Close()
+
+	mockPHR, _ := InitV6DNSProvider(testEndpoint(t, serverURL), StaticCredential("mockpassword"))
+
+	// Test case 1: Add a CNAME
+	dcs, _ := CreateChangeSet("example.com", "alias.example.com", "add")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	if !reflect.DeepEqual([]string{"alias.example.com,example.com"}, state.cnames) {
+		t.Errorf("CNAMEs: %v", state.cnames)
+	}
+
+	// Test case 2: Listed with the hosts
+	domains, _ := mockPHR.GetDNS(context.Background())
+	expected := []Domain{NewDomain("192.168.1.2", "example.com"), NewCNAME("alias.example.com", "example.com")}
+	if !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Domains: %v, Expected: %v.", domains, expected)
+	}
+
+	// Test case 3: Turning the A record into a CNAME replaces it
+	dcs, _ = CreateChangeSet("other.example.com", "example.com", "add")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from change: %s", err)
+	}
+	if len(state.hosts) != 0 || len(state.cnames) != 2 {
+		t.Errorf("Hosts: %v, CNAMEs: %v", state.hosts, state.cnames)
+	}
+
+	// Test case 4: Delete the CNAME
+	dcs, _ = CreateChangeSet("example.com", "alias.example.com", "delete")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+	if !reflect.DeepEqual([]string{"example.com,other.example.com"}, state.cnames) {
+		t.Errorf("CNAMEs: %v", state.cnames)
+	}
+}
+
+func TestV6Session(t *testing.T) {
+	mockServer, serverURL, state := startMockV6Server(t)
+	defer mockServer.Close()
+
+	// Test case 1: Wrong password
+	mockPHR, _ := InitV6DNSProvider(testEndpoint(t, serverURL), StaticCredential("wrong"))
+	_, err := mockPHR.GetDNS(context.Background())
+	var apiErr *PiHoleAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized API error, got: %v", err)
+	}
+
+	// Test case 2: Session dropped server side is renewed
+	mockPHR, _ = InitV6DNSProvider(testEndpoint(t, serverURL), StaticCredential("mockpassword"))
+	if _, err = mockPHR.GetDNS(context.Background()); err != nil {
+		t.Errorf("Error from GetDNS: %s", err)
+	}
+	state.sessions = map[string]bool{}
+	// Skip the record index so the listing goes to pi-hole.
+	mockPHR.index.invalidate()
+	if _, err = mockPHR.GetDNS(context.Background()); err != nil {
+		t.Errorf("Error from GetDNS after session loss: %s", err)
+	}
+	if state.logins != 2 {
+		t.Errorf("Logins: %d, Expected: 2.", state.logins)
+	}
+
+	// Test case 3: Logout
+	if err = mockPHR.Logout(context.Background()); err != nil {
+		t.Errorf("Error from Logout: %s", err)
+	}
+	if len(state.sessions) != 0 {
+		t.Errorf("Expected no sessions after logout: %v", state.sessions)
+	}
+
+	// Test case 4: A new session ID replaces the old one in the redacted secrets
+	mockPHR.setSession("firstsessionid")
+	mockPHR.setSession("secondsessionid")
+	if out := Redact("firstsessionid secondsessionid"); out != "firstsessionid [REDACTED]" {
+		t.Errorf("Redact: %s, Expected: firstsessionid [REDACTED].", out)
+	}
+}
+
+func TestDecodeV6Error(t *testing.T) {
+	// Test case 1: Error body
+	err := decodeV6Error(400, []byte(`{"error":{"key":"bad_request","message":"Item already present","hint":"Uniqueness of items is enforced"},"took":0.001}`))
+	expected := "pi-hole API error [400] bad_request: Item already present (Uniqueness of items is enforced)"
+	if err.Error() != expected {
+		t.Errorf("Error: %v, Expected: %v.", err, expected)
+	}
+
+	// Test case 2: No body, e.g. from a proxy
+	err = decodeV6Error(502, []byte("<html>Bad Gateway</html>"))
+	expected = "pi-hole API error [502] bad_gateway: Bad Gateway"
+	if err.Error() != expected {
+		t.Errorf("Error: %v, Expected: %v.", err, expected)
+	}
+}
+
+// Responses from api-responses.md, plus the status codes pi-hole answers
+// failures with.
+func TestV6ErrorIs(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		err        error
+	}{
+		{
+			name:       "attempt duplicate",
+			statusCode: http.StatusBadRequest,
+			body:       `{"error":{"key":"bad_request","message":"Item already present","hint":"Uniqueness of items is enforced"},"took":0.001}`,
+			err:        ErrRecordExists,
+		},
+		{
+			name:       "delete record that does not exist",
+			statusCode: http.StatusNotFound,
+			body:       `{"error":{"key":"not_found","message":"Item not found","hint":null},"took":0.001}`,
+			err:        ErrRecordNotFound,
+		},
+		{
+			name:       "wrong password",
+			statusCode: http.StatusUnauthorized,
+			body:       `{"error":{"key":"unauthorized","message":"Unauthorized","hint":null},"took":0.001}`,
+			err:        ErrUnauthorized,
+		},
+		{
+			name:       "bad gateway",
+			statusCode: http.StatusBadGateway,
+			body:       `<html>Bad Gateway</html>`,
+			err:        ErrTransient,
+		},
+	}
+
+	all := []error{ErrRecordExists, ErrRecordNotFound, ErrUnauthorized, ErrFTLNotRunning, ErrTransient}
+	for _, tt := range tests {
+		err := fmt.Errorf("Could not add record: %w", decodeV6Error(tt.statusCode, []byte(tt.body)))
+		for _, target := range all {
+			if errors.Is(err, target) != (target == tt.err) {
+				t.Errorf("%s: errors.Is(%v, %v) = %v.", tt.name, err, target, !(target == tt.err))
+			}
+		}
+	}
+}
@@ -2,13 +2,13 @@ package provider
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"reflect"
 	"regexp"
 	"time"
 
@@ -17,40 +17,176 @@ import (
 
 const (
 	apiPath = "/admin/api.php"
+
+	// Legacy API keys for each record type.
+	customDNS   = "customdns"
+	customCNAME = "customcname"
+
+	RecordA     = "A"
+	RecordAAAA  = "AAAA"
+	RecordCNAME = "CNAME"
 )
 
+// RFC1123 domain name.
+var domainRegexp = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*)([^a-z0-9-]|$)$`)
+
+// Accepted pi-hole host, optionally with a port.
+var hostRegexp = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*)([^a-z0-9-]|$)?(:\d+)?$`)
+
 type PiHoleRequest struct {
-	insecure      bool
-	piholeAddress string
-	token         string
+	endpoint *Endpoint
+	token    Credential
+
+	index recordIndex
+}
+
+// DNSProvider is the contract every DNS backend pifrost writes records to must
+// satisfy. The watcher only ever talks to a DNSProvider.
+type DNSProvider interface {
+	// List all records currently held by the provider.
+	GetDNS(ctx context.Context) ([]Domain, error)
+	// Apply a single add or delete change set.
+	ModifyDNS(ctx context.Context, dcs *DNSChangeSet) error
+	// Check the provider is reachable and credentials are accepted.
+	ValidateProvider(ctx context.Context) error
+	// Describe what the provider is able to manage.
+	Capabilities() Capabilities
+}
+
+// Capabilities describes a DNS provider.
+type Capabilities struct {
+	// Human readable provider name used in logs.
+	Name string
+	// DNS record types the provider can manage, e.g. "A".
+	RecordTypes []string
+	// The provider keeps one IPv4 and one IPv6 address per name, adding
+	// another address replaces the one of its family.
+	SingleAddress bool
+}
+
+// Supports reports whether the provider can manage the given record type.
+func (c Capabilities) Supports(recordType string) bool {
+	for _, t := range c.RecordTypes {
+		if t == recordType {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces reports whether adding d to the provider replaces other.
+func (c Capabilities) Replaces(d, other Domain) bool {
+	if d.Replaces(other) {
+		return true
+	}
+	return c.SingleAddress && d.domain == other.domain && d != other && d.Type() == other.Type()
 }
 
-type domain struct {
+// Domain is a single DNS record as known by a provider. Address records
+// carry an ip, CNAME records carry a target instead.
+type Domain struct {
 	ip     string
 	domain string
+	target string
 }
 
-type dnsChangeSet struct {
-	domain domain
-	action string
+// NewDomain builds a record, mostly useful to providers outside this package.
+func NewDomain(ip, d string) Domain {
+	return Domain{
+		ip:     ip,
+		domain: d,
+	}
+}
+
+// NewCNAME builds a CNAME record pointing d at target.
+func NewCNAME(d, target string) Domain {
+	return Domain{
+		domain: d,
+		target: target,
+	}
 }
 
-type successResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+// IP the record resolves to, empty for CNAME records.
+func (d Domain) IP() string {
+	return d.ip
 }
 
-// Create a change set struct
-func CreateChangeSet(ip, d, action string) (*dnsChangeSet, error) {
-	// Is it really an IP?
-	if pIP := net.ParseIP(ip); pIP == nil {
-		return nil, fmt.Errorf("Could not parse IP [%s]", ip)
+// Name is the domain name of the record.
+func (d Domain) Name() string {
+	return d.domain
+}
+
+// Target is the canonical name of a CNAME record, empty otherwise.
+func (d Domain) Target() string {
+	return d.target
+}
+
+// Value is what the record resolves to, the IP or the CNAME target.
+func (d Domain) Value() string {
+	if d.Type() == RecordCNAME {
+		return d.target
 	}
+	return d.ip
+}
 
-	// Is the domain valid?
-	re := regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*)([^a-z0-9-]|$)$`)
-	if match := re.MatchString(d); match == false {
-		return nil, fmt.Errorf("Could not parse change set domain [%s]", d)
+// Type is the DNS record type, AAAA for an IPv6 address.
+func (d Domain) Type() string {
+	if len(d.target) != 0 {
+		return RecordCNAME
+	}
+	if ip := net.ParseIP(d.ip); ip != nil && ip.To4() == nil {
+		return RecordAAAA
+	}
+	return RecordA
+}
+
+// Replaces reports whether adding d replaces other in any provider, a CNAME
+// can not share its name with another record. Capabilities.Replaces adds the
+// limits of a provider.
+func (d Domain) Replaces(other Domain) bool {
+	if d.domain != other.domain || d == other {
+		return false
+	}
+	return d.Type() == RecordCNAME || other.Type() == RecordCNAME
+}
+
+// DNSChangeSet is a validated add or delete of a single record.
+type DNSChangeSet struct {
+	domain Domain
+	action string
+	owner  string
+}
+
+// Domain the change set applies to.
+func (dcs *DNSChangeSet) Domain() Domain {
+	return dcs.domain
+}
+
+// Action is either add or delete.
+func (dcs *DNSChangeSet) Action() string {
+	return dcs.action
+}
+
+// Owner is the object the change is made for, e.g. service/default/echo.
+func (dcs *DNSChangeSet) Owner() string {
+	return dcs.owner
+}
+
+// WithOwner sets the object the change is made for.
+func (dcs *DNSChangeSet) WithOwner(owner string) *DNSChangeSet {
+	dcs.owner = owner
+	return dcs
+}
+
+// Make sure the pi-hole client satisfies the provider contract.
+var _ DNSProvider = &PiHoleRequest{}
+
+// Create a change set struct. An IPv4 target makes an A record, an IPv6
+// target an AAAA record, a domain target makes a CNAME record.
+func CreateChangeSet(target, d, action string) (*DNSChangeSet, error) {
+	record, err := parseRecord(target, d)
+	if err != nil {
+		return nil, err
 	}
 
 	// Is the action add or delete?
@@ -59,56 +195,80 @@ func CreateChangeSet(ip, d, action string) (*dnsChangeSet, error) {
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"ip":     ip,
+		"type":   record.Type(),
+		"target": target,
 		"domain": d,
 		"action": action,
 	}).Info("Creating change set")
 
-	dnsChangeSet := &dnsChangeSet{
-		domain{
-			ip,
-			d,
-		},
-		action,
+	dnsChangeSet := &DNSChangeSet{
+		domain: record,
+		action: action,
 	}
 
 	return dnsChangeSet, nil
 }
 
+// Validate the target and domain of a record, the target picks its type.
+func parseRecord(target, d string) (Domain, error) {
+	// Is it an IP or a domain to CNAME to?
+	var record Domain
+	if pIP := net.ParseIP(target); pIP != nil {
+		record = NewDomain(target, d)
+	} else if match := domainRegexp.MatchString(target); match {
+		record = NewCNAME(d, target)
+	} else {
+		return Domain{}, fmt.Errorf("Could not parse change set target [%s]", target)
+	}
+
+	// Is the domain valid?
+	if match := domainRegexp.MatchString(d); match == false {
+		return Domain{}, fmt.Errorf("Could not parse change set domain [%s]", d)
+	}
+
+	return record, nil
+}
+
 // Create a DNS provider request struct.
-func InitDNSProvider(insecure bool, host, token string) (*PiHoleRequest, error) {
-	re := regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*)([^a-z0-9-]|$)?(:\d+)?$`)
-	if match := re.MatchString(host); match == false {
-		return nil, fmt.Errorf("Could not parse pi-hole host/domain [%s]", host)
+func InitDNSProvider(endpoint *Endpoint, token Credential) (*PiHoleRequest, error) {
+	if endpoint == nil {
+		return nil, errors.New("Need a pi-hole endpoint")
+	}
+	if token == nil {
+		return nil, errors.New("Need a pi-hole token")
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"insecure": insecure,
-		"host":     host,
+		"url": endpoint,
 	}).Info("Creating DNS Provider")
 
 	piHoleRequest := &PiHoleRequest{
-		insecure,
-		host,
-		token,
+		endpoint: endpoint,
+		token:    token,
 	}
 
 	return piHoleRequest, nil
 }
 
 // Make GET request to check if the pi-hole accepts connections.
-func (phr *PiHoleRequest) ValidateProvider() error {
+func (phr *PiHoleRequest) ValidateProvider(ctx context.Context) error {
 	var count int = 1
 	const tries int = 8
 	for {
 		logrus.Info("Attempting to reach pi-hole...")
-		_, err := phr.GetDNS()
+		_, err := phr.GetDNS(ctx)
 		// Have connection
 		if err == nil {
 			logrus.Info("Connected.")
 			return nil
 		}
-		time.Sleep(1 << count * time.Second)
+		// Retrying will not fix the token.
+		if errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		if err := backoff(ctx, 1<<count*time.Second); err != nil {
+			return err
+		}
 		count++
 		if count == tries {
 			break
@@ -118,52 +278,113 @@ func (phr *PiHoleRequest) ValidateProvider() error {
 	return errors.New("Failed to connect to pi-hole.")
 }
 
-func getDomain(d string, domains []domain) (*domain, error) {
-	for _, domain := range domains {
-		// Given domain in list of domains
-		if d == domain.domain {
-			return &domain, nil
+// The legacy pi-hole API manages A, AAAA and CNAME records.
+func (phr *PiHoleRequest) Capabilities() Capabilities {
+	return Capabilities{
+		Name:          "pihole",
+		RecordTypes:   []string{RecordA, RecordAAAA, RecordCNAME},
+		SingleAddress: true,
+	}
+}
+
+// The records adding d to a provider with capabilities c replaces.
+func replacedBy(c Capabilities, d Domain, domains []Domain) []Domain {
+	var replaced []Domain
+	for _, current := range domains {
+		if c.Replaces(d, current) {
+			replaced = append(replaced, current)
 		}
 	}
-	return nil, fmt.Errorf("Domain not found: %s", d)
+	return replaced
 }
 
-func domainExists(d string, domains []domain) bool {
-	for _, domain := range domains {
-		// Given domain in list of domains
-		if d == domain.domain {
+// Whether domains hold exactly d.
+func hasRecord(d Domain, domains []Domain) bool {
+	for _, current := range domains {
+		if current == d {
 			return true
 		}
 	}
 	return false
 }
 
-func (phr *PiHoleRequest) GetDNS() ([]domain, error) {
-	response, err := phr.doRequest("GET", nil)
+// Records pi-hole holds, from the record index while it is fresh.
+func (phr *PiHoleRequest) GetDNS(ctx context.Context) ([]Domain, error) {
+	if domains, ok := phr.index.list(); ok {
+		return domains, nil
+	}
+
+	var domains []Domain
+	err := withCredential(ctx, phr.token, func() error {
+		var err error
+		domains, err = phr.list(ctx)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get DNS records: %s", err)
+		return nil, err
+	}
+	phr.index.set(domains)
+
+	return domains, nil
+}
+
+// List every record pi-hole holds.
+func (phr *PiHoleRequest) list(ctx context.Context) ([]Domain, error) {
+	response, err := phr.doRequest(ctx, "GET", customDNS, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get DNS records: %w", err)
 	}
 
 	domains, err := decodeDomains(response)
 	if err != nil {
-		return nil, fmt.Errorf("Failed decode domains: %s", err)
+		return nil, fmt.Errorf("Failed decode domains: %w", err)
 	}
 
-	return domains, nil
+	response, err = phr.doRequest(ctx, "GET", customCNAME, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get CNAME records: %w", err)
+	}
+
+	cnames, err := decodeCNAMEs(response)
+	if err != nil {
+		return nil, fmt.Errorf("Failed decode CNAMEs: %w", err)
+	}
+
+	return append(domains, cnames...), nil
+}
+
+// Records named name, only lists pi-hole when the record index is stale.
+func (phr *PiHoleRequest) named(ctx context.Context, name string) ([]Domain, error) {
+	if records, ok := phr.index.named(name); ok {
+		return records, nil
+	}
+
+	domains, err := phr.GetDNS(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Domain
+	for _, d := range domains {
+		if d.domain == name {
+			records = append(records, d)
+		}
+	}
+	return records, nil
 }
 
 // Call safe add function or delete function.
-func (phr *PiHoleRequest) ModifyDNS(dcs *dnsChangeSet) error {
+func (phr *PiHoleRequest) ModifyDNS(ctx context.Context, dcs *DNSChangeSet) error {
 	var err error = nil
 
 	switch dcs.action {
 	case "add":
-		err = phr.add(dcs)
+		err = phr.add(ctx, dcs)
 		if err != nil {
 			return err
 		}
 	case "delete":
-		err = phr.delete(dcs)
+		err = phr.delete(ctx, dcs)
 		if err != nil {
 			return err
 		}
@@ -173,194 +394,213 @@ func (phr *PiHoleRequest) ModifyDNS(dcs *dnsChangeSet) error {
 }
 
 // Add action but is also a change action.
-func (phr *PiHoleRequest) add(dcs *dnsChangeSet) error {
-	// Get all the current domains.
-	domains, err := phr.GetDNS()
+func (phr *PiHoleRequest) add(ctx context.Context, dcs *DNSChangeSet) error {
+	// Get the current records of the domain.
+	records, err := phr.named(ctx, dcs.domain.domain)
 	if err != nil {
-		return fmt.Errorf("Failed to add: %s", err)
+		return fmt.Errorf("Failed to add: %w", err)
 	}
 
 	logrus.WithFields(logrus.Fields{
 		"domain": dcs.domain.domain,
-		"ip":     dcs.domain.ip,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
 	}).Info("Creating record.")
 
-	// If the domain exists, delete it to add new record.
-	if domainExists(dcs.domain.domain, domains) {
-		// We need the IP of this domain
-		d, err := getDomain(dcs.domain.domain, domains)
-		if err != nil {
-			return fmt.Errorf("Domain: [%s] not found in list", dcs.domain.domain)
-		}
-
-		// We might already have done to work, so skip
-		if reflect.DeepEqual(&dcs.domain, d) {
+	// We might already have done to work, so skip
+	for _, d := range records {
+		if d == dcs.domain {
 			logrus.WithFields(logrus.Fields{
 				"domain": dcs.domain.domain,
-			}).Info("Domain already exists with hostname and ip")
+			}).Info("Domain already exists with hostname and target")
 			return nil
 		}
+	}
 
-		// Domain exists but differs on IP
+	// Domain exists but differs on IP, or is the other record type. The
+	// address of the other IP family stays.
+	replaced := replacedBy(phr.Capabilities(), dcs.domain, records)
+	if len(replaced) != 0 {
 		logrus.WithFields(logrus.Fields{
 			"domain": dcs.domain.domain,
 		}).Info("Record with domain exists, change")
-		var existingIP string
-		for _, d := range domains {
-			if dcs.domain.domain == d.domain {
-				existingIP = d.ip
-			}
-		}
-		err = phr.delete(&dnsChangeSet{
-			domain: domain{
-				existingIP,
-				dcs.domain.domain,
-			},
+	}
+	for _, d := range replaced {
+		err = phr.remove(ctx, &DNSChangeSet{
+			domain: d,
 			action: "delete",
 		})
 		if err != nil {
-			return fmt.Errorf("Could not change record: %s", err)
+			return fmt.Errorf("Could not change record: %w", err)
 		}
 	}
 
-	response, err := phr.doRequest("POST", dcs)
+	err = phr.write(ctx, dcs)
 	if err != nil {
-		return fmt.Errorf("Could not add record: %s", err)
+		return fmt.Errorf("Could not add record: %w", err)
 	}
 
 	logrus.WithFields(logrus.Fields{
 		"domain": dcs.domain.domain,
-		"ip":     dcs.domain.ip,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
 	}).Info("Created record.")
 
-	_, err = decodeSuccess(response)
-	if err != nil {
-		return fmt.Errorf("Could not add record: %s", err)
-	} else {
-		return nil
-	}
+	return nil
 }
 
 // Delete
-func (phr *PiHoleRequest) delete(dcs *dnsChangeSet) error {
-	domains, err := phr.GetDNS()
+func (phr *PiHoleRequest) delete(ctx context.Context, dcs *DNSChangeSet) error {
+	records, err := phr.named(ctx, dcs.domain.domain)
 	if err != nil {
-		return fmt.Errorf("Failed to delete: %s", err)
+		return fmt.Errorf("Failed to delete: %w", err)
+	}
+
+	if !hasRecord(dcs.domain, records) {
+		return ErrRecordNotFound
 	}
 
+	return phr.remove(ctx, dcs)
+}
+
+// Delete a record known to exist.
+func (phr *PiHoleRequest) remove(ctx context.Context, dcs *DNSChangeSet) error {
 	logrus.WithFields(logrus.Fields{
 		"domain": dcs.domain.domain,
-		"ip":     dcs.domain.ip,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
 	}).Info("Deleting record.")
 
-	// If the domain exists, delete it to add new record.
-	if domainExists(dcs.domain.domain, domains) {
-		response, err := phr.doRequest("POST", dcs)
-		if err != nil {
-			fmt.Errorf("Could not delete record: %s", err)
-		}
-		_, err = decodeSuccess(response)
+	err := phr.write(ctx, dcs)
+	if err != nil {
+		return fmt.Errorf("Could not delete record: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": dcs.domain.domain,
+		"type":   dcs.domain.Type(),
+		"target": dcs.domain.Value(),
+	}).Info("Deleted record.")
+
+	return nil
+}
+
+// Send a change set and keep the record index in step with it. When the
+// outcome is unknown the index is dropped.
+func (phr *PiHoleRequest) write(ctx context.Context, dcs *DNSChangeSet) error {
+	err := withCredential(ctx, phr.token, func() error {
+		response, err := phr.doRequest(ctx, "POST", apiFor(dcs.domain), dcs)
 		if err != nil {
-			return fmt.Errorf("Could not delete record: %s", err)
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"domain": dcs.domain.domain,
-				"ip":     dcs.domain.ip,
-			}).Info("Deleted record.")
-			return nil
+			return err
 		}
+		return decodeSuccess(response)
+	})
+	if err != nil {
+		phr.index.invalidate()
+		return err
+	}
+
+	if dcs.action == "add" {
+		phr.index.add(dcs.domain)
 	} else {
-		return errors.New("Record does not exist.")
+		phr.index.remove(dcs.domain)
 	}
+
+	return nil
 }
 
-// Perform request against pi-hole API
-func (phr *PiHoleRequest) doRequest(method string, dcs *dnsChangeSet) ([]byte, error) {
-	var protocol string
-	if phr.insecure {
-		protocol = "http"
-	} else {
-		protocol = "https"
+// Legacy API key managing the record type.
+func apiFor(d Domain) string {
+	if d.Type() == RecordCNAME {
+		return customCNAME
 	}
-	url := fmt.Sprintf("%s://%s%s", protocol, phr.piholeAddress, apiPath)
+	return customDNS
+}
+
+// Wait before retrying, giving up early when ctx is cancelled.
+func backoff(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Perform request against pi-hole API. api is either customdns or customcname.
+func (phr *PiHoleRequest) doRequest(ctx context.Context, method string, api string, dcs *DNSChangeSet) ([]byte, error) {
 	// Make request
-	req, err := http.NewRequest(method, url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, phr.endpoint.url(apiPath), nil)
 	if err != nil {
 		return nil, errors.New("Failed to create HTTP request.")
 	}
 
 	// Params
 	q := req.URL.Query()
-	// Key customdns specifices DNS api, has no value.
-	q.Add("customdns", "")
-	q.Add("auth", phr.token)
+	// Key customdns/customcname specifices DNS api, has no value.
+	q.Add(api, "")
+	token := phr.token.Get()
+	RedactSecret(token)
+	q.Add("auth", token)
 
 	if dcs != nil {
 		q.Add("action", dcs.action)
-		q.Add("ip", dcs.domain.ip)
 		q.Add("domain", dcs.domain.domain)
+		if api == customCNAME {
+			q.Add("target", dcs.domain.target)
+		} else {
+			q.Add("ip", dcs.domain.ip)
+		}
 	} else {
 		q.Add("action", "get")
 	}
 
 	req.URL.RawQuery = q.Encode()
-	// Scary secrets.
-	logrus.Debugf("Query: %s", req.URL)
+	logrus.Debugf("Query: %s", Redact(req.URL.String()))
 
 	// Perform request
-	client := &http.Client{}
-	// This API returns 200 on failure...
-	resp, err := client.Do(req)
+	resp, err := phr.endpoint.client.Do(req)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil || resp == nil {
-		return nil, errors.New("Error sending request to the server.")
+		return nil, transient(errors.New("Error sending request to the server."))
 	}
 
 	defer resp.Body.Close()
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, errors.New("Failed to read response body.")
+		return nil, transient(errors.New("Failed to read response body."))
+	}
+
+	// Failures are answered with 200, other codes come from the web server.
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("%w: %s", ErrUnauthorized, resp.Status)
+	case resp.StatusCode >= 500:
+		return nil, transient(fmt.Errorf("pi-hole returned %s", resp.Status))
 	}
 
 	return responseBody, nil
 }
 
 // Decode the domains response
-func decodeDomains(responseBody []byte) ([]domain, error) {
-	// Hacky - Post returns two json objects
-	// {"data":[["foo.example.xyz","10.1.1.1"],["bar.example.xyz","10.1.1.2"]]}[]
-	// Use decoder to get the first object.
-	// But then do some nasty stuff to turn list of list into list of struct... has to be better way.
-	type domainResponse struct {
-		Data [][]string `json:"data"`
-	}
-
-	reader := bytes.NewReader(responseBody)
-	dec := json.NewDecoder(reader)
-	var dR domainResponse
-	loop := 0
-	for {
-		if loop == 1 {
-			break
-		}
-		err := dec.Decode(&dR)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("Error decoding GET: %s", err)
-		}
-		logrus.Debugf("Found object: [%s]", dR)
-		loop += 1
+func decodeDomains(responseBody []byte) ([]Domain, error) {
+	data, err := decodeData(responseBody)
+	if err != nil {
+		return nil, err
 	}
 
-	var domains []domain
-	for _, value := range dR.Data {
-		domain := domain{
+	var domains []Domain
+	for _, value := range data {
+		domain := Domain{
 			// ip
-			value[1],
+			ip: value[1],
 			// domain
-			value[0],
+			domain: value[0],
 		}
 
 		domains = append(domains, domain)
@@ -370,28 +610,113 @@ func decodeDomains(responseBody []byte) ([]domain, error) {
 	return domains, nil
 }
 
-// Decode the success response
-func decodeSuccess(responseBody []byte) (*successResponse, error) {
-	// Hacky - Post returns two json objects
-	// "{"success":true,"message":""}{"FTLnotrunning":true}"
-	// Use a decoder, it won't decode second object into the struct.
-	reader := bytes.NewReader(responseBody)
-	dec := json.NewDecoder(reader)
-	var sR successResponse
-	loop := 0
-	for {
-		if loop == 1 {
-			break
-		}
-		err := dec.Decode(&sR)
+// Decode the CNAME response
+// {"data":[["alias.example.xyz","foo.example.xyz"]]}
+func decodeCNAMEs(responseBody []byte) ([]Domain, error) {
+	data, err := decodeData(responseBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []Domain
+	for _, value := range data {
+		domains = append(domains, NewCNAME(value[0], value[1]))
+	}
+	logrus.Debugf("Created CNAME struct: [%s]", domains)
+
+	return domains, nil
+}
+
+// Every legacy response is a stream of JSON values, the first one holds the
+// answer. pi-hole may append more, such as {"FTLnotrunning":true} or [].
+type legacyResponse struct {
+	Data          *[][]string `json:"data"`
+	Success       bool        `json:"success"`
+	Message       string      `json:"message"`
+	FTLNotRunning bool        `json:"FTLnotrunning"`
+}
+
+// Decode a legacy response. A lone [] is how the legacy API answers an
+// invalid token.
+func decodeLegacy(responseBody []byte) (*legacyResponse, error) {
+	dec := json.NewDecoder(bytes.NewReader(responseBody))
+	var lR legacyResponse
+	for loop := 0; ; loop++ {
+		var value json.RawMessage
+		err := dec.Decode(&value)
 		if err == io.EOF {
+			if loop == 0 {
+				return nil, transient(errors.New("Empty response from pi-hole."))
+			}
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("Error decoding POST: %s", err)
+			return nil, fmt.Errorf("Error decoding response: %w", err)
+		}
+
+		if bytes.HasPrefix(value, []byte("[")) {
+			if loop == 0 {
+				return nil, ErrUnauthorized
+			}
+			continue
 		}
-		loop += 1
+		if err := json.Unmarshal(value, &lR); err != nil {
+			return nil, fmt.Errorf("Error decoding response: %w", err)
+		}
+	}
+
+	return &lR, nil
+}
+
+// Decode the list of lists both legacy GET responses return.
+// {"data":[["foo.example.xyz","10.1.1.1"],["bar.example.xyz","10.1.1.2"]]}[]
+func decodeData(responseBody []byte) ([][]string, error) {
+	lR, err := decodeLegacy(responseBody)
+	if err != nil {
+		return nil, err
+	}
+	if lR.Data == nil {
+		if lR.FTLNotRunning {
+			return nil, ErrFTLNotRunning
+		}
+		if len(lR.Message) != 0 {
+			return nil, legacyError(lR.Message)
+		}
+		return nil, errors.New("Error decoding GET: response has no data.")
+	}
+	logrus.Debugf("Found object: [%s]", *lR.Data)
+
+	var data [][]string
+	for _, value := range *lR.Data {
+		if len(value) < 2 {
+			logrus.Debugf("Skipping malformed entry: [%s]", value)
+			continue
+		}
+		data = append(data, value)
 	}
 
-	return &sR, nil
+	return data, nil
+}
+
+// Decode the response to a change, nil when pi-hole made it.
+// {"success":true,"message":""}{"FTLnotrunning":true}
+func decodeSuccess(responseBody []byte) error {
+	lR, err := decodeLegacy(responseBody)
+	if err != nil {
+		return err
+	}
+
+	if !lR.Success {
+		if len(lR.Message) == 0 && lR.FTLNotRunning {
+			return ErrFTLNotRunning
+		}
+		return legacyError(lR.Message)
+	}
+
+	// The record is saved, but not served until FTL starts.
+	if lR.FTLNotRunning {
+		logrus.Debug("pi-hole reports FTL is not running")
+	}
+
+	return nil
 }
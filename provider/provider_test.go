@@ -1,13 +1,25 @@
 package provider
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
-	"strings"
 	"testing"
+	"time"
 )
 
+// Endpoint of a mock server.
+func testEndpoint(tb testing.TB, serverURL string) *Endpoint {
+	endpoint, err := NewEndpoint(serverURL, HTTPConfig{})
+	if err != nil {
+		tb.Fatalf("Error from NewEndpoint: %s", err)
+	}
+	return endpoint
+}
+
 func startMockServer(t *testing.T) (*httptest.Server, string) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var mockResponse string
@@ -21,11 +33,16 @@ func startMockServer(t *testing.T) (*httptest.Server, string) {
 			mockResponse = `{"success":true,"message":""}{"FTLnotrunning":true}`
 		}
 
+		// No CNAME records.
+		if _, ok := r.URL.Query()["customcname"]; ok && action == "get" {
+			mockResponse = `{"data":[]}`
+		}
+
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(mockResponse))
 	}))
 
-	return mockServer, strings.Replace(mockServer.URL, "http://", "", 1)
+	return mockServer, mockServer.URL
 }
 
 func TestGetDNSProvider(t *testing.T) {
@@ -33,7 +50,7 @@ func TestGetDNSProvider(t *testing.T) {
 	defer mockServer.Close()
 
 	// Test case 1: Valid get DNS
-	expected := []domain{
+	expected := []Domain{
 		{
 			ip:     "192.168.1.2",
 			domain: "example.com",
@@ -41,12 +58,11 @@ func TestGetDNSProvider(t *testing.T) {
 	}
 
 	mockPHR := &PiHoleRequest{
-		insecure:      true,
-		piholeAddress: serverURL,
-		token:         "mocktoken",
+		endpoint: testEndpoint(t, serverURL),
+		token:    StaticCredential("mocktoken"),
 	}
 
-	domains, err := mockPHR.GetDNS()
+	domains, err := mockPHR.GetDNS(context.Background())
 	if err != nil {
 		t.Errorf("Error from GetDNS: %s", err)
 	}
@@ -60,8 +76,8 @@ func TestModifyDNS(t *testing.T) {
 	mockServer, serverURL := startMockServer(t)
 	defer mockServer.Close()
 
-	dcs := &dnsChangeSet{
-		domain: domain{
+	dcs := &DNSChangeSet{
+		domain: Domain{
 			domain: "example.com",
 			ip:     "192.168.1.1",
 		},
@@ -69,19 +85,18 @@ func TestModifyDNS(t *testing.T) {
 	}
 
 	mockPHR := &PiHoleRequest{
-		insecure:      true,
-		piholeAddress: serverURL,
-		token:         "mocktoken",
+		endpoint: testEndpoint(t, serverURL),
+		token:    StaticCredential("mocktoken"),
 	}
 
-	err := mockPHR.add(dcs)
+	err := mockPHR.add(context.Background(), dcs)
 	if err != nil {
 		t.Errorf("Error from GetDNS: %s", err)
 	}
 
 	// Test case 2: Add Duplicate
-	dcs = &dnsChangeSet{
-		domain: domain{
+	dcs = &DNSChangeSet{
+		domain: Domain{
 			domain: "example.com",
 			ip:     "192.168.1.2",
 		},
@@ -89,19 +104,18 @@ func TestModifyDNS(t *testing.T) {
 	}
 
 	mockPHR = &PiHoleRequest{
-		insecure:      true,
-		piholeAddress: serverURL,
-		token:         "mocktoken",
+		endpoint: testEndpoint(t, serverURL),
+		token:    StaticCredential("mocktoken"),
 	}
 
-	err = mockPHR.add(dcs)
+	err = mockPHR.add(context.Background(), dcs)
 	if err != nil {
 		t.Errorf("Error from GetDNS: %s", err)
 	}
 
 	// Test case 3: Delete
-	dcs = &dnsChangeSet{
-		domain: domain{
+	dcs = &DNSChangeSet{
+		domain: Domain{
 			domain: "example.com",
 			ip:     "192.168.1.2",
 		},
@@ -109,19 +123,18 @@ func TestModifyDNS(t *testing.T) {
 	}
 
 	mockPHR = &PiHoleRequest{
-		insecure:      true,
-		piholeAddress: serverURL,
-		token:         "mocktoken",
+		endpoint: testEndpoint(t, serverURL),
+		token:    StaticCredential("mocktoken"),
 	}
 
-	err = mockPHR.delete(dcs)
+	err = mockPHR.delete(context.Background(), dcs)
 	if err != nil {
 		t.Errorf("Error from GetDNS: %s", err)
 	}
 
 	// Test case 4: Delete record not found
-	dcs = &dnsChangeSet{
-		domain: domain{
+	dcs = &DNSChangeSet{
+		domain: Domain{
 			domain: "boop.example.com",
 			ip:     "192.168.1.1",
 		},
@@ -129,23 +142,177 @@ func TestModifyDNS(t *testing.T) {
 	}
 
 	mockPHR = &PiHoleRequest{
-		insecure:      true,
-		piholeAddress: serverURL,
-		token:         "mocktoken",
+		endpoint: testEndpoint(t, serverURL),
+		token:    StaticCredential("mocktoken"),
 	}
 
-	err = mockPHR.delete(dcs)
-	if err.Error() != "Record does not exist." {
-		t.Errorf("Error from GetDNS: %s", err)
+	err = mockPHR.delete(context.Background(), dcs)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error from delete: %v", err)
+	}
+
+	// Test case 5: Delete a name held with another IP
+	dcs, _ = CreateChangeSet("192.168.1.9", "example.com", "delete")
+	err = mockPHR.delete(context.Background(), dcs)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error from delete: %v", err)
+	}
+}
+
+func TestModifyCNAME(t *testing.T) {
+	var queries []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var mockResponse string
+		q := r.URL.Query()
+		_, cname := q["customcname"]
+		switch q.Get("action") {
+		case "get":
+			if cname {
+				mockResponse = `{"data":[["alias.example.com","example.com"]]}`
+			} else {
+				mockResponse = `{"data":[["example.com","192.168.1.2"]]}[]`
+			}
+		case "add", "delete":
+			queries = append(queries, fmt.Sprintf("%s cname=%t %s %s%s", q.Get("action"), cname, q.Get("domain"), q.Get("ip"), q.Get("target")))
+			mockResponse = `{"success":true,"message":""}`
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(mockResponse))
+	}))
+	defer mockServer.Close()
+
+	mockPHR, _ := InitDNSProvider(testEndpoint(t, mockServer.URL), StaticCredential("mocktoken"))
+
+	// Test case 1: CNAMEs are listed along side A records
+	domains, err := mockPHR.GetDNS(context.Background())
+	expected := []Domain{NewDomain("192.168.1.2", "example.com"), NewCNAME("alias.example.com", "example.com")}
+	if err != nil || !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Domains: %v, Expected: %v. Error: %v", domains, expected, err)
+	}
+
+	// Test case 2: CNAME existing is skipped
+	dcs, _ := CreateChangeSet("example.com", "alias.example.com", "add")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+
+	// Test case 3: A record becomes a CNAME
+	dcs, _ = CreateChangeSet("other.example.com", "example.com", "add")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+
+	// Test case 4: CNAME delete uses the customcname API
+	dcs, _ = CreateChangeSet("example.com", "alias.example.com", "delete")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+
+	expectedQueries := []string{
+		"delete cname=false example.com 192.168.1.2",
+		"add cname=true example.com other.example.com",
+		"delete cname=true alias.example.com example.com",
+	}
+	if !reflect.DeepEqual(expectedQueries, queries) {
+		t.Errorf("Queries: %v, Expected: %v.", queries, expectedQueries)
+	}
+}
+
+func TestModifyDualStack(t *testing.T) {
+	var queries []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var mockResponse string
+		q := r.URL.Query()
+		_, cname := q["customcname"]
+		switch q.Get("action") {
+		case "get":
+			if cname {
+				mockResponse = `{"data":[]}`
+			} else {
+				mockResponse = `{"data":[["example.com","192.168.1.2"],["example.com","fd00::2"]]}`
+			}
+		case "add", "delete":
+			queries = append(queries, fmt.Sprintf("%s %s %s", q.Get("action"), q.Get("domain"), q.Get("ip")))
+			mockResponse = `{"success":true,"message":""}`
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(mockResponse))
+	}))
+	defer mockServer.Close()
+
+	mockPHR, _ := InitDNSProvider(testEndpoint(t, mockServer.URL), StaticCredential("mocktoken"))
+
+	// Test case 1: IPv6 addresses are AAAA records
+	domains, err := mockPHR.GetDNS(context.Background())
+	if err != nil || len(domains) != 2 || domains[0].Type() != RecordA || domains[1].Type() != RecordAAAA {
+		t.Errorf("Domains: %v, Error: %v", domains, err)
+	}
+
+	// Test case 2: Changing the IPv6 address keeps the IPv4 one
+	dcs, _ := CreateChangeSet("fd00::3", "example.com", "add")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+
+	// Test case 3: Deleting the IPv4 address keeps the IPv6 one
+	dcs, _ = CreateChangeSet("192.168.1.2", "example.com", "delete")
+	if err := mockPHR.ModifyDNS(context.Background(), dcs); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+
+	expectedQueries := []string{
+		"delete example.com fd00::2",
+		"add example.com fd00::3",
+		"delete example.com 192.168.1.2",
+	}
+	if !reflect.DeepEqual(expectedQueries, queries) {
+		t.Errorf("Queries: %v, Expected: %v.", queries, expectedQueries)
+	}
+
+	domains, _ = mockPHR.GetDNS(context.Background())
+	expected := []Domain{NewDomain("fd00::3", "example.com")}
+	if !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Domains: %v, Expected: %v.", domains, expected)
+	}
+}
+
+func TestReplaces(t *testing.T) {
+	a := NewDomain("192.168.1.2", "example.com")
+	aaaa := NewDomain("fd00::2", "example.com")
+	cname := NewCNAME("example.com", "other.example.com")
+
+	single := Capabilities{SingleAddress: true}
+
+	cases := []struct {
+		capabilities Capabilities
+		d, other     Domain
+		expected     bool
+	}{
+		{Capabilities{}, a, NewDomain("192.168.1.3", "example.com"), false},
+		{single, a, NewDomain("192.168.1.3", "example.com"), true},
+		{single, a, a, false},
+		{single, a, aaaa, false},
+		{Capabilities{}, aaaa, NewDomain("fd00::3", "example.com"), false},
+		{single, aaaa, NewDomain("fd00::3", "example.com"), true},
+		{Capabilities{}, cname, a, true},
+		{Capabilities{}, aaaa, cname, true},
+		{single, a, NewDomain("192.168.1.3", "other.example.com"), false},
+	}
+	for _, c := range cases {
+		if c.capabilities.Replaces(c.d, c.other) != c.expected {
+			t.Errorf("%v replaces %v: %t, Expected: %t.", c.d, c.other, !c.expected, c.expected)
+		}
 	}
 }
 
 func TestValidChangeSet(t *testing.T) {
 	// Test case 1: Valid changeset
-	expected := &dnsChangeSet{
-		domain: domain{
-			"1.2.3.4",
-			"one.two.three.org.uk",
+	expected := &DNSChangeSet{
+		domain: Domain{
+			ip:     "1.2.3.4",
+			domain: "one.two.three.org.uk",
 		},
 		action: "add",
 	}
@@ -155,10 +322,10 @@ func TestValidChangeSet(t *testing.T) {
 		t.Error("Valid add changeset not parsed")
 	}
 
-	expected = &dnsChangeSet{
-		domain: domain{
-			"8.8.8.8",
-			"google.tolson.io",
+	expected = &DNSChangeSet{
+		domain: Domain{
+			ip:     "8.8.8.8",
+			domain: "google.tolson.io",
 		},
 		action: "add",
 	}
@@ -168,10 +335,10 @@ func TestValidChangeSet(t *testing.T) {
 		t.Error("Valid add changeset not parsed")
 	}
 
-	expected = &dnsChangeSet{
-		domain: domain{
-			"8.8.8.8",
-			"google.tolson.io",
+	expected = &DNSChangeSet{
+		domain: Domain{
+			ip:     "8.8.8.8",
+			domain: "google.tolson.io",
 		},
 		action: "delete",
 	}
@@ -180,6 +347,23 @@ func TestValidChangeSet(t *testing.T) {
 	if !reflect.DeepEqual(expected, changeSet) {
 		t.Error("Valid delete changeset not parsed")
 	}
+
+	// Test case 2: Domain target is a CNAME
+	expected = &DNSChangeSet{
+		domain: Domain{
+			domain: "google.tolson.io",
+			target: "google.com",
+		},
+		action: "add",
+	}
+
+	changeSet, _ = CreateChangeSet("google.com", "google.tolson.io", "add")
+	if !reflect.DeepEqual(expected, changeSet) {
+		t.Error("Valid CNAME changeset not parsed")
+	}
+	if changeSet.Domain().Type() != RecordCNAME {
+		t.Errorf("Type: %s, Expected: %s.", changeSet.Domain().Type(), RecordCNAME)
+	}
 }
 
 func TestInvalidChangeSet(t *testing.T) {
@@ -199,9 +383,9 @@ func TestInvalidChangeSet(t *testing.T) {
 		t.Errorf("Error: %v, Expected: %v.", errMsg, expected)
 	}
 
-	// Test case 3: We don't support CNAME
-	expected = "Could not parse IP [google.com]"
-	_, err = CreateChangeSet("google.com", "google.tolson.io", "add")
+	// Test case 3: Target is neither an IP nor a domain
+	expected = "Could not parse change set target [not^domain.com]"
+	_, err = CreateChangeSet("not^domain.com", "google.tolson.io", "add")
 	errMsg = err.Error()
 	if errMsg != expected {
 		t.Errorf("Error: %v, Expected: %v.", errMsg, expected)
@@ -210,26 +394,20 @@ func TestInvalidChangeSet(t *testing.T) {
 
 func TestValidProvider(t *testing.T) {
 	// Test case 1: Valid provider
+	endpoint := testEndpoint(t, "http://10.1.1.5")
 	expected := &PiHoleRequest{
-		insecure:      true,
-		piholeAddress: "10.1.1.5",
-		token:         "foobar",
+		endpoint: endpoint,
+		token:    StaticCredential("foobar"),
 	}
 
-	provider, _ := InitDNSProvider(true, "10.1.1.5", "foobar")
+	provider, _ := InitDNSProvider(endpoint, StaticCredential("foobar"))
 	if !reflect.DeepEqual(expected, provider) {
 		t.Error("Valid provider not returned")
 	}
 
-	expected = &PiHoleRequest{
-		insecure:      false,
-		piholeAddress: "pihole.tolson.io",
-		token:         "foobar",
-	}
-
-	provider, _ = InitDNSProvider(false, "pihole.tolson.io", "foobar")
-	if !reflect.DeepEqual(expected, provider) {
-		t.Error("Valid provider not returned")
+	// Test case 2: Missing endpoint
+	if _, err := InitDNSProvider(nil, StaticCredential("foobar")); err == nil {
+		t.Error("Provider without endpoint returned")
 	}
 }
 
@@ -252,112 +430,163 @@ func TestValidateProvider(t *testing.T) {
 	defer mockServer.Close()
 
 	mockPHR := &PiHoleRequest{
-		insecure:      true,
-		piholeAddress: strings.Replace(mockServer.URL, "http://", "", 1),
-		token:         "mocktoken",
+		endpoint: testEndpoint(t, mockServer.URL),
+		token:    StaticCredential("mocktoken"),
 	}
 
-	err := mockPHR.ValidateProvider()
+	err := mockPHR.ValidateProvider(context.Background())
 	if err != nil {
 		t.Error("Didn't validate the provider in time")
 	}
 }
 
-func TestInvalidProvider(t *testing.T) {
-	// Test case 1: Domain parse failure
-	expected := "Could not parse pi-hole host/domain [not^domain.com]"
-	_, err := InitDNSProvider(false, "not^domain.com", "foobar")
-	errMsg := err.Error()
-	if errMsg != expected {
-		t.Errorf("Error: %v, Expected: %v.", errMsg, expected)
+func TestValidateProviderUnauthorized(t *testing.T) {
+	// The legacy API answers an invalid token with an empty list.
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer mockServer.Close()
+
+	mockPHR, _ := InitDNSProvider(testEndpoint(t, mockServer.URL), StaticCredential("wrongtoken"))
+
+	start := time.Now()
+	err := mockPHR.ValidateProvider(context.Background())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrUnauthorized)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Retried an invalid token for %s", time.Since(start))
 	}
 }
 
-func TestDomainExists(t *testing.T) {
-	// Test case 1: Domain exists in list of domains
-	var expected bool = true
-	d := domain{
-		"8.8.8.8",
-		"boop.example.com",
-	}
+func TestValidateProviderCancel(t *testing.T) {
+	// Nothing listens, every attempt fails and backs off.
+	mockServer := httptest.NewServer(http.NotFoundHandler())
+	mockServer.Close()
 
-	var ds = []domain{
-		{
-			"8.8.8.8",
-			"boop.example.com",
-		},
-		{
-			"10.1.1.1",
-			"gateway.example.com",
-		},
-		{
-			"10.2.1.4",
-			"homeassistant.example.com",
-		},
+	mockPHR := &PiHoleRequest{
+		endpoint: testEndpoint(t, mockServer.URL),
+		token:    StaticCredential("mocktoken"),
 	}
 
-	exists := domainExists(d.domain, ds)
-	if expected != exists {
-		t.Error("Domain not found in list of domains")
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
 
-	// Test case 2: Domain does not exist in list of domains
-	expected = false
-	d = domain{
-		"8.8.8.8",
-		"donthave.example.com",
+	start := time.Now()
+	err := mockPHR.ValidateProvider(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Error: %v, Expected: %v.", err, context.DeadlineExceeded)
 	}
-	exists = domainExists(d.domain, ds)
-	if expected != exists {
-		t.Error("Domain was found in domains but shouldn't have")
+	if time.Since(start) > time.Second {
+		t.Errorf("ValidateProvider kept retrying after cancel: %s", time.Since(start))
 	}
 }
 
+// Responses from api-responses.md.
 func TestDecodeDomains(t *testing.T) {
-	noDataBytes := []byte("{\"data\":[]}[]")
-	domains, _ := decodeDomains(noDataBytes)
-	if len(domains) != 0 {
-		t.Error("Found domains but should not have")
+	tests := []struct {
+		name     string
+		body     string
+		expected []Domain
+		err      error
+	}{
+		{
+			name: "records",
+			body: `{"data":[["foo.tolson.io","10.1.1.1"],["bar.tolson.io","10.1.1.1"],["tip.tolson.io","10.1.1.5"]]}[]`,
+			expected: []Domain{
+				NewDomain("10.1.1.1", "foo.tolson.io"),
+				NewDomain("10.1.1.1", "bar.tolson.io"),
+				NewDomain("10.1.1.5", "tip.tolson.io"),
+			},
+		},
+		{
+			name: "no records",
+			body: `{"data":[]}[]`,
+		},
+		{
+			name: "invalid token",
+			body: `[]`,
+			err:  ErrUnauthorized,
+		},
+		{
+			name: "FTL not running",
+			body: `{"FTLnotrunning":true}`,
+			err:  ErrFTLNotRunning,
+		},
+		{
+			name: "empty body",
+			body: ``,
+			err:  ErrTransient,
+		},
 	}
 
-	googleBytes := []byte("{\"data\":[[\"google.example.com\",\"8.8.8.8\"]]}[]")
-	domains, _ = decodeDomains(googleBytes)
-	if len(domains) != 1 {
-		t.Error("Did not find domain.")
+	for _, tt := range tests {
+		domains, err := decodeDomains([]byte(tt.body))
+		if tt.err != nil && !errors.Is(err, tt.err) || tt.err == nil && err != nil {
+			t.Errorf("%s: Error: %v, Expected: %v.", tt.name, err, tt.err)
+		}
+		if len(domains) != 0 && !reflect.DeepEqual(tt.expected, domains) {
+			t.Errorf("%s: Domains: %v, Expected: %v.", tt.name, domains, tt.expected)
+		}
+		if len(domains) != len(tt.expected) {
+			t.Errorf("%s: Found %d domains, Expected: %d.", tt.name, len(domains), len(tt.expected))
+		}
 	}
 }
 
+// Responses from api-responses.md.
 func TestDecodeSuccess(t *testing.T) {
-	// Test case 1: Normal case
-	successBytes := []byte("{\"success\":true,\"message\":\"\"}{\"FTLnotrunning\":true}")
-	expected := &successResponse{
-		Success: true,
-		Message: "",
-	}
-	decoded, _ := decodeSuccess(successBytes)
-	if !reflect.DeepEqual(expected, decoded) {
-		t.Error("Expected response was success, decoded was not")
+	tests := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{
+			name: "create record",
+			body: `{"success":true,"message":""}{"FTLnotrunning":true}`,
+		},
+		{
+			name: "attempt duplicate",
+			body: `{"success":false,"message":"This domain already has a custom DNS entry for an IPv4"}[]`,
+			err:  ErrRecordExists,
+		},
+		{
+			name: "delete record that exists",
+			body: `{"success":true,"message":""}{"FTLnotrunning":true}`,
+		},
+		{
+			name: "delete record that does not exist",
+			body: `{"success":false,"message":"This domain\/ip association does not exist"}[]`,
+			err:  ErrRecordNotFound,
+		},
+		{
+			name: "invalid token",
+			body: `[]`,
+			err:  ErrUnauthorized,
+		},
+		{
+			name: "FTL not running",
+			body: `{"success":false,"message":""}{"FTLnotrunning":true}`,
+			err:  ErrFTLNotRunning,
+		},
+		{
+			name: "empty body",
+			body: ``,
+			err:  ErrTransient,
+		},
 	}
 
-	// Test case 2: Duplicate
-	successBytes = []byte("{\"success\":false,\"message\":\"This domain\\\\/ip association does not exist\"}[]")
-	expected = &successResponse{
-		Success: false,
-		Message: "This domain\\/ip association does not exist",
-	}
-	decoded, _ = decodeSuccess(successBytes)
-	if !reflect.DeepEqual(expected, decoded) {
-		t.Error("Expected response reflection error")
+	for _, tt := range tests {
+		err := decodeSuccess([]byte(tt.body))
+		if tt.err != nil && !errors.Is(err, tt.err) || tt.err == nil && err != nil {
+			t.Errorf("%s: Error: %v, Expected: %v.", tt.name, err, tt.err)
+		}
 	}
 
-	// Test case 3: Already exists
-	successBytes = []byte("{\"success\":false,\"message\":\"This domain already has a custom DNS entry for an IPv4\"}[]")
-	expected = &successResponse{
-		Success: false,
-		Message: "This domain already has a custom DNS entry for an IPv4",
-	}
-	decoded, _ = decodeSuccess(successBytes)
-	if !reflect.DeepEqual(expected, decoded) {
-		t.Error("Expected response reflection error")
+	// Messages pi-hole gives are kept.
+	err := decodeSuccess([]byte(`{"success":false,"message":"This domain already has a custom DNS entry for an IPv4"}[]`))
+	expected := "Record already exists: This domain already has a custom DNS entry for an IPv4"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Error: %v, Expected: %v.", err, expected)
 	}
 }
@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// Shorter values are left to the patterns, scrubbing them everywhere would
+// mangle unrelated log text.
+const minSecretLength = 8
+
+// Secrets which may show up in request URLs, headers and bodies, whatever
+// their value: the v5 auth query parameter, the v6 session header and the
+// JSON fields of the v6 auth exchange.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(\bauth=)[^&\s"']+`),
+	regexp.MustCompile(`(?i)(\bX-FTL-SID:\s*)[^\s"']+`),
+	regexp.MustCompile(`(?i)(\\?"(?:password|sid|csrf)\\?"\s*:\s*\\?")[^"\\]+`),
+}
+
+// Every credential pifrost has used, so they are scrubbed wherever they end
+// up, even after they were rotated, and the current session IDs.
+var secrets = struct {
+	mu     sync.RWMutex
+	values map[string]struct{}
+}{
+	values: map[string]struct{}{},
+}
+
+// RedactSecret makes Redact scrub value from now on. Credentials register
+// every value they load.
+func RedactSecret(value string) {
+	ReplaceSecret("", value)
+}
+
+// ReplaceSecret makes Redact scrub value instead of old, e.g. a new session
+// ID in place of the expired one. An empty value only forgets old.
+func ReplaceSecret(old, value string) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+
+	delete(secrets.values, old)
+	if len(value) >= minSecretLength {
+		secrets.values[value] = struct{}{}
+	}
+}
+
+// Redact replaces the known secrets and anything that looks like a token,
+// session ID or password in s.
+func Redact(s string) string {
+	secrets.mu.RLock()
+	values := make([]string, 0, len(secrets.values))
+	for value := range secrets.values {
+		values = append(values, value)
+	}
+	secrets.mu.RUnlock()
+
+	// Longest first, so a secret containing another is scrubbed whole.
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	for _, value := range values {
+		s = strings.ReplaceAll(s, value, redacted)
+	}
+
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+redacted)
+	}
+
+	return s
+}
+
+// RedactFormatter scrubs secrets from the message and fields of every log
+// entry, and from what Formatter makes of them.
+type RedactFormatter struct {
+	Formatter logrus.Formatter
+}
+
+func (f *RedactFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	// Work on a copy, hooks and other formatters share the entry.
+	scrubbed := *entry
+	scrubbed.Message = Redact(entry.Message)
+	scrubbed.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch value := value.(type) {
+		case string:
+			scrubbed.Data[key] = Redact(value)
+		case error:
+			scrubbed.Data[key] = Redact(value.Error())
+		default:
+			scrubbed.Data[key] = value
+		}
+	}
+
+	out, err := f.Formatter.Format(&scrubbed)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(Redact(string(out))), nil
+}
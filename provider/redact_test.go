@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+	RedactSecret("knownsecret")
+
+	// Test case 1: Known secrets and secret shaped values
+	cases := map[string]string{
+		"using knownsecret":                          "using [REDACTED]",
+		"/admin/api.php?auth=abc123&customdns=":      "/admin/api.php?auth=[REDACTED]&customdns=",
+		"X-FTL-SID: abc123":                          "X-FTL-SID: [REDACTED]",
+		`{"password":"hunter2"}`:                     `{"password":"[REDACTED]"}`,
+		`{"session":{"sid":"abc123","csrf":"def"}}`:  `{"session":{"sid":"[REDACTED]","csrf":"[REDACTED]"}}`,
+		`msg="body {\"sid\":\"abc123\"}"`:            `msg="body {\"sid\":\"[REDACTED]\"}"`,
+		"Could not add record: Item already present": "Could not add record: Item already present",
+	}
+	for in, expected := range cases {
+		if out := Redact(in); out != expected {
+			t.Errorf("Redact(%s): %s, Expected: %s.", in, out, expected)
+		}
+	}
+
+	// Test case 2: Short values would scrub unrelated text
+	RedactSecret("abc")
+	if out := Redact("abcdef"); out != "abcdef" {
+		t.Errorf("Redact: %s, Expected: abcdef.", out)
+	}
+
+	// Test case 3: A replaced value is forgotten
+	ReplaceSecret("knownsecret", "rotatedsecret")
+	if out := Redact("knownsecret rotatedsecret"); out != "knownsecret [REDACTED]" {
+		t.Errorf("Redact: %s, Expected: knownsecret [REDACTED].", out)
+	}
+}
+
+// Capture debug logs through the redacting formatter for the duration of a
+// test.
+func captureLogs(t *testing.T, formatter logrus.Formatter) *bytes.Buffer {
+	var buf bytes.Buffer
+	out, level, previous := logrus.StandardLogger().Out, logrus.GetLevel(), logrus.StandardLogger().Formatter
+	t.Cleanup(func() {
+		logrus.SetOutput(out)
+		logrus.SetLevel(level)
+		logrus.SetFormatter(previous)
+	})
+
+	logrus.SetOutput(&buf)
+	logrus.SetLevel(logrus.DebugLevel)
+	logrus.SetFormatter(&RedactFormatter{Formatter: formatter})
+
+	return &buf
+}
+
+func TestRedactedDebugLogs(t *testing.T) {
+	for name, formatter := range map[string]logrus.Formatter{
+		"text": &logrus.TextFormatter{},
+		"json": &logrus.JSONFormatter{},
+	} {
+		buf := captureLogs(t, formatter)
+
+		// Test case 1: v5 sends the token with every request
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("action") == "get" {
+				w.Write([]byte(`{"data":[["example.com","192.168.1.2"]]}`))
+				return
+			}
+			w.Write([]byte(`{"success":false,"message":"Not authorized!"}`))
+		}))
+		defer mockServer.Close()
+
+		mockPHR, _ := InitDNSProvider(testEndpoint(t, mockServer.URL), StaticCredential("v5supersecrettoken"))
+		mockPHR.GetDNS(context.Background())
+		dcs, _ := CreateChangeSet("10.1.1.1", "foo.example.com", "add")
+		err := mockPHR.ModifyDNS(context.Background(), dcs)
+		logrus.WithError(err).Error("Could not add record")
+
+		// Test case 2: v6 sends the password and gets a session ID
+		v6Server, v6URL, _ := startMockV6Server(t, "192.168.1.2 example.com")
+		defer v6Server.Close()
+
+		v6PHR, _ := InitV6DNSProvider(testEndpoint(t, v6URL), StaticCredential("mockpassword"))
+		v6PHR.GetDNS(context.Background())
+		v6PHR.Logout(context.Background())
+
+		output := buf.String()
+		if !strings.Contains(output, "Query:") || !strings.Contains(output, "Authenticated new pi-hole session") {
+			t.Fatalf("%s: Debug logs were not captured: %s", name, output)
+		}
+		for _, secret := range []string{"v5supersecrettoken", "mockpassword", "mocksid"} {
+			if strings.Contains(output, secret) {
+				t.Errorf("%s: Secret [%s] in log output: %s", name, secret, output)
+			}
+		}
+	}
+}
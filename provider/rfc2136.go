@@ -0,0 +1,431 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultRFC2136TTL = 300
+
+	// How far the TSIG time may be off between us and the nameserver.
+	tsigFudge = 300
+)
+
+// RFC2136Config describes the zone an RFC2136Provider manages.
+type RFC2136Config struct {
+	// Nameserver accepting updates and transfers, host or host:port.
+	Server string
+	// Zone the records are in, e.g. home.lan.
+	Zone string
+	// TSIG key, no TSIG when the name is empty.
+	TSIGKeyName   string
+	TSIGSecret    string
+	TSIGAlgorithm string
+	// TTL of created records.
+	TTL uint32
+	// Timeout of each exchange with the nameserver.
+	Timeout time.Duration
+}
+
+// RFC2136Provider manages records of a zone on a nameserver such as BIND or
+// Knot, with RFC 2136 dynamic updates signed by TSIG. Records are listed with
+// a zone transfer.
+type RFC2136Provider struct {
+	config RFC2136Config
+	server string
+	zone   string
+
+	index recordIndex
+}
+
+// Make sure the RFC 2136 client satisfies the provider contract.
+var _ DNSProvider = &RFC2136Provider{}
+
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+func NewRFC2136Provider(config RFC2136Config) (*RFC2136Provider, error) {
+	if len(config.Server) == 0 {
+		return nil, errors.New("Need a nameserver")
+	}
+	if len(config.Zone) == 0 {
+		return nil, errors.New("Need a zone")
+	}
+
+	server := config.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	if len(config.TSIGKeyName) != 0 {
+		if len(config.TSIGSecret) == 0 {
+			return nil, errors.New("Need a TSIG secret for the TSIG key")
+		}
+		algorithm, ok := tsigAlgorithms[strings.ToLower(strings.TrimSuffix(config.TSIGAlgorithm, "."))]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TSIG algorithm [%s], must be hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384 or hmac-sha512", config.TSIGAlgorithm)
+		}
+		config.TSIGAlgorithm = algorithm
+		config.TSIGKeyName = dns.CanonicalName(config.TSIGKeyName)
+		RedactSecret(config.TSIGSecret)
+	}
+	if config.TTL == 0 {
+		config.TTL = DefaultRFC2136TTL
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultHTTPTimeout
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"server": server,
+		"zone":   config.Zone,
+		"tsig":   config.TSIGKeyName,
+	}).Info("Creating DNS Provider")
+
+	return &RFC2136Provider{
+		config: config,
+		server: server,
+		zone:   dns.CanonicalName(config.Zone),
+	}, nil
+}
+
+// Transfer the zone once, retrying while the nameserver is unreachable.
+func (rp *RFC2136Provider) ValidateProvider(ctx context.Context) error {
+	var count int = 1
+	const tries int = 5
+	for {
+		logrus.Info("Attempting to transfer zone...")
+		_, err := rp.GetDNS(ctx)
+		if err == nil {
+			logrus.Info("Connected.")
+			return nil
+		}
+		if !errors.Is(err, ErrTransient) {
+			return err
+		}
+		logrus.Debugf("Nameserver not ready: %s", err)
+		if err := backoff(ctx, 1<<count*time.Second); err != nil {
+			return err
+		}
+		count++
+		if count == tries {
+			return err
+		}
+	}
+}
+
+func (rp *RFC2136Provider) Capabilities() Capabilities {
+	return Capabilities{
+		Name:        "rfc2136",
+		RecordTypes: []string{RecordA, RecordAAAA, RecordCNAME},
+	}
+}
+
+// Records of the zone, from the record index while it is fresh.
+func (rp *RFC2136Provider) GetDNS(ctx context.Context) ([]Domain, error) {
+	if domains, ok := rp.index.list(); ok {
+		return domains, nil
+	}
+
+	domains, err := rp.transfer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to transfer zone: %w", err)
+	}
+	rp.index.set(domains)
+
+	return domains, nil
+}
+
+// The A, AAAA and CNAME records of the zone, by AXFR.
+func (rp *RFC2136Provider) transfer(ctx context.Context) ([]Domain, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(rp.zone)
+	t := &dns.Transfer{
+		DialTimeout:  rp.config.Timeout,
+		ReadTimeout:  rp.config.Timeout,
+		WriteTimeout: rp.config.Timeout,
+	}
+	rp.sign(m, &t.TsigSecret)
+
+	conn, err := dns.DialTimeout("tcp", rp.server, rp.config.Timeout)
+	if err != nil {
+		return nil, transient(err)
+	}
+	first := &firstMsgConn{Conn: conn.Conn}
+	conn.Conn = first
+	t.Conn = conn
+
+	envelopes, err := t.In(m, rp.server)
+	if err != nil {
+		t.Close()
+		return nil, transient(err)
+	}
+
+	var domains []Domain
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, rp.transferError(envelope.Error, first.rcode())
+		}
+		for _, rr := range envelope.RR {
+			name := fromFqdn(rr.Header().Name)
+			switch rr := rr.(type) {
+			case *dns.A:
+				domains = append(domains, NewDomain(rr.A.String(), name))
+			case *dns.AAAA:
+				domains = append(domains, NewDomain(rr.AAAA.String(), name))
+			case *dns.CNAME:
+				domains = append(domains, NewCNAME(name, fromFqdn(rr.Target)))
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	logrus.Debugf("Transferred zone [%s]: %d records", rp.zone, len(domains))
+
+	return domains, nil
+}
+
+// A refused transfer or bad signature will not go away by retrying. rcode is
+// that of the first message the nameserver answered, -1 when none arrived.
+func (rp *RFC2136Provider) transferError(err error, rcode int) error {
+	switch rcode {
+	case dns.RcodeRefused, dns.RcodeNotAuth:
+		return fmt.Errorf("%w: nameserver answered %s", ErrUnauthorized, dns.RcodeToString[rcode])
+	}
+	if tsigError(err) {
+		return fmt.Errorf("%w: %s", ErrUnauthorized, err)
+	}
+	return transient(err)
+}
+
+// firstMsgConn keeps the first DNS message read through a TCP connection,
+// the transfer only reports a failing rcode as error text.
+type firstMsgConn struct {
+	net.Conn
+	buf  []byte
+	done bool
+	msg  *dns.Msg
+}
+
+func (c *firstMsgConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.done {
+		return n, err
+	}
+
+	// A two byte length precedes each message, RFC 1035 section 4.2.2.
+	c.buf = append(c.buf, p[:n]...)
+	if len(c.buf) < 2 {
+		return n, err
+	}
+	length := int(c.buf[0])<<8 | int(c.buf[1])
+	if len(c.buf) < 2+length {
+		return n, err
+	}
+	msg := new(dns.Msg)
+	if msg.Unpack(c.buf[2:2+length]) == nil {
+		c.msg = msg
+	}
+	c.buf, c.done = nil, true
+	return n, err
+}
+
+// The rcode of the first message, -1 when none was read.
+func (c *firstMsgConn) rcode() int {
+	if c.msg == nil {
+		return -1
+	}
+	return c.msg.Rcode
+}
+
+// Whether err is a failed TSIG signature or verification.
+func tsigError(err error) bool {
+	return errors.Is(err, dns.ErrSig) || errors.Is(err, dns.ErrSecret) || errors.Is(err, dns.ErrKey) || errors.Is(err, dns.ErrAuth)
+}
+
+// Records named name, only transfers the zone when the record index is
+// stale.
+func (rp *RFC2136Provider) named(ctx context.Context, name string) ([]Domain, error) {
+	if records, ok := rp.index.named(name); ok {
+		return records, nil
+	}
+
+	domains, err := rp.GetDNS(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Domain
+	for _, d := range domains {
+		if d.domain == name {
+			records = append(records, d)
+		}
+	}
+	return records, nil
+}
+
+// An add inserts the record, a replace deletes the RRsets it replaces in the
+// same update, a delete removes the single record.
+func (rp *RFC2136Provider) ModifyDNS(ctx context.Context, dcs *DNSChangeSet) error {
+	if !dns.IsSubDomain(rp.zone, dns.Fqdn(dcs.domain.domain)) {
+		return fmt.Errorf("%w: %s is not in zone %s", ErrOutsideZone, dcs.domain.domain, rp.zone)
+	}
+
+	records, err := rp.named(ctx, dcs.domain.domain)
+	if err != nil {
+		return fmt.Errorf("Failed to %s: %w", dcs.action, err)
+	}
+
+	rr, err := rp.rr(dcs.domain)
+	if err != nil {
+		return err
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(rp.zone)
+
+	var replaced []Domain
+	switch dcs.action {
+	case "add":
+		if hasRecord(dcs.domain, records) {
+			logrus.WithFields(logrus.Fields{
+				"domain": dcs.domain.domain,
+			}).Info("Domain already exists with hostname and target")
+			return nil
+		}
+
+		replaced = replacedBy(rp.Capabilities(), dcs.domain, records)
+		for _, rrtype := range replacedTypes(replaced) {
+			m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: dns.Fqdn(dcs.domain.domain), Rrtype: rrtype, Class: dns.ClassINET}}})
+		}
+		m.Insert([]dns.RR{rr})
+	case "delete":
+		if !hasRecord(dcs.domain, records) {
+			return ErrRecordNotFound
+		}
+		m.Remove([]dns.RR{rr})
+	default:
+		return nil
+	}
+
+	if err := rp.exchange(ctx, m); err != nil {
+		rp.index.invalidate()
+		return fmt.Errorf("Could not %s record: %w", dcs.action, err)
+	}
+
+	for _, d := range replaced {
+		rp.index.remove(d)
+	}
+	if dcs.action == "add" {
+		rp.index.add(dcs.domain)
+	} else {
+		rp.index.remove(dcs.domain)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain":   dcs.domain.domain,
+		"type":     dcs.domain.Type(),
+		"target":   dcs.domain.Value(),
+		"action":   dcs.action,
+		"replaced": len(replaced),
+	}).Info("Updated zone.")
+
+	return nil
+}
+
+// The RRset types of replaced, each once.
+func replacedTypes(replaced []Domain) []uint16 {
+	var types []uint16
+	seen := map[uint16]bool{}
+	for _, d := range replaced {
+		rrtype := dns.StringToType[d.Type()]
+		if !seen[rrtype] {
+			seen[rrtype] = true
+			types = append(types, rrtype)
+		}
+	}
+	return types
+}
+
+// The resource record of d.
+func (rp *RFC2136Provider) rr(d Domain) (dns.RR, error) {
+	hdr := dns.RR_Header{
+		Name:   dns.Fqdn(d.domain),
+		Rrtype: dns.StringToType[d.Type()],
+		Class:  dns.ClassINET,
+		Ttl:    rp.config.TTL,
+	}
+
+	switch d.Type() {
+	case RecordA:
+		return &dns.A{Hdr: hdr, A: net.ParseIP(d.ip).To4()}, nil
+	case RecordAAAA:
+		return &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(d.ip)}, nil
+	case RecordCNAME:
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(d.target)}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedRecord, d.Type())
+}
+
+// Send an update and check the nameserver applied it.
+func (rp *RFC2136Provider) exchange(ctx context.Context, m *dns.Msg) error {
+	c := &dns.Client{
+		Net:     "tcp",
+		Timeout: rp.config.Timeout,
+	}
+	rp.sign(m, &c.TsigSecret)
+
+	logrus.Debugf("Update: %s", m.Ns)
+
+	r, _, err := c.ExchangeContext(ctx, m, rp.server)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		if tsigError(err) {
+			return fmt.Errorf("%w: %s", ErrUnauthorized, err)
+		}
+		return transient(err)
+	}
+
+	switch r.Rcode {
+	case dns.RcodeSuccess:
+		return nil
+	case dns.RcodeRefused, dns.RcodeNotAuth:
+		return fmt.Errorf("%w: nameserver answered %s", ErrUnauthorized, dns.RcodeToString[r.Rcode])
+	case dns.RcodeServerFailure:
+		return transient(fmt.Errorf("nameserver answered %s", dns.RcodeToString[r.Rcode]))
+	}
+
+	return fmt.Errorf("Nameserver answered %s", dns.RcodeToString[r.Rcode])
+}
+
+// Sign m with the TSIG key, if there is one.
+func (rp *RFC2136Provider) sign(m *dns.Msg, secrets *map[string]string) {
+	if len(rp.config.TSIGKeyName) == 0 {
+		return
+	}
+	*secrets = map[string]string{rp.config.TSIGKeyName: rp.config.TSIGSecret}
+	m.SetTsig(rp.config.TSIGKeyName, rp.config.TSIGAlgorithm, tsigFudge, time.Now().Unix())
+}
+
+// pifrost domains have no trailing dot.
+func fromFqdn(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,288 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testTSIGKey    = "pifrost."
+	testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// An in-process nameserver holding one zone, it applies signed updates and
+// answers signed transfers.
+type mockNameserver struct {
+	sync.Mutex
+	zone    string
+	records []dns.RR
+	updates int
+	rcode   int
+}
+
+func startMockNameserver(t *testing.T, zone string, records ...string) (*mockNameserver, string) {
+	ns := &mockNameserver{zone: dns.Fqdn(zone)}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("Error parsing record: %s", err)
+		}
+		ns.records = append(ns.records, rr)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          listener,
+		Handler:           ns,
+		TsigSecret:        map[string]string{testTSIGKey: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default refuses updates.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return ns, listener.Addr().String()
+}
+
+func (ns *mockNameserver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	r := new(dns.Msg)
+	r.SetReply(req)
+	defer func() {
+		if req.IsTsig() != nil && w.TsigStatus() == nil {
+			r.SetTsig(testTSIGKey, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+		}
+		w.WriteMsg(r)
+	}()
+
+	if req.IsTsig() == nil || w.TsigStatus() != nil {
+		r.Rcode = dns.RcodeNotAuth
+		return
+	}
+	if ns.rcode != dns.RcodeSuccess {
+		r.Rcode = ns.rcode
+		return
+	}
+
+	soa, _ := dns.NewRR(ns.zone + " 300 IN SOA ns." + ns.zone + " admin." + ns.zone + " 1 3600 600 86400 300")
+	switch {
+	case req.Opcode == dns.OpcodeUpdate:
+		ns.updates++
+		for _, rr := range req.Ns {
+			ns.apply(rr)
+		}
+	case len(req.Question) == 1 && req.Question[0].Qtype == dns.TypeAXFR:
+		r.Answer = append(append([]dns.RR{soa}, ns.records...), soa)
+	default:
+		r.Rcode = dns.RcodeRefused
+	}
+}
+
+// Apply an update RR, RFC 2136 section 2.5.
+func (ns *mockNameserver) apply(rr dns.RR) {
+	h := rr.Header()
+	var kept []dns.RR
+	for _, current := range ns.records {
+		ch := current.Header()
+		sameSet := ch.Name == h.Name && ch.Rrtype == h.Rrtype
+		switch h.Class {
+		case dns.ClassANY:
+			if sameSet {
+				continue
+			}
+		case dns.ClassNONE:
+			if sameSet && dns.IsDuplicate(current, rr) {
+				continue
+			}
+		}
+		kept = append(kept, current)
+	}
+	if h.Class == dns.ClassINET {
+		kept = append(kept, rr)
+	}
+	ns.records = kept
+}
+
+func newTestRFC2136Provider(t *testing.T, server string) *RFC2136Provider {
+	rp, err := NewRFC2136Provider(RFC2136Config{
+		Server:        server,
+		Zone:          "home.lan",
+		TSIGKeyName:   "pifrost",
+		TSIGSecret:    testTSIGSecret,
+		TSIGAlgorithm: "hmac-sha256",
+		Timeout:       time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Error from NewRFC2136Provider: %s", err)
+	}
+	return rp
+}
+
+func sortedDomains(domains []Domain) []Domain {
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].domain != domains[j].domain {
+			return domains[i].domain < domains[j].domain
+		}
+		return domains[i].Value() < domains[j].Value()
+	})
+	return domains
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	ns, server := startMockNameserver(t, "home.lan",
+		"router.home.lan. 300 IN A 192.168.1.1",
+		"www.home.lan. 300 IN CNAME router.home.lan.",
+		"home.lan. 300 IN MX 10 mail.home.lan.",
+	)
+	rp := newTestRFC2136Provider(t, server)
+	ctx := context.Background()
+
+	// Test case 1: The zone transfer lists A, AAAA and CNAME records
+	if err := rp.ValidateProvider(ctx); err != nil {
+		t.Fatalf("Error from ValidateProvider: %s", err)
+	}
+	domains, err := rp.GetDNS(ctx)
+	expected := []Domain{NewDomain("192.168.1.1", "router.home.lan"), NewCNAME("www.home.lan", "router.home.lan")}
+	if err != nil || !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Domains: %v, Expected: %v. Error: %v", domains, expected, err)
+	}
+
+	// Test case 2: Adding both families of a name
+	for _, ip := range []string{"192.168.5.1", "fd00::5"} {
+		dcs, _ := CreateChangeSet(ip, "echo.home.lan", "add")
+		if err := rp.ModifyDNS(ctx, dcs); err != nil {
+			t.Errorf("Error from add: %s", err)
+		}
+	}
+
+	// Test case 3: Adding a record again sends no update
+	updates := ns.updates
+	dcs, _ := CreateChangeSet("192.168.5.1", "echo.home.lan", "add")
+	if err := rp.ModifyDNS(ctx, dcs); err != nil || ns.updates != updates {
+		t.Errorf("Updates: %d, Expected: %d. Error: %v", ns.updates, updates, err)
+	}
+
+	// Test case 4: A second IPv4 address joins the A RRset
+	dcs, _ = CreateChangeSet("192.168.5.2", "echo.home.lan", "add")
+	if err := rp.ModifyDNS(ctx, dcs); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+
+	// Test case 5: An address replaces the CNAME of the name
+	dcs, _ = CreateChangeSet("router.home.lan", "alias.home.lan", "add")
+	rp.ModifyDNS(ctx, dcs)
+	dcs, _ = CreateChangeSet("192.168.5.3", "alias.home.lan", "add")
+	if err := rp.ModifyDNS(ctx, dcs); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+
+	rp.index.invalidate()
+	domains, _ = rp.GetDNS(ctx)
+	expected = []Domain{
+		NewDomain("192.168.5.3", "alias.home.lan"),
+		NewDomain("192.168.5.1", "echo.home.lan"),
+		NewDomain("192.168.5.2", "echo.home.lan"),
+		NewDomain("fd00::5", "echo.home.lan"),
+		NewDomain("192.168.1.1", "router.home.lan"),
+		NewCNAME("www.home.lan", "router.home.lan"),
+	}
+	if domains = sortedDomains(domains); !reflect.DeepEqual(expected, domains) {
+		t.Errorf("Domains: %v, Expected: %v.", domains, expected)
+	}
+
+	// Test case 6: Deleting, and deleting again
+	dcs, _ = CreateChangeSet("fd00::5", "echo.home.lan", "delete")
+	if err := rp.ModifyDNS(ctx, dcs); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+	if err := rp.ModifyDNS(ctx, dcs); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrRecordNotFound)
+	}
+
+	// Test case 7: Names outside the zone are refused
+	dcs, _ = CreateChangeSet("192.168.5.1", "echo.example.com", "add")
+	if err := rp.ModifyDNS(ctx, dcs); !errors.Is(err, ErrOutsideZone) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrOutsideZone)
+	}
+}
+
+func TestRFC2136ProviderErrors(t *testing.T) {
+	ns, server := startMockNameserver(t, "home.lan")
+	ctx := context.Background()
+
+	// Test case 1: A wrong TSIG secret is unauthorized
+	rp, _ := NewRFC2136Provider(RFC2136Config{
+		Server:        server,
+		Zone:          "home.lan",
+		TSIGKeyName:   "pifrost",
+		TSIGSecret:    "d3JvbmdzZWNyZXQ=",
+		TSIGAlgorithm: "hmac-sha256",
+		Timeout:       time.Second,
+	})
+	if err := rp.ValidateProvider(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrUnauthorized)
+	}
+
+	// Test case 2: A refused update is unauthorized, a failing server transient
+	rp = newTestRFC2136Provider(t, server)
+	rp.GetDNS(ctx)
+	for rcode, expected := range map[int]error{dns.RcodeRefused: ErrUnauthorized, dns.RcodeServerFailure: ErrTransient} {
+		ns.rcode = rcode
+		dcs, _ := CreateChangeSet("192.168.5.1", "echo.home.lan", "add")
+		if err := rp.ModifyDNS(ctx, dcs); !errors.Is(err, expected) {
+			t.Errorf("%s: Error: %v, Expected: %v.", dns.RcodeToString[rcode], err, expected)
+		}
+	}
+
+	// Test case 3: A refused transfer is unauthorized, a failing server transient
+	for rcode, expected := range map[int]error{dns.RcodeRefused: ErrUnauthorized, dns.RcodeNotAuth: ErrUnauthorized, dns.RcodeServerFailure: ErrTransient} {
+		ns.rcode = rcode
+		rp = newTestRFC2136Provider(t, server)
+		if _, err := rp.GetDNS(ctx); !errors.Is(err, expected) {
+			t.Errorf("%s: Error: %v, Expected: %v.", dns.RcodeToString[rcode], err, expected)
+		}
+	}
+
+	// Test case 4: An unreachable nameserver is transient
+	ns.rcode = dns.RcodeSuccess
+	rp = newTestRFC2136Provider(t, "127.0.0.1:1")
+	if _, err := rp.GetDNS(ctx); !errors.Is(err, ErrTransient) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrTransient)
+	}
+}
+
+func TestNewRFC2136Provider(t *testing.T) {
+	// Test case 1: The default port and TTL
+	rp, err := NewRFC2136Provider(RFC2136Config{Server: "ns.home.lan", Zone: "home.lan"})
+	if err != nil || rp.server != "ns.home.lan:53" || rp.config.TTL != DefaultRFC2136TTL {
+		t.Errorf("Server: %s, TTL: %d. Error: %v", rp.server, rp.config.TTL, err)
+	}
+
+	// Test case 2: Invalid configurations
+	for _, config := range []RFC2136Config{
+		{Zone: "home.lan"},
+		{Server: "ns.home.lan"},
+		{Server: "ns.home.lan", Zone: "home.lan", TSIGKeyName: "pifrost"},
+		{Server: "ns.home.lan", Zone: "home.lan", TSIGKeyName: "pifrost", TSIGSecret: testTSIGSecret, TSIGAlgorithm: "md5"},
+	} {
+		if _, err := NewRFC2136Provider(config); err == nil {
+			t.Errorf("Expected error for %+v", config)
+		}
+	}
+}
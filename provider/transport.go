@@ -0,0 +1,148 @@
+package provider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Default for HTTPConfig.Timeout, pi-hole answers in milliseconds.
+	DefaultHTTPTimeout = 10 * time.Second
+
+	// Idle keep-alive connections kept to pi-hole, a sync sends a few
+	// requests in a row.
+	maxIdleConnsPerHost = 4
+)
+
+// HTTPConfig is how providers reach pi-hole or AdGuard Home over HTTP.
+type HTTPConfig struct {
+	// Timeout of a whole request, 0 uses DefaultHTTPTimeout.
+	Timeout time.Duration
+	// PEM bundle trusted on top of the system roots, e.g. an internal CA.
+	CAFile string
+	// Client certificate and key for proxies requiring mTLS.
+	ClientCertFile string
+	ClientKeyFile  string
+	// Accept any server certificate.
+	SkipVerify bool
+	// Proxy URL, empty uses HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+	Proxy string
+}
+
+// Endpoint is the pi-hole web interface a provider talks to, and the client
+// it uses to get there. Providers share it, so connections are reused.
+type Endpoint struct {
+	// Root of the web interface, without a trailing /admin.
+	base   *url.URL
+	client *http.Client
+}
+
+// Create an endpoint for the pi-hole at rawURL, such as
+// https://pihole.example.com:8443/pihole/admin. A trailing /admin is optional,
+// the v5 API lives below it and the v6 API next to it.
+func NewEndpoint(rawURL string, config HTTPConfig) (*Endpoint, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || len(base.Host) == 0 {
+		return nil, fmt.Errorf("Could not parse URL [%s], must be http(s)://host[:port][/path]", rawURL)
+	}
+	base.Path = strings.TrimSuffix(strings.TrimSuffix(base.Path, "/"), "/admin")
+	base.RawPath = ""
+	base.RawQuery = ""
+	base.Fragment = ""
+
+	client, err := NewHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Endpoint{
+		base:   base,
+		client: client,
+	}, nil
+}
+
+// URL of the pi-hole given as --pihole-host, with --insecure picking http.
+func HostURL(insecure bool, host string) (string, error) {
+	if match := hostRegexp.MatchString(host); match == false {
+		return "", fmt.Errorf("Could not parse pi-hole host/domain [%s]", host)
+	}
+
+	if insecure {
+		return "http://" + host, nil
+	}
+	return "https://" + host, nil
+}
+
+// Root of the web interface, any password redacted.
+func (e *Endpoint) String() string {
+	return e.base.Redacted()
+}
+
+// Absolute URL of path, which starts with a slash and may be escaped.
+func (e *Endpoint) url(path string) string {
+	return e.base.String() + path
+}
+
+// Create an HTTP client from config. The transport keeps connections alive
+// and honours the proxy environment unless config names a proxy.
+func NewHTTPClient(config HTTPConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+
+	if len(config.Proxy) != 0 {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil || len(proxy.Host) == 0 {
+			return nil, fmt.Errorf("Could not parse proxy URL [%s]", config.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.SkipVerify,
+	}
+
+	if len(config.CAFile) != 0 {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file [%s]", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(config.ClientCertFile) != 0 || len(config.ClientKeyFile) != 0 {
+		if len(config.ClientCertFile) == 0 || len(config.ClientKeyFile) == 0 {
+			return nil, errors.New("A client certificate needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = DefaultHTTPTimeout
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
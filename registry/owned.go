@@ -0,0 +1,189 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/tolson-vkn/pifrost/provider"
+)
+
+// What to do when a change touches a record pifrost does not own.
+type ConflictPolicy string
+
+const (
+	// Treat unowned records as ours, replace and delete them.
+	PolicyTakeover ConflictPolicy = "takeover"
+	// Leave unowned records alone and log it.
+	PolicySkip ConflictPolicy = "skip"
+	// Leave unowned records alone and fail the change.
+	PolicyError ConflictPolicy = "error"
+)
+
+var ErrNotOwned = errors.New("Record is not owned by pifrost")
+
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(policy); p {
+	case PolicyTakeover, PolicySkip, PolicyError:
+		return p, nil
+	}
+	return "", fmt.Errorf("Unknown conflict policy [%s], must be takeover, skip or error", policy)
+}
+
+// OwnedProvider wraps a DNS provider so changes only touch records the
+// registry says pifrost owns, unless the conflict policy allows otherwise.
+// Changes are applied one at a time, so the ownership check and the change
+// can not interleave with another change.
+type OwnedProvider struct {
+	provider.DNSProvider
+
+	mu       sync.Mutex
+	registry *Registry
+	policy   ConflictPolicy
+}
+
+// Make sure the wrapper satisfies the provider contract.
+var _ provider.DNSProvider = &OwnedProvider{}
+
+func NewOwnedProvider(dnsProvider provider.DNSProvider, registry *Registry, policy ConflictPolicy) *OwnedProvider {
+	return &OwnedProvider{
+		DNSProvider: dnsProvider,
+		registry:    registry,
+		policy:      policy,
+	}
+}
+
+func (op *OwnedProvider) ModifyDNS(ctx context.Context, dcs *provider.DNSChangeSet) error {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	switch dcs.Action() {
+	case "add":
+		return op.add(ctx, dcs)
+	case "delete":
+		return op.delete(ctx, dcs)
+	}
+
+	return op.DNSProvider.ModifyDNS(ctx, dcs)
+}
+
+// Adding replaces the records of the same name the provider can not hold
+// next to it, so those and the record itself must be ours. Records it can
+// coexist with are left alone.
+func (op *OwnedProvider) add(ctx context.Context, dcs *provider.DNSChangeSet) error {
+	d := dcs.Domain()
+
+	domains, err := op.GetDNS(ctx)
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	var replaced []provider.Domain
+	for _, current := range domains {
+		switch {
+		case current == d:
+			exists = true
+		case op.Capabilities().Replaces(d, current):
+			replaced = append(replaced, current)
+		default:
+			continue
+		}
+
+		if op.registry.Owns(current) {
+			continue
+		}
+		if err := op.conflict(current, dcs); err != nil {
+			if errors.Is(err, errSkipped) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	if !exists {
+		if err := op.DNSProvider.ModifyDNS(ctx, dcs); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range replaced {
+		if err := op.registry.Release(ctx, r); err != nil {
+			return err
+		}
+	}
+
+	return op.registry.Claim(ctx, d, dcs.Owner())
+}
+
+func (op *OwnedProvider) delete(ctx context.Context, dcs *provider.DNSChangeSet) error {
+	d := dcs.Domain()
+
+	owner, ok := op.registry.Owner(d)
+	if !ok {
+		if err := op.conflict(d, dcs); err != nil {
+			if errors.Is(err, errSkipped) {
+				return nil
+			}
+			return err
+		}
+	} else if len(dcs.Owner()) != 0 && owner != dcs.Owner() {
+		// Another object took the record over, it still wants it.
+		logrus.WithFields(logrus.Fields{
+			"domain": d.Name(),
+			"owner":  owner,
+		}).Info("Record owned by another object, not deleting")
+		return nil
+	}
+
+	// Already gone, nothing left to do but forget it.
+	domains, err := op.GetDNS(ctx)
+	if err != nil {
+		return err
+	}
+	if !contains(domains, d) {
+		return op.registry.Release(ctx, d)
+	}
+
+	err = op.DNSProvider.ModifyDNS(ctx, dcs)
+	if err != nil && !errors.Is(err, provider.ErrRecordNotFound) {
+		return err
+	}
+
+	return op.registry.Release(ctx, d)
+}
+
+func contains(domains []provider.Domain, d provider.Domain) bool {
+	for _, current := range domains {
+		if current == d {
+			return true
+		}
+	}
+	return false
+}
+
+var errSkipped = errors.New("skipped unowned record")
+
+// Apply the conflict policy to an unowned record the change would touch.
+func (op *OwnedProvider) conflict(current provider.Domain, dcs *provider.DNSChangeSet) error {
+	fields := logrus.Fields{
+		"domain": current.Name(),
+		"target": current.Value(),
+		"action": dcs.Action(),
+		"owner":  dcs.Owner(),
+	}
+
+	switch op.policy {
+	case PolicyTakeover:
+		logrus.WithFields(fields).Warn("Taking over record not owned by pifrost")
+		return nil
+	case PolicySkip:
+		logrus.WithFields(fields).Warn("Skipping change, record not owned by pifrost")
+		return errSkipped
+	}
+
+	return fmt.Errorf("%w: %s %s", ErrNotOwned, current.Type(), current.Name())
+}
@@ -0,0 +1,336 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/tolson-vkn/pifrost/provider"
+)
+
+// fakeProvider keeps records in a map of domain to IPv4 or CNAME target, and
+// IPv6 addresses in a map of their own. Adding replaces records of the same
+// name, except for the address of the other IP family, like pi-hole does.
+type fakeProvider struct {
+	records map[string]string
+	aaaa    map[string]string
+}
+
+func (f *fakeProvider) GetDNS(ctx context.Context) ([]provider.Domain, error) {
+	var domains []provider.Domain
+	for name, value := range f.records {
+		if net.ParseIP(value) != nil {
+			domains = append(domains, provider.NewDomain(value, name))
+		} else {
+			domains = append(domains, provider.NewCNAME(name, value))
+		}
+	}
+	for name, value := range f.aaaa {
+		domains = append(domains, provider.NewDomain(value, name))
+	}
+	return domains, nil
+}
+
+func (f *fakeProvider) ModifyDNS(ctx context.Context, dcs *provider.DNSChangeSet) error {
+	d := dcs.Domain()
+	records := f.records
+	if d.Type() == provider.RecordAAAA {
+		records = f.aaaa
+	}
+
+	switch dcs.Action() {
+	case "add":
+		if d.Type() == provider.RecordCNAME {
+			delete(f.aaaa, d.Name())
+		}
+		records[d.Name()] = d.Value()
+	case "delete":
+		if records[d.Name()] != d.Value() {
+			return provider.ErrRecordNotFound
+		}
+		delete(records, d.Name())
+	}
+	return nil
+}
+
+func (f *fakeProvider) ValidateProvider(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeProvider) Capabilities() provider.Capabilities {
+	return provider.Capabilities{
+		Name:          "fake",
+		RecordTypes:   []string{provider.RecordA, provider.RecordCNAME},
+		SingleAddress: true,
+	}
+}
+
+// recorder notes the change sets sent to the wrapped provider, like the dry
+// run provider logs them.
+type recorder struct {
+	provider.DNSProvider
+	changes []string
+}
+
+func (r *recorder) ModifyDNS(ctx context.Context, dcs *provider.DNSChangeSet) error {
+	d := dcs.Domain()
+	r.changes = append(r.changes, strings.Join([]string{dcs.Action(), d.Type(), d.Name(), d.Value()}, " "))
+	return r.DNSProvider.ModifyDNS(ctx, dcs)
+}
+
+func change(t *testing.T, target, d, action, owner string) *provider.DNSChangeSet {
+	dcs, err := provider.CreateChangeSet(target, d, action)
+	if err != nil {
+		t.Fatalf("Error from CreateChangeSet: %s", err)
+	}
+	return dcs.WithOwner(owner)
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, policy := range []string{"takeover", "skip", "error"} {
+		if p, err := ParseConflictPolicy(policy); err != nil || string(p) != policy {
+			t.Errorf("Policy: %s, Error: %v", p, err)
+		}
+	}
+	if _, err := ParseConflictPolicy("yolo"); err == nil {
+		t.Error("Expected unknown policy error")
+	}
+}
+
+func TestOwnedProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   ConflictPolicy
+		change   func(*testing.T) *provider.DNSChangeSet
+		err      error
+		expected map[string]string
+		owned    bool
+	}{
+		{
+			name:   "new record is created and claimed",
+			policy: PolicySkip,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "192.168.1.5", "new.example.com", "add", "service/default/new")
+			},
+			expected: map[string]string{"manual.example.com": "192.168.1.1", "new.example.com": "192.168.1.5"},
+			owned:    true,
+		},
+		{
+			name:   "takeover replaces manual record",
+			policy: PolicyTakeover,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "192.168.1.5", "manual.example.com", "add", "service/default/manual")
+			},
+			expected: map[string]string{"manual.example.com": "192.168.1.5"},
+			owned:    true,
+		},
+		{
+			name:   "skip keeps manual record",
+			policy: PolicySkip,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "192.168.1.5", "manual.example.com", "add", "service/default/manual")
+			},
+			expected: map[string]string{"manual.example.com": "192.168.1.1"},
+		},
+		{
+			name:   "error keeps manual record",
+			policy: PolicyError,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "192.168.1.5", "manual.example.com", "add", "service/default/manual")
+			},
+			err:      ErrNotOwned,
+			expected: map[string]string{"manual.example.com": "192.168.1.1"},
+		},
+		{
+			name:   "skip does not adopt identical manual record",
+			policy: PolicySkip,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "192.168.1.1", "manual.example.com", "add", "service/default/manual")
+			},
+			expected: map[string]string{"manual.example.com": "192.168.1.1"},
+		},
+		{
+			name:   "takeover adopts identical manual record",
+			policy: PolicyTakeover,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "192.168.1.1", "manual.example.com", "add", "service/default/manual")
+			},
+			expected: map[string]string{"manual.example.com": "192.168.1.1"},
+			owned:    true,
+		},
+		{
+			name:   "skip publishes IPv6 next to manual IPv4 record",
+			policy: PolicySkip,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "fd00::5", "manual.example.com", "add", "service/default/manual")
+			},
+			expected: map[string]string{"manual.example.com": "192.168.1.1"},
+			owned:    true,
+		},
+		{
+			name:   "skip never deletes manual record",
+			policy: PolicySkip,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "192.168.1.1", "manual.example.com", "delete", "service/default/manual")
+			},
+			expected: map[string]string{"manual.example.com": "192.168.1.1"},
+		},
+		{
+			name:   "error refuses to delete manual record",
+			policy: PolicyError,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "192.168.1.1", "manual.example.com", "delete", "service/default/manual")
+			},
+			err:      ErrNotOwned,
+			expected: map[string]string{"manual.example.com": "192.168.1.1"},
+		},
+		{
+			name:   "takeover deletes manual record",
+			policy: PolicyTakeover,
+			change: func(t *testing.T) *provider.DNSChangeSet {
+				return change(t, "192.168.1.1", "manual.example.com", "delete", "service/default/manual")
+			},
+			expected: map[string]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeDNS := &fakeProvider{
+				records: map[string]string{"manual.example.com": "192.168.1.1"},
+				aaaa:    map[string]string{},
+			}
+			reg, _ := New(context.Background(), MemoryStore{})
+			owned := NewOwnedProvider(fakeDNS, reg, tc.policy)
+
+			dcs := tc.change(t)
+			err := owned.ModifyDNS(context.Background(), dcs)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("Error: %v, Expected: %v.", err, tc.err)
+			}
+			if !reflect.DeepEqual(tc.expected, fakeDNS.records) {
+				t.Errorf("Records: %v, Expected: %v.", fakeDNS.records, tc.expected)
+			}
+			if reg.Owns(dcs.Domain()) != tc.owned {
+				t.Errorf("Owned: %t, Expected: %t.", reg.Owns(dcs.Domain()), tc.owned)
+			}
+		})
+	}
+}
+
+func TestOwnedProviderLifecycle(t *testing.T) {
+	fakeDNS := &fakeProvider{
+		records: map[string]string{},
+		aaaa:    map[string]string{},
+	}
+	reg, _ := New(context.Background(), MemoryStore{})
+	owned := NewOwnedProvider(fakeDNS, reg, PolicyError)
+
+	// Test case 1: Create, then change the IP of an owned record
+	if err := owned.ModifyDNS(context.Background(), change(t, "192.168.1.5", "echo.example.com", "add", "service/default/echo")); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	if err := owned.ModifyDNS(context.Background(), change(t, "192.168.1.6", "echo.example.com", "add", "service/default/echo")); err != nil {
+		t.Errorf("Error from change: %s", err)
+	}
+	if reg.Owns(provider.NewDomain("192.168.1.5", "echo.example.com")) {
+		t.Error("Replaced record still owned")
+	}
+
+	// Test case 2: Another object wants the record, deleting the first keeps it
+	if err := owned.ModifyDNS(context.Background(), change(t, "192.168.1.6", "echo.example.com", "add", "service/other/echo")); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	if err := owned.ModifyDNS(context.Background(), change(t, "192.168.1.6", "echo.example.com", "delete", "service/default/echo")); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+	if fakeDNS.records["echo.example.com"] != "192.168.1.6" {
+		t.Errorf("Records: %v", fakeDNS.records)
+	}
+
+	// Test case 3: The owner deletes it
+	if err := owned.ModifyDNS(context.Background(), change(t, "192.168.1.6", "echo.example.com", "delete", "service/other/echo")); err != nil {
+		t.Errorf("Error from delete: %s", err)
+	}
+	if len(fakeDNS.records) != 0 || reg.Owns(provider.NewDomain("192.168.1.6", "echo.example.com")) {
+		t.Errorf("Records: %v, Registry: %v", fakeDNS.records, reg.records)
+	}
+
+	// Test case 4: Dual stack, the IPv6 address does not replace the IPv4 one
+	if err := owned.ModifyDNS(context.Background(), change(t, "192.168.1.5", "echo.example.com", "add", "service/default/echo")); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	if err := owned.ModifyDNS(context.Background(), change(t, "fd00::5", "echo.example.com", "add", "service/default/echo")); err != nil {
+		t.Errorf("Error from add: %s", err)
+	}
+	if fakeDNS.records["echo.example.com"] != "192.168.1.5" || fakeDNS.aaaa["echo.example.com"] != "fd00::5" {
+		t.Errorf("Records: %v, AAAA: %v", fakeDNS.records, fakeDNS.aaaa)
+	}
+	if !reg.Owns(provider.NewDomain("192.168.1.5", "echo.example.com")) || !reg.Owns(provider.NewDomain("fd00::5", "echo.example.com")) {
+		t.Errorf("Registry: %v", reg.records)
+	}
+}
+
+func TestOwnedProviderDryRun(t *testing.T) {
+	manual := func() *fakeProvider {
+		return &fakeProvider{
+			records: map[string]string{"manual.example.com": "192.168.1.1"},
+			aaaa:    map[string]string{},
+		}
+	}
+
+	real := &recorder{DNSProvider: manual()}
+	realReg, _ := New(context.Background(), MemoryStore{})
+	realOwned := NewOwnedProvider(real, realReg, PolicyTakeover)
+
+	dryDNS := manual()
+	dryReg, _ := New(context.Background(), ReadOnlyStore{Store: MemoryStore{}})
+	dryOwned := NewOwnedProvider(provider.NewDryRunProvider(dryDNS), dryReg, PolicyTakeover)
+
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	// Test case 1: Adopt, update twice and delete a name, the dry run logs what the real run sends
+	for _, dcs := range []*provider.DNSChangeSet{
+		change(t, "192.168.1.1", "manual.example.com", "add", "service/default/manual"),
+		change(t, "192.168.1.2", "manual.example.com", "add", "service/default/manual"),
+		change(t, "192.168.1.3", "manual.example.com", "add", "service/default/manual"),
+		change(t, "192.168.1.3", "manual.example.com", "delete", "service/default/manual"),
+	} {
+		if err := realOwned.ModifyDNS(context.Background(), dcs); err != nil {
+			t.Errorf("Error from real run: %s", err)
+		}
+		if err := dryOwned.ModifyDNS(context.Background(), dcs); err != nil {
+			t.Errorf("Error from dry run: %s", err)
+		}
+	}
+
+	var logged []string
+	for _, e := range hook.AllEntries() {
+		if e.Message != "Dry run change set" || e.Data["implicit"] == true {
+			continue
+		}
+		logged = append(logged, strings.Join([]string{
+			e.Data["action"].(string),
+			e.Data["type"].(string),
+			e.Data["domain"].(string),
+			e.Data["target"].(string),
+		}, " "))
+	}
+	if !reflect.DeepEqual(real.changes, logged) {
+		t.Errorf("Logged: %v, Expected: %v.", logged, real.changes)
+	}
+
+	// Test case 2: Both registries end up the same, the provider is untouched
+	if !reflect.DeepEqual(realReg.records, dryReg.records) {
+		t.Errorf("Registry: %v, Expected: %v.", dryReg.records, realReg.records)
+	}
+	if !reflect.DeepEqual(manual().records, dryDNS.records) {
+		t.Errorf("Records: %v", dryDNS.records)
+	}
+}
@@ -0,0 +1,168 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/tolson-vkn/pifrost/provider"
+)
+
+// Entry is a single owned record as persisted by a Store.
+type Entry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	// Kubernetes object which asked for the record, e.g. service/default/echo.
+	Owner string `json:"owner"`
+}
+
+// Store persists registry entries between pifrost restarts.
+type Store interface {
+	Load(ctx context.Context) ([]Entry, error)
+	Save(ctx context.Context, entries []Entry) error
+}
+
+// Registry remembers which records pifrost created and for which object.
+// Records missing from the registry were made by someone else.
+type Registry struct {
+	mu      sync.Mutex
+	store   Store
+	records map[provider.Domain]string
+}
+
+// New loads the registry from store.
+func New(ctx context.Context, store Store) (*Registry, error) {
+	entries, err := store.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load registry: %w", err)
+	}
+
+	r := &Registry{
+		store: store,
+	}
+	r.load(entries)
+
+	return r, nil
+}
+
+// Reload replaces what the registry holds with the store contents, e.g. after
+// another replica was writing to the store.
+func (r *Registry) Reload(ctx context.Context) error {
+	entries, err := r.store.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not load registry: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.load(entries)
+
+	return nil
+}
+
+// Caller holds the lock, or is the constructor.
+func (r *Registry) load(entries []Entry) {
+	r.records = map[provider.Domain]string{}
+	for _, e := range entries {
+		r.records[entryDomain(e)] = e.Owner
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"records": len(r.records),
+	}).Info("Loaded record registry")
+}
+
+// Owner returns the object owning d, false if pifrost does not own it.
+func (r *Registry) Owner(d provider.Domain) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	owner, ok := r.records[d]
+	return owner, ok
+}
+
+// Owns reports whether pifrost created d.
+func (r *Registry) Owns(d provider.Domain) bool {
+	_, ok := r.Owner(d)
+	return ok
+}
+
+// OwnedBy lists the records owner created, sorted by name.
+func (r *Registry) OwnedBy(owner string) []provider.Domain {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var records []provider.Domain
+	for d, o := range r.records {
+		if o == owner {
+			records = append(records, d)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name() < records[j].Name()
+	})
+
+	return records
+}
+
+// Claim records that owner created d.
+func (r *Registry) Claim(ctx context.Context, d provider.Domain, owner string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if current, ok := r.records[d]; ok && current == owner {
+		return nil
+	}
+	r.records[d] = owner
+
+	return r.save(ctx)
+}
+
+// Release forgets d, after it was removed from the provider.
+func (r *Registry) Release(ctx context.Context, d provider.Domain) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.records[d]; !ok {
+		return nil
+	}
+	delete(r.records, d)
+
+	return r.save(ctx)
+}
+
+// Caller holds the lock.
+func (r *Registry) save(ctx context.Context) error {
+	entries := make([]Entry, 0, len(r.records))
+	for d, owner := range r.records {
+		entries = append(entries, Entry{
+			Name:  d.Name(),
+			Type:  d.Type(),
+			Value: d.Value(),
+			Owner: owner,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Value < entries[j].Value
+	})
+
+	if err := r.store.Save(ctx, entries); err != nil {
+		return fmt.Errorf("Could not save registry: %w", err)
+	}
+
+	return nil
+}
+
+func entryDomain(e Entry) provider.Domain {
+	if e.Type == provider.RecordCNAME {
+		return provider.NewCNAME(e.Name, e.Value)
+	}
+	return provider.NewDomain(e.Value, e.Name)
+}
@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	fake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tolson-vkn/pifrost/provider"
+)
+
+func testStore(t *testing.T, store Store) {
+	a := provider.NewDomain("192.168.1.2", "a.example.com")
+	cname := provider.NewCNAME("b.example.com", "a.example.com")
+
+	// Test case 1: Empty store
+	reg, err := New(context.Background(), store)
+	if err != nil {
+		t.Fatalf("Error from New: %s", err)
+	}
+	if reg.Owns(a) {
+		t.Error("Empty registry owns a record")
+	}
+
+	// Test case 2: Claims survive a reload
+	if err := reg.Claim(context.Background(), a, "service/default/a"); err != nil {
+		t.Errorf("Error from Claim: %s", err)
+	}
+	if err := reg.Claim(context.Background(), cname, "ingress/default/b"); err != nil {
+		t.Errorf("Error from Claim: %s", err)
+	}
+
+	reg, err = New(context.Background(), store)
+	if err != nil {
+		t.Fatalf("Error from New: %s", err)
+	}
+	if owner, ok := reg.Owner(a); !ok || owner != "service/default/a" {
+		t.Errorf("Owner: %s, Expected: service/default/a.", owner)
+	}
+	if owner, ok := reg.Owner(cname); !ok || owner != "ingress/default/b" {
+		t.Errorf("Owner: %s, Expected: ingress/default/b.", owner)
+	}
+
+	// Test case 3: Same name, other value is not owned
+	if reg.Owns(provider.NewDomain("192.168.1.3", "a.example.com")) {
+		t.Error("Registry owns record with another IP")
+	}
+
+	// Test case 4: Released records are gone after a reload
+	if err := reg.Release(context.Background(), a); err != nil {
+		t.Errorf("Error from Release: %s", err)
+	}
+	reg, _ = New(context.Background(), store)
+	if reg.Owns(a) || !reg.Owns(cname) {
+		t.Errorf("Registry: %v", reg.records)
+	}
+
+	// Test case 5: Reload sees what another replica saved
+	other, _ := New(context.Background(), store)
+	if err := other.Claim(context.Background(), a, "service/default/a"); err != nil {
+		t.Errorf("Error from Claim: %s", err)
+	}
+	if reg.Owns(a) {
+		t.Error("Registry owns record before reload")
+	}
+	if err := reg.Reload(context.Background()); err != nil {
+		t.Errorf("Error from Reload: %s", err)
+	}
+	if !reg.Owns(a) || !reg.Owns(cname) {
+		t.Errorf("Registry: %v", reg.records)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	testStore(t, NewFileStore(filepath.Join(t.TempDir(), "registry.json")))
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "registry.json"))
+	a := provider.NewDomain("192.168.1.2", "a.example.com")
+
+	reg, _ := New(context.Background(), store)
+	reg.Claim(context.Background(), a, "service/default/a")
+
+	// Test case 1: Loads what the store holds, claims stay in memory
+	readOnly, err := New(context.Background(), ReadOnlyStore{Store: store})
+	if err != nil || !readOnly.Owns(a) {
+		t.Errorf("Read only registry does not own a, error: %v", err)
+	}
+
+	b := provider.NewDomain("192.168.1.3", "b.example.com")
+	if err := readOnly.Claim(context.Background(), b, "service/default/b"); err != nil || !readOnly.Owns(b) {
+		t.Errorf("Read only registry does not own b, error: %v", err)
+	}
+
+	// Test case 2: Nothing was saved
+	reg, _ = New(context.Background(), store)
+	if reg.Owns(b) {
+		t.Error("Read only registry saved b")
+	}
+}
+
+func TestConfigMapStore(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset()
+	testStore(t, NewConfigMapStore(fakeClient, "pifrost", "pifrost-registry"))
+
+	// Saved entries are kept sorted, so the configmap diffs nicely.
+	store := NewConfigMapStore(fakeClient, "pifrost", "pifrost-registry")
+	entries, err := store.Load(context.Background())
+	if err != nil {
+		t.Errorf("Error from Load: %s", err)
+	}
+	expected := []Entry{
+		{
+			Name:  "a.example.com",
+			Type:  provider.RecordA,
+			Value: "192.168.1.2",
+			Owner: "service/default/a",
+		},
+		{
+			Name:  "b.example.com",
+			Type:  provider.RecordCNAME,
+			Value: "a.example.com",
+			Owner: "ingress/default/b",
+		},
+	}
+	if !reflect.DeepEqual(expected, entries) {
+		t.Errorf("Entries: %v, Expected: %v.", entries, expected)
+	}
+}
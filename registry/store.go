@@ -0,0 +1,174 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	StoreMemory    = "memory"
+	StoreConfigMap = "configmap"
+	StoreFile      = "file"
+
+	// ConfigMap data key holding the entries.
+	configMapKey = "records.json"
+)
+
+// MemoryStore keeps nothing, ownership is forgotten when pifrost stops.
+type MemoryStore struct{}
+
+func (MemoryStore) Load(ctx context.Context) ([]Entry, error) {
+	return nil, nil
+}
+
+func (MemoryStore) Save(ctx context.Context, entries []Entry) error {
+	return nil
+}
+
+// ReadOnlyStore loads from a store but never saves to it, for dry runs.
+// Claims are still remembered in memory until pifrost stops.
+type ReadOnlyStore struct {
+	Store
+}
+
+func (ReadOnlyStore) Save(ctx context.Context, entries []Entry) error {
+	return nil
+}
+
+// FileStore keeps the registry in a local JSON file.
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{
+		path: path,
+	}
+}
+
+func (fs *FileStore) Load(ctx context.Context) ([]Entry, error) {
+	data, err := os.ReadFile(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("Could not parse registry file [%s]: %w", fs.path, err)
+	}
+
+	return entries, nil
+}
+
+// Save writes a temporary file and renames it, so a crash never leaves a
+// half written registry behind.
+func (fs *FileStore) Save(ctx context.Context, entries []Entry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+// ConfigMapStore keeps the registry in a ConfigMap, which survives the pod
+// being rescheduled.
+type ConfigMapStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func NewConfigMapStore(client kubernetes.Interface, namespace, name string) *ConfigMapStore {
+	return &ConfigMapStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func (cs *ConfigMapStore) Load(ctx context.Context) ([]Entry, error) {
+	cm, err := cs.client.CoreV1().ConfigMaps(cs.namespace).Get(ctx, cs.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := cm.Data[configMapKey]
+	if !ok {
+		return nil, nil
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal([]byte(data), &entries); err != nil {
+		return nil, fmt.Errorf("Could not parse registry configmap [%s/%s]: %w", cs.namespace, cs.name, err)
+	}
+
+	return entries, nil
+}
+
+func (cs *ConfigMapStore) Save(ctx context.Context, entries []Entry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	configMaps := cs.client.CoreV1().ConfigMaps(cs.namespace)
+
+	cm, err := configMaps.Get(ctx, cs.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      cs.name,
+				Namespace: cs.namespace,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "pifrost",
+				},
+			},
+			Data: map[string]string{
+				configMapKey: string(data),
+			},
+		}
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[configMapKey] = string(data)
+	_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+
+	return err
+}
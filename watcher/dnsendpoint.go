@@ -0,0 +1,280 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+const dnsEndpointGroup = "externaldns.k8s.io"
+
+// The external-dns custom resource listing records directly, read as an
+// unstructured object through the dynamic client.
+const KindDNSEndpoint = "DNSEndpoint"
+
+// Condition of a DNSEndpoint status, false while some of its records are not
+// published.
+const dnsEndpointConditionPublished = "Published"
+
+// A record external-dns would create from a DNSEndpoint.
+// {"dnsName":"foo.example.xyz","recordType":"A","targets":["10.1.1.1"]}
+type dnsEndpointRecord struct {
+	dnsName    string
+	recordType string
+	targets    []string
+}
+
+// The DNSEndpoint resource the cluster serves, in the preferred version of
+// the group. Not ok when the CRD is not installed.
+func dnsEndpointResource(client discovery.DiscoveryInterface) (schema.GroupVersionResource, bool, error) {
+	resources, err := groupResources(client, dnsEndpointGroup, []string{KindDNSEndpoint})
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	gvr, ok := resources[KindDNSEndpoint]
+	return gvr, ok, nil
+}
+
+func watcherDNSEndpoint(ctx context.Context, dynamicClient dynamic.Interface, gvr schema.GroupVersionResource, dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig, ready <-chan struct{}, drain time.Duration, w *sync.WaitGroup) {
+	defer w.Done()
+
+	logrus.Info("Starting DNSEndpoint watcher...")
+
+	var store cache.Store
+	worker := newQueueWorker("dnsendpoint", defaultRateLimiter(), func(ctx context.Context, key string) error {
+		return syncDNSEndpoint(ctx, key, store, dynamicClient.Resource(gvr), dnsProvider, reg, config)
+	})
+
+	store, controller := cache.NewInformer(
+		dynamicListWatch(ctx, dynamicClient, gvr),
+		&unstructured.Unstructured{},
+		0,
+		worker.handlers(),
+	)
+
+	runWorker(ctx, worker, controller, ready, drain)
+}
+
+// Make the records of the DNSEndpoint keyed by namespace/name match the
+// object in store, then record the generation handled in its status like
+// external-dns does. Endpoints and records the provider can not hold, or the
+// conflict policy skips, are listed in the Published condition.
+func syncDNSEndpoint(ctx context.Context, key string, store cache.Store, client dynamic.NamespaceableResourceInterface, dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig) error {
+	obj, exists, err := store.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	var endpoint *unstructured.Unstructured
+	var desired []provider.Domain
+	var skipped []string
+	if exists {
+		var ok bool
+		endpoint, ok = obj.(*unstructured.Unstructured)
+		if !ok {
+			return permanent(fmt.Errorf("cast failed %T to %T", obj, endpoint))
+		}
+
+		desired, skipped, err = desiredDNSEndpointRecords(endpoint, dnsProvider.Capabilities())
+		if err != nil {
+			return permanent(err)
+		}
+	}
+
+	unowned, err := syncRecords(ctx, dnsProvider, reg, dnsEndpointOwner(key), desired)
+	if err != nil || !exists || config.DryRun {
+		return err
+	}
+	for _, d := range unowned {
+		skipped = append(skipped, fmt.Sprintf("%s %s %s: touches a record pifrost does not own", d.Type(), d.Name(), d.Value()))
+	}
+
+	return updateDNSEndpointStatus(ctx, client, endpoint, skipped)
+}
+
+// Set status.observedGeneration of endpoint to its generation and the
+// Published condition to skipped, unless they are already. An object deleted
+// meanwhile needs no status.
+func updateDNSEndpointStatus(ctx context.Context, client dynamic.NamespaceableResourceInterface, endpoint *unstructured.Unstructured, skipped []string) error {
+	observed, _, _ := unstructured.NestedInt64(endpoint.Object, "status", "observedGeneration")
+	current, _, _ := unstructured.NestedSlice(endpoint.Object, "status", "conditions")
+	conditions := publishedConditions(current, endpoint.GetGeneration(), skipped)
+	if observed == endpoint.GetGeneration() && reflect.DeepEqual(current, conditions) {
+		return nil
+	}
+
+	updated := endpoint.DeepCopy()
+	if err := unstructured.SetNestedField(updated.Object, endpoint.GetGeneration(), "status", "observedGeneration"); err != nil {
+		return permanent(err)
+	}
+	if err := unstructured.SetNestedSlice(updated.Object, conditions, "status", "conditions"); err != nil {
+		return permanent(err)
+	}
+
+	_, err := client.Namespace(endpoint.GetNamespace()).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Could not update DNSEndpoint status: %w", err)
+	}
+	return nil
+}
+
+// Records a DNSEndpoint wants, and what of it is not published. Endpoints of
+// record types capabilities lack, endpoints pifrost can not express and
+// records the provider can not hold next to those of earlier endpoints are
+// skipped.
+func desiredDNSEndpointRecords(endpoint *unstructured.Unstructured, capabilities provider.Capabilities) ([]provider.Domain, []string, error) {
+	endpoints, _, err := unstructured.NestedSlice(endpoint.Object, "spec", "endpoints")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid DNSEndpoint spec: %w", err)
+	}
+
+	fields := logrus.Fields{
+		"dnsendpoint": endpoint.GetNamespace() + "/" + endpoint.GetName(),
+	}
+
+	var desired []provider.Domain
+	var skipped []string
+	for _, item := range endpoints {
+		record, ok := parseDNSEndpointRecord(item)
+		if !ok {
+			logrus.WithFields(fields).Warn("Skipping invalid endpoint")
+			skipped = append(skipped, "invalid endpoint")
+			continue
+		}
+		if !capabilities.Supports(record.recordType) {
+			logrus.WithFields(fields).Debugf("Skipping %s record [%s], %s does not support it", record.recordType, record.dnsName, capabilities.Name)
+			skipped = append(skipped, fmt.Sprintf("%s %s: not supported by %s", record.recordType, record.dnsName, capabilities.Name))
+			continue
+		}
+
+		domains, err := record.domains()
+		if err != nil {
+			logrus.WithFields(fields).Warnf("Skipping %s record [%s]: %s", record.recordType, record.dnsName, err)
+			skipped = append(skipped, fmt.Sprintf("%s %s: %s", record.recordType, record.dnsName, err))
+			continue
+		}
+		desired = append(desired, domains...)
+	}
+
+	desired, dropped := fit(capabilities, desired)
+	for _, d := range dropped {
+		logrus.WithFields(fields).Warnf("Skipping %s record [%s] to [%s], %s can not hold it next to the other records of the name", d.Type(), d.Name(), d.Value(), capabilities.Name)
+		skipped = append(skipped, fmt.Sprintf("%s %s %s: %s can not hold it next to the other records of the name", d.Type(), d.Name(), d.Value(), capabilities.Name))
+	}
+
+	return desired, skipped, nil
+}
+
+// The status conditions of a DNSEndpoint at generation with skipped not
+// published, the Published condition replaced in current. Its transition
+// time only moves when its status does.
+func publishedConditions(current []interface{}, generation int64, skipped []string) []interface{} {
+	condition := map[string]interface{}{
+		"type":               dnsEndpointConditionPublished,
+		"status":             string(metav1.ConditionTrue),
+		"reason":             "RecordsPublished",
+		"message":            "Every record is published",
+		"observedGeneration": generation,
+		"lastTransitionTime": metav1.Now().UTC().Format(time.RFC3339),
+	}
+	if len(skipped) != 0 {
+		condition["status"] = string(metav1.ConditionFalse)
+		condition["reason"] = "RecordsSkipped"
+		condition["message"] = "Not published: " + strings.Join(skipped, "; ")
+	}
+
+	var conditions []interface{}
+	for _, c := range current {
+		existing, ok := c.(map[string]interface{})
+		if !ok || existing["type"] != dnsEndpointConditionPublished {
+			conditions = append(conditions, c)
+			continue
+		}
+		if existing["status"] == condition["status"] && existing["lastTransitionTime"] != nil {
+			condition["lastTransitionTime"] = existing["lastTransitionTime"]
+		}
+	}
+	return append(conditions, condition)
+}
+
+// An endpoint of spec.endpoints, external-dns names end in a dot.
+func parseDNSEndpointRecord(item interface{}) (dnsEndpointRecord, bool) {
+	fields, ok := item.(map[string]interface{})
+	if !ok {
+		return dnsEndpointRecord{}, false
+	}
+
+	dnsName, _, _ := unstructured.NestedString(fields, "dnsName")
+	recordType, _, _ := unstructured.NestedString(fields, "recordType")
+	targets, _, _ := unstructured.NestedStringSlice(fields, "targets")
+	if len(dnsName) == 0 || len(recordType) == 0 || len(targets) == 0 {
+		return dnsEndpointRecord{}, false
+	}
+
+	return dnsEndpointRecord{
+		dnsName:    strings.TrimSuffix(dnsName, "."),
+		recordType: strings.ToUpper(recordType),
+		targets:    targets,
+	}, true
+}
+
+// The records of an endpoint. A and AAAA endpoints get a record per target
+// of the family, other targets are ignored. CNAME endpoints must have a
+// single target.
+func (r dnsEndpointRecord) domains() ([]provider.Domain, error) {
+	var targets []string
+	switch r.recordType {
+	case provider.RecordA, provider.RecordAAAA:
+		for _, t := range r.targets {
+			ip := net.ParseIP(t)
+			if ip != nil && (ip.To4() != nil) == (r.recordType == provider.RecordA) {
+				targets = append(targets, t)
+			}
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no %s target in %v", r.recordType, r.targets)
+		}
+	case provider.RecordCNAME:
+		if len(r.targets) != 1 {
+			return nil, errors.New("a CNAME needs a single target")
+		}
+		targets = []string{strings.TrimSuffix(r.targets[0], ".")}
+	default:
+		return nil, provider.ErrUnsupportedRecord
+	}
+
+	var domains []provider.Domain
+	for _, target := range unique(targets) {
+		changeSet, err := provider.CreateChangeSet(target, r.dnsName, "add")
+		if err != nil {
+			return nil, err
+		}
+		d := changeSet.Domain()
+		if d.Type() != r.recordType {
+			return nil, fmt.Errorf("target [%s] makes a %s record", target, d.Type())
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
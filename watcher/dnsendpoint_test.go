@@ -0,0 +1,242 @@
+package watcher
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	fake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+var dnsEndpoints = schema.GroupVersionResource{Group: dnsEndpointGroup, Version: "v1alpha1", Resource: "dnsendpoints"}
+
+// A DNSEndpoint holding endpoints, each a dnsName, recordType and targets.
+func exampleDNSEndpoint(endpoints ...[]interface{}) *unstructured.Unstructured {
+	var items []interface{}
+	for _, e := range endpoints {
+		items = append(items, map[string]interface{}{
+			"dnsName":    e[0],
+			"recordType": e[1],
+			"targets":    e[2:],
+		})
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": dnsEndpointGroup + "/v1alpha1",
+		"kind":       KindDNSEndpoint,
+		"metadata": map[string]interface{}{
+			"name":       "example-dnsendpoint",
+			"namespace":  "default",
+			"generation": int64(2),
+		},
+		"spec": map[string]interface{}{
+			"endpoints": items,
+		},
+	}}
+}
+
+func TestDesiredDNSEndpointRecords(t *testing.T) {
+	capabilities := provider.Capabilities{Name: "fake", RecordTypes: []string{provider.RecordA, provider.RecordAAAA, provider.RecordCNAME}}
+
+	// Test case 1: A, AAAA and CNAME endpoints, every target published, trailing dots dropped
+	endpoint := exampleDNSEndpoint(
+		[]interface{}{"a.example.com.", "A", "192.168.5.1", "192.168.5.2"},
+		[]interface{}{"a.example.com", "AAAA", "fd00::1"},
+		[]interface{}{"www.example.com", "CNAME", "a.example.com."},
+	)
+	records, skipped, err := desiredDNSEndpointRecords(endpoint, capabilities)
+	expected := []provider.Domain{
+		provider.NewDomain("192.168.5.1", "a.example.com"),
+		provider.NewDomain("192.168.5.2", "a.example.com"),
+		provider.NewDomain("fd00::1", "a.example.com"),
+		provider.NewCNAME("www.example.com", "a.example.com"),
+	}
+	if err != nil || len(skipped) != 0 || !reflect.DeepEqual(records, expected) {
+		t.Errorf("Records: %v, Expected: %v. Skipped: %v, Error: %v", records, expected, skipped, err)
+	}
+
+	// Test case 2: Types the provider lacks and endpoints pifrost can not express are skipped
+	endpoint = exampleDNSEndpoint(
+		[]interface{}{"b.example.com", "AAAA", "fd00::2"},
+		[]interface{}{"b.example.com", "TXT", "heritage=external-dns"},
+		[]interface{}{"c.example.com", "A", "lb.example.com"},
+		[]interface{}{"d.example.com", "CNAME", "a.example.com", "b.example.com"},
+		[]interface{}{"e.example.com", "A", "192.168.5.5"},
+	)
+	records, skipped, err = desiredDNSEndpointRecords(endpoint, provider.Capabilities{Name: "v4", RecordTypes: []string{provider.RecordA, provider.RecordCNAME}})
+	if err != nil || len(skipped) != 4 || !reflect.DeepEqual(records, []provider.Domain{provider.NewDomain("192.168.5.5", "e.example.com")}) {
+		t.Errorf("Records: %v, Skipped: %v, Error: %v", records, skipped, err)
+	}
+
+	// Test case 3: A CNAME can not join the addresses of earlier endpoints
+	endpoint = exampleDNSEndpoint(
+		[]interface{}{"f.example.com", "A", "192.168.5.6"},
+		[]interface{}{"f.example.com", "CNAME", "a.example.com"},
+		[]interface{}{"f.example.com", "A", "192.168.5.7"},
+	)
+	records, skipped, err = desiredDNSEndpointRecords(endpoint, capabilities)
+	expected = []provider.Domain{provider.NewDomain("192.168.5.6", "f.example.com"), provider.NewDomain("192.168.5.7", "f.example.com")}
+	if err != nil || len(skipped) != 1 || !reflect.DeepEqual(records, expected) {
+		t.Errorf("Records: %v, Skipped: %v, Error: %v", records, skipped, err)
+	}
+
+	// Test case 4: A provider keeping one address per family takes the first target
+	endpoint = exampleDNSEndpoint(
+		[]interface{}{"g.example.com", "A", "192.168.5.8", "192.168.5.9"},
+	)
+	capabilities.SingleAddress = true
+	records, skipped, err = desiredDNSEndpointRecords(endpoint, capabilities)
+	if err != nil || len(skipped) != 1 || !reflect.DeepEqual(records, []provider.Domain{provider.NewDomain("192.168.5.8", "g.example.com")}) {
+		t.Errorf("Records: %v, Skipped: %v, Error: %v", records, skipped, err)
+	}
+}
+
+func TestSyncDNSEndpoint(t *testing.T) {
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		dnsEndpoints: "DNSEndpointList",
+	})
+	key := "default/example-dnsendpoint"
+
+	sync := func(config SourceConfig) {
+		t.Helper()
+		if err := syncDNSEndpoint(context.Background(), key, store, dynamicClient.Resource(dnsEndpoints), ownedDNS, reg, config); err != nil {
+			t.Errorf("DNSEndpoint sync test error: %s", err)
+		}
+	}
+	status := func() *unstructured.Unstructured {
+		t.Helper()
+		obj, err := dynamicClient.Resource(dnsEndpoints).Namespace("default").Get(context.Background(), "example-dnsendpoint", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Error getting DNSEndpoint: %s", err)
+		}
+		return obj
+	}
+	observedGeneration := func() int64 {
+		t.Helper()
+		generation, _, _ := unstructured.NestedInt64(status().Object, "status", "observedGeneration")
+		return generation
+	}
+	published := func() string {
+		t.Helper()
+		conditions, _, _ := unstructured.NestedSlice(status().Object, "status", "conditions")
+		for _, c := range conditions {
+			if condition, ok := c.(map[string]interface{}); ok && condition["type"] == dnsEndpointConditionPublished {
+				return condition["status"].(string)
+			}
+		}
+		return ""
+	}
+
+	endpoint := exampleDNSEndpoint([]interface{}{"a.example.com", "A", "192.168.5.1"})
+	dynamicClient.Tracker().Create(dnsEndpoints, endpoint, "default")
+	store.Add(endpoint)
+
+	// Test case 1: A dry run writes no status
+	sync(SourceConfig{DryRun: true})
+	if generation := observedGeneration(); generation != 0 {
+		t.Errorf("Observed generation: %d, Expected: 0.", generation)
+	}
+
+	// Test case 2: Records are written, then the generation observed
+	sync(SourceConfig{})
+	if fakeDNS.records["a.example.com"] != "192.168.5.1" {
+		t.Errorf("Expected a.example.com record, got: %v", fakeDNS.records)
+	}
+	if owner, _ := reg.Owner(provider.NewDomain("192.168.5.1", "a.example.com")); owner != "dnsendpoint/default/example-dnsendpoint" {
+		t.Errorf("Owner: %s", owner)
+	}
+	if generation := observedGeneration(); generation != 2 {
+		t.Errorf("Observed generation: %d, Expected: 2.", generation)
+	}
+	if condition := published(); condition != "True" {
+		t.Errorf("Published: %s, Expected: True.", condition)
+	}
+
+	// Test case 3: Addresses the provider can not hold are reported in status
+	endpoint = exampleDNSEndpoint([]interface{}{"a.example.com", "A", "192.168.5.1", "192.168.5.2"})
+	endpoint.SetGeneration(3)
+	store.Update(endpoint)
+	sync(SourceConfig{})
+	if fakeDNS.records["a.example.com"] != "192.168.5.1" {
+		t.Errorf("Expected a.example.com record, got: %v", fakeDNS.records)
+	}
+	if generation, condition := observedGeneration(), published(); generation != 3 || condition != "False" {
+		t.Errorf("Observed generation: %d, Published: %s, Expected: 3 and False.", generation, condition)
+	}
+
+	// Test case 4: A record the conflict policy skips is reported in status
+	skipDNS, skipReg, skipOwned := newOwnedFakeProvider(registry.PolicySkip)
+	skipDNS.records["a.example.com"] = "10.0.0.1"
+	endpoint = exampleDNSEndpoint([]interface{}{"a.example.com", "A", "192.168.5.1"})
+	endpoint.SetGeneration(4)
+	store.Update(endpoint)
+	if err := syncDNSEndpoint(context.Background(), key, store, dynamicClient.Resource(dnsEndpoints), skipOwned, skipReg, SourceConfig{}); err != nil {
+		t.Errorf("DNSEndpoint sync test error: %s", err)
+	}
+	if skipDNS.records["a.example.com"] != "10.0.0.1" {
+		t.Errorf("Expected unowned record kept, got: %v", skipDNS.records)
+	}
+	if generation, condition := observedGeneration(), published(); generation != 4 || condition != "False" {
+		t.Errorf("Observed generation: %d, Published: %s, Expected: 4 and False.", generation, condition)
+	}
+
+	// Test case 5: Deleted
+	store.Delete(endpoint)
+	sync(SourceConfig{})
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
+	}
+}
+
+func TestReconcileDNSEndpoints(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		dnsEndpoints: "DNSEndpointList",
+	})
+	dynamicClient.Tracker().Create(dnsEndpoints, exampleDNSEndpoint([]interface{}{"a.example.com", "A", "192.168.5.1"}), "default")
+
+	fakeClient := fake.NewSimpleClientset()
+	fakeClient.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: dnsEndpointGroup + "/v1alpha1",
+			APIResources: []metav1.APIResource{
+				{Name: "dnsendpoints", Kind: KindDNSEndpoint, Namespaced: true},
+				{Name: "dnsendpoints/status", Kind: KindDNSEndpoint, Namespaced: true},
+			},
+		},
+	}
+
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+
+	// Test case 1: DNSEndpoints are only published when enabled
+	reconciler := NewReconciler(fakeClient, dynamicClient, ownedDNS, reg, SourceConfig{}, time.Minute, false)
+	if err := reconciler.Reconcile(context.Background()); err != nil || len(fakeDNS.records) != 0 {
+		t.Errorf("Records: %v, Error: %v", fakeDNS.records, err)
+	}
+
+	// Test case 2: Enabled
+	reconciler = NewReconciler(fakeClient, dynamicClient, ownedDNS, reg, SourceConfig{DNSEndpoint: true}, time.Minute, false)
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Errorf("Reconcile error: %s", err)
+	}
+	if fakeDNS.records["a.example.com"] != "192.168.5.1" {
+		t.Errorf("Expected a record, got: %v", fakeDNS.records)
+	}
+
+	// Test case 3: Without the CRD nothing is listed
+	reconciler = NewReconciler(fake.NewSimpleClientset(), dynamicClient, ownedDNS, reg, SourceConfig{DNSEndpoint: true}, time.Minute, false)
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Errorf("Reconcile error: %s", err)
+	}
+}
@@ -0,0 +1,86 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Which addresses of an object are published, A records for IPv4 and AAAA
+// records for IPv6.
+type IPFamily string
+
+const (
+	IPFamilyIPv4 IPFamily = "ipv4"
+	IPFamilyIPv6 IPFamily = "ipv6"
+	IPFamilyDual IPFamily = "dual"
+)
+
+var ErrNoAddressInFamily = errors.New("No load balancer address in the requested IP family")
+
+func ParseIPFamily(family string) (IPFamily, error) {
+	switch f := IPFamily(family); f {
+	case IPFamilyIPv4, IPFamilyIPv6, IPFamilyDual:
+		return f, nil
+	}
+	return "", fmt.Errorf("Unknown IP family [%s], must be ipv4, ipv6 or dual", family)
+}
+
+// The IP family annotation of an object, fallback when it has none.
+func getIPFamilyAnnotation(annotations map[string]string, fallback IPFamily) (IPFamily, error) {
+	if val, ok := annotations["pifrost.tolson.io/ip-family"]; ok && len(val) != 0 {
+		return ParseIPFamily(val)
+	}
+	return fallback, nil
+}
+
+// Whether family publishes ip.
+func (f IPFamily) allows(ip net.IP) bool {
+	if ip.To4() != nil {
+		return f != IPFamilyIPv6
+	}
+	return f != IPFamilyIPv4
+}
+
+// The record targets of the load balancer targets, every address family
+// allows, IPv4 before IPv6 and otherwise in the order given. Without
+// addresses the single hostname is the target.
+func familyTargets(targets []string, family IPFamily) ([]string, error) {
+	var v4, v6, hostnames []string
+	for _, target := range targets {
+		ip := net.ParseIP(target)
+		switch {
+		case ip == nil:
+			hostnames = append(hostnames, target)
+		case !family.allows(ip):
+		case ip.To4() != nil:
+			v4 = append(v4, target)
+		default:
+			v6 = append(v6, target)
+		}
+	}
+
+	if len(v4) != 0 || len(v6) != 0 {
+		return unique(append(v4, v6...)), nil
+	}
+
+	switch len(unique(hostnames)) {
+	case 0:
+		return nil, ErrNoAddressInFamily
+	case 1:
+		return hostnames[:1], nil
+	}
+	return nil, ErrPifrostSingleLB
+}
+
+func unique(values []string) []string {
+	seen := map[string]bool{}
+	var kept []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
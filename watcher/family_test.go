@@ -0,0 +1,64 @@
+package watcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIPFamily(t *testing.T) {
+	for _, family := range []string{"ipv4", "ipv6", "dual"} {
+		if f, err := ParseIPFamily(family); err != nil || string(f) != family {
+			t.Errorf("Family: %s, Error: %v", f, err)
+		}
+	}
+	if _, err := ParseIPFamily("ipx"); err == nil {
+		t.Error("Expected unknown family error")
+	}
+
+	// The annotation wins over the server default.
+	annotations := map[string]string{"pifrost.tolson.io/ip-family": "ipv6"}
+	if f, err := getIPFamilyAnnotation(annotations, IPFamilyIPv4); err != nil || f != IPFamilyIPv6 {
+		t.Errorf("Family: %s, Error: %v", f, err)
+	}
+	if f, _ := getIPFamilyAnnotation(nil, IPFamilyIPv4); f != IPFamilyIPv4 {
+		t.Errorf("Family: %s, Expected: ipv4.", f)
+	}
+}
+
+func TestFamilyTargets(t *testing.T) {
+	targets := []string{"fd00::2", "192.168.5.2", "fd00::1", "192.168.5.1", "192.168.5.2"}
+
+	// Test case 1: Every address of both families, IPv4 first, duplicates dropped
+	got, err := familyTargets(targets, IPFamilyDual)
+	expected := []string{"192.168.5.2", "192.168.5.1", "fd00::2", "fd00::1"}
+	if err != nil || !reflect.DeepEqual(got, expected) {
+		t.Errorf("Targets: %v, Expected: %v. Error: %v", got, expected, err)
+	}
+
+	// Test case 2: Every address of a single family
+	got, err = familyTargets(targets, IPFamilyIPv6)
+	expected = []string{"fd00::2", "fd00::1"}
+	if err != nil || !reflect.DeepEqual(got, expected) {
+		t.Errorf("Targets: %v, Expected: %v. Error: %v", got, expected, err)
+	}
+
+	// Test case 3: Addresses win over hostnames
+	got, err = familyTargets([]string{"lb.example.com", "192.168.5.1"}, IPFamilyDual)
+	if err != nil || !reflect.DeepEqual(got, []string{"192.168.5.1"}) {
+		t.Errorf("Targets: %v, Error: %v", got, err)
+	}
+
+	// Test case 4: A single hostname, but not several
+	got, err = familyTargets([]string{"lb.example.com", "lb.example.com"}, IPFamilyDual)
+	if err != nil || !reflect.DeepEqual(got, []string{"lb.example.com"}) {
+		t.Errorf("Targets: %v, Error: %v", got, err)
+	}
+	if _, err = familyTargets([]string{"a.example.com", "b.example.com"}, IPFamilyDual); err != ErrPifrostSingleLB {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrPifrostSingleLB)
+	}
+
+	// Test case 5: No address in the family
+	if _, err = familyTargets([]string{"192.168.5.1"}, IPFamilyIPv6); err != ErrNoAddressInFamily {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrNoAddressInFamily)
+	}
+}
@@ -0,0 +1,506 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+const gatewayGroup = "gateway.networking.k8s.io"
+
+// Gateway API kinds pifrost reads. Routes are read as unstructured objects
+// through the dynamic client, clusters without the CRDs need nothing extra.
+const (
+	KindGateway   = "Gateway"
+	KindHTTPRoute = "HTTPRoute"
+	KindGRPCRoute = "GRPCRoute"
+	KindTLSRoute  = "TLSRoute"
+)
+
+var routeKinds = []string{KindHTTPRoute, KindGRPCRoute, KindTLSRoute}
+
+var (
+	ErrRouteMissingAnnotation = errors.New("Missing pifrost route annotation")
+	ErrRouteNotAttached       = errors.New("Route is not attached to a Gateway listener")
+	ErrGatewayMissingAddress  = errors.New("Gateway was not assigned an address")
+)
+
+// A Gateway listener, as far as attaching routes goes.
+type gatewayListener struct {
+	name     string
+	hostname string
+	port     int64
+	protocol string
+	// Same, All or Selector.
+	from  string
+	kinds []string
+}
+
+// A route's reference to a Gateway, and optionally one of its listeners.
+type parentRef struct {
+	namespace   string
+	name        string
+	sectionName string
+	port        int64
+}
+
+// Gateway API resources the cluster serves, by kind, in the preferred version
+// of the group. Empty when the CRDs are not installed.
+func gatewayResources(client discovery.DiscoveryInterface) (map[string]schema.GroupVersionResource, error) {
+	return groupResources(client, gatewayGroup, append([]string{KindGateway}, routeKinds...))
+}
+
+// Resources of the kinds the cluster serves in group, by kind, in the
+// preferred version of the group when it has them. Empty when the group is
+// not served, e.g. its CRDs are not installed.
+func groupResources(client discovery.DiscoveryInterface, groupName string, kinds []string) (map[string]schema.GroupVersionResource, error) {
+	resources := map[string]schema.GroupVersionResource{}
+
+	groups, err := client.ServerGroups()
+	if err != nil {
+		return nil, fmt.Errorf("Could not discover API groups: %w", err)
+	}
+
+	var versions []string
+	for _, group := range groups.Groups {
+		if group.Name != groupName {
+			continue
+		}
+		versions = append(versions, group.PreferredVersion.Version)
+		for _, version := range group.Versions {
+			if version.Version != group.PreferredVersion.Version {
+				versions = append(versions, version.Version)
+			}
+		}
+	}
+
+	for _, version := range versions {
+		gv := schema.GroupVersion{Group: groupName, Version: version}
+		list, err := client.ServerResourcesForGroupVersion(gv.String())
+		if err != nil {
+			return nil, fmt.Errorf("Could not discover %s: %w", gv, err)
+		}
+		for _, resource := range list.APIResources {
+			// Skip subresources such as httproutes/status.
+			if strings.Contains(resource.Name, "/") || !containsString(kinds, resource.Kind) {
+				continue
+			}
+			if _, ok := resources[resource.Kind]; !ok {
+				resources[resource.Kind] = gv.WithResource(resource.Name)
+			}
+		}
+	}
+
+	return resources, nil
+}
+
+// Watch Gateways and their routes until ctx is cancelled. Every route kind
+// has its own queue, a Gateway change queues the routes attached to it.
+func watcherGateway(ctx context.Context, dynamicClient dynamic.Interface, resources map[string]schema.GroupVersionResource, dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig, ready <-chan struct{}, drain time.Duration, w *sync.WaitGroup) {
+	defer w.Done()
+
+	logrus.Info("Starting gateway watcher...")
+
+	var gatewayStore cache.Store
+	routeStores := map[string]cache.Store{}
+	workers := map[string]*queueWorker{}
+	controllers := map[string]cache.Controller{}
+
+	for _, kind := range routeKinds {
+		gvr, ok := resources[kind]
+		if !ok {
+			logrus.Infof("%s not served by the cluster, not watching it", kind)
+			continue
+		}
+
+		kind := kind
+		worker := newQueueWorker(strings.ToLower(kind), defaultRateLimiter(), func(ctx context.Context, key string) error {
+			return syncRoute(ctx, kind, key, routeStores[kind], gatewayStore, dnsProvider, reg, config)
+		})
+		routeStores[kind], controllers[kind] = cache.NewInformer(
+			dynamicListWatch(ctx, dynamicClient, gvr),
+			&unstructured.Unstructured{},
+			0,
+			worker.handlers(),
+		)
+		workers[kind] = worker
+	}
+
+	// Routes follow the address of their Gateway.
+	requeue := func(obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return
+		}
+		for kind, store := range routeStores {
+			for _, item := range store.List() {
+				route, ok := item.(*unstructured.Unstructured)
+				if !ok || !attachedTo(route, key) {
+					continue
+				}
+				workers[kind].enqueue(route)
+			}
+		}
+	}
+	gatewayStore, gatewayController := cache.NewInformer(
+		dynamicListWatch(ctx, dynamicClient, resources[KindGateway]),
+		&unstructured.Unstructured{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    requeue,
+			UpdateFunc: func(oldObj, newObj interface{}) { requeue(newObj) },
+			DeleteFunc: requeue,
+		},
+	)
+
+	go gatewayController.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), gatewayController.HasSynced) {
+		return
+	}
+
+	routes := &sync.WaitGroup{}
+	for kind, worker := range workers {
+		routes.Add(1)
+		go func(worker *queueWorker, controller cache.Controller) {
+			defer routes.Done()
+			runWorker(ctx, worker, controller, ready, drain)
+		}(worker, controllers[kind])
+	}
+	routes.Wait()
+}
+
+// List and watch gvr in every namespace through the dynamic client.
+func dynamicListWatch(ctx context.Context, dynamicClient dynamic.Interface, gvr schema.GroupVersionResource) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return dynamicClient.Resource(gvr).Namespace(v1.NamespaceAll).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return dynamicClient.Resource(gvr).Namespace(v1.NamespaceAll).Watch(ctx, options)
+		},
+	}
+}
+
+// Make the records of the route of kind keyed by namespace/name match the
+// route in store. A route which is gone, is not opted in or whose Gateway has
+// no address yet wants no records.
+func syncRoute(ctx context.Context, kind, key string, store, gatewayStore cache.Store, dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig) error {
+	obj, exists, err := store.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	var desired []provider.Domain
+	if exists {
+		route, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return permanent(fmt.Errorf("cast failed %T to %T", obj, route))
+		}
+
+		desired, err = desiredRouteRecords(kind, route, storeGateways(gatewayStore), config)
+		switch {
+		case errors.Is(err, ErrRouteMissingAnnotation):
+		case wantsNoRecords(err):
+			logrus.WithFields(logrus.Fields{
+				"route": routeOwner(kind, key),
+			}).Debugf("Route wants no records: %s", err)
+		case err != nil:
+			return permanent(err)
+		}
+	}
+
+	_, err = syncRecords(ctx, dnsProvider, reg, routeOwner(kind, key), desired)
+	return err
+}
+
+// Look up Gateways by namespace/name in an informer store.
+func storeGateways(store cache.Store) func(key string) (*unstructured.Unstructured, bool) {
+	return func(key string) (*unstructured.Unstructured, bool) {
+		obj, exists, err := store.GetByKey(key)
+		if err != nil || !exists {
+			return nil, false
+		}
+		gateway, ok := obj.(*unstructured.Unstructured)
+		return gateway, ok
+	}
+}
+
+// Records a route of kind wants: its hostnames, resolved against the listeners of
+// its parent Gateways, pointing at the Gateway addresses. The target
+// annotation and --ingress-externalip win over the Gateway addresses like
+// they do for ingresses. A hostname attached through several Gateways takes
+// the addresses of the first.
+func desiredRouteRecords(kind string, route *unstructured.Unstructured, gateways func(key string) (*unstructured.Unstructured, bool), config SourceConfig) ([]provider.Domain, error) {
+	annotations := route.GetAnnotations()
+	if !config.IngressAuto && !hasIngressAnnotation(annotations) {
+		return nil, ErrRouteMissingAnnotation
+	}
+
+	family, err := getIPFamilyAnnotation(annotations, config.IPFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	hostnames, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+
+	var desired []provider.Domain
+	seen := map[string]bool{}
+	attached := false
+	for _, ref := range routeParentRefs(route) {
+		gateway, ok := gateways(ref.namespace + "/" + ref.name)
+		if !ok || !routeAccepted(route, ref) {
+			continue
+		}
+
+		var hosts []string
+		for _, listener := range gatewayListeners(gateway) {
+			if !listener.attaches(kind, route, gateway, ref) {
+				continue
+			}
+			for _, host := range listenerHostnames(listener.hostname, hostnames) {
+				if !seen[host] {
+					seen[host] = true
+					hosts = append(hosts, host)
+				}
+			}
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+		attached = true
+
+		targets, err := gatewayTargets(route, gateway, config.IngressExternalIP, family)
+		if err != nil {
+			return nil, err
+		}
+
+		records, err := records(hosts, targets)
+		if err != nil {
+			return nil, err
+		}
+		desired = append(desired, records...)
+	}
+
+	if !attached {
+		return nil, ErrRouteNotAttached
+	}
+
+	return desired, nil
+}
+
+// The record targets for a route attached to gateway, limited to family.
+func gatewayTargets(route, gateway *unstructured.Unstructured, ingressIP string, family IPFamily) ([]string, error) {
+	if target, ok := getTargetAnnotation(route.GetAnnotations()); ok {
+		return familyTargets([]string{target}, family)
+	}
+
+	if len(ingressIP) != 0 {
+		return familyTargets([]string{ingressIP}, family)
+	}
+
+	addresses, _, _ := unstructured.NestedSlice(gateway.Object, "status", "addresses")
+	var targets []string
+	for _, address := range addresses {
+		if value, ok := address.(map[string]interface{})["value"].(string); ok && len(value) != 0 {
+			targets = append(targets, value)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, ErrGatewayMissingAddress
+	}
+
+	return familyTargets(targets, family)
+}
+
+// The Gateways a route names as parents. Namespaces default to the route's,
+// parents which are not Gateways are skipped.
+func routeParentRefs(route *unstructured.Unstructured) []parentRef {
+	refs, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+
+	var parents []parentRef
+	for _, item := range refs {
+		ref, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(ref, "group")
+		kind, _, _ := unstructured.NestedString(ref, "kind")
+		if (len(group) != 0 && group != gatewayGroup) || (len(kind) != 0 && kind != KindGateway) {
+			continue
+		}
+
+		parent := parentRef{namespace: route.GetNamespace()}
+		parent.name, _, _ = unstructured.NestedString(ref, "name")
+		if namespace, _, _ := unstructured.NestedString(ref, "namespace"); len(namespace) != 0 {
+			parent.namespace = namespace
+		}
+		parent.sectionName, _, _ = unstructured.NestedString(ref, "sectionName")
+		parent.port, _, _ = unstructured.NestedInt64(ref, "port")
+		parents = append(parents, parent)
+	}
+
+	return parents
+}
+
+// Whether route names the Gateway keyed by namespace/name as a parent.
+func attachedTo(route *unstructured.Unstructured, key string) bool {
+	for _, ref := range routeParentRefs(route) {
+		if ref.namespace+"/"+ref.name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the Gateway controller did not reject the route for ref, e.g.
+// because a namespace selector does not match. Routes without status are
+// given the benefit of the doubt.
+func routeAccepted(route *unstructured.Unstructured, ref parentRef) bool {
+	parents, _, _ := unstructured.NestedSlice(route.Object, "status", "parents")
+	for _, item := range parents {
+		parent, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(parent, "parentRef", "name")
+		namespace, _, _ := unstructured.NestedString(parent, "parentRef", "namespace")
+		sectionName, _, _ := unstructured.NestedString(parent, "parentRef", "sectionName")
+		if len(namespace) == 0 {
+			namespace = route.GetNamespace()
+		}
+		if name != ref.name || namespace != ref.namespace || sectionName != ref.sectionName {
+			continue
+		}
+
+		conditions, _, _ := unstructured.NestedSlice(parent, "conditions")
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if ok && condition["type"] == "Accepted" && condition["status"] == string(metav1.ConditionFalse) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func gatewayListeners(gateway *unstructured.Unstructured) []gatewayListener {
+	items, _, _ := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+
+	var listeners []gatewayListener
+	for _, item := range items {
+		l, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		listener := gatewayListener{from: "Same"}
+		listener.name, _, _ = unstructured.NestedString(l, "name")
+		listener.hostname, _, _ = unstructured.NestedString(l, "hostname")
+		listener.port, _, _ = unstructured.NestedInt64(l, "port")
+		listener.protocol, _, _ = unstructured.NestedString(l, "protocol")
+		if from, _, _ := unstructured.NestedString(l, "allowedRoutes", "namespaces", "from"); len(from) != 0 {
+			listener.from = from
+		}
+		kinds, _, _ := unstructured.NestedSlice(l, "allowedRoutes", "kinds")
+		for _, k := range kinds {
+			if kind, ok := k.(map[string]interface{})["kind"].(string); ok {
+				listener.kinds = append(listener.kinds, kind)
+			}
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners
+}
+
+// Whether route of kind attaches to the listener of gateway through ref. Namespace
+// selectors need the namespace labels, those are left to the Gateway
+// controller, see routeAccepted.
+func (l gatewayListener) attaches(kind string, route, gateway *unstructured.Unstructured, ref parentRef) bool {
+	if len(ref.sectionName) != 0 && ref.sectionName != l.name {
+		return false
+	}
+	if ref.port != 0 && ref.port != l.port {
+		return false
+	}
+	if l.from == "Same" && route.GetNamespace() != gateway.GetNamespace() {
+		return false
+	}
+
+	kinds := l.kinds
+	if len(kinds) == 0 {
+		switch l.protocol {
+		case "HTTP", "HTTPS":
+			kinds = []string{KindHTTPRoute, KindGRPCRoute}
+		case "TLS":
+			kinds = []string{KindTLSRoute}
+		}
+	}
+	return containsString(kinds, kind)
+}
+
+// The names a route gets on a listener, the intersection of the listener
+// hostname and the route hostnames. Either may be a wildcard like
+// *.example.com, which matches one or more labels. Wildcards are not
+// published, DNS providers hold plain names.
+func listenerHostnames(listener string, route []string) []string {
+	var names []string
+	switch {
+	case len(listener) == 0:
+		names = route
+	case len(route) == 0:
+		names = []string{listener}
+	default:
+		for _, host := range route {
+			switch {
+			case host == listener, wildcardMatches(listener, host):
+				names = append(names, host)
+			case wildcardMatches(host, listener):
+				names = append(names, listener)
+			}
+		}
+	}
+
+	var hostnames []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, "*") {
+			hostnames = append(hostnames, name)
+		}
+	}
+	return hostnames
+}
+
+// Whether the wildcard hostname pattern matches the more specific host.
+func wildcardMatches(pattern, host string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+	suffix := pattern[1:]
+	return len(host) > len(suffix) && strings.HasSuffix(host, suffix) && host != pattern
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,303 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	fake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+func exampleGateway(listeners ...map[string]interface{}) *unstructured.Unstructured {
+	var items []interface{}
+	for _, l := range listeners {
+		items = append(items, l)
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       KindGateway,
+		"metadata": map[string]interface{}{
+			"name":      "example-gateway",
+			"namespace": "default",
+		},
+		"spec": map[string]interface{}{
+			"gatewayClassName": "example",
+			"listeners":        items,
+		},
+		"status": map[string]interface{}{
+			"addresses": []interface{}{
+				map[string]interface{}{"type": "IPAddress", "value": "192.168.5.1"},
+			},
+		},
+	}}
+}
+
+func exampleListener(name, hostname, protocol string, port int64) map[string]interface{} {
+	listener := map[string]interface{}{
+		"name":     name,
+		"port":     port,
+		"protocol": protocol,
+	}
+	if len(hostname) != 0 {
+		listener["hostname"] = hostname
+	}
+	return listener
+}
+
+func exampleRoute(kind string, hostnames ...string) *unstructured.Unstructured {
+	var items []interface{}
+	for _, h := range hostnames {
+		items = append(items, h)
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"name":      "example-route",
+			"namespace": "default",
+			"annotations": map[string]interface{}{
+				"pifrost.tolson.io/ingress": "true",
+			},
+		},
+		"spec": map[string]interface{}{
+			"parentRefs": []interface{}{
+				map[string]interface{}{"name": "example-gateway"},
+			},
+			"hostnames": items,
+		},
+	}}
+}
+
+func gatewayLookup(gateways ...*unstructured.Unstructured) func(string) (*unstructured.Unstructured, bool) {
+	return func(key string) (*unstructured.Unstructured, bool) {
+		for _, g := range gateways {
+			if g.GetNamespace()+"/"+g.GetName() == key {
+				return g, true
+			}
+		}
+		return nil, false
+	}
+}
+
+func TestListenerHostnames(t *testing.T) {
+	cases := []struct {
+		listener string
+		route    []string
+		expected []string
+	}{
+		// Test case 1: No listener hostname, the route names
+		{"", []string{"a.example.com", "b.example.com"}, []string{"a.example.com", "b.example.com"}},
+		// Test case 2: No route hostnames, the listener name
+		{"gw.example.com", nil, []string{"gw.example.com"}},
+		// Test case 3: Only matching names
+		{"a.example.com", []string{"a.example.com", "b.example.com"}, []string{"a.example.com"}},
+		// Test case 4: Wildcard listener
+		{"*.example.com", []string{"a.example.com", "a.b.example.com", "example.com", "a.example.org"}, []string{"a.example.com", "a.b.example.com"}},
+		// Test case 5: Wildcard route
+		{"a.example.com", []string{"*.example.com"}, []string{"a.example.com"}},
+		// Test case 6: Wildcards are not published
+		{"*.example.com", nil, nil},
+		{"", []string{"*.example.com"}, nil},
+	}
+
+	for i, c := range cases {
+		if hostnames := listenerHostnames(c.listener, c.route); !reflect.DeepEqual(hostnames, c.expected) {
+			t.Errorf("Case %d: Hostnames: %v, Expected: %v.", i+1, hostnames, c.expected)
+		}
+	}
+}
+
+func TestDesiredRouteRecords(t *testing.T) {
+	gateway := exampleGateway(
+		exampleListener("http", "", "HTTP", 80),
+		exampleListener("tls", "*.tls.example.com", "TLS", 443),
+	)
+	gateways := gatewayLookup(gateway)
+
+	// Test case 1: Opted in route on the HTTP listener
+	route := exampleRoute(KindHTTPRoute, "a.example.com")
+	records, err := desiredRouteRecords(KindHTTPRoute, route, gateways, SourceConfig{})
+	expected := []provider.Domain{provider.NewDomain("192.168.5.1", "a.example.com")}
+	if err != nil || !reflect.DeepEqual(records, expected) {
+		t.Errorf("Records: %v, Expected: %v. Error: %v", records, expected, err)
+	}
+
+	// Test case 2: No annotation, unless every route is published
+	route.SetAnnotations(nil)
+	if _, err := desiredRouteRecords(KindHTTPRoute, route, gateways, SourceConfig{}); !errors.Is(err, ErrRouteMissingAnnotation) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrRouteMissingAnnotation)
+	}
+	if _, err := desiredRouteRecords(KindHTTPRoute, route, gateways, SourceConfig{IngressAuto: true}); err != nil {
+		t.Errorf("Error with IngressAuto: %s", err)
+	}
+
+	// Test case 3: TLSRoutes only attach to the TLS listener and its names
+	route = exampleRoute(KindTLSRoute, "db.tls.example.com", "db.example.com")
+	records, _ = desiredRouteRecords(KindTLSRoute, route, gateways, SourceConfig{})
+	expected = []provider.Domain{provider.NewDomain("192.168.5.1", "db.tls.example.com")}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Records: %v, Expected: %v.", records, expected)
+	}
+
+	// Test case 4: A section name picks the listener
+	route = exampleRoute(KindHTTPRoute, "a.example.com")
+	route.Object["spec"].(map[string]interface{})["parentRefs"] = []interface{}{
+		map[string]interface{}{"name": "example-gateway", "sectionName": "tls"},
+	}
+	if _, err := desiredRouteRecords(KindHTTPRoute, route, gateways, SourceConfig{}); !errors.Is(err, ErrRouteNotAttached) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrRouteNotAttached)
+	}
+
+	// Test case 5: Listeners only allow routes of their namespace by default
+	route = exampleRoute(KindHTTPRoute, "a.example.com")
+	route.SetNamespace("other")
+	route.Object["spec"].(map[string]interface{})["parentRefs"] = []interface{}{
+		map[string]interface{}{"name": "example-gateway", "namespace": "default"},
+	}
+	if _, err := desiredRouteRecords(KindHTTPRoute, route, gateways, SourceConfig{}); !errors.Is(err, ErrRouteNotAttached) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrRouteNotAttached)
+	}
+	unstructured.SetNestedField(gateway.Object, []interface{}{
+		map[string]interface{}{"name": "http", "port": int64(80), "protocol": "HTTP", "allowedRoutes": map[string]interface{}{
+			"namespaces": map[string]interface{}{"from": "All"},
+		}},
+	}, "spec", "listeners")
+	if _, err := desiredRouteRecords(KindHTTPRoute, route, gateways, SourceConfig{}); err != nil {
+		t.Errorf("Error with from All: %s", err)
+	}
+
+	// Test case 6: Rejected by the Gateway controller
+	unstructured.SetNestedSlice(route.Object, []interface{}{
+		map[string]interface{}{
+			"parentRef":  map[string]interface{}{"name": "example-gateway", "namespace": "default"},
+			"conditions": []interface{}{map[string]interface{}{"type": "Accepted", "status": "False"}},
+		},
+	}, "status", "parents")
+	if _, err := desiredRouteRecords(KindHTTPRoute, route, gateways, SourceConfig{}); !errors.Is(err, ErrRouteNotAttached) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrRouteNotAttached)
+	}
+
+	// Test case 7: The target annotation wins, a Gateway without address wants nothing
+	route = exampleRoute(KindGRPCRoute, "grpc.example.com")
+	gateway = exampleGateway(exampleListener("https", "", "HTTPS", 443))
+	unstructured.RemoveNestedField(gateway.Object, "status")
+	if _, err := desiredRouteRecords(KindGRPCRoute, route, gatewayLookup(gateway), SourceConfig{}); !errors.Is(err, ErrGatewayMissingAddress) {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrGatewayMissingAddress)
+	}
+	route.SetAnnotations(map[string]string{"pifrost.tolson.io/ingress": "true", "pifrost.tolson.io/target": "lb.example.com"})
+	records, _ = desiredRouteRecords(KindGRPCRoute, route, gatewayLookup(gateway), SourceConfig{})
+	expected = []provider.Domain{provider.NewCNAME("grpc.example.com", "lb.example.com")}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Records: %v, Expected: %v.", records, expected)
+	}
+}
+
+func TestSyncRoute(t *testing.T) {
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	gatewayStore := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	key := "default/example-route"
+
+	sync := func() {
+		t.Helper()
+		if err := syncRoute(context.Background(), KindHTTPRoute, key, store, gatewayStore, ownedDNS, reg, SourceConfig{}); err != nil {
+			t.Errorf("Route sync test error: %s", err)
+		}
+	}
+
+	// Test case 1: No Gateway yet
+	store.Add(exampleRoute(KindHTTPRoute, "a.example.com"))
+	sync()
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
+	}
+
+	// Test case 2: The Gateway is assigned an address
+	gateway := exampleGateway(exampleListener("http", "", "HTTP", 80))
+	gatewayStore.Add(gateway)
+	sync()
+	if fakeDNS.records["a.example.com"] != "192.168.5.1" {
+		t.Errorf("Expected a record, got: %v", fakeDNS.records)
+	}
+	if owner, _ := reg.Owner(provider.NewDomain("192.168.5.1", "a.example.com")); owner != "httproute/default/example-route" {
+		t.Errorf("Owner: %s, Expected: httproute/default/example-route.", owner)
+	}
+
+	// Test case 3: The Gateway address changes
+	gateway = gateway.DeepCopy()
+	unstructured.SetNestedSlice(gateway.Object, []interface{}{
+		map[string]interface{}{"type": "IPAddress", "value": "192.168.5.9"},
+	}, "status", "addresses")
+	gatewayStore.Update(gateway)
+	sync()
+	if fakeDNS.records["a.example.com"] != "192.168.5.9" {
+		t.Errorf("Expected record moved to 192.168.5.9, got: %v", fakeDNS.records)
+	}
+
+	// Test case 4: Route deleted
+	store.Delete(exampleRoute(KindHTTPRoute))
+	sync()
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
+	}
+}
+
+func TestReconcileRoutes(t *testing.T) {
+	gateways := schema.GroupVersionResource{Group: gatewayGroup, Version: "v1", Resource: "gateways"}
+	httpRoutes := schema.GroupVersionResource{Group: gatewayGroup, Version: "v1", Resource: "httproutes"}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gateways:   "GatewayList",
+		httpRoutes: "HTTPRouteList",
+	})
+	// The fake guesses resource names from kinds, wrongly for Gateway.
+	dynamicClient.Tracker().Create(gateways, exampleGateway(exampleListener("http", "", "HTTP", 80)), "default")
+	dynamicClient.Tracker().Create(httpRoutes, exampleRoute(KindHTTPRoute, "a.example.com"), "default")
+
+	fakeClient := fake.NewSimpleClientset()
+	fakeClient.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: gatewayGroup + "/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "gateways", Kind: KindGateway, Namespaced: true},
+				{Name: "gateways/status", Kind: KindGateway, Namespaced: true},
+				{Name: "httproutes", Kind: KindHTTPRoute, Namespaced: true},
+			},
+		},
+	}
+
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+
+	// Test case 1: Routes are only published with the Gateway API enabled
+	reconciler := NewReconciler(fakeClient, dynamicClient, ownedDNS, reg, SourceConfig{}, time.Minute, false)
+	if err := reconciler.Reconcile(context.Background()); err != nil || len(fakeDNS.records) != 0 {
+		t.Errorf("Records: %v, Error: %v", fakeDNS.records, err)
+	}
+
+	// Test case 2: Served route kinds are listed, missing ones skipped
+	reconciler = NewReconciler(fakeClient, dynamicClient, ownedDNS, reg, SourceConfig{GatewayAPI: true}, time.Minute, false)
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Errorf("Reconcile error: %s", err)
+	}
+	if fakeDNS.records["a.example.com"] != "192.168.5.1" {
+		t.Errorf("Expected a record, got: %v", fakeDNS.records)
+	}
+
+	// Test case 3: Without the CRDs nothing is listed
+	reconciler = NewReconciler(fake.NewSimpleClientset(), dynamicClient, ownedDNS, reg, SourceConfig{GatewayAPI: true}, time.Minute, false)
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Errorf("Reconcile error: %s", err)
+	}
+}
@@ -2,50 +2,36 @@ package watcher
 
 import (
 	"context"
-	"net/http"
-	"net/http/httptest"
-	"strings"
+	"reflect"
 	"testing"
 	"time"
 
 	v1Networking "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/informers"
 	fake "k8s.io/client-go/kubernetes/fake"
-	clienttesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 
 	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
 )
 
-func TestPollIngress(t *testing.T) {
-	// Test Case 1: Poll for an ingress object
-	ingress := &v1Networking.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "example-ingress",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"nginx.ingress.kubernetes.io/rewrite-target": "/",
-			},
-		},
-		Spec: v1Networking.IngressSpec{
-			Rules: []v1Networking.IngressRule{
-				{
-					Host: "example.com",
-					IngressRuleValue: v1Networking.IngressRuleValue{
-						HTTP: &v1Networking.HTTPIngressRuleValue{
-							Paths: []v1Networking.HTTPIngressPath{
-								{
-									Path: "/",
-									Backend: v1Networking.IngressBackend{
-										Service: &v1Networking.IngressServiceBackend{
-											Name: "example-service",
-											Port: v1Networking.ServiceBackendPort{
-												Number: 80,
-											},
-										},
+func exampleIngress(hosts ...string) *v1Networking.Ingress {
+	var rules []v1Networking.IngressRule
+	for _, host := range hosts {
+		rules = append(rules, v1Networking.IngressRule{
+			Host: host,
+			IngressRuleValue: v1Networking.IngressRuleValue{
+				HTTP: &v1Networking.HTTPIngressRuleValue{
+					Paths: []v1Networking.HTTPIngressPath{
+						{
+							Path: "/",
+							Backend: v1Networking.IngressBackend{
+								Service: &v1Networking.IngressServiceBackend{
+									Name: "example-service",
+									Port: v1Networking.ServiceBackendPort{
+										Number: 80,
 									},
 								},
 							},
@@ -53,29 +39,10 @@ func TestPollIngress(t *testing.T) {
 					},
 				},
 			},
-		},
-		Status: v1Networking.IngressStatus{
-			LoadBalancer: v1Networking.IngressLoadBalancerStatus{
-				Ingress: []v1Networking.IngressLoadBalancerIngress{
-					{
-						IP: "192.168.1.2",
-					},
-				},
-			},
-		},
+		})
 	}
 
-	fakeClient := fake.NewSimpleClientset(ingress)
-
-	_, err := pollIngress(fakeClient, ingress)
-	if err != nil {
-		t.Errorf("Ingress poll error: %s", err)
-	}
-}
-
-func TestFetchIngressLB(t *testing.T) {
-	// Test case 1: Good case
-	ingress := &v1Networking.Ingress{
+	return &v1Networking.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "example-ingress",
 			Namespace: "default",
@@ -84,28 +51,7 @@ func TestFetchIngressLB(t *testing.T) {
 			},
 		},
 		Spec: v1Networking.IngressSpec{
-			Rules: []v1Networking.IngressRule{
-				{
-					Host: "example.com",
-					IngressRuleValue: v1Networking.IngressRuleValue{
-						HTTP: &v1Networking.HTTPIngressRuleValue{
-							Paths: []v1Networking.HTTPIngressPath{
-								{
-									Path: "/",
-									Backend: v1Networking.IngressBackend{
-										Service: &v1Networking.IngressServiceBackend{
-											Name: "example-service",
-											Port: v1Networking.ServiceBackendPort{
-												Number: 80,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
+			Rules: rules,
 		},
 		Status: v1Networking.IngressStatus{
 			LoadBalancer: v1Networking.IngressLoadBalancerStatus{
@@ -117,15 +63,21 @@ func TestFetchIngressLB(t *testing.T) {
 			},
 		},
 	}
+}
 
-	fakeClient := fake.NewSimpleClientset(ingress)
-	_, err := fetchIngressLB(fakeClient, ingress)
-	if err != nil {
-		t.Errorf("Ingress poll error: %s", err)
+func TestIngressTargets(t *testing.T) {
+	// Test case 1: Good case
+	ingress := exampleIngress("example.com")
+	targets, err := ingressTargets(ingress, "", IPFamilyDual)
+	if err != nil || !reflect.DeepEqual(targets, []string{"192.168.5.1"}) {
+		t.Errorf("Targets: %v, Error: %v", targets, err)
 	}
 
-	// Test case 2: More IPs than supported
-	invalidFetch := []v1Networking.IngressLoadBalancerIngress{
+	// Test case 2: Dual stack, every address with IPv4 first
+	ingress.Status.LoadBalancer.Ingress = []v1Networking.IngressLoadBalancerIngress{
+		{
+			IP: "fd00::1",
+		},
 		{
 			IP: "192.168.5.1",
 		},
@@ -133,318 +85,183 @@ func TestFetchIngressLB(t *testing.T) {
 			IP: "192.168.5.2",
 		},
 	}
-
-	ingress.Status.LoadBalancer.Ingress = invalidFetch
-	fakeClient = fake.NewSimpleClientset(ingress)
-	_, err = fetchIngressLB(fakeClient, ingress)
-	if err.Error() != "pifrost only supports single LB IP ingress objects" {
-		t.Error("Fetch should have errored")
+	targets, err = ingressTargets(ingress, "", IPFamilyDual)
+	if err != nil || !reflect.DeepEqual(targets, []string{"192.168.5.1", "192.168.5.2", "fd00::1"}) {
+		t.Errorf("Targets: %v, Error: %v", targets, err)
+	}
+	targets, _ = ingressTargets(ingress, "", IPFamilyIPv6)
+	if !reflect.DeepEqual(targets, []string{"fd00::1"}) {
+		t.Errorf("Targets: %v, Expected: [fd00::1].", targets)
 	}
 
 	// Test case 3: Doesn't yet have a LB from controller.
-	hasNoIPFetch := []v1Networking.IngressLoadBalancerIngress{{}}
+	ingress.Status.LoadBalancer.Ingress = []v1Networking.IngressLoadBalancerIngress{{}}
+	_, err = ingressTargets(ingress, "", IPFamilyDual)
+	if err == nil || err.Error() != "Ingress does not have a LoadBalancerIP" {
+		t.Error("Target should have errored")
+	}
+
+	// Test case 4: Load balancer only has a hostname, CNAME to it.
+	ingress.Status.LoadBalancer.Ingress = []v1Networking.IngressLoadBalancerIngress{
+		{
+			Hostname: "lb.cloud.example.net",
+		},
+	}
+	targets, err = ingressTargets(ingress, "", IPFamilyIPv4)
+	if err != nil || !reflect.DeepEqual(targets, []string{"lb.cloud.example.net"}) {
+		t.Errorf("Expected hostname target, got: %v, %v", targets, err)
+	}
+
+	// Test case 5: --ingress-externalip wins over the load balancer
+	targets, _ = ingressTargets(ingress, "192.168.1.2", IPFamilyDual)
+	if !reflect.DeepEqual(targets, []string{"192.168.1.2"}) {
+		t.Errorf("Targets: %v, Expected: [192.168.1.2].", targets)
+	}
+	if _, err = ingressTargets(ingress, "192.168.1.2", IPFamilyIPv6); err != ErrNoAddressInFamily {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrNoAddressInFamily)
+	}
 
-	ingress.Status.LoadBalancer.Ingress = hasNoIPFetch
-	fakeClient = fake.NewSimpleClientset(ingress)
-	_, err = fetchIngressLB(fakeClient, ingress)
-	if err.Error() != "Ingress does not have a LoadBalancerIP" {
-		t.Error("Fetch should have errored")
+	// Test case 6: Target annotation wins over everything
+	ingress.Annotations["pifrost.tolson.io/target"] = "other.home.lan"
+	targets, _ = ingressTargets(ingress, "192.168.1.2", IPFamilyDual)
+	if !reflect.DeepEqual(targets, []string{"other.home.lan"}) {
+		t.Errorf("Targets: %v, Expected: [other.home.lan].", targets)
 	}
 }
 
-func TestAddIngressLB(t *testing.T) {
+func TestSyncIngressLB(t *testing.T) {
 	mockServer, serverURL := startMockServer(t)
 	defer mockServer.Close()
 
-	ingress := &v1Networking.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "example-ingress",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"nginx.ingress.kubernetes.io/rewrite-target": "/",
-			},
-		},
-		Spec: v1Networking.IngressSpec{
-			Rules: []v1Networking.IngressRule{
-				{
-					Host: "example.com",
-					IngressRuleValue: v1Networking.IngressRuleValue{
-						HTTP: &v1Networking.HTTPIngressRuleValue{
-							Paths: []v1Networking.HTTPIngressPath{
-								{
-									Path: "/",
-									Backend: v1Networking.IngressBackend{
-										Service: &v1Networking.IngressServiceBackend{
-											Name: "example-service",
-											Port: v1Networking.ServiceBackendPort{
-												Number: 80,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-		Status: v1Networking.IngressStatus{
-			LoadBalancer: v1Networking.IngressLoadBalancerStatus{
-				Ingress: []v1Networking.IngressLoadBalancerIngress{
-					{
-						IP: "192.168.5.1",
-					},
-				},
-			},
-		},
+	mockPHR, err := provider.InitDNSProvider(testEndpoint(t, serverURL), provider.StaticCredential("mocktoken"))
+	if err != nil {
+		t.Errorf("Ingress sync test error: %s", err)
 	}
+	reg, _ := registry.New(context.Background(), registry.MemoryStore{})
+	ownedPHR := registry.NewOwnedProvider(mockPHR, reg, registry.PolicyTakeover)
 
-	mockPHR, err := provider.InitDNSProvider(true, serverURL, "mocktoken")
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	store.Add(exampleIngress("example.com"))
+
+	// Test case 1: Ingress with --ingress-auto
+	err = syncIngress(context.Background(), "default/example-ingress", store, ownedPHR, reg, SourceConfig{IngressAuto: true, IngressExternalIP: "192.168.1.2"})
 	if err != nil {
-		t.Errorf("Ingress handler test error: %s", err)
+		t.Errorf("Ingress sync test error: %s", err)
 	}
 
-	fakeClient := fake.NewSimpleClientset(ingress)
-
-	addIngressHandler(fakeClient, mockPHR, true, "192.168.1.2", ingress)
+	// Test case 2: Ingress deleted
+	store.Delete(exampleIngress("example.com"))
+	err = syncIngress(context.Background(), "default/example-ingress", store, ownedPHR, reg, SourceConfig{IngressAuto: true, IngressExternalIP: "192.168.1.2"})
+	if err != nil {
+		t.Errorf("Ingress sync test error: %s", err)
+	}
 }
 
-func TestDelIngressLB(t *testing.T) {
-	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-
-		var mockResponse string
-		action := r.URL.Query().Get("action")
-		switch action {
-		case "get":
-			mockResponse = `{"data":[["example.com","192.168.1.2"]]}[]`
-		case "add":
-			mockResponse = `{"success":true,"message":""}{"FTLnotrunning":true}`
-		case "delete":
-			mockResponse = `{"success":true,"message":""}{"FTLnotrunning":true}`
-		}
-
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(mockResponse))
-	}))
-	defer mockServer.Close()
+func TestSyncIngress(t *testing.T) {
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	key := "default/example-ingress"
 
-	ingress := &v1Networking.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "example-ingress",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"nginx.ingress.kubernetes.io/rewrite-target": "/",
-			},
-		},
-		Spec: v1Networking.IngressSpec{
-			Rules: []v1Networking.IngressRule{
-				{
-					Host: "example.com",
-					IngressRuleValue: v1Networking.IngressRuleValue{
-						HTTP: &v1Networking.HTTPIngressRuleValue{
-							Paths: []v1Networking.HTTPIngressPath{
-								{
-									Path: "/",
-									Backend: v1Networking.IngressBackend{
-										Service: &v1Networking.IngressServiceBackend{
-											Name: "example-service",
-											Port: v1Networking.ServiceBackendPort{
-												Number: 80,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-		Status: v1Networking.IngressStatus{
-			LoadBalancer: v1Networking.IngressLoadBalancerStatus{
-				Ingress: []v1Networking.IngressLoadBalancerIngress{
-					{
-						IP: "192.168.5.1",
-					},
-				},
-			},
-		},
+	sync := func() {
+		t.Helper()
+		if err := syncIngress(context.Background(), key, store, ownedDNS, reg, SourceConfig{}); err != nil {
+			t.Errorf("Ingress sync test error: %s", err)
+		}
 	}
 
-	mockPHR, err := provider.InitDNSProvider(true, strings.Replace(mockServer.URL, "http://", "", 1), "mocktoken")
-	if err != nil {
-		t.Errorf("Ingress handler test error: %s", err)
+	// Test case 1: No annotation, ignored
+	ingress := exampleIngress("a.example.com", "b.example.com")
+	store.Add(ingress)
+	sync()
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
 	}
 
-	fakeClient := fake.NewSimpleClientset(ingress)
-
-	delIngressHandler(fakeClient, mockPHR, true, "192.168.1.2", ingress)
-}
+	// Test case 2: Opted in
+	ingress = ingress.DeepCopy()
+	ingress.Annotations["pifrost.tolson.io/ingress"] = "true"
+	store.Update(ingress)
+	sync()
+	if fakeDNS.records["a.example.com"] != "192.168.5.1" || fakeDNS.records["b.example.com"] != "192.168.5.1" {
+		t.Errorf("Expected a and b records, got: %v", fakeDNS.records)
+	}
 
-func TestUpdateIngressLB(t *testing.T) {
-	// Test case 1: Update an ingress object
-	// State tracker for the httptest server
-	var added int = 0
-
-	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var mockResponse string
-		action := r.URL.Query().Get("action")
-		switch action {
-		case "get":
-			if added > 0 {
-				mockResponse = `{"data":[["example.com","192.168.1.2"]]}[]`
-			} else if added > 1 {
-				mockResponse = `{"data":[["new.example.com","192.168.1.2"],["example.com","192.168.1.2"]]}[]`
-			} else if added > 2 {
-				mockResponse = `{"data":[["new.example.com","192.168.1.2"]]}[]`
-			}
-			added = added + 1
-		case "add":
-			mockResponse = `{"success":true,"message":""}{"FTLnotrunning":true}`
-		case "delete":
-			mockResponse = `{"success":true,"message":""}{"FTLnotrunning":true}`
-		}
+	// Test case 3: Host renamed
+	ingress = ingress.DeepCopy()
+	ingress.Spec.Rules[1].Host = "c.example.com"
+	store.Update(ingress)
+	sync()
+	if _, ok := fakeDNS.records["b.example.com"]; ok || fakeDNS.records["c.example.com"] != "192.168.5.1" {
+		t.Errorf("Expected b replaced by c, got: %v", fakeDNS.records)
+	}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(mockResponse))
-	}))
-	defer mockServer.Close()
+	// Test case 4: Load balancer IP changed
+	ingress = ingress.DeepCopy()
+	ingress.Status.LoadBalancer.Ingress[0].IP = "192.168.5.9"
+	store.Update(ingress)
+	sync()
+	if fakeDNS.records["a.example.com"] != "192.168.5.9" || fakeDNS.records["c.example.com"] != "192.168.5.9" {
+		t.Errorf("Expected records moved to 192.168.5.9, got: %v", fakeDNS.records)
+	}
 
-	mockPHR, err := provider.InitDNSProvider(true, strings.Replace(mockServer.URL, "http://", "", 1), "mocktoken")
-	if err != nil {
-		t.Errorf("Ingress handler test error: %s", err)
+	// Test case 5: Annotation removed
+	ingress = ingress.DeepCopy()
+	delete(ingress.Annotations, "pifrost.tolson.io/ingress")
+	store.Update(ingress)
+	sync()
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
 	}
 
-	oldIngress := &v1Networking.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "example-ingress",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"nginx.ingress.kubernetes.io/rewrite-target": "/",
-			},
-		},
-		Spec: v1Networking.IngressSpec{
-			Rules: []v1Networking.IngressRule{
-				{
-					Host: "example.com",
-					IngressRuleValue: v1Networking.IngressRuleValue{
-						HTTP: &v1Networking.HTTPIngressRuleValue{
-							Paths: []v1Networking.HTTPIngressPath{
-								{
-									Path: "/",
-									Backend: v1Networking.IngressBackend{
-										Service: &v1Networking.IngressServiceBackend{
-											Name: "example-service",
-											Port: v1Networking.ServiceBackendPort{
-												Number: 80,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-		Status: v1Networking.IngressStatus{
-			LoadBalancer: v1Networking.IngressLoadBalancerStatus{
-				Ingress: []v1Networking.IngressLoadBalancerIngress{
-					{
-						IP: "192.168.5.1",
-					},
-				},
-			},
-		},
+	// Test case 6: Deleted while opted in
+	ingress = ingress.DeepCopy()
+	ingress.Annotations["pifrost.tolson.io/ingress"] = "true"
+	store.Update(ingress)
+	sync()
+	store.Delete(ingress)
+	sync()
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
 	}
+}
 
+func TestSyncIngressQueue(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	watcherStarted := make(chan struct{})
-	client := fake.NewSimpleClientset(oldIngress)
-	client.PrependWatchReactor("*", func(action clienttesting.Action) (handled bool, ret watch.Interface, err error) {
-		gvr := action.GetResource()
-		ns := action.GetNamespace()
-		watch, err := client.Tracker().Watch(gvr, ns)
-		if err != nil {
-			return false, nil, err
-		}
-		close(watcherStarted)
-		return true, watch, nil
-	})
-
-	ingresses := make(chan *v1Networking.Ingress, 1)
-	informers := informers.NewSharedInformerFactory(client, 0)
-	ingressInformer := informers.Networking().V1().Ingresses().Informer()
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	client := fake.NewSimpleClientset(exampleIngress("example.com"))
 
-	ingressInformer.AddEventHandler(&cache.ResourceEventHandlerFuncs{
-		UpdateFunc: func(oldObject, newObject interface{}) {
-			oI := oldObject.(*v1Networking.Ingress)
-			nI := newObject.(*v1Networking.Ingress)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	ingressInformer := factory.Networking().V1().Ingresses().Informer()
 
-			updateIngressHandler(client, mockPHR, true, "192.168.1.2", oI, nI)
-			ingresses <- nI
-		},
+	worker := newQueueWorker("ingress-test", defaultRateLimiter(), func(ctx context.Context, key string) error {
+		return syncIngress(ctx, key, ingressInformer.GetStore(), ownedDNS, reg, SourceConfig{IngressAuto: true, IngressExternalIP: "192.168.1.2"})
 	})
+	ingressInformer.AddEventHandler(worker.handlers())
 
-	informers.Start(ctx.Done())
+	factory.Start(ctx.Done())
 	cache.WaitForCacheSync(ctx.Done(), ingressInformer.HasSynced)
-	<-watcherStarted
+	go worker.Run(ctx, time.Second)
 
-	newIngress := &v1Networking.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "example-ingress",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"nginx.ingress.kubernetes.io/rewrite-target": "/",
-			},
-		},
-		Spec: v1Networking.IngressSpec{
-			Rules: []v1Networking.IngressRule{
-				{
-					Host: "new.example.com",
-					IngressRuleValue: v1Networking.IngressRuleValue{
-						HTTP: &v1Networking.HTTPIngressRuleValue{
-							Paths: []v1Networking.HTTPIngressPath{
-								{
-									Path: "/",
-									Backend: v1Networking.IngressBackend{
-										Service: &v1Networking.IngressServiceBackend{
-											Name: "example-service",
-											Port: v1Networking.ServiceBackendPort{
-												Number: 80,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-		Status: v1Networking.IngressStatus{
-			LoadBalancer: v1Networking.IngressLoadBalancerStatus{
-				Ingress: []v1Networking.IngressLoadBalancerIngress{
-					{
-						IP: "192.168.5.1",
-					},
-				},
-			},
-		},
+	waitForRecord := func(d, expected string) {
+		t.Helper()
+		err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, wait.ForeverTestTimeout, true, func(context.Context) (bool, error) {
+			return fakeDNS.record(d) == expected, nil
+		})
+		if err != nil {
+			t.Errorf("Record %s: %s, Expected: %s.", d, fakeDNS.record(d), expected)
+		}
 	}
 
-	_, err = client.NetworkingV1().Ingresses(newIngress.ObjectMeta.Namespace).Update(context.TODO(), newIngress, metav1.UpdateOptions{})
-	if err != nil {
-		t.Fatalf("error injecting pod add: %v", err)
-	}
+	// Test case 1: Existing ingress is synced
+	waitForRecord("example.com", "192.168.1.2")
 
-	select {
-	case ingress := <-ingresses:
-		t.Logf("Got ingress from channel: %s/%s", ingress.Namespace, ingress.Name)
-	case <-time.After(wait.ForeverTestTimeout):
-		t.Error("Informer did not get the added ingress")
+	// Test case 2: Update moves the record
+	_, err := client.NetworkingV1().Ingresses("default").Update(ctx, exampleIngress("new.example.com"), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("error injecting ingress update: %v", err)
 	}
+	waitForRecord("new.example.com", "192.168.1.2")
+	waitForRecord("example.com", "")
 }
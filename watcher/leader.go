@@ -0,0 +1,101 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElection configures the Lease pifrost replicas campaign for. Only
+// the leader writes to the DNS provider.
+type LeaderElection struct {
+	LeaseName string
+	Namespace string
+	// Unique per replica, the pod name.
+	Identity string
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// Lead returns a channel which is already closed, for a single replica which
+// does not campaign.
+func Lead() <-chan struct{} {
+	leading := make(chan struct{})
+	close(leading)
+	return leading
+}
+
+// Elect campaigns for the lease in the background and returns a channel
+// closed once this replica leads. A leader which loses the lease exits, it
+// may still have writes in flight and a restarted pod rejoins as a standby.
+// Cancelling ctx releases the lease so a standby takes over right away, the
+// second channel is closed once the lease was released.
+func Elect(ctx context.Context, client kubernetes.Interface, le LeaderElection) (<-chan struct{}, <-chan struct{}, error) {
+	lock, err := resourcelock.New(
+		resourcelock.LeasesResourceLock,
+		le.Namespace,
+		le.LeaseName,
+		client.CoreV1(),
+		client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{
+			Identity: le.Identity,
+		},
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not create leader election lock: %w", err)
+	}
+
+	fields := logrus.Fields{
+		"lease":    le.Namespace + "/" + le.LeaseName,
+		"identity": le.Identity,
+	}
+
+	leading := make(chan struct{})
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   le.LeaseDuration,
+		RenewDeadline:   le.RenewDeadline,
+		RetryPeriod:     le.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            le.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				logrus.WithFields(fields).Info("Became leader, writing to DNS provider")
+				close(leading)
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() != nil {
+					logrus.WithFields(fields).Info("Stopped campaigning for leader")
+					return
+				}
+				logrus.WithFields(fields).Fatal("Lost leader election")
+			},
+			OnNewLeader: func(identity string) {
+				if identity == le.Identity {
+					return
+				}
+				logrus.WithFields(fields).Infof("Standing by, %s is leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not create leader elector: %w", err)
+	}
+
+	logrus.WithFields(fields).Info("Campaigning for leader...")
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		elector.Run(ctx)
+	}()
+
+	return leading, released, nil
+}
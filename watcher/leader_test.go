@@ -0,0 +1,71 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestElect(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	le := LeaderElection{
+		LeaseName:     "pifrost",
+		Namespace:     "pifrost",
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+	}
+
+	// Test case 1: First replica leads
+	firstCtx, firstCancel := context.WithCancel(context.Background())
+	defer firstCancel()
+
+	le.Identity = "pifrost-a"
+	first, firstReleased, err := Elect(firstCtx, client, le)
+	if err != nil {
+		t.Fatalf("Error from Elect: %s", err)
+	}
+	select {
+	case <-first:
+	case <-time.After(5 * time.Second):
+		t.Fatal("First replica never became leader")
+	}
+
+	// Test case 2: Second replica stands by
+	secondCtx, secondCancel := context.WithCancel(context.Background())
+	defer secondCancel()
+
+	le.Identity = "pifrost-b"
+	second, _, err := Elect(secondCtx, client, le)
+	if err != nil {
+		t.Fatalf("Error from Elect: %s", err)
+	}
+	select {
+	case <-second:
+		t.Fatal("Second replica became leader while the first holds the lease")
+	case <-time.After(2 * le.LeaseDuration):
+	}
+
+	// Test case 3: Leader releases the lease, the standby takes over
+	firstCancel()
+	select {
+	case <-firstReleased:
+	case <-time.After(5 * time.Second):
+		t.Fatal("First replica never released the lease")
+	}
+	select {
+	case <-second:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Second replica never took over")
+	}
+}
+
+func TestLead(t *testing.T) {
+	select {
+	case <-Lead():
+	default:
+		t.Error("Single replica does not lead")
+	}
+}
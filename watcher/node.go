@@ -0,0 +1,265 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+var (
+	ErrNodeNotSelected    = errors.New("Node does not match the node selector")
+	ErrNodeNotReady       = errors.New("Node is NotReady for longer than the grace period")
+	ErrNodeMissingAddress = errors.New("Node has no address of the preferred types")
+)
+
+// Node address types published when none are configured, in order of
+// preference.
+var DefaultNodeAddressTypes = []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP, v1.NodeHostName}
+
+// Parse the template naming the record of a node, it is executed with the
+// v1.Node, e.g. {{.Name}}.k8s.home.lan.
+func ParseNodeNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("node").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid node name template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// Parse node address types, in order of preference.
+func ParseNodeAddressTypes(types []string) ([]v1.NodeAddressType, error) {
+	var parsed []v1.NodeAddressType
+	for _, t := range types {
+		switch addressType := v1.NodeAddressType(t); addressType {
+		case v1.NodeInternalIP, v1.NodeExternalIP, v1.NodeHostName, v1.NodeInternalDNS, v1.NodeExternalDNS:
+			parsed = append(parsed, addressType)
+		default:
+			return nil, fmt.Errorf("Unknown node address type [%s], must be InternalIP, ExternalIP, Hostname, InternalDNS or ExternalDNS", t)
+		}
+	}
+	return parsed, nil
+}
+
+func watcherNode(ctx context.Context, client kubernetes.Interface, dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig, ready <-chan struct{}, drain time.Duration, w *sync.WaitGroup) {
+	defer w.Done()
+
+	logrus.Info("Starting node watcher...")
+
+	// The selector is applied to the nodes in the store, so a node whose
+	// labels stop matching loses its records.
+	watchlist := cache.NewListWatchFromClient(
+		client.CoreV1().RESTClient(),
+		"nodes",
+		v1.NamespaceAll,
+		fields.Everything(),
+	)
+
+	var store cache.Store
+	var worker *queueWorker
+	worker = newQueueWorker("node", defaultRateLimiter(), func(ctx context.Context, key string) error {
+		return syncNode(ctx, key, store, worker.enqueueAfter, dnsProvider, reg, config)
+	})
+
+	store, controller := cache.NewInformer(
+		watchlist,
+		&v1.Node{},
+		0,
+		worker.handlers(),
+	)
+
+	runWorker(ctx, worker, controller, ready, drain)
+}
+
+// Make the records of the node keyed by name match the node in store. A node
+// which is gone, not selected or NotReady past the grace period wants no
+// records. A NotReady node within the grace period is queued again when the
+// period ends, nodes rarely change once they stop reporting.
+func syncNode(ctx context.Context, key string, store cache.Store, requeue func(key string, after time.Duration), dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig) error {
+	obj, exists, err := store.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	var desired []provider.Domain
+	if exists {
+		node, ok := obj.(*v1.Node)
+		if !ok {
+			return permanent(fmt.Errorf("cast failed %T to %T", obj, node))
+		}
+
+		now := time.Now()
+		if left := nodeGraceLeft(node, config.NodeNotReadyGrace, now); left > 0 {
+			requeue(key, left)
+		}
+
+		desired, err = desiredNodeRecords(node, config, now)
+		switch {
+		case errors.Is(err, ErrNodeNotSelected):
+		case wantsNoRecords(err):
+			logrus.WithFields(logrus.Fields{
+				"node": key,
+			}).Debugf("Node wants no records: %s", err)
+		case err != nil:
+			return permanent(err)
+		}
+	}
+
+	_, err = syncRecords(ctx, dnsProvider, reg, nodeOwner(key), desired)
+	return err
+}
+
+// Records a node wants at now: one name from the template, pointing at the
+// addresses of the first preferred type the node has in its IP family.
+func desiredNodeRecords(node *v1.Node, config SourceConfig, now time.Time) ([]provider.Domain, error) {
+	if config.NodeSelector != nil && !config.NodeSelector.Matches(labels.Set(node.Labels)) {
+		return nil, ErrNodeNotSelected
+	}
+
+	if !nodeReady(node, config.NodeNotReadyGrace, now) {
+		return nil, ErrNodeNotReady
+	}
+
+	family, err := getIPFamilyAnnotation(node.Annotations, config.IPFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := nodeTargets(node, config.NodeAddressTypes, family)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := nodeName(node, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return records([]string{host}, targets)
+}
+
+// The record name of node from the name template.
+func nodeName(node *v1.Node, config SourceConfig) (string, error) {
+	if config.NodeNameTemplate == nil {
+		return "", errors.New("No node name template")
+	}
+
+	var name bytes.Buffer
+	if err := config.NodeNameTemplate.Execute(&name, node); err != nil {
+		return "", fmt.Errorf("Could not name node [%s]: %w", node.Name, err)
+	}
+	return strings.ToLower(strings.TrimSpace(name.String())), nil
+}
+
+// The record targets of a node, the addresses of the first type in
+// preference, empty for the defaults, which has addresses in family. Host
+// names which are not fully qualified are skipped, a CNAME to them would not
+// resolve. The target annotation wins like it does for services.
+func nodeTargets(node *v1.Node, preference []v1.NodeAddressType, family IPFamily) ([]string, error) {
+	if target, ok := getTargetAnnotation(node.Annotations); ok {
+		return familyTargets([]string{target}, family)
+	}
+
+	if len(preference) == 0 {
+		preference = DefaultNodeAddressTypes
+	}
+
+	for _, addressType := range preference {
+		var addresses []string
+		for _, address := range node.Status.Addresses {
+			if address.Type == addressType && qualified(address.Address) {
+				addresses = append(addresses, address.Address)
+			}
+		}
+		if len(addresses) == 0 {
+			continue
+		}
+
+		targets, err := familyTargets(addresses, family)
+		if errors.Is(err, ErrNoAddressInFamily) {
+			continue
+		}
+		return targets, err
+	}
+
+	return nil, ErrNodeMissingAddress
+}
+
+// Whether a node address is an IP or a fully qualified name, e.g. not the
+// bare Hostname kubelet reports.
+func qualified(address string) bool {
+	if net.ParseIP(address) != nil {
+		return true
+	}
+	return strings.Contains(strings.Trim(address, "."), ".")
+}
+
+// Whether node is Ready, or NotReady for less than grace at now.
+func nodeReady(node *v1.Node, grace time.Duration, now time.Time) bool {
+	since, notReady := nodeNotReadySince(node)
+	return !notReady || now.Sub(since) < grace
+}
+
+// How long a NotReady node keeps its records from now, zero for Ready nodes
+// and nodes past the grace period.
+func nodeGraceLeft(node *v1.Node, grace time.Duration, now time.Time) time.Duration {
+	since, notReady := nodeNotReadySince(node)
+	if !notReady {
+		return 0
+	}
+	if left := since.Add(grace).Sub(now); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// When a node stopped being Ready. A node which never reported is NotReady
+// since it was created.
+func nodeNotReadySince(node *v1.Node) (time.Time, bool) {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != v1.NodeReady {
+			continue
+		}
+		if condition.Status == v1.ConditionTrue {
+			return time.Time{}, false
+		}
+		return condition.LastTransitionTime.Time, true
+	}
+	return node.CreationTimestamp.Time, true
+}
+
+// Whether a node update changes what services on node IPs publish, with
+// addresses of the first type in preference. A node NotReady before and
+// after gives them no targets, otherwise its readiness or its targets must
+// change, not its heartbeat or unrelated annotations.
+func nodeTargetsChanged(oldNode, newNode *v1.Node, preference []v1.NodeAddressType) bool {
+	_, oldNotReady := nodeNotReadySince(oldNode)
+	_, newNotReady := nodeNotReadySince(newNode)
+	if oldNotReady != newNotReady {
+		return true
+	}
+	if newNotReady {
+		return false
+	}
+
+	oldTargets, _ := nodeTargets(oldNode, preference, IPFamilyDual)
+	newTargets, _ := nodeTargets(newNode, preference, IPFamilyDual)
+	return !reflect.DeepEqual(oldTargets, newTargets)
+}
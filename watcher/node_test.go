@@ -0,0 +1,285 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	fake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+func exampleNode() *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "worker-1",
+			Labels: map[string]string{
+				"topology.kubernetes.io/zone": "rack-a",
+			},
+		},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: "worker-1"},
+				{Type: v1.NodeInternalIP, Address: "192.168.10.1"},
+				{Type: v1.NodeInternalIP, Address: "fd00::10:1"},
+				{Type: v1.NodeExternalIP, Address: "203.0.113.1"},
+			},
+			Conditions: []v1.NodeCondition{
+				{Type: v1.NodeReady, Status: v1.ConditionTrue},
+			},
+		},
+	}
+}
+
+// A source config publishing nodes as name.k8s.home.lan.
+func exampleNodeConfig(t *testing.T) SourceConfig {
+	tmpl, err := ParseNodeNameTemplate("{{.Name}}.k8s.home.lan")
+	if err != nil {
+		t.Fatalf("Error from ParseNodeNameTemplate: %s", err)
+	}
+	return SourceConfig{
+		NodeNameTemplate:  tmpl,
+		NodeNotReadyGrace: 5 * time.Minute,
+	}
+}
+
+// Mark node NotReady since since.
+func notReady(node *v1.Node, since time.Time) *v1.Node {
+	node = node.DeepCopy()
+	node.Status.Conditions = []v1.NodeCondition{
+		{Type: v1.NodeReady, Status: v1.ConditionUnknown, LastTransitionTime: metav1.NewTime(since)},
+	}
+	return node
+}
+
+func TestNodeTargets(t *testing.T) {
+	node := exampleNode()
+
+	// Test case 1: Internal addresses by default, limited by family
+	for family, expected := range map[IPFamily][]string{
+		IPFamilyDual: {"192.168.10.1", "fd00::10:1"},
+		IPFamilyIPv4: {"192.168.10.1"},
+		IPFamilyIPv6: {"fd00::10:1"},
+	} {
+		targets, err := nodeTargets(node, nil, family)
+		if err != nil || !reflect.DeepEqual(targets, expected) {
+			t.Errorf("%s: Targets: %v, Expected: %v. Error: %v", family, targets, expected, err)
+		}
+	}
+
+	// Test case 2: Preference order
+	targets, err := nodeTargets(node, []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP}, IPFamilyDual)
+	if err != nil || !reflect.DeepEqual(targets, []string{"203.0.113.1"}) {
+		t.Errorf("Targets: %v, Error: %v", targets, err)
+	}
+
+	// Test case 3: A preferred type without an address in the family is skipped
+	targets, err = nodeTargets(node, []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP}, IPFamilyIPv6)
+	if err != nil || !reflect.DeepEqual(targets, []string{"fd00::10:1"}) {
+		t.Errorf("Targets: %v, Error: %v", targets, err)
+	}
+
+	// Test case 4: A fully qualified hostname makes a CNAME target, a bare one is skipped
+	if _, err = nodeTargets(node, []v1.NodeAddressType{v1.NodeHostName}, IPFamilyDual); err != ErrNodeMissingAddress {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrNodeMissingAddress)
+	}
+	qualifiedNode := node.DeepCopy()
+	qualifiedNode.Status.Addresses = append(qualifiedNode.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalDNS, Address: "worker-1.home.lan"})
+	targets, err = nodeTargets(qualifiedNode, []v1.NodeAddressType{v1.NodeHostName, v1.NodeInternalDNS}, IPFamilyDual)
+	if err != nil || !reflect.DeepEqual(targets, []string{"worker-1.home.lan"}) {
+		t.Errorf("Targets: %v, Error: %v", targets, err)
+	}
+
+	// Test case 5: No address of a preferred type
+	if _, err = nodeTargets(node, []v1.NodeAddressType{v1.NodeExternalDNS}, IPFamilyDual); err != ErrNodeMissingAddress {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrNodeMissingAddress)
+	}
+
+	// Test case 6: Target annotation overrides the addresses
+	node.Annotations = map[string]string{"pifrost.tolson.io/target": "192.168.10.100"}
+	targets, err = nodeTargets(node, nil, IPFamilyDual)
+	if err != nil || !reflect.DeepEqual(targets, []string{"192.168.10.100"}) {
+		t.Errorf("Targets: %v, Error: %v", targets, err)
+	}
+}
+
+func TestNodeTargetsChanged(t *testing.T) {
+	node := exampleNode()
+
+	// Test case 1: Heartbeats and unrelated annotations change nothing
+	updated := node.DeepCopy()
+	updated.Annotations = map[string]string{"flannel.alpha.coreos.com/public-ip": "192.168.10.1"}
+	updated.Status.Conditions[0].LastHeartbeatTime = metav1.Now()
+	if nodeTargetsChanged(node, updated, nil) {
+		t.Error("Expected no change")
+	}
+
+	// Test case 2: New addresses, the target annotation and readiness do
+	updated = node.DeepCopy()
+	updated.Status.Addresses[1].Address = "192.168.10.2"
+	if !nodeTargetsChanged(node, updated, nil) {
+		t.Error("Expected an address change")
+	}
+	updated = node.DeepCopy()
+	updated.Annotations = map[string]string{"pifrost.tolson.io/target": "192.168.10.100"}
+	if !nodeTargetsChanged(node, updated, nil) {
+		t.Error("Expected a target change")
+	}
+	down := notReady(node, time.Now())
+	if !nodeTargetsChanged(node, down, nil) {
+		t.Error("Expected a readiness change")
+	}
+
+	// Test case 3: A node NotReady before and after gives no targets either way
+	updated = down.DeepCopy()
+	updated.Status.Addresses[1].Address = "192.168.10.2"
+	if nodeTargetsChanged(down, updated, nil) {
+		t.Error("Expected no change of a NotReady node")
+	}
+}
+
+func TestDesiredNodeRecords(t *testing.T) {
+	config := exampleNodeConfig(t)
+	now := time.Now()
+
+	// Test case 1: A record per address of the named node
+	records, err := desiredNodeRecords(exampleNode(), config, now)
+	expected := []provider.Domain{
+		provider.NewDomain("192.168.10.1", "worker-1.k8s.home.lan"),
+		provider.NewDomain("fd00::10:1", "worker-1.k8s.home.lan"),
+	}
+	if err != nil || !reflect.DeepEqual(records, expected) {
+		t.Errorf("Records: %v, Expected: %v. Error: %v", records, expected, err)
+	}
+
+	// Test case 2: Templates see the labels
+	config.NodeNameTemplate, _ = ParseNodeNameTemplate(`{{.Name}}.{{index .Labels "topology.kubernetes.io/zone"}}.home.lan`)
+	records, err = desiredNodeRecords(exampleNode(), config, now)
+	if err != nil || len(records) == 0 || records[0].Name() != "worker-1.rack-a.home.lan" {
+		t.Errorf("Records: %v, Error: %v", records, err)
+	}
+
+	// Test case 3: Nodes outside the selector
+	config = exampleNodeConfig(t)
+	config.NodeSelector, _ = labels.Parse("topology.kubernetes.io/zone=rack-b")
+	if _, err = desiredNodeRecords(exampleNode(), config, now); err != ErrNodeNotSelected {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrNodeNotSelected)
+	}
+
+	// Test case 4: NotReady within the grace period keeps the records
+	config = exampleNodeConfig(t)
+	if _, err = desiredNodeRecords(notReady(exampleNode(), now.Add(-time.Minute)), config, now); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	// Test case 5: NotReady past the grace period
+	if _, err = desiredNodeRecords(notReady(exampleNode(), now.Add(-time.Hour)), config, now); err != ErrNodeNotReady {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrNodeNotReady)
+	}
+
+	// Test case 6: Template naming an invalid domain
+	config.NodeNameTemplate, _ = ParseNodeNameTemplate("{{.Name}}..home.lan")
+	if _, err = desiredNodeRecords(exampleNode(), config, now); err == nil {
+		t.Error("Expected error for an invalid domain")
+	}
+}
+
+func TestSyncNode(t *testing.T) {
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	config := exampleNodeConfig(t)
+	key := "worker-1"
+
+	var requeued time.Duration
+	sync := func() {
+		t.Helper()
+		requeued = 0
+		requeue := func(key string, after time.Duration) {
+			requeued = after
+		}
+		if err := syncNode(context.Background(), key, store, requeue, ownedDNS, reg, config); err != nil {
+			t.Errorf("Node sync test error: %s", err)
+		}
+	}
+
+	// Test case 1: Ready node
+	store.Add(exampleNode())
+	sync()
+	if fakeDNS.records["worker-1.k8s.home.lan"] != "192.168.10.1" || fakeDNS.aaaa["worker-1.k8s.home.lan"] != "fd00::10:1" {
+		t.Errorf("Expected A and AAAA records, got: %v, %v", fakeDNS.records, fakeDNS.aaaa)
+	}
+	if owner, _ := reg.Owner(provider.NewDomain("192.168.10.1", "worker-1.k8s.home.lan")); owner != "node/worker-1" {
+		t.Errorf("Owner: %s", owner)
+	}
+
+	// Test case 2: NotReady within the grace period, checked again when it ends
+	store.Update(notReady(exampleNode(), time.Now().Add(-time.Minute)))
+	sync()
+	if len(fakeDNS.records) != 1 || requeued <= 3*time.Minute || requeued > 4*time.Minute {
+		t.Errorf("Records: %v, Requeued after: %s", fakeDNS.records, requeued)
+	}
+
+	// Test case 3: NotReady past the grace period
+	store.Update(notReady(exampleNode(), time.Now().Add(-time.Hour)))
+	sync()
+	if len(fakeDNS.records) != 0 || len(fakeDNS.aaaa) != 0 || requeued != 0 {
+		t.Errorf("Expected no records, got: %v, %v. Requeued after: %s", fakeDNS.records, fakeDNS.aaaa, requeued)
+	}
+
+	// Test case 4: Ready again, then deleted
+	store.Update(exampleNode())
+	sync()
+	if fakeDNS.records["worker-1.k8s.home.lan"] != "192.168.10.1" {
+		t.Errorf("Expected worker-1 record, got: %v", fakeDNS.records)
+	}
+	store.Delete(exampleNode())
+	sync()
+	if len(fakeDNS.records) != 0 || len(fakeDNS.aaaa) != 0 {
+		t.Errorf("Expected no records, got: %v, %v", fakeDNS.records, fakeDNS.aaaa)
+	}
+}
+
+func TestParseNodeAddressTypes(t *testing.T) {
+	// Test case 1: Known types keep their order
+	types, err := ParseNodeAddressTypes([]string{"ExternalIP", "InternalIP"})
+	if err != nil || !reflect.DeepEqual(types, []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP}) {
+		t.Errorf("Types: %v, Error: %v", types, err)
+	}
+
+	// Test case 2: Unknown type
+	if _, err = ParseNodeAddressTypes([]string{"PublicIP"}); err == nil {
+		t.Error("Expected error for an unknown type")
+	}
+
+	// Test case 3: Invalid template
+	if _, err = ParseNodeNameTemplate("{{.Name"); err == nil || errors.Unwrap(err) == nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
+func TestReconcileNodes(t *testing.T) {
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	gone := notReady(exampleNode(), time.Now().Add(-time.Hour))
+	gone.Name = "worker-2"
+	client := fake.NewSimpleClientset(exampleNode(), gone)
+
+	// Test case 1: Only the Ready node is published
+	reconciler := NewReconciler(client, nil, ownedDNS, reg, exampleNodeConfig(t), time.Minute, false)
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile error: %s", err)
+	}
+	if fakeDNS.records["worker-1.k8s.home.lan"] != "192.168.10.1" || len(fakeDNS.records) != 1 {
+		t.Errorf("Expected only the worker-1 record, got: %v", fakeDNS.records)
+	}
+	if owner, _ := reg.Owner(provider.NewDomain("fd00::10:1", "worker-1.k8s.home.lan")); owner != "node/worker-1" {
+		t.Errorf("Owner: %s", owner)
+	}
+}
@@ -0,0 +1,132 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+const (
+	PlanCreate   = "create"
+	PlanUpdate   = "update"
+	PlanDelete   = "delete"
+	PlanAdopt    = "adopt"
+	PlanConflict = "conflict"
+)
+
+// PlannedChange is a record change a reconcile pass would make.
+type PlannedChange struct {
+	// create, update, delete, adopt or conflict. An adopt claims a record
+	// pifrost does not own which already matches, a conflict touches records
+	// pifrost does not own and fails with the error policy.
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	// What the record should resolve to, empty for deletes.
+	Value string `json:"value,omitempty"`
+	// What the provider holds for the name right now.
+	Current []string `json:"current,omitempty"`
+	// Object wanting the record, for deletes the object which created it.
+	Owner string `json:"owner,omitempty"`
+}
+
+// Plan runs the comparison of a reconcile pass without changing anything.
+// Orphaned records are only planned for deletion when prune is set, like
+// Reconcile only deletes them then. Changes touching records pifrost does
+// not own are resolved with policy like the server does, skipped ones are
+// left out.
+func (r *Reconciler) Plan(ctx context.Context, policy registry.ConflictPolicy) ([]PlannedChange, error) {
+	desired, owners, err := r.desiredRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := r.dnsProvider.GetDNS(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list provider records: %s", err)
+	}
+
+	have := map[string][]provider.Domain{}
+	for _, d := range current {
+		have[d.Name()] = append(have[d.Name()], d)
+	}
+
+	capabilities := r.dnsProvider.Capabilities()
+	diff := diffRecords(desired, current, capabilities, r.registry.Owns)
+
+	var changes []PlannedChange
+	for _, d := range diff.create {
+		changes = append(changes, plannedChange(PlanCreate, d, nil, owners[d]))
+	}
+	for _, d := range diff.update {
+		replaced := replacedBy(capabilities, d, have[d.Name()])
+		unowned := false
+		for _, c := range replaced {
+			if !r.registry.Owns(c) {
+				unowned = true
+			}
+		}
+		if action, ok := conflictAction(policy, PlanUpdate, unowned, d); ok {
+			changes = append(changes, plannedChange(action, d, replaced, owners[d]))
+		}
+	}
+	for _, d := range diff.adopt {
+		if action, ok := conflictAction(policy, PlanAdopt, true, d); ok {
+			changes = append(changes, plannedChange(action, d, []provider.Domain{d}, owners[d]))
+		}
+	}
+	if r.prune {
+		for _, d := range diff.delete {
+			owner, _ := r.registry.Owner(d)
+			change := plannedChange(PlanDelete, d, have[d.Name()], owner)
+			change.Value = ""
+			changes = append(changes, change)
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return changes, nil
+}
+
+// The planned action of a change touching unowned records under policy, not
+// ok when the server skips the change.
+func conflictAction(policy registry.ConflictPolicy, action string, unowned bool, d provider.Domain) (string, bool) {
+	if !unowned {
+		return action, true
+	}
+
+	switch policy {
+	case registry.PolicyTakeover:
+		return action, true
+	case registry.PolicySkip:
+		logrus.WithFields(logrus.Fields{
+			"domain": d.Name(),
+			"target": d.Value(),
+		}).Info("Record not owned by pifrost, server skips it")
+		return "", false
+	}
+	return PlanConflict, true
+}
+
+func plannedChange(action string, d provider.Domain, current []provider.Domain, owner string) PlannedChange {
+	change := PlannedChange{
+		Action: action,
+		Name:   d.Name(),
+		Type:   d.Type(),
+		Value:  d.Value(),
+		Owner:  owner,
+	}
+	for _, c := range current {
+		change.Current = append(change.Current, c.Value())
+	}
+
+	return change
+}
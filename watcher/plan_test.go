@@ -0,0 +1,79 @@
+package watcher
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	fake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+func TestPlan(t *testing.T) {
+	ingress := exampleIngress("a.example.com", "b.example.com", "c.example.com")
+	ingress.Annotations["pifrost.tolson.io/ingress"] = "true"
+
+	fakeClient := fake.NewSimpleClientset(exampleService(), ingress)
+	fakeDNS := newFakeProvider()
+	fakeDNS.records = map[string]string{
+		// Ours, wrong IP
+		"a.example.com": "10.0.0.1",
+		// Hand made, wrong IP
+		"b.example.com": "10.0.0.2",
+		// Hand made, already right
+		"c.example.com": "192.168.5.1",
+		// Ours, nobody wants it
+		"orphan.example.com": "10.0.0.4",
+	}
+
+	reg, _ := registry.New(context.Background(), registry.MemoryStore{})
+	reg.Claim(context.Background(), provider.NewDomain("10.0.0.1", "a.example.com"), "ingress/default/example-ingress")
+	reg.Claim(context.Background(), provider.NewDomain("10.0.0.4", "orphan.example.com"), "service/default/gone")
+
+	// Test case 1: Every kind of change, without prune orphans stay
+	reconciler := NewReconciler(fakeClient, nil, fakeDNS, reg, SourceConfig{}, time.Minute, false)
+	changes, err := reconciler.Plan(context.Background(), registry.PolicyError)
+	if err != nil {
+		t.Fatalf("Plan error: %s", err)
+	}
+
+	expected := []PlannedChange{
+		{Action: PlanUpdate, Name: "a.example.com", Type: "A", Value: "192.168.5.1", Current: []string{"10.0.0.1"}, Owner: "ingress/default/example-ingress"},
+		{Action: PlanConflict, Name: "b.example.com", Type: "A", Value: "192.168.5.1", Current: []string{"10.0.0.2"}, Owner: "ingress/default/example-ingress"},
+		{Action: PlanConflict, Name: "c.example.com", Type: "A", Value: "192.168.5.1", Current: []string{"192.168.5.1"}, Owner: "ingress/default/example-ingress"},
+		{Action: PlanCreate, Name: "example.com", Type: "A", Value: "192.168.5.1", Owner: "service/default/example-service"},
+	}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Errorf("Changes: %+v, Expected: %+v.", changes, expected)
+	}
+
+	// Test case 2: The skip policy leaves unowned records out, the server does not touch them
+	changes, _ = reconciler.Plan(context.Background(), registry.PolicySkip)
+	expected = []PlannedChange{expected[0], expected[3]}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Errorf("Changes: %+v, Expected: %+v.", changes, expected)
+	}
+
+	// Test case 3: The takeover policy updates and adopts them
+	changes, _ = reconciler.Plan(context.Background(), registry.PolicyTakeover)
+	if len(changes) != 4 || changes[1].Action != PlanUpdate || changes[2].Action != PlanAdopt {
+		t.Errorf("Changes: %+v", changes)
+	}
+
+	// Test case 4: Prune plans the orphan for deletion
+	reconciler = NewReconciler(fakeClient, nil, fakeDNS, reg, SourceConfig{}, time.Minute, true)
+	changes, _ = reconciler.Plan(context.Background(), registry.PolicySkip)
+	last := changes[len(changes)-1]
+	orphan := PlannedChange{Action: PlanDelete, Name: "orphan.example.com", Type: "A", Current: []string{"10.0.0.4"}, Owner: "service/default/gone"}
+	if !reflect.DeepEqual(orphan, last) {
+		t.Errorf("Change: %+v, Expected: %+v.", last, orphan)
+	}
+
+	// Test case 5: Nothing was changed
+	if len(fakeDNS.changes) != 0 {
+		t.Errorf("Plan changed records: %v", fakeDNS.changes)
+	}
+}
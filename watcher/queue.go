@@ -0,0 +1,203 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// How often a key is retried before it is dropped. With the default rate
+// limiter this is roughly eight minutes of backoff, the reconciler picks up
+// anything dropped after that.
+const maxRetries = 10
+
+// Number of keys waiting in each queue, served on /debug/vars.
+var queueDepth = expvar.NewMap("pifrost_queue_depth")
+
+// permanentError marks sync errors retrying will not fix, such as an
+// annotation holding an invalid domain.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return &permanentError{
+		err: err,
+	}
+}
+
+// Per key exponential backoff from half a second to five minutes, so an
+// outage does not hammer the DNS provider.
+func defaultRateLimiter() workqueue.RateLimiter {
+	return workqueue.NewItemExponentialFailureRateLimiter(500*time.Millisecond, 5*time.Minute)
+}
+
+// drainContext returns a context which is cancelled drain after ctx, so work
+// started before shutdown gets a bounded time to finish.
+func drainContext(ctx context.Context, drain time.Duration) (context.Context, context.CancelFunc) {
+	drainCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(drain, cancel)
+	})
+
+	return drainCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// queueWorker feeds informer events into a rate limited workqueue as
+// namespace/name keys, and syncs each key. Event handlers never do work
+// themselves, sync reads the latest object from the informer store.
+type queueWorker struct {
+	name  string
+	queue workqueue.RateLimitingInterface
+	sync  func(ctx context.Context, key string) error
+}
+
+func newQueueWorker(name string, rateLimiter workqueue.RateLimiter, sync func(ctx context.Context, key string) error) *queueWorker {
+	queue := workqueue.NewRateLimitingQueueWithConfig(rateLimiter, workqueue.RateLimitingQueueConfig{
+		Name: name,
+	})
+	queueDepth.Set(name, expvar.Func(func() any {
+		return queue.Len()
+	}))
+
+	return &queueWorker{
+		name:  name,
+		queue: queue,
+		sync:  sync,
+	}
+}
+
+// Depth is the number of keys waiting to be synced.
+func (qw *queueWorker) Depth() int {
+	return qw.queue.Len()
+}
+
+// Event handlers for the informer feeding the queue.
+func (qw *queueWorker) handlers() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			qw.enqueue(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			qw.enqueue(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			qw.enqueue(obj)
+		},
+	}
+}
+
+func (qw *queueWorker) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"queue": qw.name,
+		}).Errorf("Could not get object key: %s", err)
+		return
+	}
+	qw.queue.Add(key)
+}
+
+// Queue key on behalf of another object, such as the EndpointSlice of a
+// service.
+func (qw *queueWorker) enqueueKey(key string) {
+	qw.queue.Add(key)
+}
+
+// Queue key again after d, for records which change with time rather than
+// with an event.
+func (qw *queueWorker) enqueueAfter(key string, d time.Duration) {
+	qw.queue.AddAfter(key, d)
+}
+
+// Run processes keys until ctx is cancelled. A sync in flight at that point
+// is given up to drain to finish before its context is cancelled too. Keys
+// still waiting are dropped, the informer lists them again on next start.
+func (qw *queueWorker) Run(ctx context.Context, drain time.Duration) {
+	syncCtx, cancel := drainContext(ctx, drain)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for qw.processNextItem(ctx, syncCtx) {
+		}
+	}()
+
+	<-ctx.Done()
+	qw.queue.ShutDown()
+	<-done
+
+	logrus.WithFields(logrus.Fields{
+		"queue": qw.name,
+	}).Info("Queue drained")
+}
+
+func (qw *queueWorker) processNextItem(ctx, syncCtx context.Context) bool {
+	key, quit := qw.queue.Get()
+	if quit {
+		return false
+	}
+	defer qw.queue.Done(key)
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	err := qw.sync(syncCtx, key.(string))
+	qw.handleErr(syncCtx, err, key)
+
+	return true
+}
+
+func (qw *queueWorker) handleErr(ctx context.Context, err error, key interface{}) {
+	if err == nil {
+		qw.queue.Forget(key)
+		return
+	}
+
+	fields := logrus.Fields{
+		"queue": qw.name,
+		"key":   key,
+	}
+
+	if ctx.Err() != nil {
+		logrus.WithFields(fields).Warnf("Sync cut short by shutdown: %s", err)
+		qw.queue.Forget(key)
+		return
+	}
+
+	var permErr *permanentError
+	if errors.As(err, &permErr) {
+		logrus.WithFields(fields).Warnf("Dropping, retry will not help: %s", err)
+		qw.queue.Forget(key)
+		return
+	}
+
+	retries := qw.queue.NumRequeues(key)
+	if retries < maxRetries {
+		fields["retry"] = retries + 1
+		logrus.WithFields(fields).Infof("Sync failed, retrying: %s", err)
+		qw.queue.AddRateLimited(key)
+		return
+	}
+
+	logrus.WithFields(fields).Errorf("Dropping after %d retries: %s", maxRetries, err)
+	qw.queue.Forget(key)
+}
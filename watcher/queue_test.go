@@ -0,0 +1,134 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestQueueWorker(t *testing.T) {
+	calls := map[string]int{}
+	worker := newQueueWorker("queue-test", workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond), func(ctx context.Context, key string) error {
+		calls[key]++
+		switch key {
+		case "default/flaky":
+			if calls[key] < 3 {
+				return errors.New("pi-hole unreachable")
+			}
+		case "default/broken":
+			return permanent(errors.New("invalid domain"))
+		case "default/down":
+			return errors.New("pi-hole unreachable")
+		}
+		return nil
+	})
+
+	for _, key := range []string{"default/ok", "default/flaky", "default/broken", "default/down"} {
+		worker.queue.Add(key)
+	}
+	if worker.Depth() != 4 {
+		t.Errorf("Depth: %d, Expected: 4.", worker.Depth())
+	}
+
+	// Process until every key is forgotten.
+	deadline := time.Now().Add(5 * time.Second)
+	for worker.Depth() != 0 || calls["default/down"] <= maxRetries {
+		if time.Now().After(deadline) {
+			t.Fatalf("Queue did not drain: %v", calls)
+		}
+		if worker.Depth() == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		worker.processNextItem(context.Background(), context.Background())
+	}
+
+	expected := map[string]int{
+		// Synced once.
+		"default/ok": 1,
+		// Transient errors are retried.
+		"default/flaky": 3,
+		// Permanent errors are dropped straight away.
+		"default/broken": 1,
+		// Transient errors are dropped after maxRetries.
+		"default/down": maxRetries + 1,
+	}
+	for key, n := range expected {
+		if calls[key] != n {
+			t.Errorf("Calls for %s: %d, Expected: %d.", key, calls[key], n)
+		}
+	}
+	if worker.queue.NumRequeues("default/down") != 0 {
+		t.Error("Dropped key still tracked by the rate limiter")
+	}
+}
+
+func TestQueueWorkerDrain(t *testing.T) {
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	var cut []string
+	worker := newQueueWorker("drain-test", defaultRateLimiter(), func(ctx context.Context, key string) error {
+		started <- key
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			cut = append(cut, key)
+			return ctx.Err()
+		}
+	})
+
+	// Test case 1: The sync in flight finishes, waiting keys are dropped
+	ctx, cancel := context.WithCancel(context.Background())
+	worker.queue.Add("default/a")
+	worker.queue.Add("default/b")
+
+	done := make(chan struct{})
+	go func() {
+		worker.Run(ctx, 5*time.Second)
+		close(done)
+	}()
+
+	if key := <-started; key != "default/a" {
+		t.Fatalf("Started: %s, Expected: default/a.", key)
+	}
+	cancel()
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the sync in flight finished")
+	}
+	if len(started) != 0 || len(cut) != 0 {
+		t.Errorf("Expected only default/a to sync, also started: %d, cut: %v", len(started), cut)
+	}
+
+	// Test case 2: A sync outlasting the drain period is cancelled
+	worker = newQueueWorker("drain-test-slow", defaultRateLimiter(), worker.sync)
+	release = make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	worker.queue.Add("default/slow")
+
+	done = make(chan struct{})
+	go func() {
+		worker.Run(ctx, 50*time.Millisecond)
+		close(done)
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the drain period")
+	}
+	if !reflect.DeepEqual(cut, []string{"default/slow"}) {
+		t.Errorf("Cut short: %v, Expected: [default/slow].", cut)
+	}
+}
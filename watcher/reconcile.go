@@ -0,0 +1,511 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	v1Networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+// Reconciler periodically compares the records all watched objects want with
+// what the DNS provider holds, and repairs the difference. This catches events
+// missed while pifrost was down and handlers which failed.
+type Reconciler struct {
+	client      kubernetes.Interface
+	dynamic     dynamic.Interface
+	dnsProvider provider.DNSProvider
+	registry    *registry.Registry
+	config      SourceConfig
+	interval    time.Duration
+	prune       bool
+}
+
+// Result of comparing desired records with provider records.
+type recordDiff struct {
+	create []provider.Domain
+	update []provider.Domain
+	delete []provider.Domain
+	// Desired records which exist but are not owned yet.
+	adopt []provider.Domain
+}
+
+// The DNS provider should be wrapped by registry.NewOwnedProvider with the
+// same registry, so records the reconciler creates are claimed. The dynamic
+// client reads Gateway API routes, it may be nil without config.GatewayAPI.
+func NewReconciler(client kubernetes.Interface, dynamicClient dynamic.Interface, dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig, interval time.Duration, prune bool) *Reconciler {
+	return &Reconciler{
+		client:      client,
+		dynamic:     dynamicClient,
+		dnsProvider: dnsProvider,
+		registry:    reg,
+		config:      config,
+		interval:    interval,
+		prune:       prune,
+	}
+}
+
+// Run reconciles on start and every interval until ctx is cancelled. A pass
+// in flight at that point is given up to drain to finish.
+func (r *Reconciler) Run(ctx context.Context, drain time.Duration) {
+	logrus.WithFields(logrus.Fields{
+		"interval": r.interval,
+		"prune":    r.prune,
+	}).Info("Starting reconciler...")
+
+	passCtx, cancel := drainContext(ctx, drain)
+	defer cancel()
+
+	// Records which went stale while pifrost was down are repaired right
+	// away, not an interval later.
+	if err := r.Reconcile(passCtx); err != nil {
+		logrus.Errorf("Reconcile error: %s", err)
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reconcile(passCtx); err != nil {
+				logrus.Errorf("Reconcile error: %s", err)
+			}
+		}
+	}
+}
+
+// Reconcile runs a single full pass, stopping early when ctx is cancelled.
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	desired, owners, err := r.desiredRecords(ctx)
+	if err != nil {
+		return err
+	}
+
+	current, err := r.dnsProvider.GetDNS(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not list provider records: %s", err)
+	}
+
+	diff := diffRecords(desired, current, r.dnsProvider.Capabilities(), r.registry.Owns)
+
+	logrus.WithFields(logrus.Fields{
+		"desired": len(desired),
+		"create":  len(diff.create),
+		"update":  len(diff.update),
+		"orphan":  len(diff.delete),
+		"adopt":   len(diff.adopt),
+	}).Info("Reconciling records")
+
+	// Adopting is an add of an existing record, the conflict policy decides
+	// whether it becomes ours.
+	for _, d := range append(append(diff.create, diff.update...), diff.adopt...) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = addRecord(ctx, r.dnsProvider, owners[d], d.Name(), d.Value())
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"domain": d.Name(),
+			}).Errorf("Reconcile could not create record: %s", err)
+		}
+	}
+
+	for _, d := range diff.delete {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !r.prune {
+			logrus.WithFields(logrus.Fields{
+				"domain": d.Name(),
+				"target": d.Value(),
+			}).Info("Orphaned record, enable --prune to remove")
+			continue
+		}
+
+		owner, _ := r.registry.Owner(d)
+		err = delRecord(ctx, r.dnsProvider, owner, d.Name(), d.Value())
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"domain": d.Name(),
+			}).Errorf("Reconcile could not remove orphaned record: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Every record the watched services, ingresses, nodes, routes and
+// DNSEndpoints want right now, and the object wanting it.
+func (r *Reconciler) desiredRecords(ctx context.Context) ([]provider.Domain, map[provider.Domain]string, error) {
+	var desired []provider.Domain
+	owners := map[provider.Domain]string{}
+
+	services, err := r.client.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not list services: %s", err)
+	}
+	nodes := &v1.NodeList{}
+	if r.config.ServiceNodeIPs || r.config.NodeNameTemplate != nil {
+		nodes, err = r.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not list nodes: %s", err)
+		}
+	}
+	sources := serviceSources{
+		nodes: cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+	if r.config.HeadlessServices {
+		slices, err := r.client.DiscoveryV1().EndpointSlices(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not list endpoint slices: %s", err)
+		}
+		sources.slices = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{sliceServiceIndex: sliceServiceKey})
+		for i := range slices.Items {
+			sources.slices.Add(&slices.Items[i])
+		}
+	}
+	for i := range nodes.Items {
+		sources.nodes.Add(&nodes.Items[i])
+	}
+
+	for i := range services.Items {
+		key := objectKey(&services.Items[i].ObjectMeta)
+		records, err := desiredServiceRecords(&services.Items[i], sources, r.config)
+		records = r.wanted(serviceOwner(key), records, err)
+		for _, d := range records {
+			if _, ok := owners[d]; !ok {
+				owners[d] = serviceOwner(key)
+			}
+		}
+		desired = append(desired, records...)
+	}
+
+	ingresses, err := r.client.NetworkingV1().Ingresses(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not list ingresses: %s", err)
+	}
+	for i := range ingresses.Items {
+		owner := ingressOwner(objectKey(&ingresses.Items[i].ObjectMeta))
+		records, err := desiredIngressRecords(&ingresses.Items[i], r.config)
+		records = r.wanted(owner, records, err)
+		for _, d := range records {
+			if _, ok := owners[d]; !ok {
+				owners[d] = owner
+			}
+		}
+		desired = append(desired, records...)
+	}
+
+	if r.config.NodeNameTemplate != nil {
+		now := time.Now()
+		for i := range nodes.Items {
+			owner := nodeOwner(nodes.Items[i].ObjectMeta.Name)
+			records, err := desiredNodeRecords(&nodes.Items[i], r.config, now)
+			records = r.wanted(owner, records, err)
+			for _, d := range records {
+				if _, ok := owners[d]; !ok {
+					owners[d] = owner
+				}
+			}
+			desired = append(desired, records...)
+		}
+	}
+
+	if r.config.GatewayAPI && r.dynamic != nil {
+		routes, routeOwners, err := r.desiredRouteRecords(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, d := range routes {
+			if _, ok := owners[d]; !ok {
+				owners[d] = routeOwners[d]
+			}
+		}
+		desired = append(desired, routes...)
+	}
+
+	if r.config.DNSEndpoint && r.dynamic != nil {
+		endpoints, endpointOwners, err := r.desiredDNSEndpointRecords(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, d := range endpoints {
+			if _, ok := owners[d]; !ok {
+				owners[d] = endpointOwners[d]
+			}
+		}
+		desired = append(desired, endpoints...)
+	}
+
+	return desired, owners, nil
+}
+
+// Every record the DNSEndpoints want, and the DNSEndpoint wanting it. Nothing
+// when the CRD is not installed.
+func (r *Reconciler) desiredDNSEndpointRecords(ctx context.Context) ([]provider.Domain, map[provider.Domain]string, error) {
+	gvr, ok, err := dnsEndpointResource(r.client.Discovery())
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+
+	list, err := r.dynamic.Resource(gvr).Namespace(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not list DNSEndpoints: %s", err)
+	}
+
+	var desired []provider.Domain
+	owners := map[provider.Domain]string{}
+	for i := range list.Items {
+		owner := dnsEndpointOwner(list.Items[i].GetNamespace() + "/" + list.Items[i].GetName())
+		records, _, err := desiredDNSEndpointRecords(&list.Items[i], r.dnsProvider.Capabilities())
+		records = r.wanted(owner, records, err)
+		for _, d := range records {
+			if _, ok := owners[d]; !ok {
+				owners[d] = owner
+			}
+		}
+		desired = append(desired, records...)
+	}
+
+	return desired, owners, nil
+}
+
+// Every record the Gateway API routes want, and the route wanting it. Route
+// kinds the cluster does not serve are skipped.
+func (r *Reconciler) desiredRouteRecords(ctx context.Context) ([]provider.Domain, map[provider.Domain]string, error) {
+	resources, err := gatewayResources(r.client.Discovery())
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := resources[KindGateway]; !ok {
+		return nil, nil, nil
+	}
+
+	list, err := r.dynamic.Resource(resources[KindGateway]).Namespace(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not list gateways: %s", err)
+	}
+	gateways := map[string]*unstructured.Unstructured{}
+	for i := range list.Items {
+		gateways[list.Items[i].GetNamespace()+"/"+list.Items[i].GetName()] = &list.Items[i]
+	}
+	lookup := func(key string) (*unstructured.Unstructured, bool) {
+		gateway, ok := gateways[key]
+		return gateway, ok
+	}
+
+	var desired []provider.Domain
+	owners := map[provider.Domain]string{}
+	for _, kind := range routeKinds {
+		gvr, ok := resources[kind]
+		if !ok {
+			continue
+		}
+		routes, err := r.dynamic.Resource(gvr).Namespace(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not list %s: %s", gvr.Resource, err)
+		}
+		for i := range routes.Items {
+			route := &routes.Items[i]
+			owner := routeOwner(kind, route.GetNamespace()+"/"+route.GetName())
+			records, err := desiredRouteRecords(kind, route, lookup, r.config)
+			records = r.wanted(owner, records, err)
+			for _, d := range records {
+				if _, ok := owners[d]; !ok {
+					owners[d] = owner
+				}
+			}
+			desired = append(desired, records...)
+		}
+	}
+
+	return desired, owners, nil
+}
+
+// The records owner wants given the outcome of computing them. An object
+// which opted out or can not have records wants none. Any other error may
+// pass, the records owner holds are kept so --prune does not delete them as
+// orphans.
+func (r *Reconciler) wanted(owner string, records []provider.Domain, err error) []provider.Domain {
+	if err == nil {
+		return records
+	}
+
+	fields := logrus.Fields{
+		"owner": owner,
+	}
+	if wantsNoRecords(err) {
+		logrus.WithFields(fields).Debugf("Skipping object: %s", err)
+		return nil
+	}
+
+	held := r.registry.OwnedBy(owner)
+	logrus.WithFields(fields).Warnf("Could not compute records, keeping the %d held: %s", len(held), err)
+	return held
+}
+
+// Records a service wants, at the addresses of its target source. Headless
+// services have no load balancer, with config.HeadlessServices they take
+// their addresses from their EndpointSlices unless an annotation names a
+// target or another source.
+func desiredServiceRecords(service *v1.Service, sources serviceSources, config SourceConfig) ([]provider.Domain, error) {
+	host, hasIt := getSvcAnnotation(service.Annotations)
+	if !hasIt {
+		return nil, ErrSvcMissingAnnotation
+	}
+
+	family, err := getIPFamilyAnnotation(service.Annotations, config.IPFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := getTargetSourceAnnotation(service.Annotations, config.ServiceTargetSource)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := getTargetAnnotation(service.Annotations); !ok && source == TargetSourceLoadBalancer && config.HeadlessServices && isHeadless(service) {
+		return headlessServiceRecords(service, host, sources.endpointSlices(objectKey(&service.ObjectMeta)), family)
+	}
+
+	var nodes []*v1.Node
+	if source == TargetSourceNodeIPs {
+		if !config.ServiceNodeIPs {
+			return nil, ErrSvcNodeIPsDisabled
+		}
+		nodes = sources.nodeList()
+	}
+
+	targets, err := serviceTargets(service, source, nodes, config.NodeAddressTypes, family)
+	if err != nil {
+		return nil, err
+	}
+
+	return records([]string{host}, targets)
+}
+
+// Records an ingress wants.
+func desiredIngressRecords(ingress *v1Networking.Ingress, config SourceConfig) ([]provider.Domain, error) {
+	if !config.IngressAuto && !hasIngressAnnotation(ingress.Annotations) {
+		return nil, ErrIngMissingAnnotation
+	}
+
+	family, err := getIPFamilyAnnotation(ingress.Annotations, config.IPFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := ingressTargets(ingress, config.IngressExternalIP, family)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	for _, rule := range ingress.Spec.Rules {
+		if len(rule.Host) != 0 {
+			hosts = append(hosts, rule.Host)
+		}
+	}
+
+	return records(hosts, targets)
+}
+
+// A record for every host and target.
+func records(hosts, targets []string) ([]provider.Domain, error) {
+	var records []provider.Domain
+	for _, host := range hosts {
+		for _, target := range targets {
+			changeSet, err := provider.CreateChangeSet(target, host, "add")
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, changeSet.Domain())
+		}
+	}
+
+	return records, nil
+}
+
+// Compare desired records with those held by a provider with capabilities.
+// Desired records which replace provider records are updates, matching
+// records owned by someone else are adopted, records nobody wants and no
+// desired record replaces are only deleted when owned says they belong to
+// pifrost.
+func diffRecords(desired, current []provider.Domain, capabilities provider.Capabilities, owned func(provider.Domain) bool) recordDiff {
+	var diff recordDiff
+
+	kept, dropped := fit(capabilities, desired)
+	wanted := map[string][]provider.Domain{}
+	for _, d := range kept {
+		wanted[d.Name()] = append(wanted[d.Name()], d)
+	}
+	for _, d := range dropped {
+		logrus.WithFields(logrus.Fields{
+			"domain": d.Name(),
+			"kept":   replacedBy(capabilities, d, wanted[d.Name()])[0].Value(),
+			"ignore": d.Value(),
+		}).Warn("Desired records of the domain can not coexist")
+	}
+
+	have := map[string][]provider.Domain{}
+	for _, d := range current {
+		have[d.Name()] = append(have[d.Name()], d)
+	}
+
+	for name, records := range wanted {
+		for _, d := range records {
+			switch {
+			case len(replacedBy(capabilities, d, have[name])) != 0:
+				diff.update = append(diff.update, d)
+			case !contains(have[name], d):
+				diff.create = append(diff.create, d)
+			case !owned(d):
+				diff.adopt = append(diff.adopt, d)
+			}
+		}
+	}
+
+	for _, d := range current {
+		if wants(capabilities, wanted[d.Name()], d) {
+			continue
+		}
+		if owned(d) {
+			diff.delete = append(diff.delete, d)
+		}
+	}
+
+	sortRecords(diff.create)
+	sortRecords(diff.update)
+	sortRecords(diff.delete)
+	sortRecords(diff.adopt)
+
+	return diff
+}
+
+func sortRecords(records []provider.Domain) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name() != records[j].Name() {
+			return records[i].Name() < records[j].Name()
+		}
+		if records[i].Type() != records[j].Type() {
+			return records[i].Type() < records[j].Type()
+		}
+		return records[i].Value() < records[j].Value()
+	})
+}
@@ -0,0 +1,230 @@
+package watcher
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	v1Networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+func TestReconcile(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "example-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"pifrost.tolson.io/domain": "svc.example.com",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{
+				Ingress: []v1.LoadBalancerIngress{
+					{
+						IP: "192.168.5.1",
+					},
+				},
+			},
+		},
+	}
+
+	ingress := &v1Networking.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "example-ingress",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"pifrost.tolson.io/ingress": "true",
+			},
+		},
+		Spec: v1Networking.IngressSpec{
+			Rules: []v1Networking.IngressRule{
+				{
+					Host: "a.example.com",
+				},
+				{
+					Host: "b.example.com",
+				},
+			},
+		},
+		Status: v1Networking.IngressStatus{
+			LoadBalancer: v1Networking.IngressLoadBalancerStatus{
+				Ingress: []v1Networking.IngressLoadBalancerIngress{
+					{
+						IP: "192.168.5.2",
+					},
+				},
+			},
+		},
+	}
+
+	// Ignored, no annotation.
+	unmanaged := ingress.DeepCopy()
+	unmanaged.Name = "unmanaged-ingress"
+	unmanaged.Annotations = map[string]string{}
+	unmanaged.Spec.Rules = []v1Networking.IngressRule{{Host: "unmanaged.example.com"}}
+
+	fakeClient := fake.NewSimpleClientset(service, ingress, unmanaged)
+	fakeDNS := newFakeProvider()
+	fakeDNS.records = map[string]string{
+		// Wrong IP
+		"a.example.com": "10.0.0.1",
+		// Hand made
+		"router.example.com": "192.168.1.1",
+	}
+
+	reg, _ := registry.New(context.Background(), registry.MemoryStore{})
+	ownedDNS := registry.NewOwnedProvider(fakeDNS, reg, registry.PolicyTakeover)
+	reconciler := NewReconciler(fakeClient, nil, ownedDNS, reg, SourceConfig{}, time.Minute, true)
+
+	// Test case 1: Missing records created, wrong ones repaired, manual ones kept.
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Errorf("Reconcile error: %s", err)
+	}
+
+	expected := map[string]string{
+		"svc.example.com":    "192.168.5.1",
+		"a.example.com":      "192.168.5.2",
+		"b.example.com":      "192.168.5.2",
+		"router.example.com": "192.168.1.1",
+	}
+	if !reflect.DeepEqual(expected, fakeDNS.records) {
+		t.Errorf("Records: %v, Expected: %v.", fakeDNS.records, expected)
+	}
+	if owner, _ := reg.Owner(provider.NewDomain("192.168.5.2", "a.example.com")); owner != "ingress/default/example-ingress" {
+		t.Errorf("Owner: %s, Expected: ingress/default/example-ingress.", owner)
+	}
+
+	// Test case 2: Ingress deleted while its event was missed, orphans pruned.
+	fakeClient = fake.NewSimpleClientset(service)
+	reconciler.client = fakeClient
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Errorf("Reconcile error: %s", err)
+	}
+
+	expected = map[string]string{
+		"svc.example.com":    "192.168.5.1",
+		"router.example.com": "192.168.1.1",
+	}
+	if !reflect.DeepEqual(expected, fakeDNS.records) {
+		t.Errorf("Records: %v, Expected: %v.", fakeDNS.records, expected)
+	}
+
+	// Test case 3: Without prune orphans are only reported.
+	reconciler = NewReconciler(fake.NewSimpleClientset(service), nil, ownedDNS, reg, SourceConfig{}, time.Minute, false)
+	reg.Claim(context.Background(), provider.NewDomain("192.168.1.1", "router.example.com"), "service/default/router")
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Errorf("Reconcile error: %s", err)
+	}
+	if _, ok := fakeDNS.records["router.example.com"]; !ok {
+		t.Error("Record removed without --prune")
+	}
+
+	// Test case 4: Records which can not be computed are kept, not pruned.
+	invalid := service.DeepCopy()
+	invalid.Annotations["pifrost.tolson.io/target-source"] = "bogus"
+	reconciler = NewReconciler(fake.NewSimpleClientset(invalid), nil, ownedDNS, reg, SourceConfig{}, time.Minute, true)
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Errorf("Reconcile error: %s", err)
+	}
+	if fakeDNS.records["svc.example.com"] != "192.168.5.1" {
+		t.Errorf("Expected svc.example.com record kept, got: %v", fakeDNS.records)
+	}
+
+	// Test case 5: A service without an address wants no records, like the event handlers say.
+	pending := service.DeepCopy()
+	pending.Status = v1.ServiceStatus{}
+	reconciler = NewReconciler(fake.NewSimpleClientset(pending), nil, ownedDNS, reg, SourceConfig{}, time.Minute, true)
+	if err := reconciler.Reconcile(context.Background()); err != nil {
+		t.Errorf("Reconcile error: %s", err)
+	}
+	if _, ok := fakeDNS.records["svc.example.com"]; ok {
+		t.Errorf("Expected svc.example.com record deleted, got: %v", fakeDNS.records)
+	}
+}
+
+func TestDiffRecords(t *testing.T) {
+	desired := []provider.Domain{
+		provider.NewDomain("10.0.0.1", "new.example.com"),
+		provider.NewDomain("10.0.0.2", "same.example.com"),
+		provider.NewCNAME("changed.example.com", "lb.example.com"),
+	}
+	current := []provider.Domain{
+		provider.NewDomain("10.0.0.2", "same.example.com"),
+		provider.NewDomain("10.0.0.3", "changed.example.com"),
+		provider.NewDomain("10.0.0.4", "orphan.example.com"),
+		provider.NewDomain("10.0.0.5", "manual.example.com"),
+	}
+	owned := func(d provider.Domain) bool {
+		return d.Name() == "orphan.example.com"
+	}
+
+	diff := diffRecords(desired, current, provider.Capabilities{}, owned)
+
+	var names []string
+	for _, d := range append(append(diff.create, diff.update...), diff.delete...) {
+		names = append(names, d.Name())
+	}
+	sort.Strings(names)
+
+	expected := []string{"changed.example.com", "new.example.com", "orphan.example.com"}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("Diff: %v, Expected: %v.", names, expected)
+	}
+	if len(diff.create) != 1 || len(diff.update) != 1 || len(diff.delete) != 1 || len(diff.adopt) != 1 {
+		t.Errorf("Diff: %+v", diff)
+	}
+}
+
+func TestDiffRecordsDualStack(t *testing.T) {
+	desired := []provider.Domain{
+		provider.NewDomain("10.0.0.1", "dual.example.com"),
+		provider.NewDomain("fd00::1", "dual.example.com"),
+		provider.NewDomain("10.0.0.2", "v4.example.com"),
+	}
+	current := []provider.Domain{
+		provider.NewDomain("10.0.0.1", "dual.example.com"),
+		provider.NewDomain("fd00::9", "dual.example.com"),
+		provider.NewDomain("10.0.0.2", "v4.example.com"),
+		provider.NewDomain("fd00::2", "v4.example.com"),
+	}
+	owned := func(d provider.Domain) bool {
+		return true
+	}
+
+	diff := diffRecords(desired, current, provider.Capabilities{SingleAddress: true}, owned)
+
+	// Test case 1: The IPv6 address changed, the IPv4 one is left alone
+	if !reflect.DeepEqual(diff.update, []provider.Domain{provider.NewDomain("fd00::1", "dual.example.com")}) || len(diff.create) != 0 {
+		t.Errorf("Diff: %+v", diff)
+	}
+
+	// Test case 2: An address of a family no longer wanted is orphaned
+	if !reflect.DeepEqual(diff.delete, []provider.Domain{provider.NewDomain("fd00::2", "v4.example.com")}) {
+		t.Errorf("Diff: %+v", diff)
+	}
+
+	// Test case 3: Providers holding several addresses per name get the new
+	// address next to the old one, which is orphaned
+	diff = diffRecords(desired, current, provider.Capabilities{}, owned)
+	if !reflect.DeepEqual(diff.create, []provider.Domain{provider.NewDomain("fd00::1", "dual.example.com")}) || len(diff.update) != 0 {
+		t.Errorf("Diff: %+v", diff)
+	}
+	expected := []provider.Domain{
+		provider.NewDomain("fd00::9", "dual.example.com"),
+		provider.NewDomain("fd00::2", "v4.example.com"),
+	}
+	if !reflect.DeepEqual(diff.delete, expected) {
+		t.Errorf("Diff: %+v", diff)
+	}
+}
@@ -0,0 +1,142 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tolson-vkn/pifrost/provider"
+)
+
+// SecretCredential reads the pi-hole credential from a key of a Secret and
+// follows changes to it through the API, so nothing is mounted or passed on
+// the command line.
+type SecretCredential struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	key       string
+
+	mu    sync.RWMutex
+	value string
+}
+
+// Make sure the secret credential satisfies the credential contract.
+var _ provider.Credential = &SecretCredential{}
+
+// Create a credential from ref, namespace/name/key of a Secret which must
+// exist and hold the key.
+func NewSecretCredential(ctx context.Context, client kubernetes.Interface, ref string) (*SecretCredential, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return nil, fmt.Errorf("Could not parse secret reference [%s], must be namespace/name/key", ref)
+	}
+
+	sc := &SecretCredential{
+		client:    client,
+		namespace: parts[0],
+		name:      parts[1],
+		key:       parts[2],
+	}
+	if _, err := sc.Reload(ctx); err != nil {
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+func (sc *SecretCredential) Get() string {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.value
+}
+
+// Get the Secret from the API.
+func (sc *SecretCredential) Reload(ctx context.Context) (bool, error) {
+	secret, err := sc.client.CoreV1().Secrets(sc.namespace).Get(ctx, sc.name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("Could not get secret %s/%s: %w", sc.namespace, sc.name, err)
+	}
+
+	return sc.set(secret)
+}
+
+// Take the credential from secret, keeping the current one when the key is
+// missing or empty.
+func (sc *SecretCredential) set(secret *v1.Secret) (bool, error) {
+	value := strings.TrimSpace(string(secret.Data[sc.key]))
+	if len(value) == 0 {
+		return false, fmt.Errorf("Secret %s/%s has no key [%s]", sc.namespace, sc.name, sc.key)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if value == sc.value {
+		return false, nil
+	}
+	provider.RedactSecret(value)
+	sc.value = value
+
+	return true, nil
+}
+
+// Follow changes to the Secret until ctx is cancelled.
+func (sc *SecretCredential) Watch(ctx context.Context) {
+	selector := fields.OneTermEqualSelector("metadata.name", sc.name).String()
+	watchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return sc.client.CoreV1().Secrets(sc.namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return sc.client.CoreV1().Secrets(sc.namespace).Watch(ctx, options)
+		},
+	}
+
+	update := func(obj interface{}) {
+		secret, ok := obj.(*v1.Secret)
+		if !ok || secret.Name != sc.name {
+			return
+		}
+
+		logFields := logrus.Fields{
+			"secret": sc.namespace + "/" + sc.name,
+			"key":    sc.key,
+		}
+		changed, err := sc.set(secret)
+		if err != nil {
+			logrus.WithFields(logFields).Warnf("Keeping current pi-hole credential: %s", err)
+			return
+		}
+		if changed {
+			logrus.WithFields(logFields).Info("pi-hole credential changed, reloaded")
+		}
+	}
+
+	_, controller := cache.NewInformer(
+		watchlist,
+		&v1.Secret{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: update,
+			UpdateFunc: func(old, new interface{}) {
+				update(new)
+			},
+		},
+	)
+
+	controller.Run(ctx.Done())
+}
@@ -0,0 +1,69 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fake "k8s.io/client-go/kubernetes/fake"
+)
+
+func exampleSecret(token string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pifrost",
+			Namespace: "pifrost",
+		},
+		Data: map[string][]byte{
+			"pihole_token": []byte(token + "\n"),
+		},
+	}
+}
+
+func TestSecretCredential(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewSimpleClientset(exampleSecret("first"))
+
+	// Test case 1: Bad references and missing keys
+	for _, ref := range []string{"pifrost/pifrost", "pifrost//pihole_token", "pifrost/missing/pihole_token", "pifrost/pifrost/missing"} {
+		if _, err := NewSecretCredential(ctx, client, ref); err == nil {
+			t.Errorf("%s: Expected error from NewSecretCredential", ref)
+		}
+	}
+
+	// Test case 2: Read on creation
+	credential, err := NewSecretCredential(ctx, client, "pifrost/pifrost/pihole_token")
+	if err != nil {
+		t.Fatalf("Error from NewSecretCredential: %s", err)
+	}
+	if credential.Get() != "first" {
+		t.Errorf("Credential: %s, Expected: first.", credential.Get())
+	}
+
+	// Test case 3: Reload fetches the rotated secret
+	client.CoreV1().Secrets("pifrost").Update(ctx, exampleSecret("second"), metav1.UpdateOptions{})
+	changed, err := credential.Reload(ctx)
+	if err != nil || !changed || credential.Get() != "second" {
+		t.Errorf("Credential: %s, Changed: %v, Error: %v", credential.Get(), changed, err)
+	}
+	if changed, _ := credential.Reload(ctx); changed {
+		t.Error("Reload of an unchanged secret reported a change")
+	}
+
+	// Test case 4: Watch follows updates, a missing key keeps the credential
+	go credential.Watch(ctx)
+	time.Sleep(100 * time.Millisecond)
+	client.CoreV1().Secrets("pifrost").Update(ctx, exampleSecret(""), metav1.UpdateOptions{})
+	client.CoreV1().Secrets("pifrost").Update(ctx, exampleSecret("third"), metav1.UpdateOptions{})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for credential.Get() != "third" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if credential.Get() != "third" {
+		t.Errorf("Credential: %s, Expected: third.", credential.Get())
+	}
+}
@@ -4,224 +4,318 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"time"
+	"net"
+	"sort"
 
 	"github.com/sirupsen/logrus"
 
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
 )
 
 var (
 	ErrSvcNotTypeLoadBalancer   = errors.New("Service does not have a LoadBalancerIP")
 	ErrSvcMissingLoadBalancerIP = errors.New("Service is a LoadBalancer but was not assigned an IP")
 	ErrSvcMissingAnnotation     = errors.New("Missing pifrost Service annotation")
+	ErrSvcSingleLB              = errors.New("pifrost only supports a single load balancer hostname per service")
+	ErrSvcNoReadyEndpoints      = errors.New("Headless service has no ready endpoints")
+	ErrSvcMissingExternalIP     = errors.New("Service has no external IPs")
+	ErrSvcMissingClusterIP      = errors.New("Service has no cluster IP")
+	ErrSvcNoReadyNodes          = errors.New("No ready node has an address for the service")
+	ErrSvcNodeIPsDisabled       = errors.New("The node-ips target source needs --service-node-ips")
 )
 
-func pollService(client kubernetes.Interface, svc *v1.Service) (*v1.Service, error) {
-	var count int = 1
-	const tries int = 10
-	for {
-		svc, err := client.CoreV1().Services(svc.ObjectMeta.Namespace).Get(context.TODO(), svc.ObjectMeta.Name, metav1.GetOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("Failed to create service poll client: %s", err)
-		}
-		if len(svc.Status.LoadBalancer.Ingress) != 0 {
-			return svc, nil
-		} else {
-			time.Sleep(1 << count * time.Second)
-		}
-		count++
-		if count == tries {
-			return nil, ErrSvcNotTypeLoadBalancer
-		}
+// Which address field of a service its records point at.
+type TargetSource string
+
+const (
+	TargetSourceLoadBalancer TargetSource = "loadbalancer"
+	TargetSourceExternalIPs  TargetSource = "externalIPs"
+	TargetSourceClusterIP    TargetSource = "clusterIP"
+	TargetSourceNodeIPs      TargetSource = "node-ips"
+)
+
+func ParseTargetSource(source string) (TargetSource, error) {
+	switch s := TargetSource(source); s {
+	case TargetSourceLoadBalancer, TargetSourceExternalIPs, TargetSourceClusterIP, TargetSourceNodeIPs:
+		return s, nil
 	}
+	return "", fmt.Errorf("Unknown target source [%s], must be loadbalancer, externalIPs, clusterIP or node-ips", source)
 }
 
-func addServiceRecord(dnsProvider *provider.PiHoleRequest, host string, ip string) error {
-	changeSet, err := provider.CreateChangeSet(ip, host, "add")
-	if err != nil {
-		return fmt.Errorf("Could not create add changeset: %s", err)
+// The target source annotation of a service, fallback when it has none.
+// An unset fallback is the load balancer.
+func getTargetSourceAnnotation(annotations map[string]string, fallback TargetSource) (TargetSource, error) {
+	if val, ok := annotations["pifrost.tolson.io/target-source"]; ok && len(val) != 0 {
+		return ParseTargetSource(val)
 	}
-
-	err = dnsProvider.ModifyDNS(changeSet)
-	if err != nil {
-		return fmt.Errorf("Could not create record: %s", err)
+	if len(fallback) == 0 {
+		return TargetSourceLoadBalancer, nil
 	}
+	return fallback, nil
+}
 
-	return nil
+// Index of the EndpointSlice store, slices by the namespace/name of their
+// service.
+const sliceServiceIndex = "service"
+
+// Objects besides the service its records are built from. Either store may
+// be nil, the service then has no endpoints or no nodes.
+type serviceSources struct {
+	// EndpointSlices, indexed by sliceServiceIndex.
+	slices cache.Indexer
+	nodes  cache.Store
 }
 
-func delServiceRecord(dnsProvider *provider.PiHoleRequest, host string, ip string) error {
-	changeSet, err := provider.CreateChangeSet(ip, host, "delete")
-	if err != nil {
-		return fmt.Errorf("Could not create delete changeset: %s", err)
+// The record targets for a service, the target annotation wins over the
+// address field source names. Node addresses are of the first type in
+// preference, empty for the defaults. Addresses are limited to family.
+func serviceTargets(service *v1.Service, source TargetSource, nodes []*v1.Node, preference []v1.NodeAddressType, family IPFamily) ([]string, error) {
+	if target, ok := getTargetAnnotation(service.Annotations); ok {
+		return familyTargets([]string{target}, family)
 	}
 
-	err = dnsProvider.ModifyDNS(changeSet)
-	if err != nil {
-		return fmt.Errorf("Could not delete record: %s", err)
+	switch source {
+	case TargetSourceExternalIPs:
+		if len(service.Spec.ExternalIPs) == 0 {
+			return nil, ErrSvcMissingExternalIP
+		}
+		return familyTargets(service.Spec.ExternalIPs, family)
+	case TargetSourceClusterIP:
+		ips, err := clusterIPs(service)
+		if err != nil {
+			return nil, err
+		}
+		return familyTargets(ips, family)
+	case TargetSourceNodeIPs:
+		return nodeIPTargets(nodes, preference, family)
 	}
 
-	return nil
-}
+	if service.Spec.Type != "LoadBalancer" {
+		return nil, ErrSvcNotTypeLoadBalancer
+	}
 
-func addServiceHandler(client kubernetes.Interface, dnsProvider *provider.PiHoleRequest, service *v1.Service) error {
-	host, hasIt := getSvcAnnotation(service.Annotations)
-	if hasIt {
-		service, err := pollService(client, service)
-		if err != nil {
-			return err
+	var targets []string
+	for _, lb := range service.Status.LoadBalancer.Ingress {
+		if target := lbTarget(lb.IP, lb.Hostname); len(target) != 0 {
+			targets = append(targets, target)
 		}
+	}
+	if len(targets) == 0 {
+		return nil, ErrSvcMissingLoadBalancerIP
+	}
 
-		if service.Spec.Type == "LoadBalancer" {
-			ip := service.Status.LoadBalancer.Ingress[0].IP
-			if len(ip) == 0 {
-				return ErrSvcNotTypeLoadBalancer
-			}
+	targets, err := familyTargets(targets, family)
+	if errors.Is(err, ErrPifrostSingleLB) {
+		return nil, ErrSvcSingleLB
+	}
+	return targets, err
+}
 
-			logrus.WithFields(logrus.Fields{
-				"service": service.ObjectMeta.Name,
-				"domain":  host,
-			}).Info("Adding service domain with annotation")
+// The cluster IPs of a service, both families on dual-stack clusters. Empty
+// for headless services.
+func clusterIPs(service *v1.Service) ([]string, error) {
+	ips := service.Spec.ClusterIPs
+	if len(ips) == 0 && len(service.Spec.ClusterIP) != 0 {
+		ips = []string{service.Spec.ClusterIP}
+	}
 
-			err = addServiceRecord(dnsProvider, host, ip)
-			if err != nil {
-				return err
-			}
+	var kept []string
+	for _, ip := range ips {
+		if ip != v1.ClusterIPNone && net.ParseIP(ip) != nil {
+			kept = append(kept, ip)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, ErrSvcMissingClusterIP
+	}
+	return kept, nil
+}
 
-			logrus.WithFields(logrus.Fields{
-				"service": service.ObjectMeta.Name,
-				"domain":  host,
-			}).Info("Completed service creation for domain")
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"service": service.ObjectMeta.Name,
-			}).Warn("Service is not of type LoadBalancer. Ignored")
+// Targets of a service reached through any node, e.g. a NodePort. Every
+// ready node gives its addresses of the first type in preference, like its
+// node record, sorted so the records are stable.
+func nodeIPTargets(nodes []*v1.Node, preference []v1.NodeAddressType, family IPFamily) ([]string, error) {
+	var addresses []string
+	for _, node := range nodes {
+		if _, notReady := nodeNotReadySince(node); notReady {
+			continue
+		}
+		targets, err := nodeTargets(node, preference, family)
+		if err != nil {
+			continue
 		}
+		addresses = append(addresses, targets...)
+	}
+	if len(addresses) == 0 {
+		return nil, ErrSvcNoReadyNodes
 	}
 
-	return nil
+	sort.Strings(addresses)
+	return familyTargets(addresses, family)
 }
 
-func delServiceHandler(client kubernetes.Interface, dnsProvider *provider.PiHoleRequest, service *v1.Service) error {
-	host, hasIt := getSvcAnnotation(service.Annotations)
-	if hasIt {
-		if service.Spec.Type == "LoadBalancer" {
-			ip := service.Status.LoadBalancer.Ingress[0].IP
-			if len(ip) == 0 {
-				return ErrSvcNotTypeLoadBalancer
-			}
-
-			logrus.WithFields(logrus.Fields{
-				"service": service.ObjectMeta.Name,
-				"domain":  host,
-			}).Info("Deleting service domain with annotation")
+// Make the records of the service keyed by namespace/name match the service
+// in store. A service which is gone, lost its annotation or has no address
+// in its target source yet wants no records. Once the address is assigned
+// the update queues the service again.
+func syncService(ctx context.Context, key string, store cache.Store, sources serviceSources, dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig) error {
+	obj, exists, err := store.GetByKey(key)
+	if err != nil {
+		return err
+	}
 
-			err := delServiceRecord(dnsProvider, host, ip)
-			if err != nil {
-				return err
-			}
+	var desired []provider.Domain
+	if exists {
+		service, err := convertToService(obj)
+		if err != nil {
+			return permanent(err)
+		}
 
+		desired, err = desiredServiceRecords(service, sources, config)
+		switch {
+		case errors.Is(err, ErrSvcMissingAnnotation):
+		case wantsNoRecords(err):
 			logrus.WithFields(logrus.Fields{
-				"service": service.ObjectMeta.Name,
-				"domain":  host,
-			}).Info("Completed service deletion for domain")
+				"service": key,
+			}).Debugf("Service wants no records: %s", err)
+		case err != nil:
+			return permanent(err)
 		}
-	} else {
-		return ErrSvcMissingAnnotation
 	}
 
-	return nil
+	_, err = syncRecords(ctx, dnsProvider, reg, serviceOwner(key), desired)
+	return err
 }
 
-func updateServiceHandler(client kubernetes.Interface, dnsProvider *provider.PiHoleRequest, oldService *v1.Service, newService *v1.Service) error {
-	oldHost, oldHasIt := getSvcAnnotation(oldService.Annotations)
-	newHost, newHasIt := getSvcAnnotation(newService.Annotations)
+// Whether a service is headless, its DNS name resolves to its pods.
+func isHeadless(service *v1.Service) bool {
+	return service.Spec.ClusterIP == v1.ClusterIPNone
+}
 
-	// LB type changed.
-	if newService.Spec.Type != "LoadBalancer" {
-		logrus.WithFields(logrus.Fields{
-			"service": newService.ObjectMeta.Name,
-		}).Warn("Service is not of type LoadBalancer. Ignored")
-		return nil
+// Records of a headless service named host. host resolves to the ready
+// endpoint addresses, with the pod-hostnames annotation every ready pod also
+// gets hostname.host. Addresses are sorted so the records are stable while
+// pods come and go.
+func headlessServiceRecords(service *v1.Service, host string, slices []*discoveryv1.EndpointSlice, family IPFamily) ([]provider.Domain, error) {
+	var addresses []string
+	podAddresses := map[string][]string{}
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			addresses = append(addresses, endpoint.Addresses...)
+			if hostname := endpointHostname(endpoint); len(hostname) != 0 {
+				podAddresses[hostname] = append(podAddresses[hostname], endpoint.Addresses...)
+			}
+		}
 	}
-
-	// Condition where pending IP is now assigned is captured by add event...
-	if oldHost == newHost && len(oldService.Status.LoadBalancer.Ingress) == 0 &&
-		len(newService.Status.LoadBalancer.Ingress) > 0 {
-
-		logrus.WithFields(logrus.Fields{
-			"service": newService.ObjectMeta.Name,
-		}).Debug("LoadBalancer IP skip condition")
-
-		return nil
+	if len(addresses) == 0 {
+		return nil, ErrSvcNoReadyEndpoints
 	}
 
-	if len(oldService.Status.LoadBalancer.Ingress) != 1 || len(newService.Status.LoadBalancer.Ingress) != 1 {
-		return errors.New("pifrost only supports single LB IP service objects both service objects have LB IP issues")
+	sort.Strings(addresses)
+	targets, err := familyTargets(addresses, family)
+	if err != nil {
+		return nil, err
 	}
-
-	oldIP := oldService.Status.LoadBalancer.Ingress[0].IP
-	if len(oldIP) == 0 {
-		return ErrSvcMissingLoadBalancerIP
+	desired, err := records([]string{host}, targets)
+	if err != nil {
+		return nil, err
 	}
-	newIP := newService.Status.LoadBalancer.Ingress[0].IP
-	if len(newIP) == 0 {
-		return ErrSvcMissingLoadBalancerIP
+
+	if !hasPodHostnamesAnnotation(service.Annotations) {
+		return desired, nil
 	}
 
-	// Was unmanaged. Now wants to manage.
-	if !oldHasIt && newHasIt {
-		err := addServiceRecord(dnsProvider, newHost, newIP)
+	hostnames := make([]string, 0, len(podAddresses))
+	for hostname := range podAddresses {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		sort.Strings(podAddresses[hostname])
+		targets, err := familyTargets(podAddresses[hostname], family)
+		if errors.Is(err, ErrNoAddressInFamily) {
+			continue
+		}
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		logrus.WithFields(logrus.Fields{
-			"service": newService.ObjectMeta.Name,
-			"domain":  newHost,
-		}).Info("Completed service management for domain")
-	}
-
-	// Was managed. Now wish to unmanage.
-	if oldHasIt && !newHasIt {
-		// Removing old host becuase that has the registered record.
-		err := delServiceRecord(dnsProvider, oldHost, oldIP)
+		records, err := records([]string{hostname + "." + host}, targets)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		desired = append(desired, records...)
+	}
 
-		logrus.WithFields(logrus.Fields{
-			"service": oldService.ObjectMeta.Name,
-			"domain":  oldHost,
-		}).Info("No longer managing record. Removed")
+	return desired, nil
+}
+
+// The hostname of the pod behind an endpoint, the pod name when the pod sets
+// no hostname. StatefulSet pods use their name either way.
+func endpointHostname(endpoint discoveryv1.Endpoint) string {
+	if endpoint.Hostname != nil && len(*endpoint.Hostname) != 0 {
+		return *endpoint.Hostname
+	}
+	if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+		return endpoint.TargetRef.Name
 	}
+	return ""
+}
 
-	// It was always managed, but something else changed...
-	if oldHasIt && newHasIt {
-		if oldHost != newHost || oldIP != newIP {
-			err := delServiceRecord(dnsProvider, oldHost, oldIP)
-			if err != nil {
-				return err
-			}
+// The namespace/name of the service an EndpointSlice belongs to.
+func sliceServiceKey(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil, fmt.Errorf("cast failed %T to %T", obj, slice)
+	}
+	name, ok := slice.Labels[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil, nil
+	}
+	return []string{slice.Namespace + "/" + name}, nil
+}
 
-			err = addServiceRecord(dnsProvider, newHost, newIP)
-			if err != nil {
-				return err
-			}
+// The EndpointSlices of the service keyed by namespace/name.
+func (s serviceSources) endpointSlices(key string) []*discoveryv1.EndpointSlice {
+	if s.slices == nil {
+		return nil
+	}
+	objs, err := s.slices.ByIndex(sliceServiceIndex, key)
+	if err != nil {
+		return nil
+	}
 
-			logrus.WithFields(logrus.Fields{
-				"service": oldService.ObjectMeta.Name,
-				"domain":  oldHost,
-			}).Info("Record updated")
+	var found []*discoveryv1.EndpointSlice
+	for _, obj := range objs {
+		if slice, ok := obj.(*discoveryv1.EndpointSlice); ok {
+			found = append(found, slice)
 		}
 	}
+	return found
+}
+
+// Every node in the node store.
+func (s serviceSources) nodeList() []*v1.Node {
+	if s.nodes == nil {
+		return nil
+	}
 
-	// If any of the conditions above didn't evaluate... I don't care about it.
-	return nil
+	var nodes []*v1.Node
+	for _, obj := range s.nodes.List() {
+		if node, ok := obj.(*v1.Node); ok {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
 }
@@ -2,31 +2,32 @@ package watcher
 
 import (
 	"context"
-	"net/http"
-	"net/http/httptest"
-	"strings"
+	"errors"
+	"reflect"
 	"testing"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/informers"
 	fake "k8s.io/client-go/kubernetes/fake"
-	clienttesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 
 	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
 )
 
-func TestPollService(t *testing.T) {
-	// Test Case 1: Poll for an service object
-	service := &v1.Service{
+func exampleService() *v1.Service {
+	return &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "example-service",
 			Namespace: "default",
+			Annotations: map[string]string{
+				"pifrost.tolson.io/domain": "example.com",
+			},
 		},
 		Spec: v1.ServiceSpec{
 			Selector: map[string]string{
@@ -51,254 +52,505 @@ func TestPollService(t *testing.T) {
 			},
 		},
 	}
+}
 
-	fakeClient := fake.NewSimpleClientset(service)
-
-	_, err := pollService(fakeClient, service)
-	if err != nil {
-		t.Errorf("Service poll error: %s", err)
+func TestServiceTargets(t *testing.T) {
+	// Test case 1: Load balancer IP
+	service := exampleService()
+	targets, err := serviceTargets(service, TargetSourceLoadBalancer, nil, nil, IPFamilyDual)
+	if err != nil || !reflect.DeepEqual(targets, []string{"192.168.5.1"}) {
+		t.Errorf("Targets: %v, Error: %v", targets, err)
 	}
-}
 
-func TestAddServiceLB(t *testing.T) {
-	mockServer, serverURL := startMockServer(t)
-	defer mockServer.Close()
+	// Test case 2: Load balancer not assigned yet
+	service.Status.LoadBalancer.Ingress = nil
+	if _, err = serviceTargets(service, TargetSourceLoadBalancer, nil, nil, IPFamilyDual); err != ErrSvcMissingLoadBalancerIP {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrSvcMissingLoadBalancerIP)
+	}
 
-	service := &v1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "example-service",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"pifrost.tolson.io/domain": "example.com",
-			},
-		},
-		Spec: v1.ServiceSpec{
-			Selector: map[string]string{
-				"app": "example-app",
-			},
-			Ports: []v1.ServicePort{
-				{
-					Protocol:   v1.ProtocolTCP,
-					Port:       80,
-					TargetPort: intstr.FromInt(8080),
-				},
-			},
-			Type: v1.ServiceTypeLoadBalancer,
-		},
-		Status: v1.ServiceStatus{
-			LoadBalancer: v1.LoadBalancerStatus{
-				Ingress: []v1.LoadBalancerIngress{
-					{
-						IP: "192.168.5.1",
-					},
-				},
-			},
-		},
+	// Test case 3: Dual stack load balancer, limited by family
+	service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.5.1"}, {IP: "fd00::1"}}
+	for family, expected := range map[IPFamily][]string{
+		IPFamilyDual: {"192.168.5.1", "fd00::1"},
+		IPFamilyIPv4: {"192.168.5.1"},
+		IPFamilyIPv6: {"fd00::1"},
+	} {
+		targets, err = serviceTargets(service, TargetSourceLoadBalancer, nil, nil, family)
+		if err != nil || !reflect.DeepEqual(targets, expected) {
+			t.Errorf("%s: Targets: %v, Expected: %v. Error: %v", family, targets, expected, err)
+		}
 	}
 
-	mockPHR, err := provider.InitDNSProvider(true, serverURL, "mocktoken")
-	if err != nil {
-		t.Errorf("Service handler test error: %s", err)
+	// Test case 4: No address in the family
+	service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.5.1"}}
+	if _, err = serviceTargets(service, TargetSourceLoadBalancer, nil, nil, IPFamilyIPv6); err != ErrNoAddressInFamily {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrNoAddressInFamily)
 	}
 
-	fakeClient := fake.NewSimpleClientset(service)
+	// Test case 5: More load balancer hostnames than supported
+	service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{Hostname: "a.example.net"}, {Hostname: "b.example.net"}}
+	if _, err = serviceTargets(service, TargetSourceLoadBalancer, nil, nil, IPFamilyDual); err != ErrSvcSingleLB {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrSvcSingleLB)
+	}
 
-	err = addServiceHandler(fakeClient, mockPHR, service)
-	if err != nil {
-		t.Errorf("Service handler test error: %s", err)
+	// Test case 6: Not a load balancer
+	service.Spec.Type = v1.ServiceTypeClusterIP
+	if _, err = serviceTargets(service, TargetSourceLoadBalancer, nil, nil, IPFamilyDual); err != ErrSvcNotTypeLoadBalancer {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrSvcNotTypeLoadBalancer)
 	}
 }
 
-func TestDelServiceLB(t *testing.T) {
+func TestSyncServiceLB(t *testing.T) {
 	mockServer, serverURL := startMockServer(t)
 	defer mockServer.Close()
 
-	service := &v1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "example-service",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"pifrost.tolson.io/domain": "example.com",
-			},
-		},
-		Spec: v1.ServiceSpec{
-			Selector: map[string]string{
-				"app": "example-app",
-			},
-			Ports: []v1.ServicePort{
-				{
-					Protocol:   v1.ProtocolTCP,
-					Port:       80,
-					TargetPort: intstr.FromInt(8080),
-				},
-			},
-			Type: v1.ServiceTypeLoadBalancer,
-		},
-		Status: v1.ServiceStatus{
-			LoadBalancer: v1.LoadBalancerStatus{
-				Ingress: []v1.LoadBalancerIngress{
-					{
-						IP: "192.168.5.1",
-					},
-				},
-			},
-		},
+	mockPHR, err := provider.InitDNSProvider(testEndpoint(t, serverURL), provider.StaticCredential("mocktoken"))
+	if err != nil {
+		t.Errorf("Service sync test error: %s", err)
 	}
+	reg, _ := registry.New(context.Background(), registry.MemoryStore{})
+	ownedPHR := registry.NewOwnedProvider(mockPHR, reg, registry.PolicyTakeover)
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	store.Add(exampleService())
 
-	mockPHR, err := provider.InitDNSProvider(true, serverURL, "mocktoken")
+	// Test case 1: Service with annotation
+	err = syncService(context.Background(), "default/example-service", store, serviceSources{}, ownedPHR, reg, SourceConfig{})
 	if err != nil {
-		t.Errorf("Service handler test error: %s", err)
+		t.Errorf("Service sync test error: %s", err)
 	}
 
-	fakeClient := fake.NewSimpleClientset(service)
-
-	err = delServiceHandler(fakeClient, mockPHR, service)
+	// Test case 2: Service deleted
+	store.Delete(exampleService())
+	err = syncService(context.Background(), "default/example-service", store, serviceSources{}, ownedPHR, reg, SourceConfig{})
 	if err != nil {
-		t.Errorf("Service handler test error: %s", err)
+		t.Errorf("Service sync test error: %s", err)
 	}
 }
 
-func TestUpdateServiceLB(t *testing.T) {
-	// Test case 1: Update a service object
-	// State tracker for the httptest server
-	var added int = 0
-
-	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var mockResponse string
-		action := r.URL.Query().Get("action")
-		switch action {
-		case "get":
-			if added > 0 {
-				mockResponse = `{"data":[["example.com","192.168.1.2"]]}[]`
-			} else if added > 1 {
-				mockResponse = `{"data":[["new.example.com","192.168.1.2"],["example.com","192.168.1.2"]]}[]`
-			} else if added > 2 {
-				mockResponse = `{"data":[["new.example.com","192.168.1.2"]]}[]`
-			}
-			added = added + 1
-		case "add":
-			mockResponse = `{"success":true,"message":""}{"FTLnotrunning":true}`
-		case "delete":
-			mockResponse = `{"success":true,"message":""}{"FTLnotrunning":true}`
+func TestSyncService(t *testing.T) {
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	key := "default/example-service"
+
+	sync := func() {
+		t.Helper()
+		if err := syncService(context.Background(), key, store, serviceSources{}, ownedDNS, reg, SourceConfig{}); err != nil {
+			t.Errorf("Service sync test error: %s", err)
 		}
+	}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(mockResponse))
-	}))
-	defer mockServer.Close()
+	// Test case 1: Load balancer not assigned yet, nothing to do
+	service := exampleService()
+	service.Status.LoadBalancer.Ingress = nil
+	store.Add(service)
+	sync()
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
+	}
 
-	mockPHR, err := provider.InitDNSProvider(true, strings.Replace(mockServer.URL, "http://", "", 1), "mocktoken")
-	if err != nil {
-		t.Errorf("Service handler test error: %s", err)
+	// Test case 2: Load balancer assigned
+	service = exampleService()
+	store.Update(service)
+	sync()
+	if fakeDNS.records["example.com"] != "192.168.5.1" {
+		t.Errorf("Expected example.com record, got: %v", fakeDNS.records)
 	}
 
-	oldService := &v1.Service{
+	// Test case 3: Syncing again changes nothing
+	sync()
+	if len(fakeDNS.changes) != 1 {
+		t.Errorf("Expected 1 change, got: %v", fakeDNS.changes)
+	}
+
+	// Test case 4: Domain changed
+	service = exampleService()
+	service.Annotations["pifrost.tolson.io/domain"] = "new.example.com"
+	store.Update(service)
+	sync()
+	if _, ok := fakeDNS.records["example.com"]; ok || fakeDNS.records["new.example.com"] != "192.168.5.1" {
+		t.Errorf("Expected only new.example.com record, got: %v", fakeDNS.records)
+	}
+
+	// Test case 5: Load balancer only has a hostname
+	service = service.DeepCopy()
+	service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{Hostname: "lb.cloud.example.net"}}
+	store.Update(service)
+	sync()
+	if fakeDNS.records["new.example.com"] != "lb.cloud.example.net" {
+		t.Errorf("Expected CNAME to lb.cloud.example.net, got: %v", fakeDNS.records)
+	}
+
+	// Test case 6: Target annotation overrides the load balancer
+	service = service.DeepCopy()
+	service.Annotations["pifrost.tolson.io/target"] = "other.home.lan"
+	store.Update(service)
+	sync()
+	if fakeDNS.records["new.example.com"] != "other.home.lan" {
+		t.Errorf("Expected CNAME to other.home.lan, got: %v", fakeDNS.records)
+	}
+
+	// Test case 7: Dual stack load balancer, an A and an AAAA record
+	service = service.DeepCopy()
+	delete(service.Annotations, "pifrost.tolson.io/target")
+	service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.5.1"}, {IP: "fd00::1"}}
+	store.Update(service)
+	sync()
+	if fakeDNS.records["new.example.com"] != "192.168.5.1" || fakeDNS.aaaa["new.example.com"] != "fd00::1" {
+		t.Errorf("Expected A and AAAA records, got: %v, %v", fakeDNS.records, fakeDNS.aaaa)
+	}
+
+	// Test case 8: ip-family annotation drops the IPv4 record
+	service = service.DeepCopy()
+	service.Annotations["pifrost.tolson.io/ip-family"] = "ipv6"
+	store.Update(service)
+	sync()
+	if _, ok := fakeDNS.records["new.example.com"]; ok || fakeDNS.aaaa["new.example.com"] != "fd00::1" {
+		t.Errorf("Expected only the AAAA record, got: %v, %v", fakeDNS.records, fakeDNS.aaaa)
+	}
+
+	// Test case 9: Annotation removed
+	service = service.DeepCopy()
+	delete(service.Annotations, "pifrost.tolson.io/domain")
+	store.Update(service)
+	sync()
+	if len(fakeDNS.records) != 0 || len(fakeDNS.aaaa) != 0 {
+		t.Errorf("Expected no records, got: %v, %v", fakeDNS.records, fakeDNS.aaaa)
+	}
+
+	// Test case 10: Target annotation on a ClusterIP service, then deleted
+	clusterIP := &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "example-service",
+			Name:      "internal-service",
 			Namespace: "default",
 			Annotations: map[string]string{
-				"pifrost.tolson.io/domain": "example.com",
+				"pifrost.tolson.io/domain": "internal.example.com",
+				"pifrost.tolson.io/target": "example.com",
 			},
 		},
 		Spec: v1.ServiceSpec{
-			Selector: map[string]string{
-				"app": "example-app",
-			},
-			Ports: []v1.ServicePort{
-				{
-					Protocol:   v1.ProtocolTCP,
-					Port:       80,
-					TargetPort: intstr.FromInt(8080),
-				},
-			},
-			Type: v1.ServiceTypeLoadBalancer,
-		},
-		Status: v1.ServiceStatus{
-			LoadBalancer: v1.LoadBalancerStatus{
-				Ingress: []v1.LoadBalancerIngress{
-					{
-						IP: "192.168.5.1",
-					},
-				},
-			},
+			Type: v1.ServiceTypeClusterIP,
 		},
 	}
+	store.Add(clusterIP)
+	if err := syncService(context.Background(), "default/internal-service", store, serviceSources{}, ownedDNS, reg, SourceConfig{}); err != nil {
+		t.Errorf("Service sync test error: %s", err)
+	}
+	if fakeDNS.records["internal.example.com"] != "example.com" {
+		t.Errorf("Expected CNAME to example.com, got: %v", fakeDNS.records)
+	}
+
+	store.Delete(clusterIP)
+	if err := syncService(context.Background(), "default/internal-service", store, serviceSources{}, ownedDNS, reg, SourceConfig{}); err != nil {
+		t.Errorf("Service sync test error: %s", err)
+	}
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
+	}
+
+	// Test case 11: Invalid domain is permanent
+	service = exampleService()
+	service.Annotations["pifrost.tolson.io/domain"] = "not^valid"
+	store.Update(service)
+	err := syncService(context.Background(), key, store, serviceSources{}, ownedDNS, reg, SourceConfig{})
+	var permErr *permanentError
+	if !errors.As(err, &permErr) {
+		t.Errorf("Expected permanent error, got: %v", err)
+	}
+}
 
+func TestSyncServiceQueue(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	watcherStarted := make(chan struct{})
-	client := fake.NewSimpleClientset(oldService)
-	client.PrependWatchReactor("*", func(action clienttesting.Action) (handled bool, ret watch.Interface, err error) {
-		gvr := action.GetResource()
-		ns := action.GetNamespace()
-		watch, err := client.Tracker().Watch(gvr, ns)
-		if err != nil {
-			return false, nil, err
-		}
-		close(watcherStarted)
-		return true, watch, nil
-	})
-
-	services := make(chan *v1.Service, 1)
-	informers := informers.NewSharedInformerFactory(client, 0)
-	serviceInformer := informers.Core().V1().Services().Informer()
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	client := fake.NewSimpleClientset(exampleService())
 
-	serviceInformer.AddEventHandler(&cache.ResourceEventHandlerFuncs{
-		UpdateFunc: func(oldObject, newObject interface{}) {
-			oS := oldObject.(*v1.Service)
-			nS := newObject.(*v1.Service)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	serviceInformer := factory.Core().V1().Services().Informer()
 
-			updateServiceHandler(client, mockPHR, oS, nS)
-			services <- nS
-		},
+	worker := newQueueWorker("service-test", defaultRateLimiter(), func(ctx context.Context, key string) error {
+		return syncService(ctx, key, serviceInformer.GetStore(), serviceSources{}, ownedDNS, reg, SourceConfig{})
 	})
+	serviceInformer.AddEventHandler(worker.handlers())
 
-	informers.Start(ctx.Done())
+	factory.Start(ctx.Done())
 	cache.WaitForCacheSync(ctx.Done(), serviceInformer.HasSynced)
-	<-watcherStarted
+	go worker.Run(ctx, time.Second)
+
+	waitForRecord := func(d, expected string) {
+		t.Helper()
+		err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, wait.ForeverTestTimeout, true, func(context.Context) (bool, error) {
+			return fakeDNS.record(d) == expected, nil
+		})
+		if err != nil {
+			t.Errorf("Record %s: %s, Expected: %s.", d, fakeDNS.record(d), expected)
+		}
+	}
 
-	newService := &v1.Service{
+	// Test case 1: Existing service is synced
+	waitForRecord("example.com", "192.168.5.1")
+
+	// Test case 2: Update moves the record
+	newService := exampleService()
+	newService.Annotations["pifrost.tolson.io/domain"] = "new.example.com"
+	_, err := client.CoreV1().Services("default").Update(ctx, newService, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("error injecting service update: %v", err)
+	}
+	waitForRecord("new.example.com", "192.168.5.1")
+	waitForRecord("example.com", "")
+
+	// Test case 3: Delete removes the record
+	err = client.CoreV1().Services("default").Delete(ctx, "example-service", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("error injecting service delete: %v", err)
+	}
+	waitForRecord("new.example.com", "")
+}
+
+func exampleHeadlessService() *v1.Service {
+	return &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "example-service",
+			Name:      "mqtt",
 			Namespace: "default",
 			Annotations: map[string]string{
-				"pifrost.tolson.io/domain": "new.example.com",
+				"pifrost.tolson.io/domain":        "mqtt.home.lan",
+				"pifrost.tolson.io/pod-hostnames": "true",
 			},
 		},
 		Spec: v1.ServiceSpec{
-			Selector: map[string]string{
-				"app": "example-app",
-			},
-			Ports: []v1.ServicePort{
-				{
-					Protocol:   v1.ProtocolTCP,
-					Port:       80,
-					TargetPort: intstr.FromInt(8080),
-				},
-			},
-			Type: v1.ServiceTypeLoadBalancer,
+			ClusterIP: v1.ClusterIPNone,
 		},
-		Status: v1.ServiceStatus{
-			LoadBalancer: v1.LoadBalancerStatus{
-				Ingress: []v1.LoadBalancerIngress{
-					{
-						IP: "192.168.5.1",
-					},
-				},
+	}
+}
+
+// An EndpointSlice of the mqtt service, one endpoint per address, hostname
+// pairs, ready unless listed in notReady.
+func exampleSlice(name string, addressType discoveryv1.AddressType, endpoints map[string]string, notReady ...string) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: "mqtt",
 			},
 		},
+		AddressType: addressType,
 	}
+	for address, hostname := range endpoints {
+		hostname := hostname
+		ready := true
+		for _, n := range notReady {
+			if n == address {
+				ready = false
+			}
+		}
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{address},
+			Hostname:   &hostname,
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		})
+	}
+	return slice
+}
 
-	_, err = client.CoreV1().Services(newService.ObjectMeta.Namespace).Update(context.TODO(), newService, metav1.UpdateOptions{})
-	if err != nil {
-		t.Fatalf("error injecting pod add: %v", err)
+func TestHeadlessServiceRecords(t *testing.T) {
+	service := exampleHeadlessService()
+	slices := serviceSources{
+		slices: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{sliceServiceIndex: sliceServiceKey}),
+	}
+	slices.slices.Add(exampleSlice("mqtt-v4", discoveryv1.AddressTypeIPv4, map[string]string{"10.42.0.7": "mqtt-1", "10.42.0.5": "mqtt-0", "10.42.0.9": "mqtt-2"}, "10.42.0.9"))
+
+	// Test case 1: Every ready address, and ready pods
+	slices.slices.Add(exampleSlice("mqtt-v6", discoveryv1.AddressTypeIPv6, map[string]string{"fd00:42::5": "mqtt-0"}))
+	records, err := desiredServiceRecords(service, slices, SourceConfig{HeadlessServices: true})
+	expected := []provider.Domain{
+		provider.NewDomain("10.42.0.5", "mqtt.home.lan"),
+		provider.NewDomain("10.42.0.7", "mqtt.home.lan"),
+		provider.NewDomain("fd00:42::5", "mqtt.home.lan"),
+		provider.NewDomain("10.42.0.5", "mqtt-0.mqtt.home.lan"),
+		provider.NewDomain("fd00:42::5", "mqtt-0.mqtt.home.lan"),
+		provider.NewDomain("10.42.0.7", "mqtt-1.mqtt.home.lan"),
+	}
+	if err != nil || !reflect.DeepEqual(records, expected) {
+		t.Errorf("Records: %v, Expected: %v. Error: %v", records, expected, err)
+	}
+
+	// Test case 2: Pod records are opt in
+	delete(service.Annotations, "pifrost.tolson.io/pod-hostnames")
+	records, err = desiredServiceRecords(service, slices, SourceConfig{IPFamily: IPFamilyIPv4, HeadlessServices: true})
+	expected = []provider.Domain{provider.NewDomain("10.42.0.5", "mqtt.home.lan"), provider.NewDomain("10.42.0.7", "mqtt.home.lan")}
+	if err != nil || !reflect.DeepEqual(records, expected) {
+		t.Errorf("Records: %v, Expected: %v. Error: %v", records, expected, err)
+	}
+
+	// Test case 3: No ready address in the family, or no ready endpoints at all
+	slices.slices.Delete(exampleSlice("mqtt-v6", discoveryv1.AddressTypeIPv6, nil))
+	if _, err = desiredServiceRecords(service, slices, SourceConfig{IPFamily: IPFamilyIPv6, HeadlessServices: true}); err != ErrNoAddressInFamily {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrNoAddressInFamily)
+	}
+	if _, err = desiredServiceRecords(service, serviceSources{}, SourceConfig{HeadlessServices: true}); err != ErrSvcNoReadyEndpoints {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrSvcNoReadyEndpoints)
+	}
+
+	// Test case 4: Headless services are opt in
+	if _, err = desiredServiceRecords(service, slices, SourceConfig{}); err != ErrSvcNotTypeLoadBalancer {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrSvcNotTypeLoadBalancer)
+	}
+}
+
+func TestSyncHeadlessService(t *testing.T) {
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	slices := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{sliceServiceIndex: sliceServiceKey})
+	key := "default/mqtt"
+
+	sync := func() {
+		t.Helper()
+		if err := syncService(context.Background(), key, store, serviceSources{slices: slices}, ownedDNS, reg, SourceConfig{HeadlessServices: true}); err != nil {
+			t.Errorf("Service sync test error: %s", err)
+		}
+	}
+
+	// Test case 1: No pods yet
+	store.Add(exampleHeadlessService())
+	sync()
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
+	}
+
+	// Test case 2: Pods come up
+	slices.Add(exampleSlice("mqtt-v4", discoveryv1.AddressTypeIPv4, map[string]string{"10.42.0.5": "mqtt-0", "10.42.0.7": "mqtt-1"}))
+	sync()
+	if fakeDNS.records["mqtt.home.lan"] != "10.42.0.5" || fakeDNS.records["mqtt-1.mqtt.home.lan"] != "10.42.0.7" {
+		t.Errorf("Expected service and pod records, got: %v", fakeDNS.records)
+	}
+
+	// Test case 3: A pod goes away, the service moves to the next address
+	slices.Update(exampleSlice("mqtt-v4", discoveryv1.AddressTypeIPv4, map[string]string{"10.42.0.7": "mqtt-1"}))
+	sync()
+	expected := map[string]string{"mqtt.home.lan": "10.42.0.7", "mqtt-1.mqtt.home.lan": "10.42.0.7"}
+	if !reflect.DeepEqual(fakeDNS.records, expected) {
+		t.Errorf("Records: %v, Expected: %v.", fakeDNS.records, expected)
+	}
+
+	// Test case 4: Service deleted
+	store.Delete(exampleHeadlessService())
+	sync()
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
+	}
+}
+
+func TestServiceTargetSources(t *testing.T) {
+	service := exampleService()
+	service.Spec.ClusterIP = "10.43.0.10"
+	service.Spec.ClusterIPs = []string{"10.43.0.10", "fd00:43::10"}
+	service.Spec.ExternalIPs = []string{"192.168.20.1"}
+	down := notReady(exampleNode(), time.Now())
+	down.Name = "worker-0"
+	down.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.10.0"}}
+	nodes := []*v1.Node{exampleNode(), down}
+
+	// Test case 1: Every source reads its own address field
+	for source, expected := range map[TargetSource][]string{
+		TargetSourceLoadBalancer: {"192.168.5.1"},
+		TargetSourceExternalIPs:  {"192.168.20.1"},
+		TargetSourceClusterIP:    {"10.43.0.10", "fd00:43::10"},
+		TargetSourceNodeIPs:      {"192.168.10.1", "fd00::10:1"},
+	} {
+		targets, err := serviceTargets(service, source, nodes, nil, IPFamilyDual)
+		if err != nil || !reflect.DeepEqual(targets, expected) {
+			t.Errorf("%s: Targets: %v, Expected: %v. Error: %v", source, targets, expected, err)
+		}
+	}
+
+	// Test case 2: Sources without an address
+	service.Spec.ClusterIP = v1.ClusterIPNone
+	service.Spec.ClusterIPs = nil
+	service.Spec.ExternalIPs = nil
+	for source, expected := range map[TargetSource]error{
+		TargetSourceExternalIPs: ErrSvcMissingExternalIP,
+		TargetSourceClusterIP:   ErrSvcMissingClusterIP,
+		TargetSourceNodeIPs:     ErrSvcNoReadyNodes,
+	} {
+		if _, err := serviceTargets(service, source, []*v1.Node{down}, nil, IPFamilyDual); err != expected {
+			t.Errorf("%s: Error: %v, Expected: %v.", source, err, expected)
+		}
+	}
+
+	// Test case 3: Node addresses of the preferred type, like node records
+	targets, err := serviceTargets(service, TargetSourceNodeIPs, nodes, []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP}, IPFamilyDual)
+	if err != nil || !reflect.DeepEqual(targets, []string{"203.0.113.1"}) {
+		t.Errorf("Targets: %v, Error: %v", targets, err)
+	}
+
+	// Test case 4: The annotation wins over the default, which defaults to the load balancer
+	source, err := getTargetSourceAnnotation(map[string]string{"pifrost.tolson.io/target-source": "clusterIP"}, TargetSourceNodeIPs)
+	if err != nil || source != TargetSourceClusterIP {
+		t.Errorf("Source: %s, Error: %v", source, err)
+	}
+	if source, _ = getTargetSourceAnnotation(nil, ""); source != TargetSourceLoadBalancer {
+		t.Errorf("Source: %s, Expected: %s.", source, TargetSourceLoadBalancer)
+	}
+	if _, err = getTargetSourceAnnotation(map[string]string{"pifrost.tolson.io/target-source": "nodePort"}, ""); err == nil {
+		t.Error("Expected error for an unknown target source")
+	}
+}
+
+func TestSyncServiceTypeChange(t *testing.T) {
+	fakeDNS, reg, ownedDNS := newOwnedFakeProvider(registry.PolicyTakeover)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	sources := serviceSources{nodes: cache.NewStore(cache.MetaNamespaceKeyFunc)}
+	sources.nodes.Add(exampleNode())
+	key := "default/example-service"
+
+	sync := func(config SourceConfig) {
+		t.Helper()
+		if err := syncService(context.Background(), key, store, sources, ownedDNS, reg, config); err != nil {
+			t.Errorf("Service sync test error: %s", err)
+		}
+	}
+
+	// Test case 1: Load balancer
+	service := exampleService()
+	store.Add(service)
+	sync(SourceConfig{})
+	if fakeDNS.records["example.com"] != "192.168.5.1" {
+		t.Errorf("Expected load balancer record, got: %v", fakeDNS.records)
+	}
+
+	// Test case 2: Now a NodePort on the node IPs, the record moves
+	service = service.DeepCopy()
+	service.Spec.Type = v1.ServiceTypeNodePort
+	service.Status.LoadBalancer.Ingress = nil
+	service.Annotations["pifrost.tolson.io/target-source"] = "node-ips"
+	store.Update(service)
+	sync(SourceConfig{ServiceNodeIPs: true})
+	if fakeDNS.records["example.com"] != "192.168.10.1" || fakeDNS.aaaa["example.com"] != "fd00::10:1" {
+		t.Errorf("Expected node records, got: %v, %v", fakeDNS.records, fakeDNS.aaaa)
+	}
+
+	// Test case 3: The node-ips source must be enabled
+	if _, err := desiredServiceRecords(service, sources, SourceConfig{}); err != ErrSvcNodeIPsDisabled {
+		t.Errorf("Error: %v, Expected: %v.", err, ErrSvcNodeIPsDisabled)
+	}
+
+	// Test case 4: Now a ClusterIP, by the server default
+	service = service.DeepCopy()
+	service.Spec.Type = v1.ServiceTypeClusterIP
+	service.Spec.ClusterIPs = []string{"10.43.0.10"}
+	delete(service.Annotations, "pifrost.tolson.io/target-source")
+	store.Update(service)
+	sync(SourceConfig{ServiceTargetSource: TargetSourceClusterIP})
+	if fakeDNS.records["example.com"] != "10.43.0.10" || len(fakeDNS.aaaa) != 0 {
+		t.Errorf("Expected cluster IP record, got: %v, %v", fakeDNS.records, fakeDNS.aaaa)
 	}
 
-	select {
-	case service := <-services:
-		t.Logf("Got service from channel: %s/%s", service.Namespace, service.Name)
-	case <-time.After(wait.ForeverTestTimeout):
-		t.Error("Informer did not get the added service")
+	// Test case 5: A ClusterIP with the load balancer default wants no records
+	sync(SourceConfig{})
+	if len(fakeDNS.records) != 0 {
+		t.Errorf("Expected no records, got: %v", fakeDNS.records)
 	}
 }
@@ -0,0 +1,189 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
+)
+
+func addRecord(ctx context.Context, dnsProvider provider.DNSProvider, owner string, host string, target string) error {
+	changeSet, err := provider.CreateChangeSet(target, host, "add")
+	if err != nil {
+		return permanent(fmt.Errorf("Could not create add changeset: %w", err))
+	}
+
+	err = dnsProvider.ModifyDNS(ctx, changeSet.WithOwner(owner))
+	if err != nil {
+		return providerError(fmt.Errorf("Could not create record: %w", err))
+	}
+
+	return nil
+}
+
+func delRecord(ctx context.Context, dnsProvider provider.DNSProvider, owner string, host string, target string) error {
+	changeSet, err := provider.CreateChangeSet(target, host, "delete")
+	if err != nil {
+		return permanent(fmt.Errorf("Could not create delete changeset: %w", err))
+	}
+
+	err = dnsProvider.ModifyDNS(ctx, changeSet.WithOwner(owner))
+	// Someone beat us to it.
+	if errors.Is(err, provider.ErrRecordNotFound) {
+		logrus.WithFields(logrus.Fields{
+			"owner":  owner,
+			"domain": host,
+		}).Debug("Record already deleted")
+		return nil
+	}
+	if err != nil {
+		return providerError(fmt.Errorf("Could not delete record: %w", err))
+	}
+
+	return nil
+}
+
+// Errors retrying will not fix are permanent: ErrUnauthorized for bad
+// credentials, ErrUnsupportedRecord for a record type the provider lacks,
+// ErrUnmanagedRecord for a record it may not change and ErrOutsideZone for a
+// name outside its zones. The reconciler tries those again later. Everything
+// else, ErrTransient included, is retried.
+func providerError(err error) error {
+	if errors.Is(err, provider.ErrUnauthorized) || errors.Is(err, provider.ErrUnsupportedRecord) || errors.Is(err, provider.ErrUnmanagedRecord) || errors.Is(err, provider.ErrOutsideZone) {
+		return permanent(err)
+	}
+	return err
+}
+
+// Make the records owner holds match desired. Desired records the provider
+// can not hold next to an earlier one are left out. Records owner holds which
+// it no longer wants are deleted, unless a desired record replaces them when
+// it is added. Desired records owner already holds are left alone, the
+// reconciler repairs drift. Calling it again with the same arguments changes
+// nothing. Returns the desired records the conflict policy skipped, the
+// provider adds them without error but owner does not get them.
+func syncRecords(ctx context.Context, dnsProvider provider.DNSProvider, reg *registry.Registry, owner string, desired []provider.Domain) ([]provider.Domain, error) {
+	capabilities := dnsProvider.Capabilities()
+	desired, dropped := fit(capabilities, desired)
+	for _, d := range dropped {
+		logrus.WithFields(logrus.Fields{
+			"owner":    owner,
+			"domain":   d.Name(),
+			"target":   d.Value(),
+			"provider": capabilities.Name,
+		}).Info("Provider can not hold the record next to the others of its name, not publishing")
+	}
+
+	for _, d := range reg.OwnedBy(owner) {
+		if wants(capabilities, desired, d) {
+			continue
+		}
+
+		err := delRecord(ctx, dnsProvider, owner, d.Name(), d.Value())
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"owner":  owner,
+			"domain": d.Name(),
+			"type":   d.Type(),
+		}).Info("Completed record deletion for domain")
+	}
+
+	var skipped []provider.Domain
+	for _, d := range desired {
+		if current, ok := reg.Owner(d); ok && current == owner {
+			continue
+		}
+
+		err := addRecord(ctx, dnsProvider, owner, d.Name(), d.Value())
+		if err != nil {
+			return nil, err
+		}
+		if current, ok := reg.Owner(d); !ok || current != owner {
+			skipped = append(skipped, d)
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"owner":  owner,
+			"domain": d.Name(),
+			"target": d.Value(),
+		}).Info("Completed record creation for domain")
+	}
+
+	return skipped, nil
+}
+
+// Whether d is desired, or a desired record replaces it. Either way d does
+// not need deleting.
+func wants(capabilities provider.Capabilities, desired []provider.Domain, d provider.Domain) bool {
+	for _, w := range desired {
+		if w == d || capabilities.Replaces(w, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// The records adding d replaces.
+func replacedBy(capabilities provider.Capabilities, d provider.Domain, records []provider.Domain) []provider.Domain {
+	var replaced []provider.Domain
+	for _, r := range records {
+		if capabilities.Replaces(d, r) {
+			replaced = append(replaced, r)
+		}
+	}
+	return replaced
+}
+
+// The desired records a provider with capabilities can hold together, and
+// those left out. Of records replacing each other the first is kept, sources
+// order their targets so the choice is stable. Duplicates are dropped.
+func fit(capabilities provider.Capabilities, desired []provider.Domain) ([]provider.Domain, []provider.Domain) {
+	var kept, dropped []provider.Domain
+	for _, d := range desired {
+		switch {
+		case contains(kept, d):
+		case len(replacedBy(capabilities, d, kept)) != 0:
+			dropped = append(dropped, d)
+		default:
+			kept = append(kept, d)
+		}
+	}
+	return kept, dropped
+}
+
+// Whether err means an object wants no records, it opted out or has no
+// address in its source yet, rather than that its records could not be
+// computed. The event handlers and the reconciler both delete the records
+// of such objects.
+func wantsNoRecords(err error) bool {
+	for _, none := range []error{
+		ErrSvcMissingAnnotation, ErrSvcNotTypeLoadBalancer, ErrSvcMissingLoadBalancerIP, ErrSvcNoReadyEndpoints,
+		ErrSvcMissingExternalIP, ErrSvcMissingClusterIP, ErrSvcNoReadyNodes,
+		ErrIngMissingAnnotation, ErrIngNotTypeLoadBalancer,
+		ErrRouteMissingAnnotation, ErrRouteNotAttached, ErrGatewayMissingAddress,
+		ErrNodeNotSelected, ErrNodeNotReady, ErrNodeMissingAddress,
+		ErrNoAddressInFamily,
+	} {
+		if errors.Is(err, none) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(records []provider.Domain, d provider.Domain) bool {
+	for _, r := range records {
+		if r == d {
+			return true
+		}
+	}
+	return false
+}
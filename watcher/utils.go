@@ -3,15 +3,15 @@ package watcher
 import (
 	"errors"
 	"fmt"
-	"reflect"
-	"sort"
+	"strings"
 
 	v1 "k8s.io/api/core/v1"
 	v1Networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 )
 
-var ErrPifrostSingleLB = errors.New("pifrost only supports single LB IP ingress objects")
+var ErrPifrostSingleLB = errors.New("pifrost only supports a single load balancer hostname")
 
 func getSvcAnnotation(annotations map[string]string) (string, bool) {
 	if val, ok := annotations["pifrost.tolson.io/domain"]; ok {
@@ -21,6 +21,58 @@ func getSvcAnnotation(annotations map[string]string) (string, bool) {
 	}
 }
 
+// An explicit record target, an IP or a domain to CNAME to.
+func getTargetAnnotation(annotations map[string]string) (string, bool) {
+	if val, ok := annotations["pifrost.tolson.io/target"]; ok && len(val) != 0 {
+		return val, true
+	} else {
+		return "", false
+	}
+}
+
+// Load balancers report an IP, or a hostname which we CNAME to.
+func lbTarget(ip, hostname string) string {
+	if len(ip) != 0 {
+		return ip
+	}
+	return hostname
+}
+
+// The namespace/name key of an object, as used by the workqueues.
+func objectKey(meta *metav1.ObjectMeta) string {
+	if len(meta.Namespace) == 0 {
+		return meta.Name
+	}
+	return meta.Namespace + "/" + meta.Name
+}
+
+// Registry owner of the records the service keyed by namespace/name asked for.
+func serviceOwner(key string) string {
+	return "service/" + key
+}
+
+// Registry owner of the records the ingress keyed by namespace/name asked for.
+func ingressOwner(key string) string {
+	return "ingress/" + key
+}
+
+// Registry owner of the records the node keyed by name asked for.
+func nodeOwner(key string) string {
+	return "node/" + key
+}
+
+// Registry owner of the records the DNSEndpoint keyed by namespace/name
+// asked for.
+func dnsEndpointOwner(key string) string {
+	return "dnsendpoint/" + key
+}
+
+// Registry owner of the records the route of kind keyed by namespace/name
+// asked for, e.g. httproute/default/echo.
+func routeOwner(kind, key string) string {
+	return strings.ToLower(kind) + "/" + key
+}
+
 func hasIngressAnnotation(annotations map[string]string) bool {
 	if val, ok := annotations["pifrost.tolson.io/ingress"]; ok {
 		if val == "true" {
@@ -32,6 +84,11 @@ func hasIngressAnnotation(annotations map[string]string) bool {
 	}
 }
 
+// Whether a headless service asks for a record per pod.
+func hasPodHostnamesAnnotation(annotations map[string]string) bool {
+	return annotations["pifrost.tolson.io/pod-hostnames"] == "true"
+}
+
 func convertToIngress(obj interface{}) (*v1Networking.Ingress, error) {
 	dest, ok := obj.(*v1Networking.Ingress)
 	if !ok {
@@ -47,56 +104,3 @@ func convertToService(obj interface{}) (*v1.Service, error) {
 	}
 	return dest, nil
 }
-
-func sameHosts(s1, s2 []string) bool {
-	if len(s1) != len(s2) {
-		return false
-	}
-
-	copy1 := make([]string, len(s1))
-	copy2 := make([]string, len(s2))
-	copy(copy1, s1)
-	copy(copy2, s2)
-
-	sort.Strings(copy1)
-	sort.Strings(copy2)
-
-	return reflect.DeepEqual(copy1, copy2)
-}
-
-func hostsAddedRemovedBoth(s1, s2 []string) ([]string, []string, []string) {
-	var removed, added, both []string
-	countS1 := make(map[string]int)
-	countS2 := make(map[string]int)
-
-	for _, value := range s1 {
-		countS1[value]++
-	}
-
-	for _, value := range s2 {
-		countS2[value]++
-	}
-
-	// in s2 but not s1
-	for key, count := range countS2 {
-		if count > countS1[key] {
-			added = append(added, key)
-		}
-	}
-
-	// in s1 but not s2
-	for key, count := range countS1 {
-		if count > countS2[key] {
-			removed = append(removed, key)
-		}
-	}
-
-	// in both
-	for key, count := range countS1 {
-		if count > 0 && countS2[key] > 0 {
-			both = append(both, key)
-		}
-	}
-
-	return added, removed, both
-}
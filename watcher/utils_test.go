@@ -1,17 +1,116 @@
 package watcher
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"reflect"
-	"strings"
+	"sync"
 	"testing"
 
 	v1 "k8s.io/api/core/v1"
 	v1Networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
 )
 
+// fakeProvider is an in memory DNSProvider, no pi-hole required. Like
+// pi-hole it keeps one IPv4 address or CNAME target in records and one IPv6
+// address in aaaa per name.
+type fakeProvider struct {
+	mu      sync.Mutex
+	records map[string]string
+	aaaa    map[string]string
+	changes []string
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{
+		records: map[string]string{},
+		aaaa:    map[string]string{},
+	}
+}
+
+// Record value for d, safe while a worker modifies records.
+func (f *fakeProvider) record(d string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.records[d]
+}
+
+func (f *fakeProvider) GetDNS(ctx context.Context) ([]provider.Domain, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var domains []provider.Domain
+	for d, target := range f.records {
+		if net.ParseIP(target) == nil {
+			domains = append(domains, provider.NewCNAME(d, target))
+		} else {
+			domains = append(domains, provider.NewDomain(target, d))
+		}
+	}
+	for d, ip := range f.aaaa {
+		domains = append(domains, provider.NewDomain(ip, d))
+	}
+	return domains, nil
+}
+
+func (f *fakeProvider) ModifyDNS(ctx context.Context, dcs *provider.DNSChangeSet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d := dcs.Domain()
+	records := f.records
+	if d.Type() == provider.RecordAAAA {
+		records = f.aaaa
+	}
+
+	switch dcs.Action() {
+	case "add":
+		if d.Type() == provider.RecordCNAME {
+			delete(f.aaaa, d.Name())
+		}
+		records[d.Name()] = d.Value()
+	case "delete":
+		delete(records, d.Name())
+	}
+	f.changes = append(f.changes, fmt.Sprintf("%s %s %s %s", dcs.Action(), d.Type(), d.Name(), d.Value()))
+	return nil
+}
+
+func (f *fakeProvider) ValidateProvider(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeProvider) Capabilities() provider.Capabilities {
+	return provider.Capabilities{
+		Name:          "fake",
+		RecordTypes:   []string{"A", "AAAA", "CNAME"},
+		SingleAddress: true,
+	}
+}
+
+// The fake provider behind a registry, as the server wires providers up.
+func newOwnedFakeProvider(policy registry.ConflictPolicy) (*fakeProvider, *registry.Registry, provider.DNSProvider) {
+	fakeDNS := newFakeProvider()
+	reg, _ := registry.New(context.Background(), registry.MemoryStore{})
+	return fakeDNS, reg, registry.NewOwnedProvider(fakeDNS, reg, policy)
+}
+
+// Endpoint of a mock server.
+func testEndpoint(t *testing.T, serverURL string) *provider.Endpoint {
+	endpoint, err := provider.NewEndpoint(serverURL, provider.HTTPConfig{})
+	if err != nil {
+		t.Fatalf("Error from NewEndpoint: %s", err)
+	}
+	return endpoint
+}
+
 func startMockServer(t *testing.T) (*httptest.Server, string) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var mockResponse string
@@ -25,11 +124,16 @@ func startMockServer(t *testing.T) (*httptest.Server, string) {
 			mockResponse = `{"success":true,"message":""}{"FTLnotrunning":true}`
 		}
 
+		// No CNAME records.
+		if _, ok := r.URL.Query()["customcname"]; ok && action == "get" {
+			mockResponse = `{"data":[]}`
+		}
+
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(mockResponse))
 	}))
 
-	return mockServer, strings.Replace(mockServer.URL, "http://", "", 1)
+	return mockServer, mockServer.URL
 }
 
 func TestGetSvcAnnotation(t *testing.T) {
@@ -70,6 +174,42 @@ func TestGetSvcAnnotation(t *testing.T) {
 	}
 }
 
+func TestGetTargetAnnotation(t *testing.T) {
+	// Test case 1: Target present
+	result, found := getTargetAnnotation(map[string]string{
+		"pifrost.tolson.io/target": "other.home.lan",
+	})
+	if !found || result != "other.home.lan" {
+		t.Errorf("Expected target 'other.home.lan', but got '%s'", result)
+	}
+
+	// Test case 2: Empty target is ignored
+	_, found = getTargetAnnotation(map[string]string{
+		"pifrost.tolson.io/target": "",
+	})
+	if found {
+		t.Errorf("Expected empty annotation to not be found, but it was found")
+	}
+
+	// Test case 3: Missing
+	_, found = getTargetAnnotation(map[string]string{})
+	if found {
+		t.Errorf("Expected annotation to not be found, but it was found")
+	}
+}
+
+func TestLBTarget(t *testing.T) {
+	// Test case 1: IP wins
+	if result := lbTarget("192.168.1.2", "lb.example.com"); result != "192.168.1.2" {
+		t.Errorf("Expected '192.168.1.2', but got '%s'", result)
+	}
+
+	// Test case 2: Hostname only
+	if result := lbTarget("", "lb.example.com"); result != "lb.example.com" {
+		t.Errorf("Expected 'lb.example.com', but got '%s'", result)
+	}
+}
+
 func TestHasIngressAnnotation(t *testing.T) {
 	// Test case 1: Annotation "pifrost.tolson.io/ingress" is present with value "true"
 	annotations1 := map[string]string{
@@ -167,69 +307,57 @@ func TestConvertToService(t *testing.T) {
 	}
 }
 
-func TestSameHosts(t *testing.T) {
-	// Test case 1: Both slices are empty, should return true
-	slice1 := []string{}
-	slice2 := []string{}
-	result1 := sameHosts(slice1, slice2)
-	if !result1 {
-		t.Errorf("Expected true, but got false")
+func TestOwners(t *testing.T) {
+	meta := &metav1.ObjectMeta{
+		Name:      "echo",
+		Namespace: "default",
 	}
 
-	// Test case 2: Both slices have the same elements in the same order, should return true
-	slice3 := []string{"example.com", "test.com", "sample.com"}
-	slice4 := []string{"example.com", "test.com", "sample.com"}
-	result2 := sameHosts(slice3, slice4)
-	if !result2 {
-		t.Errorf("Expected true, but got false")
+	// Test case 1: Namespaced objects
+	if owner := serviceOwner(objectKey(meta)); owner != "service/default/echo" {
+		t.Errorf("Owner: %s, Expected: service/default/echo.", owner)
 	}
-
-	// Test case 3: Both slices have the same elements in a different order, should return true
-	slice5 := []string{"sample.com", "test.com", "example.com"}
-	slice6 := []string{"example.com", "test.com", "sample.com"}
-	result3 := sameHosts(slice5, slice6)
-	if !result3 {
-		t.Errorf("Expected true, but got false")
+	if owner := ingressOwner(objectKey(meta)); owner != "ingress/default/echo" {
+		t.Errorf("Owner: %s, Expected: ingress/default/echo.", owner)
 	}
 
-	// Test case 4: Slices have different lengths, should return false
-	slice7 := []string{"example.com", "test.com", "sample.com"}
-	slice8 := []string{"example.com", "test.com"}
-	result4 := sameHosts(slice7, slice8)
-	if result4 {
-		t.Errorf("Expected false, but got true")
+	// Test case 2: Cluster scoped objects have no namespace in the key
+	if key := objectKey(&metav1.ObjectMeta{Name: "node-1"}); key != "node-1" {
+		t.Errorf("Key: %s, Expected: node-1.", key)
 	}
+}
 
-	// Test case 5: One slice is empty, should return false
-	slice9 := []string{"example.com", "test.com", "sample.com"}
-	slice10 := []string{}
-	result5 := sameHosts(slice9, slice10)
-	if result5 {
-		t.Errorf("Expected false, but got true")
-	}
+// errProvider fails every change with err.
+type errProvider struct {
+	*fakeProvider
+	err error
 }
 
-func TestHostsAddedRemovedBoth(t *testing.T) {
-	// Test case 1: Both slices are empty, should return empty slices for added, removed, and both
-	slice1 := []string{}
-	slice2 := []string{}
-	added1, removed1, both1 := hostsAddedRemovedBoth(slice1, slice2)
-	if len(added1) != 0 || len(removed1) != 0 || len(both1) != 0 {
-		t.Errorf("Expected empty slices, but got non-empty slices")
+func (e *errProvider) ModifyDNS(ctx context.Context, dcs *provider.DNSChangeSet) error {
+	return fmt.Errorf("Could not delete record: %w", e.err)
+}
+
+func TestProviderErrors(t *testing.T) {
+	ctx := context.Background()
+
+	// Test case 1: Deleting a record which is already gone succeeds
+	dnsProvider := &errProvider{newFakeProvider(), provider.ErrRecordNotFound}
+	if err := delRecord(ctx, dnsProvider, "service/default/a", "a.example.com", "192.168.1.2"); err != nil {
+		t.Errorf("Error from delRecord: %s", err)
 	}
 
-	// Test case 2: Both slices are the same, should return empty slices for added and removed, and non-empty for both
-	slice3 := []string{"example.com", "test.com", "sample.com"}
-	added2, removed2, both2 := hostsAddedRemovedBoth(slice3, slice3)
-	if len(added2) != 0 || len(removed2) != 0 || !reflect.DeepEqual(both2, slice3) {
-		t.Errorf("Expected empty slices for added and removed, and the same slice for both")
+	// Test case 2: Bad credentials are not retried
+	dnsProvider.err = provider.ErrUnauthorized
+	err := addRecord(ctx, dnsProvider, "service/default/a", "a.example.com", "192.168.1.2")
+	var permErr *permanentError
+	if !errors.As(err, &permErr) || !errors.Is(err, provider.ErrUnauthorized) {
+		t.Errorf("Error: %v, Expected permanent %v.", err, provider.ErrUnauthorized)
 	}
 
-	// Test case 3: One slice is empty, the other is not, should return added for the non-empty slice and empty for removed and both
-	slice4 := []string{}
-	slice5 := []string{"example.com", "test.com", "sample.com"}
-	added3, removed3, both3 := hostsAddedRemovedBoth(slice4, slice5)
-	if !reflect.DeepEqual(added3, slice5) || len(removed3) != 0 || len(both3) != 0 {
-		t.Errorf("Expected added slice to be the non-empty slice, and empty slices for removed and both")
+	// Test case 3: Transient errors are retried
+	dnsProvider.err = provider.ErrTransient
+	err = addRecord(ctx, dnsProvider, "service/default/a", "a.example.com", "192.168.1.2")
+	if errors.As(err, &permErr) || !errors.Is(err, provider.ErrTransient) {
+		t.Errorf("Error: %v, Expected retryable %v.", err, provider.ErrTransient)
 	}
 }
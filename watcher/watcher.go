@@ -1,46 +1,167 @@
 package watcher
 
 import (
+	"context"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	v1Networking "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 
 	"github.com/tolson-vkn/pifrost/provider"
+	"github.com/tolson-vkn/pifrost/registry"
 )
 
-func Watch(dnsProvider *provider.PiHoleRequest, kconfig *rest.Config, ingressAnnotation bool, ingressEIP string) {
+// How long the informers a watcher builds records from get to sync.
+const sourceSyncTimeout = 2 * time.Minute
+
+// SourceConfig is how watched objects are turned into records, shared by the
+// event handlers and the reconciler.
+type SourceConfig struct {
+	// Externalize every ingress, not only the annotated ones.
+	IngressAuto bool
+	// Record target of every ingress, instead of its load balancer.
+	IngressExternalIP string
+	// Address field of services without a target-source annotation, the
+	// load balancer when empty.
+	ServiceTargetSource TargetSource
+	// Publish annotated headless services at their ready endpoints, which
+	// needs an EndpointSlice informer.
+	HeadlessServices bool
+	// Allow the node-ips target source, which needs a node informer.
+	ServiceNodeIPs bool
+	// Addresses published for objects without an ip-family annotation, both
+	// families when empty.
+	IPFamily IPFamily
+	// Publish Gateway API routes, with the opt-in of ingresses.
+	GatewayAPI bool
+	// Publish the records of external-dns DNSEndpoint objects.
+	DNSEndpoint bool
+	// Leave the status of DNSEndpoints alone, for --dry-run.
+	DryRun bool
+	// Name of the record published per node, nodes are not published when
+	// nil.
+	NodeNameTemplate *template.Template
+	// Node address types in order of preference, DefaultNodeAddressTypes
+	// when empty.
+	NodeAddressTypes []v1.NodeAddressType
+	// Nodes to publish, every node when nil.
+	NodeSelector labels.Selector
+	// How long a NotReady node keeps its records.
+	NodeNotReadyGrace time.Duration
+}
+
+// Watch the sources config enables until ctx is cancelled. Caches warm up
+// right away, but nothing is written until leading is closed. Changes in
+// flight are given up to drain to finish before Watch returns.
+func Watch(ctx context.Context, dnsProvider provider.DNSProvider, reg *registry.Registry, kconfig *rest.Config, config SourceConfig, reconcileInterval time.Duration, prune bool, leading <-chan struct{}, drain time.Duration) {
 	client, err := kubernetes.NewForConfig(kconfig)
 	if err != nil {
 		logrus.Fatal("Could not create kubeconfig")
 	}
 	w := &sync.WaitGroup{}
 
+	// The previous leader may have claimed records since the registry was
+	// loaded.
+	ready := make(chan struct{})
+	go func() {
+		select {
+		case <-leading:
+		case <-ctx.Done():
+			return
+		}
+		if err := reg.Reload(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.Fatalf("Could not reload record registry: %s", err)
+		}
+		close(ready)
+	}()
+
+	dynamicClient, err := dynamic.NewForConfig(kconfig)
+	if err != nil {
+		logrus.Fatal("Could not create dynamic client")
+	}
+
 	w.Add(2)
-	go watcherIngress(client, dnsProvider, ingressAnnotation, ingressEIP, w)
-	go watcherService(client, dnsProvider, w)
+	go watcherIngress(ctx, client, dnsProvider, reg, config, ready, drain, w)
+	go watcherService(ctx, client, dnsProvider, reg, config, ready, drain, w)
+
+	if config.NodeNameTemplate != nil {
+		w.Add(1)
+		go watcherNode(ctx, client, dnsProvider, reg, config, ready, drain, w)
+	}
+
+	if config.GatewayAPI {
+		resources, err := gatewayResources(client.Discovery())
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if _, ok := resources[KindGateway]; ok {
+			w.Add(1)
+			go watcherGateway(ctx, dynamicClient, resources, dnsProvider, reg, config, ready, drain, w)
+		} else {
+			logrus.Warn("Gateway API CRDs are not installed, not watching routes")
+		}
+	}
+
+	if config.DNSEndpoint {
+		gvr, ok, err := dnsEndpointResource(client.Discovery())
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if ok {
+			w.Add(1)
+			go watcherDNSEndpoint(ctx, dynamicClient, gvr, dnsProvider, reg, config, ready, drain, w)
+		} else {
+			logrus.Warn("DNSEndpoint CRD is not installed, not watching DNSEndpoints")
+		}
+	}
+
+	// Event handlers only see changes, the reconciler repairs what they miss.
+	if reconcileInterval > 0 {
+		reconciler := NewReconciler(client, dynamicClient, dnsProvider, reg, config, reconcileInterval, prune)
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			select {
+			case <-ready:
+				reconciler.Run(ctx, drain)
+			case <-ctx.Done():
+			}
+		}()
+	} else {
+		logrus.Info("Reconciler disabled.")
+	}
+
 	w.Wait()
+	logrus.Info("Watchers stopped")
 }
 
-func watcherIngress(client kubernetes.Interface, dnsProvider *provider.PiHoleRequest, ingressAnnotation bool, ingressEIP string, w *sync.WaitGroup) {
+func watcherIngress(ctx context.Context, client kubernetes.Interface, dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig, ready <-chan struct{}, drain time.Duration, w *sync.WaitGroup) {
+	defer w.Done()
+
 	logrus.Info("Starting ingress watcher...")
-	if !ingressAnnotation {
+	if !config.IngressAuto {
 		logrus.Info("Will only externalize dns for ingress with annotations.")
 	} else {
 		logrus.Info("Externalizing all ingress objects")
 	}
 
-	if len(ingressEIP) != 0 {
-		logrus.Infof("Externalized ingress hosts will use IP: %s", ingressEIP)
+	if len(config.IngressExternalIP) != 0 {
+		logrus.Infof("Externalized ingress hosts will use IP: %s", config.IngressExternalIP)
 	}
 
 	watchlist := cache.NewListWatchFromClient(
@@ -50,72 +171,24 @@ func watcherIngress(client kubernetes.Interface, dnsProvider *provider.PiHoleReq
 		fields.Everything(),
 	)
 
-	_, controller := cache.NewInformer(
+	var store cache.Store
+	worker := newQueueWorker("ingress", defaultRateLimiter(), func(ctx context.Context, key string) error {
+		return syncIngress(ctx, key, store, dnsProvider, reg, config)
+	})
+
+	store, controller := cache.NewInformer(
 		watchlist,
 		&v1Networking.Ingress{},
 		0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				ingress, err := convertToIngress(obj)
-				if err != nil {
-					logrus.Fatalf("Watch error: %s", err)
-				}
-
-				err = addIngressHandler(
-					client, dnsProvider, ingressAnnotation, ingressEIP, ingress,
-				)
-				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"ingress": ingress.ObjectMeta.Name,
-					}).Fatalf("Watch error: %s", err)
-				}
-			},
-			DeleteFunc: func(obj interface{}) {
-				ingress, err := convertToIngress(obj)
-				if err != nil {
-					logrus.Fatalf("Watch error: %s", err)
-				}
-
-				err = delIngressHandler(
-					client, dnsProvider, ingressAnnotation, ingressEIP, ingress,
-				)
-				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"ingress": ingress.ObjectMeta.Name,
-					}).Fatalf("Watch error: %s", err)
-				}
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				oldIngress, err := convertToIngress(oldObj)
-				if err != nil {
-					logrus.Fatalf("Watch error: %s", err)
-				}
-
-				newIngress, err := convertToIngress(newObj)
-				if err != nil {
-					logrus.Fatalf("Watch error: %s", err)
-				}
-
-				err = updateIngressHandler(
-					client, dnsProvider, ingressAnnotation, ingressEIP,
-					oldIngress, newIngress,
-				)
-				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"ingress": oldIngress.ObjectMeta.Name,
-					}).Fatalf("Watch error: %s", err)
-				}
-			},
-		},
+		worker.handlers(),
 	)
 
-	go controller.Run(wait.NeverStop)
-	for {
-		time.Sleep(time.Second)
-	}
+	runWorker(ctx, worker, controller, ready, drain)
 }
 
-func watcherService(client kubernetes.Interface, dnsProvider *provider.PiHoleRequest, w *sync.WaitGroup) {
+func watcherService(ctx context.Context, client kubernetes.Interface, dnsProvider provider.DNSProvider, reg *registry.Registry, config SourceConfig, ready <-chan struct{}, drain time.Duration, w *sync.WaitGroup) {
+	defer w.Done()
+
 	logrus.Info("Starting service watcher...")
 
 	watchlist := cache.NewListWatchFromClient(
@@ -125,62 +198,164 @@ func watcherService(client kubernetes.Interface, dnsProvider *provider.PiHoleReq
 		fields.Everything(),
 	)
 
-	_, controller := cache.NewInformer(
+	var store cache.Store
+	var sources serviceSources
+	worker := newQueueWorker("service", defaultRateLimiter(), func(ctx context.Context, key string) error {
+		return syncService(ctx, key, store, sources, dnsProvider, reg, config)
+	})
+
+	store, controller := cache.NewInformer(
 		watchlist,
 		&v1.Service{},
 		0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				service, err := convertToService(obj)
-				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"service": service.ObjectMeta.Name,
-					}).Fatalf("Watch error: %s", err)
-				}
+		worker.handlers(),
+	)
 
-				err = addServiceHandler(client, dnsProvider, service)
-				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"service": service.ObjectMeta.Name,
-					}).Fatalf("Watch error: %s", err)
-				}
+	// Queue the annotated services matching wanted.
+	requeue := func(wanted func(service *v1.Service) bool, keys ...string) {
+		for _, key := range keys {
+			obj, exists, err := store.GetByKey(key)
+			if err != nil || !exists {
+				continue
+			}
+			service, err := convertToService(obj)
+			if err != nil {
+				continue
+			}
+			if _, ok := getSvcAnnotation(service.Annotations); ok && wanted(service) {
+				worker.enqueueKey(key)
+			}
+		}
+	}
+
+	var controllers []cache.Controller
+
+	// Headless services follow their pods, EndpointSlice changes queue the
+	// service when it is headless and annotated.
+	if config.HeadlessServices {
+		requeueSlice := func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			keys, err := sliceServiceKey(obj)
+			if err != nil {
+				return
+			}
+			requeue(isHeadless, keys...)
+		}
+		var sliceController cache.Controller
+		sources.slices, sliceController = cache.NewIndexerInformer(
+			cache.NewListWatchFromClient(
+				client.DiscoveryV1().RESTClient(),
+				"endpointslices",
+				v1.NamespaceAll,
+				fields.Everything(),
+			),
+			&discoveryv1.EndpointSlice{},
+			0,
+			cache.ResourceEventHandlerFuncs{
+				AddFunc:    requeueSlice,
+				UpdateFunc: func(oldObj, newObj interface{}) { requeueSlice(newObj) },
+				DeleteFunc: requeueSlice,
 			},
-			DeleteFunc: func(obj interface{}) {
-				service, err := convertToService(obj)
-				if err != nil {
-					logrus.Fatalf("Watch error: %s", err)
-				}
+			cache.Indexers{sliceServiceIndex: sliceServiceKey},
+		)
+		controllers = append(controllers, sliceController)
+	}
 
-				err = delServiceHandler(client, dnsProvider, service)
-				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"service": service.ObjectMeta.Name,
-					}).Fatalf("Watch error: %s", err)
+	// Services on node IPs follow the nodes. Only nodes giving them targets
+	// matter, NotReady nodes and heartbeats do not.
+	if config.ServiceNodeIPs {
+		usesNodeIPs := func(service *v1.Service) bool {
+			source, err := getTargetSourceAnnotation(service.Annotations, config.ServiceTargetSource)
+			return err == nil && source == TargetSourceNodeIPs
+		}
+		requeueNode := func(obj interface{}) {
+			if node, ok := obj.(*v1.Node); ok {
+				if _, notReady := nodeNotReadySince(node); notReady {
+					return
 				}
+			}
+			requeue(usesNodeIPs, store.ListKeys()...)
+		}
+		var nodeController cache.Controller
+		sources.nodes, nodeController = cache.NewInformer(
+			cache.NewListWatchFromClient(
+				client.CoreV1().RESTClient(),
+				"nodes",
+				v1.NamespaceAll,
+				fields.Everything(),
+			),
+			&v1.Node{},
+			0,
+			cache.ResourceEventHandlerFuncs{
+				AddFunc: requeueNode,
+				UpdateFunc: func(oldObj, newObj interface{}) {
+					oldNode, oldOk := oldObj.(*v1.Node)
+					newNode, newOk := newObj.(*v1.Node)
+					if oldOk && newOk && !nodeTargetsChanged(oldNode, newNode, config.NodeAddressTypes) {
+						return
+					}
+					requeue(usesNodeIPs, store.ListKeys()...)
+				},
+				DeleteFunc: requeueNode,
 			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				oldService, err := convertToService(oldObj)
-				if err != nil {
-					logrus.Fatalf("Watch error: %s", err)
-				}
+		)
+		controllers = append(controllers, nodeController)
+	}
 
-				newService, err := convertToService(newObj)
-				if err != nil {
-					logrus.Fatalf("Watch error: %s", err)
-				}
+	if !runSources(ctx, "service", controllers...) {
+		return
+	}
 
-				err = updateServiceHandler(client, dnsProvider, oldService, newService)
-				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"service": oldService.ObjectMeta.Name,
-					}).Fatalf("Watch error: %s", err)
-				}
-			},
-		},
-	)
+	runWorker(ctx, worker, controller, ready, drain)
+}
 
-	go controller.Run(wait.NeverStop)
-	for {
-		time.Sleep(time.Second)
+// Start the informers of the objects besides its own a watcher builds
+// records from, and wait for their stores to hold every object. Informers
+// retry forever, e.g. without RBAC to list their objects, so pifrost exits
+// when they are not synced in sourceSyncTimeout. False when ctx is cancelled
+// first.
+func runSources(ctx context.Context, name string, controllers ...cache.Controller) bool {
+	var synced []cache.InformerSynced
+	for _, controller := range controllers {
+		go controller.Run(ctx.Done())
+		synced = append(synced, controller.HasSynced)
 	}
+
+	syncCtx, cancel := context.WithTimeout(ctx, sourceSyncTimeout)
+	defer cancel()
+	if cache.WaitForCacheSync(syncCtx.Done(), synced...) {
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"watcher": name,
+		"timeout": sourceSyncTimeout,
+	}).Fatal("Could not sync informers, check pifrost may list and watch their objects")
+	return false
+}
+
+// Start the informer and process its queue once the informer store holds
+// every object, before that a key missing from the store does not mean the
+// object was deleted. Standby replicas keep queueing keys until ready is
+// closed.
+func runWorker(ctx context.Context, worker *queueWorker, controller cache.Controller, ready <-chan struct{}, drain time.Duration) {
+	go controller.Run(ctx.Done())
+
+	// Only gives up once ctx is cancelled.
+	if !cache.WaitForCacheSync(ctx.Done(), controller.HasSynced) {
+		return
+	}
+
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+
+	worker.Run(ctx, drain)
 }